@@ -0,0 +1,50 @@
+package baremetal
+
+import (
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// BootAuthorizer admits hosts that are not listed in [[hosts]] to network
+// boot while they are being provisioned. It is implemented by *pxe.Server.
+type BootAuthorizer interface {
+	GrantTicket(mac string, ttl time.Duration) error
+	RevokeTicket(mac string) error
+}
+
+// EnableBootAuthorization makes the provisioner grant each host it
+// provisions a ticket to network boot, valid for the provisioning timeout
+// and revoked once provisioning ends. Together with require_authorization
+// this confines the PXE server to listed hosts and hosts being provisioned.
+func (p *Provisioner) EnableBootAuthorization(srv BootAuthorizer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.authorizer = srv
+}
+
+// grantBootTicket allows a host to network boot for the provisioning timeout
+func (p *Provisioner) grantBootTicket(host *Host) error {
+	p.mu.Lock()
+	srv := p.authorizer
+	p.mu.Unlock()
+
+	if srv == nil || host.MAC == "" {
+		return nil
+	}
+	return srv.GrantTicket(host.MAC, time.Duration(p.config.Timeout))
+}
+
+// revokeBootTicket withdraws a host's ticket to network boot
+func (p *Provisioner) revokeBootTicket(host *Host) {
+	p.mu.Lock()
+	srv := p.authorizer
+	p.mu.Unlock()
+
+	if srv == nil || host.MAC == "" {
+		return
+	}
+	if err := srv.RevokeTicket(host.MAC); err != nil {
+		log.Warn().Err(err).Str("host", host.Hostname).Msg("Failed to revoke boot ticket")
+	}
+}
@@ -0,0 +1,450 @@
+// Package baremetaltest provides fake BMCs and a fake PXE server for running
+// the bare metal provisioner without hardware.
+package baremetaltest
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nimbus-project/nimbus/baremetal"
+	"github.com/nimbus-project/nimbus/pxe"
+)
+
+// Power states reported by a FakeBMC
+const (
+	PowerOn  = "On"
+	PowerOff = "Off"
+)
+
+// FakeBMC is an in-memory BMC. It implements baremetal.BMC.
+type FakeBMC struct {
+	// Address the BMC was dialed at
+	Address string
+
+	// OnPowerOn, if set, is called after the host is powered on, for
+	// example to simulate its network boot with FakePXE.Boot
+	OnPowerOn func()
+
+	// PowerOffPolls is how many power state queries still report the
+	// host on after it was told to power off
+	PowerOffPolls int
+
+	mu         sync.Mutex
+	power      string
+	bootDevice string
+	calls      []string
+	errs       map[string]error
+	pending    int
+}
+
+// NewFakeBMC creates a fake BMC for a host in the given power state
+func NewFakeBMC(address, power string) *FakeBMC {
+	return &FakeBMC{
+		Address: address,
+		power:   power,
+		errs:    make(map[string]error),
+	}
+}
+
+// Fail makes a method of the BMC, such as "PowerOff", return err. A nil
+// err makes it succeed again.
+func (b *FakeBMC) Fail(method string, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		delete(b.errs, method)
+	} else {
+		b.errs[method] = err
+	}
+}
+
+// Calls returns the methods called on the BMC, in order. SetBootDevice
+// calls include the device, as in "SetBootDevice Pxe".
+func (b *FakeBMC) Calls() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]string(nil), b.calls...)
+}
+
+// PowerState returns the host's power state without recording a call
+func (b *FakeBMC) PowerState() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.power
+}
+
+// BootDevice returns the boot device last set on the BMC
+func (b *FakeBMC) BootDevice() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.bootDevice
+}
+
+// Connect implements baremetal.BMC
+func (b *FakeBMC) Connect(ctx context.Context) error {
+	return b.call("Connect")
+}
+
+// PowerOn implements baremetal.BMC
+func (b *FakeBMC) PowerOn() error {
+	if err := b.call("PowerOn"); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	b.power = PowerOn
+	hook := b.OnPowerOn
+	b.mu.Unlock()
+
+	if hook != nil {
+		hook()
+	}
+	return nil
+}
+
+// PowerOff implements baremetal.BMC
+func (b *FakeBMC) PowerOff() error {
+	if err := b.call("PowerOff"); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.PowerOffPolls > 0 {
+		b.pending = b.PowerOffPolls
+	} else {
+		b.power = PowerOff
+	}
+	return nil
+}
+
+// SetBootDevice implements baremetal.BMC
+func (b *FakeBMC) SetBootDevice(device string) error {
+	if err := b.call("SetBootDevice " + device); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.bootDevice = device
+	return nil
+}
+
+// GetPowerState implements baremetal.BMC
+func (b *FakeBMC) GetPowerState() (string, error) {
+	if err := b.call("GetPowerState"); err != nil {
+		return "", err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.pending > 0 {
+		if b.pending--; b.pending == 0 {
+			b.power = PowerOff
+		}
+		return PowerOn, nil
+	}
+	return b.power, nil
+}
+
+// Close implements baremetal.BMC
+func (b *FakeBMC) Close() error {
+	return b.call("Close")
+}
+
+// call records a method call and returns the error set for it
+func (b *FakeBMC) call(name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.calls = append(b.calls, name)
+
+	method, _, _ := strings.Cut(name, " ")
+	return b.errs[method]
+}
+
+// FakeBMCs hands out fake BMCs by address
+type FakeBMCs struct {
+	mu   sync.Mutex
+	bmcs map[string]*FakeBMC
+}
+
+// NewFakeBMCs creates an empty set of fake BMCs
+func NewFakeBMCs() *FakeBMCs {
+	return &FakeBMCs{bmcs: make(map[string]*FakeBMC)}
+}
+
+// Get returns the fake BMC at an address, creating one for a powered on
+// host if there is none
+func (f *FakeBMCs) Get(address string) *FakeBMC {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	b, ok := f.bmcs[address]
+	if !ok {
+		b = NewFakeBMC(address, PowerOn)
+		f.bmcs[address] = b
+	}
+	return b
+}
+
+// Dial is a baremetal.BMCDialer returning the fake BMC at address
+func (f *FakeBMCs) Dial(address, username, password, protocol string) (baremetal.BMC, error) {
+	if address == "" {
+		return nil, fmt.Errorf("no BMC address")
+	}
+	return f.Get(address), nil
+}
+
+// fakePXEURL is the base of the URLs a FakePXE hands out
+const fakePXEURL = "http://pxe.test"
+
+// FakePXE is an in-memory PXE server. It implements
+// baremetal.BootEventSource, baremetal.BootSelector,
+// baremetal.BootAuthorizer and baremetal.MetadataServer. Its HTTP handlers
+// are served by ServeHTTP rather than a listener.
+type FakePXE struct {
+	mu       sync.Mutex
+	subs     map[chan pxe.Event]struct{}
+	profiles map[string]string
+	tickets  map[string]time.Time
+	cmdlines map[string]string
+	mux      *http.ServeMux
+}
+
+// NewFakePXE creates a fake PXE server
+func NewFakePXE() *FakePXE {
+	return &FakePXE{
+		subs:     make(map[chan pxe.Event]struct{}),
+		profiles: make(map[string]string),
+		tickets:  make(map[string]time.Time),
+		cmdlines: make(map[string]string),
+		mux:      http.NewServeMux(),
+	}
+}
+
+// Subscribe implements baremetal.BootEventSource
+func (f *FakePXE) Subscribe(buffer int) (<-chan pxe.Event, func()) {
+	ch := make(chan pxe.Event, buffer)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.subs[ch] = struct{}{}
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			delete(f.subs, ch)
+			close(ch)
+		})
+	}
+}
+
+// Emit delivers an event to all subscribers. Like pxe.Server, it drops
+// events for subscribers whose buffer is full.
+func (f *FakePXE) Emit(e pxe.Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for ch := range f.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// Boot emits the events of a host network booting its profile through
+// iPXE: a DHCP acknowledgement carrying the iPXE binary, a second one
+// carrying its script URL once iPXE is running, followed by the complete
+// downloads of its kernel and initrd
+func (f *FakePXE) Boot(mac string) error {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return err
+	}
+
+	f.Emit(pxe.Event{Type: pxe.EventDHCPAck, MAC: hw, File: "ipxe.efi"})
+	f.Emit(pxe.Event{Type: pxe.EventDHCPAck, MAC: hw, File: fakePXEURL + "/ipxe/" + hw.String()})
+	f.Emit(pxe.Event{
+		Type:     pxe.EventHTTPFile,
+		MAC:      hw,
+		File:     "/vmlinuz",
+		Role:     pxe.RoleKernel,
+		Complete: true,
+	})
+	f.Emit(pxe.Event{
+		Type:     pxe.EventHTTPFile,
+		MAC:      hw,
+		File:     "/initrd.img",
+		Role:     pxe.RoleInitrd,
+		Complete: true,
+	})
+	return nil
+}
+
+// SetHostProfile implements baremetal.BootSelector
+func (f *FakePXE) SetHostProfile(mac, profile string) error {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.profiles[hw.String()] = profile
+	return nil
+}
+
+// HostProfile returns the profile last assigned to a host, or "" if none
+// was
+func (f *FakePXE) HostProfile(mac string) string {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return ""
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.profiles[hw.String()]
+}
+
+// GrantTicket implements baremetal.BootAuthorizer
+func (f *FakePXE) GrantTicket(mac string, ttl time.Duration) error {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.tickets[hw.String()] = time.Now().Add(ttl)
+	return nil
+}
+
+// RevokeTicket implements baremetal.BootAuthorizer
+func (f *FakePXE) RevokeTicket(mac string) error {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.tickets, hw.String())
+	return nil
+}
+
+// HasTicket reports whether a host holds an unexpired boot ticket
+func (f *FakePXE) HasTicket(mac string) bool {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return false
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	expires, ok := f.tickets[hw.String()]
+	return ok && time.Now().Before(expires)
+}
+
+// AddPXEHandler implements baremetal.MetadataServer
+func (f *FakePXE) AddPXEHandler(path string, handler http.Handler, middleware ...pxe.Middleware) {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	f.mux.Handle(path, handler)
+}
+
+// ServeHTTP serves a request with the handlers added to the server
+func (f *FakePXE) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mux.ServeHTTP(w, r)
+}
+
+// SetHostCmdline implements baremetal.MetadataServer
+func (f *FakePXE) SetHostCmdline(mac, args string) error {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.cmdlines[hw.String()] = args
+	return nil
+}
+
+// HostCmdline returns the kernel arguments last set for a host
+func (f *FakePXE) HostCmdline(mac string) string {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return ""
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.cmdlines[hw.String()]
+}
+
+// ClientMAC implements baremetal.MetadataServer. The fake hands out no
+// leases, so it knows no clients.
+func (f *FakePXE) ClientMAC(ip net.IP) net.HardwareAddr {
+	return nil
+}
+
+// URL implements baremetal.MetadataServer
+func (f *FakePXE) URL(path string) string {
+	return fakePXEURL + path
+}
+
+// CacheArtifact implements baremetal.MetadataServer. Nothing is downloaded;
+// the artifact is only given a path.
+func (f *FakePXE) CacheArtifact(ctx context.Context, rawURL, sha256 string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	return "/artifacts/" + sha256 + "/" + path.Base(u.Path), nil
+}
+
+// PhoneHome posts an installer report for a host to the phone-home URL on
+// its kernel command line, as its installer would, and returns the HTTP
+// status of the response
+func (f *FakePXE) PhoneHome(mac string, event baremetal.InstallEvent, percent int, message string) (int, error) {
+	var target string
+	for _, arg := range strings.Fields(f.HostCmdline(mac)) {
+		if v, ok := strings.CutPrefix(arg, "nimbus.phone_home="); ok {
+			target = v
+		}
+	}
+	if target == "" {
+		return 0, fmt.Errorf("host %s has no phone-home URL", mac)
+	}
+
+	form := url.Values{"event": {string(event)}}
+	if percent > 0 {
+		form.Set("percent", strconv.Itoa(percent))
+	}
+	if message != "" {
+		form.Set("message", message)
+	}
+	req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	rec := httptest.NewRecorder()
+	f.ServeHTTP(rec, req)
+	return rec.Code, nil
+}
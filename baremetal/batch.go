@@ -0,0 +1,260 @@
+package baremetal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ErrBatchHalted is the reason hosts are skipped once a batch has reached
+// its failure threshold
+var ErrBatchHalted = errors.New("batch halted after too many failures")
+
+// BatchConfig limits how ProvisionAll provisions hosts in parallel
+type BatchConfig struct {
+	// Maximum number of hosts provisioned at once. 0 means no limit.
+	MaxConcurrency int `toml:"max_concurrency"`
+
+	// Maximum number of hosts sharing a BMC address, such as the blades of
+	// a chassis, provisioned at once. 0 means no limit.
+	PerBMC int `toml:"per_bmc"`
+
+	// Maximum number of hosts network booting and installing from the PXE
+	// server at once. Hosts wait for a slot before powering on, so the
+	// wait does not count against their booting timeout. 0 means no
+	// limit.
+	PerPXEServer int `toml:"per_pxe_server"`
+
+	// Number of failed hosts after which no more hosts are started. Hosts
+	// already being provisioned are allowed to finish. 0 means the batch
+	// never halts.
+	MaxFailures int `toml:"max_failures"`
+}
+
+// validate checks the batch limits
+func (c *BatchConfig) validate() error {
+	if c.MaxConcurrency < 0 || c.PerBMC < 0 || c.PerPXEServer < 0 || c.MaxFailures < 0 {
+		return fmt.Errorf("batch limits must not be negative")
+	}
+	return nil
+}
+
+// Outcome is how provisioning a host in a batch ended
+type Outcome string
+
+// Batch outcomes
+const (
+	OutcomeSucceeded Outcome = "succeeded"
+	OutcomeFailed    Outcome = "failed"
+	OutcomeSkipped   Outcome = "skipped"
+)
+
+// HostResult is the outcome of provisioning one host of a batch
+type HostResult struct {
+	Hostname string
+	Outcome  Outcome
+
+	// State the host ended in, empty for skipped hosts
+	State State
+
+	// Err is why the host failed or was skipped
+	Err error
+
+	Started  time.Time
+	Duration time.Duration
+}
+
+// BatchReport is the consolidated outcome of ProvisionAll
+type BatchReport struct {
+	// Results in the order the hosts were given
+	Results []HostResult
+
+	// Halted is set if the batch reached its failure threshold
+	Halted bool
+
+	Started  time.Time
+	Duration time.Duration
+}
+
+// Succeeded returns the results of hosts that were provisioned
+func (r *BatchReport) Succeeded() []HostResult {
+	return r.filter(OutcomeSucceeded)
+}
+
+// Failed returns the results of hosts whose provisioning failed
+func (r *BatchReport) Failed() []HostResult {
+	return r.filter(OutcomeFailed)
+}
+
+// Skipped returns the results of hosts that were never started
+func (r *BatchReport) Skipped() []HostResult {
+	return r.filter(OutcomeSkipped)
+}
+
+// String summarizes the report, listing every host that did not succeed
+func (r *BatchReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d succeeded, %d failed, %d skipped in %s",
+		len(r.Succeeded()), len(r.Failed()), len(r.Skipped()), r.Duration.Round(time.Second))
+	if r.Halted {
+		b.WriteString(" (halted)")
+	}
+	for _, res := range r.Results {
+		if res.Outcome != OutcomeSucceeded {
+			fmt.Fprintf(&b, "\n%s %s: %v", res.Hostname, res.Outcome, res.Err)
+		}
+	}
+	return b.String()
+}
+
+// filter returns the results with the given outcome
+func (r *BatchReport) filter(o Outcome) []HostResult {
+	var results []HostResult
+	for _, res := range r.Results {
+		if res.Outcome == o {
+			results = append(results, res)
+		}
+	}
+	return results
+}
+
+// batchDone reports a finished host to the ProvisionAll scheduler
+type batchDone struct {
+	index  int
+	result HostResult
+}
+
+// ProvisionAll provisions hosts in parallel within the limits of [batch].
+// Hosts are started in the order given, except that a host whose BMC is at
+// its limit is passed over for later hosts until a slot frees up. Once
+// max_failures hosts have failed, or ctx is cancelled, no more hosts are
+// started and the rest are reported as skipped.
+//
+// The report is always returned. The error is non-nil if any host did not
+// succeed, and wraps ErrBatchHalted if the batch was halted.
+func (p *Provisioner) ProvisionAll(ctx context.Context, hosts []*Host) (*BatchReport, error) {
+	limits := p.config.Batch
+	report := &BatchReport{
+		Results: make([]HostResult, len(hosts)),
+		Started: time.Now(),
+	}
+
+	var bootSlots chan struct{}
+	if limits.PerPXEServer > 0 {
+		bootSlots = make(chan struct{}, limits.PerPXEServer)
+	}
+
+	// Hosts are started in order; duplicates would only race each other
+	seen := make(map[string]bool)
+	var pending []int
+	for i, host := range hosts {
+		report.Results[i].Hostname = host.Hostname
+		if seen[host.Hostname] {
+			report.Results[i].Outcome = OutcomeSkipped
+			report.Results[i].Err = fmt.Errorf("host %s is listed more than once", host.Hostname)
+			continue
+		}
+		seen[host.Hostname] = true
+		pending = append(pending, i)
+	}
+
+	done := make(chan batchDone)
+	bmcBusy := make(map[string]int)
+	running, failures := 0, 0
+
+	for len(pending) > 0 || running > 0 {
+		if report.Halted || ctx.Err() != nil {
+			reason := ErrBatchHalted
+			if !report.Halted {
+				reason = ctx.Err()
+			}
+			for _, i := range pending {
+				report.Results[i].Outcome = OutcomeSkipped
+				report.Results[i].Err = reason
+			}
+			pending = nil
+		}
+
+		// Start every pending host there is room for
+		kept := pending[:0]
+		for _, i := range pending {
+			host := hosts[i]
+			bmc := host.BMC.Address
+			if (limits.MaxConcurrency > 0 && running >= limits.MaxConcurrency) ||
+				(limits.PerBMC > 0 && bmc != "" && bmcBusy[bmc] >= limits.PerBMC) {
+				kept = append(kept, i)
+				continue
+			}
+
+			running++
+			if bmc != "" {
+				bmcBusy[bmc]++
+			}
+			go func(i int, host *Host) {
+				start := time.Now()
+				err := p.provision(ctx, host, bootSlots)
+				res := HostResult{
+					Hostname: host.Hostname,
+					Outcome:  OutcomeSucceeded,
+					State:    StateReady,
+					Err:      err,
+					Started:  start,
+					Duration: time.Since(start),
+				}
+				if err != nil {
+					res.Outcome, res.State = OutcomeFailed, StateFailed
+					var se *StateError
+					if errors.As(err, &se) {
+						res.State = se.State
+					}
+				}
+				done <- batchDone{index: i, result: res}
+			}(i, host)
+		}
+		pending = kept
+
+		if running == 0 {
+			break
+		}
+
+		d := <-done
+		running--
+		if bmc := hosts[d.index].BMC.Address; bmc != "" {
+			bmcBusy[bmc]--
+		}
+		report.Results[d.index] = d.result
+
+		if d.result.Outcome == OutcomeFailed {
+			failures++
+			if limits.MaxFailures > 0 && failures >= limits.MaxFailures && !report.Halted {
+				report.Halted = true
+				log.Error().
+					Int("failures", failures).
+					Int("pending", len(pending)).
+					Msg("Halting batch after too many failures")
+			}
+		}
+	}
+
+	report.Duration = time.Since(report.Started)
+	log.Info().
+		Int("succeeded", len(report.Succeeded())).
+		Int("failed", len(report.Failed())).
+		Int("skipped", len(report.Skipped())).
+		Bool("halted", report.Halted).
+		Dur("duration", report.Duration).
+		Msg("Batch provisioning finished")
+
+	notOK := len(report.Failed()) + len(report.Skipped())
+	switch {
+	case report.Halted:
+		return report, fmt.Errorf("%w: %d of %d hosts did not succeed", ErrBatchHalted, notOK, len(hosts))
+	case notOK > 0:
+		return report, fmt.Errorf("%d of %d hosts did not succeed", notOK, len(hosts))
+	}
+	return report, nil
+}
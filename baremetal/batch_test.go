@@ -0,0 +1,240 @@
+package baremetal_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nimbus-project/nimbus/baremetal"
+)
+
+// bootDelay keeps hosts network booting long enough for batch limits to
+// matter
+const bootDelay = 20 * time.Millisecond
+
+// concurrency tracks the most hosts that were in a stretch of states at
+// once, overall and per BMC
+type concurrency struct {
+	enter, leave map[string]bool
+
+	mu        sync.Mutex
+	active    map[string]string
+	max       int
+	maxPerBMC map[string]int
+}
+
+// track counts hosts from entering one of enter until entering one of
+// leave or failing
+func track(tb *testbed, enter, leave []baremetal.State) *concurrency {
+	c := &concurrency{
+		enter:     make(map[string]bool),
+		leave:     map[string]bool{string(baremetal.StateFailed): true},
+		active:    make(map[string]string),
+		maxPerBMC: make(map[string]int),
+	}
+	for _, s := range enter {
+		c.enter[string(s)] = true
+	}
+	for _, s := range leave {
+		c.leave[string(s)] = true
+	}
+
+	tb.p.OnStatusUpdate(func(host *baremetal.Host, status, message string) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		switch {
+		case c.enter[status]:
+			c.active[host.Hostname] = host.BMC.Address
+		case c.leave[status]:
+			delete(c.active, host.Hostname)
+			return
+		default:
+			return
+		}
+
+		perBMC := make(map[string]int)
+		for _, bmc := range c.active {
+			perBMC[bmc]++
+		}
+		c.max = max(c.max, len(c.active))
+		for bmc, n := range perBMC {
+			c.maxPerBMC[bmc] = max(c.maxPerBMC[bmc], n)
+		}
+	})
+	return c
+}
+
+// batchHosts returns n hosts, each with its own BMC
+func batchHosts(n int) []baremetal.Host {
+	hosts := make([]baremetal.Host, n)
+	for i := range hosts {
+		hosts[i] = testHost(fmt.Sprintf("n%d", i+1), fmt.Sprintf("52:54:00:00:00:%02x", i+1), fmt.Sprintf("10.0.1.%d", i+1))
+	}
+	return hosts
+}
+
+// slowBoot delays the network boot of every host by bootDelay
+func slowBoot(tb *testbed) {
+	for _, host := range tb.cfg.Hosts {
+		bmc := tb.bmcs.Get(host.BMC.Address)
+		if boot := bmc.OnPowerOn; boot != nil {
+			bmc.OnPowerOn = func() {
+				time.Sleep(bootDelay)
+				boot()
+			}
+		}
+	}
+}
+
+// hostPointers returns pointers to the configured hosts
+func (tb *testbed) hostPointers() []*baremetal.Host {
+	hosts := make([]*baremetal.Host, len(tb.cfg.Hosts))
+	for i := range tb.cfg.Hosts {
+		hosts[i] = &tb.cfg.Hosts[i]
+	}
+	return hosts
+}
+
+func TestProvisionAllMaxConcurrency(t *testing.T) {
+	tb := newTestbed(t, batchHosts(5), func(c *baremetal.Config) { c.Batch.MaxConcurrency = 2 })
+	slowBoot(tb)
+	c := track(tb, []baremetal.State{baremetal.StateRegistered}, []baremetal.State{baremetal.StateReady})
+
+	report, err := tb.p.ProvisionAll(context.Background(), tb.hostPointers())
+	if err != nil {
+		t.Fatalf("ProvisionAll: %v\n%s", err, report)
+	}
+	if n := len(report.Succeeded()); n != 5 {
+		t.Errorf("%d hosts succeeded, want 5", n)
+	}
+	if c.max != 2 {
+		t.Errorf("at most %d hosts provisioned at once, want 2", c.max)
+	}
+	for i, res := range report.Results {
+		if want := fmt.Sprintf("n%d", i+1); res.Hostname != want || res.State != baremetal.StateReady {
+			t.Errorf("result %d = %s in %s, want %s ready", i, res.Hostname, res.State, want)
+		}
+	}
+}
+
+func TestProvisionAllPerBMC(t *testing.T) {
+	// n1 and n2 are blades of one chassis; n3 has its own BMC
+	hosts := []baremetal.Host{
+		testHost("n1", "52:54:00:00:00:01", "10.0.1.1"),
+		testHost("n2", "52:54:00:00:00:02", "10.0.1.1"),
+		testHost("n3", "52:54:00:00:00:03", "10.0.1.3"),
+	}
+	tb := newTestbed(t, hosts, func(c *baremetal.Config) { c.Batch.PerBMC = 1 })
+	slowBoot(tb)
+	c := track(tb, []baremetal.State{baremetal.StateRegistered}, []baremetal.State{baremetal.StateReady})
+
+	report, err := tb.p.ProvisionAll(context.Background(), tb.hostPointers())
+	if err != nil {
+		t.Fatalf("ProvisionAll: %v\n%s", err, report)
+	}
+	if n := c.maxPerBMC["10.0.1.1"]; n != 1 {
+		t.Errorf("at most %d hosts of the chassis provisioned at once, want 1", n)
+	}
+	// n3 is not held up behind n2
+	if c.max != 2 {
+		t.Errorf("at most %d hosts provisioned at once, want 2", c.max)
+	}
+}
+
+func TestProvisionAllPerPXEServer(t *testing.T) {
+	tb := newTestbed(t, batchHosts(4), func(c *baremetal.Config) { c.Batch.PerPXEServer = 1 })
+	slowBoot(tb)
+	c := track(tb, []baremetal.State{baremetal.StateBooting}, []baremetal.State{baremetal.StatePostInstall})
+
+	report, err := tb.p.ProvisionAll(context.Background(), tb.hostPointers())
+	if err != nil {
+		t.Fatalf("ProvisionAll: %v\n%s", err, report)
+	}
+	if c.max != 1 {
+		t.Errorf("at most %d hosts network booted at once, want 1", c.max)
+	}
+}
+
+func TestProvisionAllMaxFailures(t *testing.T) {
+	errBMC := errors.New("BMC unreachable")
+	tb := newTestbed(t, batchHosts(4), func(c *baremetal.Config) {
+		c.Batch.MaxConcurrency = 1
+		c.Batch.MaxFailures = 1
+	})
+	tb.bmcs.Get("10.0.1.2").Fail("PowerOn", errBMC)
+
+	report, err := tb.p.ProvisionAll(context.Background(), tb.hostPointers())
+	if !errors.Is(err, baremetal.ErrBatchHalted) {
+		t.Fatalf("err = %v, want %v", err, baremetal.ErrBatchHalted)
+	}
+	if !report.Halted {
+		t.Error("report not marked halted")
+	}
+
+	want := []struct {
+		outcome baremetal.Outcome
+		state   baremetal.State
+	}{
+		{baremetal.OutcomeSucceeded, baremetal.StateReady},
+		{baremetal.OutcomeFailed, baremetal.StateBooting},
+		{baremetal.OutcomeSkipped, ""},
+		{baremetal.OutcomeSkipped, ""},
+	}
+	for i, res := range report.Results {
+		if res.Outcome != want[i].outcome || res.State != want[i].state {
+			t.Errorf("%s = %s in %q, want %s in %q", res.Hostname, res.Outcome, res.State, want[i].outcome, want[i].state)
+		}
+	}
+	if err := report.Results[1].Err; !errors.Is(err, errBMC) {
+		t.Errorf("n2 error = %v, want %v", err, errBMC)
+	}
+	for _, res := range report.Skipped() {
+		if !errors.Is(res.Err, baremetal.ErrBatchHalted) {
+			t.Errorf("%s skipped with %v, want %v", res.Hostname, res.Err, baremetal.ErrBatchHalted)
+		}
+		if _, ok := tb.p.Status(res.Hostname); ok {
+			t.Errorf("skipped host %s was started", res.Hostname)
+		}
+	}
+}
+
+func TestProvisionAllDuplicateHost(t *testing.T) {
+	tb := newTestbed(t, batchHosts(2), nil)
+	hosts := tb.hostPointers()
+	hosts = append(hosts, hosts[0])
+
+	report, err := tb.p.ProvisionAll(context.Background(), hosts)
+	if err == nil || errors.Is(err, baremetal.ErrBatchHalted) {
+		t.Fatalf("err = %v, want the duplicate reported", err)
+	}
+	if n := len(report.Succeeded()); n != 2 {
+		t.Errorf("%d hosts succeeded, want 2", n)
+	}
+	dup := report.Results[2]
+	if dup.Hostname != "n1" || dup.Outcome != baremetal.OutcomeSkipped || dup.Err == nil {
+		t.Errorf("duplicate result = %+v, want n1 skipped with an error", dup)
+	}
+}
+
+func TestProvisionAllCancelled(t *testing.T) {
+	tb := newTestbed(t, batchHosts(3), nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	report, err := tb.p.ProvisionAll(ctx, tb.hostPointers())
+	if err == nil {
+		t.Fatal("ProvisionAll succeeded with a cancelled context")
+	}
+	if n := len(report.Skipped()); n != 3 {
+		t.Errorf("%d hosts skipped, want 3", n)
+	}
+	for _, res := range report.Skipped() {
+		if !errors.Is(res.Err, context.Canceled) {
+			t.Errorf("%s skipped with %v, want %v", res.Hostname, res.Err, context.Canceled)
+		}
+	}
+}
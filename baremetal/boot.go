@@ -0,0 +1,122 @@
+package baremetal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/nimbus-project/nimbus/pxe"
+)
+
+// maxBootAttempts is how many times a host may network boot without fetching
+// its kernel before it is considered stuck in a boot loop
+const maxBootAttempts = 3
+
+// ErrBootLoop is returned when a host keeps network booting without getting
+// as far as loading its kernel
+var ErrBootLoop = errors.New("host is stuck in a network boot loop")
+
+// BootEventSource delivers network boot events. It is implemented by
+// *pxe.Server.
+type BootEventSource interface {
+	Subscribe(buffer int) (<-chan pxe.Event, func())
+}
+
+// LocalBootProfile is the name of the PXE boot profile that hands a host
+// over to its local disk. Hosts are switched to it once they have been
+// installed so that they do not install again when they next network boot.
+const LocalBootProfile = "local-disk"
+
+// BootSelector chooses the profile a host network boots with. It is
+// implemented by *pxe.Server.
+type BootSelector interface {
+	SetHostProfile(mac, profile string) error
+}
+
+// EnableBootSelection makes the provisioner point each host it provisions
+// at its install profile before powering it on, and at LocalBootProfile
+// once it has been installed
+func (p *Provisioner) EnableBootSelection(srv BootSelector) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.selector = srv
+}
+
+// SetBootEvents makes the provisioner follow hosts through their network
+// boot using events from src
+func (p *Provisioner) SetBootEvents(src BootEventSource) {
+	p.bootEvents = src
+}
+
+// waitForBoot follows a host's network boot until it has loaded its kernel,
+// returning the address it was leased. A boot attempt starts with a DHCP
+// acknowledgement handing the firmware its boot loader, which is the boot
+// file of the first acknowledgement seen. Loaders such as iPXE ask for an
+// address again before fetching their script, and those acknowledgements
+// with other boot files belong to the attempt in progress. A host that
+// makes more than maxBootAttempts without fetching its kernel is stuck.
+func (p *Provisioner) waitForBoot(ctx context.Context, host *Host, events <-chan pxe.Event) (net.IP, error) {
+	mac, err := net.ParseMAC(host.MAC)
+	if err != nil {
+		return nil, fmt.Errorf("invalid MAC address for host %s: %w", host.Hostname, err)
+	}
+
+	var (
+		ip       net.IP
+		loader   string
+		attempts int
+	)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case e, ok := <-events:
+			if !ok {
+				return nil, fmt.Errorf("PXE server stopped")
+			}
+			if e.MAC.String() != mac.String() {
+				continue
+			}
+
+			log.Debug().
+				Str("host", host.Hostname).
+				Str("event", string(e.Type)).
+				Str("ip", e.IP.String()).
+				Str("file", e.File).
+				Msg("Boot progress")
+
+			switch {
+			case e.Type == pxe.EventDHCPAck && e.File != "":
+				if e.IP != nil {
+					ip = e.IP
+				}
+				if loader == "" {
+					loader = e.File
+				}
+				if e.File != loader {
+					p.reportProgress(host, 0.5, "Boot loader chainloading %s", e.File)
+					continue
+				}
+				attempts++
+				if attempts > maxBootAttempts {
+					return nil, fmt.Errorf("%w after %d attempts", ErrBootLoop, attempts)
+				}
+				p.reportProgress(host, 0.3, "Network boot attempt %d with %s", attempts, e.File)
+			case e.Role == pxe.RoleKernel && e.Complete:
+				log.Info().
+					Str("host", host.Hostname).
+					Str("ip", e.IP.String()).
+					Str("arch", e.Arch.String()).
+					Msg("Host loaded its kernel")
+				p.reportProgress(host, 1, "Loaded kernel")
+				if ip == nil {
+					ip = e.IP
+				}
+				return ip, nil
+			}
+		}
+	}
+}
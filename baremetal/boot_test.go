@@ -0,0 +1,87 @@
+package baremetal
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/nimbus-project/nimbus/pxe"
+)
+
+func TestWaitForBoot(t *testing.T) {
+	mac, _ := net.ParseMAC("52:54:00:00:00:01")
+	other, _ := net.ParseMAC("52:54:00:00:00:02")
+	ip := net.IPv4(10, 0, 0, 100)
+
+	firmware := pxe.Event{Type: pxe.EventDHCPAck, MAC: mac, IP: ip, File: "ipxe.efi"}
+	script := pxe.Event{Type: pxe.EventDHCPAck, MAC: mac, IP: ip, File: "http://10.0.0.1:8080/ipxe/52:54:00:00:00:01"}
+	partial := pxe.Event{Type: pxe.EventHTTPFile, MAC: mac, File: "/vmlinuz", Role: pxe.RoleKernel}
+	kernel := pxe.Event{Type: pxe.EventHTTPFile, MAC: mac, File: "/vmlinuz", Role: pxe.RoleKernel, Complete: true}
+
+	repeat := func(n int, events ...pxe.Event) []pxe.Event {
+		var out []pxe.Event
+		for i := 0; i < n; i++ {
+			out = append(out, events...)
+		}
+		return out
+	}
+
+	tests := []struct {
+		name   string
+		events []pxe.Event
+		err    error
+	}{
+		{
+			name:   "pxe",
+			events: []pxe.Event{{Type: pxe.EventDHCPAck, MAC: mac, IP: ip, File: "pxelinux.0"}, kernel},
+		},
+		{
+			name:   "ipxe chainload",
+			events: []pxe.Event{firmware, script, kernel},
+		},
+		{
+			name:   "ipxe retries",
+			events: append(repeat(maxBootAttempts, firmware, script, partial), kernel),
+		},
+		{
+			name:   "boot loop",
+			events: repeat(maxBootAttempts+1, firmware, script),
+			err:    ErrBootLoop,
+		},
+		{
+			name: "other hosts",
+			events: append(repeat(maxBootAttempts+1, pxe.Event{Type: pxe.EventDHCPAck, MAC: other, File: "ipxe.efi"}),
+				firmware, kernel),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Provisioner{config: &Config{}, status: make(map[string]*HostStatus)}
+			host := &Host{Hostname: "n1", MAC: mac.String()}
+
+			events := make(chan pxe.Event, len(tt.events))
+			for _, e := range tt.events {
+				events <- e
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			got, err := p.waitForBoot(ctx, host, events)
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("err = %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("waitForBoot: %v", err)
+			}
+			if !got.Equal(ip) {
+				t.Errorf("boot address = %s, want %s", got, ip)
+			}
+		})
+	}
+}
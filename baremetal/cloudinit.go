@@ -0,0 +1,368 @@
+package baremetal
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/nimbus-project/nimbus/pxe"
+)
+
+const (
+	// cloudInitPath is the HTTP path prefix cloud-init NoCloud data is
+	// served under
+	cloudInitPath = "/cloud-init/"
+
+	// metadataTokenGrace is how long a metadata token stays valid after it
+	// is first used, so that cloud-init can fetch all of its files
+	metadataTokenGrace = 10 * time.Minute
+
+	// defaultMetadataTokenTTL is how long an unused metadata token is valid
+	// when no provisioning timeout is configured
+	defaultMetadataTokenTTL = time.Hour
+)
+
+// MetadataServer serves cloud-init data and passes hosts the URL of their
+// data on the kernel command line. It is implemented by *pxe.Server.
+type MetadataServer interface {
+	AddPXEHandler(path string, handler http.Handler, middleware ...pxe.Middleware)
+	SetHostCmdline(mac, args string) error
+	ClientMAC(ip net.IP) net.HardwareAddr
+	URL(path string) string
+	CacheArtifact(ctx context.Context, url, sha256 string) (string, error)
+}
+
+// metadataToken identifies the host a one-time metadata URL was issued to
+type metadataToken struct {
+	host    Host
+	expires time.Time
+	used    bool
+}
+
+// EnableMetadata serves cloud-init NoCloud meta-data, user-data and
+// network-config and installer answer files for each host from the PXE
+// server. Hosts being provisioned are given one-time URLs on their kernel
+// command line; other hosts are identified by the address they were
+// assigned.
+func (p *Provisioner) EnableMetadata(srv MetadataServer) {
+	srv.AddPXEHandler(cloudInitPath, http.HandlerFunc(p.serveMetadata))
+	srv.AddPXEHandler(installerPath, http.HandlerFunc(p.serveInstallerConfig))
+	srv.AddPXEHandler(phoneHomePath, http.HandlerFunc(p.servePhoneHome))
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.metadata = srv
+	p.tokens = make(map[string]*metadataToken)
+}
+
+// issueMetadataToken creates one-time metadata and installer URLs for a host
+// and adds them to the host's kernel command line, replacing any earlier
+// ones. The token is recorded in the host's status; a resumed run passes
+// the token it had issued, so that the URLs it handed out stay valid.
+func (p *Provisioner) issueMetadataToken(host *Host, token string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.metadata == nil || host.MAC == "" {
+		return nil
+	}
+
+	if token == "" {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			return fmt.Errorf("failed to generate metadata token: %w", err)
+		}
+		token = hex.EncodeToString(b)
+	}
+
+	ttl := time.Duration(p.config.Timeout)
+	if ttl == 0 {
+		ttl = defaultMetadataTokenTTL
+	}
+
+	mac, err := net.ParseMAC(host.MAC)
+	if err != nil {
+		return fmt.Errorf("invalid MAC address for host %s: %w", host.Hostname, err)
+	}
+	for t, mt := range p.tokens {
+		if mt.host.MAC == mac.String() {
+			delete(p.tokens, t)
+		}
+	}
+
+	args := "ds=nocloud;s=" + p.metadata.URL(cloudInitPath+token+"/")
+	if installer := installerArgs(p.config.InstallerFormat(host), p.config.HostOS(host), p.metadata.URL(installerPath+token+"/")); installer != "" {
+		args = installer + " " + args
+	}
+	if u := p.phoneHomeURL(host.Hostname); u != "" {
+		args += " " + phoneHomeArg + "=" + u
+	}
+	if err := p.metadata.SetHostCmdline(mac.String(), args); err != nil {
+		return err
+	}
+
+	snapshot := *host
+	snapshot.MAC = mac.String()
+	p.tokens[token] = &metadataToken{host: snapshot, expires: time.Now().Add(ttl)}
+	if st, ok := p.status[host.Hostname]; ok {
+		st.Tokens.Metadata = token
+	}
+	return nil
+}
+
+// serveMetadata serves a cloud-init file for the host identified by the
+// token in the path or, without a token, by the client's address. Hosts
+// installing Ubuntu get their autoinstall configuration as user-data.
+func (p *Provisioner) serveMetadata(w http.ResponseWriter, r *http.Request) {
+	host, file, err := p.requestHost(r, cloudInitPath)
+	if err != nil {
+		log.Debug().Err(err).Str("remote", r.RemoteAddr).Msg("Refusing cloud-init request")
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	var data []byte
+	switch file {
+	case "meta-data", "user-data", "network-config":
+		data, err = p.config.renderCloudInit(host, file)
+	case "vendor-data":
+		// cloud-init asks for vendor data, which Nimbus does not provide
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Str("host", host.Hostname).Str("file", file).Msg("Failed to render cloud-init data")
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Debug().Str("host", host.Hostname).Str("file", file).Str("remote", r.RemoteAddr).Msg("Serving cloud-init data")
+
+	// JSON is valid YAML, which is what cloud-init expects
+	w.Header().Set("Content-Type", "text/yaml; charset=utf-8")
+	w.Write(append(data, '\n'))
+}
+
+// renderCloudInit renders a host's cloud-init meta-data, user-data or
+// network-config
+func (c *Config) renderCloudInit(host *Host, file string) ([]byte, error) {
+	switch file {
+	case "meta-data":
+		return json.MarshalIndent(cloudInitMetaData(host), "", "  ")
+	case "user-data":
+		if c.InstallerFormat(host) == InstallerAutoinstall {
+			return c.RenderAutoinstall(host)
+		}
+		data, err := json.MarshalIndent(c.cloudInitUserData(host), "", "  ")
+		return append([]byte("#cloud-config\n"), data...), err
+	case "network-config":
+		return json.MarshalIndent(c.cloudInitNetworkConfig(host), "", "  ")
+	default:
+		return nil, fmt.Errorf("unknown cloud-init file %q", file)
+	}
+}
+
+// requestHost looks up the host a request below prefix is for, returning
+// the requested file name. The path is either <prefix><token>/<file> or,
+// for hosts identified by their address, <prefix><file>.
+func (p *Provisioner) requestHost(r *http.Request, prefix string) (*Host, string, error) {
+	rest := strings.TrimPrefix(r.URL.Path, prefix)
+	token, file, ok := strings.Cut(rest, "/")
+	if !ok {
+		token, file = "", rest
+	}
+
+	host, err := p.metadataHost(token, r.RemoteAddr)
+	return host, file, err
+}
+
+// metadataHost looks up the host a metadata request is for. A token is
+// valid until it expires or for metadataTokenGrace after its first use.
+func (p *Provisioner) metadataHost(token, remoteAddr string) (*Host, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if token != "" {
+		mt, ok := p.tokens[token]
+		if !ok || time.Now().After(mt.expires) {
+			delete(p.tokens, token)
+			return nil, fmt.Errorf("unknown or expired metadata token")
+		}
+		if !mt.used {
+			mt.used = true
+			if grace := time.Now().Add(metadataTokenGrace); grace.Before(mt.expires) {
+				mt.expires = grace
+			}
+		}
+		host := mt.host
+		return &host, nil
+	}
+
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid client address %s", host)
+	}
+
+	// Hosts are known by the address they were acknowledged with over DHCP
+	// or by a static address in their configuration
+	if mac := p.metadata.ClientMAC(ip); mac != nil {
+		if h := p.findHost(mac); h != nil {
+			found := *h
+			return &found, nil
+		}
+	}
+	for i := range p.config.Hosts {
+		h := &p.config.Hosts[i]
+		if iface := h.bootInterface(); iface != nil && net.ParseIP(iface.Address).Equal(ip) {
+			found := *h
+			return &found, nil
+		}
+	}
+	return nil, fmt.Errorf("no host with address %s", ip)
+}
+
+// cloudInitMetaData renders a host's NoCloud meta-data
+func cloudInitMetaData(host *Host) map[string]interface{} {
+	return map[string]interface{}{
+		"instance-id":    "nimbus-" + strings.ReplaceAll(host.MAC, ":", ""),
+		"local-hostname": hostHostname(host),
+	}
+}
+
+// cloudInitUserData renders a host's cloud-config from its OS and the
+// post-installation configuration
+func (c *Config) cloudInitUserData(host *Host) map[string]interface{} {
+	osCfg := c.HostOS(host)
+	post := c.PostInstall
+
+	root := map[string]interface{}{
+		"name":        "root",
+		"lock_passwd": osCfg.RootPassword == "",
+	}
+	if osCfg.RootPassword != "" {
+		root["hashed_passwd"] = osCfg.RootPassword
+	}
+	if len(osCfg.SSHKeys) > 0 {
+		root["ssh_authorized_keys"] = osCfg.SSHKeys
+	}
+
+	data := map[string]interface{}{
+		"hostname":     hostHostname(host),
+		"users":        []interface{}{"default", root},
+		"disable_root": !post.PermitRootLogin,
+		"ssh_pwauth":   post.PasswordAuthentication,
+	}
+	if len(osCfg.Packages) > 0 {
+		data["packages"] = osCfg.Packages
+		data["package_update"] = true
+	}
+	if post.Timezone != "" {
+		data["timezone"] = post.Timezone
+	}
+	if post.Locale != "" {
+		data["locale"] = post.Locale
+	}
+
+	var runcmd []string
+	runcmd = append(runcmd, osCfg.PostInstallScripts...)
+	runcmd = append(runcmd, post.Commands...)
+	if len(runcmd) > 0 {
+		data["runcmd"] = runcmd
+	}
+	return data
+}
+
+// cloudInitNetworkConfig renders a host's interfaces as network config
+// version 2. A host without configured interfaces uses DHCP on the
+// interface it booted from.
+func (c *Config) cloudInitNetworkConfig(host *Host) map[string]interface{} {
+	osCfg := c.HostOS(host)
+	nameservers := c.hostNameservers(osCfg)
+
+	ethernets := make(map[string]interface{})
+	for _, iface := range osCfg.Network.Interfaces {
+		eth := map[string]interface{}{"dhcp4": iface.DHCP}
+		for _, nic := range host.Hardware.NICs {
+			if nic.Name == iface.Name && nic.MAC != "" {
+				eth["match"] = map[string]string{"macaddress": strings.ToLower(nic.MAC)}
+				eth["set-name"] = iface.Name
+			}
+		}
+
+		if !iface.DHCP && iface.Address != "" {
+			addr := iface.Address
+			if mask, err := parseIPv4(iface.Netmask); err == nil && mask != nil {
+				ones, _ := net.IPMask(mask).Size()
+				addr = fmt.Sprintf("%s/%d", addr, ones)
+			}
+			eth["addresses"] = []string{addr}
+
+			gateway := iface.Gateway
+			if gateway == "" && iface.DefaultRoute {
+				gateway = c.Network.Gateway
+			}
+			if gateway != "" {
+				eth["routes"] = []map[string]string{{"to": "default", "via": gateway}}
+			}
+			ns := make(map[string][]string)
+			if len(nameservers) > 0 {
+				ns["addresses"] = nameservers
+			}
+			if len(osCfg.Network.SearchDomains) > 0 {
+				ns["search"] = osCfg.Network.SearchDomains
+			}
+			if len(ns) > 0 {
+				eth["nameservers"] = ns
+			}
+		}
+		if !iface.OnBoot {
+			eth["optional"] = true
+		}
+		ethernets[iface.Name] = eth
+	}
+
+	if len(ethernets) == 0 && host.MAC != "" {
+		ethernets["boot"] = map[string]interface{}{
+			"match": map[string]string{"macaddress": strings.ToLower(host.MAC)},
+			"dhcp4": true,
+		}
+	}
+
+	return map[string]interface{}{
+		"version":   2,
+		"ethernets": ethernets,
+	}
+}
+
+// hostNameservers returns the DNS servers for a host's OS configuration,
+// falling back to those of the provisioning network
+func (c *Config) hostNameservers(osCfg *OSConfig) []string {
+	if len(osCfg.Network.Nameservers) > 0 {
+		return osCfg.Network.Nameservers
+	}
+	return c.Network.DNSServers
+}
+
+// hostHostname returns the hostname a host should give itself
+func hostHostname(host *Host) string {
+	if host.Hostname != "" {
+		return host.Hostname
+	}
+	if host.OS != nil && host.OS.Network.Hostname != "" {
+		return host.OS.Network.Hostname
+	}
+	return "host-" + strings.ReplaceAll(host.MAC, ":", "")
+}
@@ -0,0 +1,34 @@
+package baremetal
+
+import "testing"
+
+func TestRenderCloudInit(t *testing.T) {
+	tests := []struct {
+		name    string
+		version string
+		file    string
+	}{
+		{name: "cloudinit-meta-data", version: "rocky-9", file: "meta-data"},
+		{name: "cloudinit-user-data", version: "rocky-9", file: "user-data"},
+		{name: "cloudinit-network-config", version: "rocky-9", file: "network-config"},
+		// Ubuntu's installer reads its answer file as user-data
+		{name: "autoinstall", version: "ubuntu-24.04", file: "user-data"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, host := rendererHost(t, tt.version, "", false)
+
+			got, err := cfg.renderCloudInit(host, tt.file)
+			if err != nil {
+				t.Fatalf("renderCloudInit: %v", err)
+			}
+			checkGolden(t, tt.name, got)
+		})
+	}
+
+	cfg, host := rendererHost(t, "rocky-9", "", false)
+	if _, err := cfg.renderCloudInit(host, "vendor-data"); err == nil {
+		t.Error("rendered an unknown cloud-init file")
+	}
+}
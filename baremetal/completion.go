@@ -0,0 +1,268 @@
+package baremetal
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nimbus-project/nimbus/pxe"
+)
+
+// SSH probe settings
+const (
+	defaultSSHPort          = 22
+	defaultSSHProbeInterval = 15 * time.Second
+	sshProbeTimeout         = 5 * time.Second
+	sshBannerPrefix         = "SSH-"
+)
+
+const (
+	// installProgressMilestone is the percentage installers report when
+	// they start their post-install scripts
+	installProgressMilestone = 80
+
+	// installStartedFraction is the progress through StateInstalling once
+	// the installer has started
+	installStartedFraction = 0.05
+
+	// notReported marks an installer that has not reported in
+	notReported = -1
+)
+
+// CompletionConfig controls how the provisioner learns that a host has
+// finished installing
+type CompletionConfig struct {
+	// Have installers report their start, progress and completion to the
+	// PXE server's phone-home endpoint. Requires metadata to be served.
+	PhoneHome bool `toml:"phone_home"`
+
+	// Consider installation complete once the host answers on SSH, having
+	// been unreachable since installation started
+	SSHProbe bool `toml:"ssh_probe"`
+
+	// Port probed for SSH, 22 if not set
+	SSHPort int `toml:"ssh_port"`
+
+	// Time between SSH probes, 15s if not set
+	ProbeInterval Duration `toml:"probe_interval"`
+}
+
+// validate checks the completion configuration
+func (c *CompletionConfig) validate() error {
+	if c.SSHPort < 0 || c.SSHPort > 65535 {
+		return fmt.Errorf("invalid SSH probe port %d", c.SSHPort)
+	}
+	if c.ProbeInterval < 0 {
+		return fmt.Errorf("SSH probe interval must not be negative")
+	}
+	return nil
+}
+
+// monitorInstallation waits for a host's installation to finish. The host is
+// switched to LocalBootProfile as soon as its installer is running, so that
+// the reboot at the end of installation boots the installed system.
+// Completion is detected from the installer's phone-home reports or, as a
+// fallback, from the installed system answering on SSH. Without either the
+// step returns at once, as nothing can tell when installation ends.
+func (p *Provisioner) monitorInstallation(ctx context.Context, r *provisionRun) error {
+	var reports <-chan installReport
+	if r.install != nil {
+		reports = r.install.reports
+	}
+	probeAddr := p.sshProbeAddr(r)
+
+	if reports == nil && probeAddr == "" {
+		p.logProgress(r.host, "Installation completion cannot be detected without phone_home or ssh_probe")
+		return nil
+	}
+
+	handedOver := false
+	handOver := func() error {
+		if handedOver || !p.config.PXE.Enabled {
+			return nil
+		}
+		handedOver = true
+		if err := p.selectProfile(r.host, LocalBootProfile); err != nil {
+			return err
+		}
+		p.logProgress(r.host, "Installer is running, host will boot from its disk next")
+		return nil
+	}
+
+	// Without boot events there is no telling when the installer has been
+	// loaded, so the host is handed over now and relies on the installer
+	// not network booting again
+	events := r.events
+	if events == nil {
+		if err := handOver(); err != nil {
+			return err
+		}
+	}
+	mac, _ := net.ParseMAC(r.host.MAC)
+
+	var sshUp <-chan struct{}
+	if probeAddr != "" {
+		p.logProgress(r.host, "Probing SSH on %s", probeAddr)
+		// A host resumed while installing may already run the installed system
+		sshUp = p.probeSSH(ctx, probeAddr, r.resumed != StateInstalling)
+	}
+
+	last := installReport{percent: notReported}
+	for {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%s: %w", installWaitReason(reports != nil, last, probeAddr), ctx.Err())
+
+		case e, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			// The installer is running once it has its initrd
+			if mac != nil && e.MAC.String() == mac.String() && e.Role == pxe.RoleInitrd && e.Complete {
+				if err := handOver(); err != nil {
+					return err
+				}
+			}
+
+		case rep := <-reports:
+			last = rep
+			switch rep.event {
+			case InstallStarted:
+				p.reportProgress(r.host, installStartedFraction, "Installer started")
+				if err := handOver(); err != nil {
+					return err
+				}
+			case InstallProgress:
+				msg := rep.message
+				if msg == "" {
+					msg = "Installing"
+				}
+				p.reportProgress(r.host, float64(rep.percent)/100, "%s", msg)
+			case InstallCompleted:
+				if err := handOver(); err != nil {
+					return err
+				}
+				p.reportProgress(r.host, 1, "Installer reported completion")
+				return nil
+			case InstallFailed:
+				msg := rep.message
+				if msg == "" {
+					msg = "no reason given"
+				}
+				return fmt.Errorf("%w: %s", ErrInstallFailed, msg)
+			}
+
+		case <-sshUp:
+			if err := handOver(); err != nil {
+				return err
+			}
+			p.reportProgress(r.host, 1, "Host answers on SSH at %s", probeAddr)
+			return nil
+		}
+	}
+}
+
+// installWaitReason describes how far a host's installation got, for the
+// error of an installation that did not finish in time
+func installWaitReason(phoneHome bool, last installReport, probeAddr string) string {
+	var reasons []string
+	if phoneHome {
+		switch {
+		case last.percent == notReported:
+			reasons = append(reasons, "installer never reported in")
+		case last.message != "":
+			reasons = append(reasons, fmt.Sprintf("installer last reported %s at %d%%: %s", last.event, last.percent, last.message))
+		default:
+			reasons = append(reasons, fmt.Sprintf("installer last reported %s at %d%%", last.event, last.percent))
+		}
+	}
+	if probeAddr != "" {
+		reasons = append(reasons, fmt.Sprintf("SSH on %s never became reachable", probeAddr))
+	}
+	return strings.Join(reasons, "; ")
+}
+
+// sshProbeAddr returns the address to probe a host's SSH on, or "" if SSH
+// probing is disabled or the host's address is unknown. The host's static
+// address is preferred over the one it was leased while network booting.
+func (p *Provisioner) sshProbeAddr(r *provisionRun) string {
+	cfg := p.config.Completion
+	if !cfg.SSHProbe {
+		return ""
+	}
+
+	ip := r.bootIP
+	if iface := r.host.bootInterface(); iface != nil {
+		if addr := net.ParseIP(strings.SplitN(iface.Address, "/", 2)[0]); addr != nil {
+			ip = addr
+		}
+	}
+	if ip == nil {
+		return ""
+	}
+
+	port := cfg.SSHPort
+	if port == 0 {
+		port = defaultSSHPort
+	}
+	return net.JoinHostPort(ip.String(), strconv.Itoa(port))
+}
+
+// probeSSH probes addr until an SSH server answers there, then closes the
+// returned channel. If requireDown is set, an answer only counts once a
+// probe has failed, so that SSH in the installer environment or in a
+// system that has not yet rebooted is not mistaken for the installed one.
+func (p *Provisioner) probeSSH(ctx context.Context, addr string, requireDown bool) <-chan struct{} {
+	interval := time.Duration(p.config.Completion.ProbeInterval)
+	if interval == 0 {
+		interval = defaultSSHProbeInterval
+	}
+
+	up := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		seenDown := !requireDown
+		for {
+			if sshReachable(ctx, addr) {
+				if seenDown {
+					close(up)
+					return
+				}
+			} else {
+				seenDown = true
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return up
+}
+
+// sshReachable reports whether an SSH server answers at addr with its
+// version banner
+func sshReachable(ctx context.Context, addr string) bool {
+	d := net.Dialer{Timeout: sshProbeTimeout}
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(sshProbeTimeout))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil && line == "" {
+		return false
+	}
+	return strings.HasPrefix(line, sshBannerPrefix)
+}
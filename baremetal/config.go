@@ -2,10 +2,15 @@
 package baremetal
 
 import (
-	"context"
+	"crypto/ed25519"
+	"encoding/base64"
 	"fmt"
 	"net"
+	"strings"
+	"sync"
 	"time"
+
+	"github.com/nimbus-project/nimbus/pxe"
 )
 
 // Config holds the configuration for bare metal provisioning
@@ -27,6 +32,21 @@ type Config struct {
 
 	// Timeout for provisioning operations
 	Timeout Duration `toml:"timeout"`
+
+	// Timeouts of the individual provisioning states
+	StateTimeouts StateTimeouts `toml:"state_timeouts"`
+
+	// Where provisioning state is persisted so that runs survive restarts
+	StateStore StateStoreConfig `toml:"state_store"`
+
+	// Limits for provisioning hosts in parallel
+	Batch BatchConfig `toml:"batch"`
+
+	// How the end of installation is detected
+	Completion CompletionConfig `toml:"completion"`
+
+	// Hosts managed by this provisioner
+	Hosts []Host `toml:"hosts"`
 }
 
 // NetworkConfig holds network configuration for bare metal servers
@@ -41,11 +61,58 @@ type NetworkConfig struct {
 	} `toml:"dhcp_range"`
 
 	// Network configuration for provisioned servers
-	Network  string   `toml:"network"`
-	Netmask  string   `toml:"netmask"`
-	Gateway  string   `toml:"gateway"`
+	Network    string   `toml:"network"`
+	Netmask    string   `toml:"netmask"`
+	Gateway    string   `toml:"gateway"`
 	DNSServers []string `toml:"dns_servers"`
-	NTP      string   `toml:"ntp"`
+	NTP        string   `toml:"ntp"`
+
+	// DHCP lease duration (defaults to 1h)
+	LeaseTime Duration `toml:"lease_time"`
+
+	// Networks reached through DHCP relay agents
+	Subnets []SubnetConfig `toml:"subnets"`
+
+	// IPv6 netboot through DHCPv6
+	IPv6 IPv6Config `toml:"ipv6"`
+}
+
+// IPv6Config describes the IPv6 side of the provisioning network, used when
+// the PXE server's DHCPv6 is enabled
+type IPv6Config struct {
+	// Server address handed out in boot file URLs, taken from the
+	// interface if unset
+	Address string `toml:"address"`
+
+	// IPv6 address range for DHCPv6. Without one hosts are only given
+	// boot information and configure their address with SLAAC.
+	DHCPRange struct {
+		Start string `toml:"start"`
+		End   string `toml:"end"`
+	} `toml:"dhcp_range"`
+
+	DNSServers []string `toml:"dns_servers"`
+}
+
+// SubnetConfig describes a network whose hosts reach the PXE server through
+// a DHCP relay agent. Requests are matched to it by the relay's address or
+// by the relay agent circuit-id or remote-id.
+type SubnetConfig struct {
+	// Network in CIDR notation
+	Network string `toml:"network"`
+
+	// IP address range for DHCP
+	DHCPRange struct {
+		Start string `toml:"start"`
+		End   string `toml:"end"`
+	} `toml:"dhcp_range"`
+
+	Gateway    string   `toml:"gateway"`
+	DNSServers []string `toml:"dns_servers"`
+
+	// Relay agent circuit-ids and remote-ids that select this subnet
+	CircuitIDs []string `toml:"circuit_ids"`
+	RemoteIDs  []string `toml:"remote_ids"`
 }
 
 // PXEConfig holds PXE boot configuration
@@ -53,18 +120,119 @@ type PXEConfig struct {
 	// Enable PXE boot server
 	Enabled bool `toml:"enabled"`
 
-	// Path to kernel and initrd
+	// Path to kernel and initrd, or HTTP(S) URLs to download them from
 	Kernel  string `toml:"kernel"`
 	Initrd  string `toml:"initrd"`
 	Cmdline string `toml:"cmdline"`
 
+	// SHA-256 digests of remote kernel and initrd
+	KernelSHA256 string `toml:"kernel_sha256"`
+	InitrdSHA256 string `toml:"initrd_sha256"`
+
+	// Cache for remote boot artifacts
+	Artifacts ArtifactConfig `toml:"artifacts"`
+
 	// HTTP server configuration
 	HTTPAddr string `toml:"http_addr"`
 	TFTPAddr string `toml:"tftp_addr"`
 	DHCPAddr string `toml:"dhcp_addr"`
 
+	// Answer DHCPv6 netboot clients, configured by [network.ipv6]
+	DHCPv6     bool   `toml:"dhcpv6"`
+	DHCPv6Addr string `toml:"dhcpv6_addr"`
+
 	// Root directory for PXE files
 	RootDir string `toml:"root_dir"`
+
+	// File used to persist DHCP leases across restarts
+	LeaseFile string `toml:"lease_file"`
+
+	// Time allowed for in-flight transfers when shutting down (defaults to 10s)
+	ShutdownTimeout Duration `toml:"shutdown_timeout"`
+
+	// Only serve hosts listed in [[hosts]] and hosts being provisioned.
+	// iPXE scripts are then fetched with single-use tokens valid for
+	// boot_token_ttl (defaults to 5m).
+	RequireAuthorization bool     `toml:"require_authorization"`
+	BootTokenTTL         Duration `toml:"boot_token_ttl"`
+
+	// Run as a proxyDHCP server alongside an existing DHCP server. Only
+	// PXE clients are answered and no addresses are assigned.
+	ProxyDHCP     bool   `toml:"proxy_dhcp"`
+	ProxyDHCPAddr string `toml:"proxy_dhcp_addr"`
+
+	// Chainload iPXE and boot from a per-host iPXE script served over HTTP
+	IPXE bool `toml:"ipxe"`
+
+	// Boot UEFI hosts through shim and GRUB for Secure Boot
+	GRUB bool `toml:"grub"`
+
+	// Additional boot profiles that hosts can be assigned to. The kernel,
+	// initrd and cmdline above form the default profile.
+	Profiles []BootProfile `toml:"profiles"`
+
+	// Hardware discovery for hosts that are not listed in [[hosts]]
+	Discovery DiscoveryConfig `toml:"discovery"`
+
+	// Agent booted by hosts that deploy a disk image
+	Deploy DeployConfig `toml:"deploy"`
+}
+
+// DeployConfig holds the kernel and initrd of the deploy agent, which writes
+// a host's disk image and reboots it into the deployed system. The agent is
+// supplied by the operator and follows the DeployManifest it is given.
+type DeployConfig struct {
+	Kernel  string `toml:"kernel"`
+	Initrd  string `toml:"initrd"`
+	Cmdline string `toml:"cmdline"`
+
+	KernelSHA256 string `toml:"kernel_sha256"`
+	InitrdSHA256 string `toml:"initrd_sha256"`
+}
+
+// DiscoveryConfig holds configuration for hardware discovery. Hosts that are
+// not listed boot an agent that reports their hardware, after which they
+// wait as pending hosts until they are approved. Discovery cannot be
+// combined with PXEConfig.RequireAuthorization.
+type DiscoveryConfig struct {
+	Enabled bool `toml:"enabled"`
+
+	// Discovery agent kernel and initrd, as paths or HTTP(S) URLs
+	Kernel  string `toml:"kernel"`
+	Initrd  string `toml:"initrd"`
+	Cmdline string `toml:"cmdline"`
+
+	KernelSHA256 string `toml:"kernel_sha256"`
+	InitrdSHA256 string `toml:"initrd_sha256"`
+}
+
+// BootProfile describes a named network boot configuration
+type BootProfile struct {
+	Name string `toml:"name"`
+
+	// Action is one of install, rescue, localboot or wipe
+	Action string `toml:"action"`
+
+	Kernel  string `toml:"kernel"`
+	Initrd  string `toml:"initrd"`
+	Cmdline string `toml:"cmdline"`
+
+	KernelSHA256 string `toml:"kernel_sha256"`
+	InitrdSHA256 string `toml:"initrd_sha256"`
+}
+
+// ArtifactConfig holds configuration for the remote boot artifact cache
+type ArtifactConfig struct {
+	// Maximum size of the cache in MB (0 for unlimited)
+	CacheSizeMB int64 `toml:"cache_size_mb"`
+
+	// Signed manifest listing SHA-256 digests of remote artifacts, and the
+	// base64 encoded ed25519 public key it is signed with
+	ManifestURL string `toml:"manifest_url"`
+	ManifestKey string `toml:"manifest_key"`
+
+	// Time allowed for downloading an artifact, 30m if not set
+	FetchTimeout Duration `toml:"fetch_timeout"`
 }
 
 // BMCConfig holds BMC (Baseboard Management Controller) configuration
@@ -91,6 +259,10 @@ type OSConfig struct {
 	// Installation source (URL to ISO or repository)
 	Source string `toml:"source"`
 
+	// Installer answer file format: autoinstall, preseed or kickstart.
+	// Inferred from the version (ubuntu-*, debian-*, rocky-*, ...) if empty.
+	Installer string `toml:"installer"`
+
 	// Root password (hashed)
 	RootPassword string `toml:"root_password"`
 
@@ -124,7 +296,7 @@ type OSConfig struct {
 		Interfaces []NetworkInterface `toml:"interfaces"`
 
 		// DNS configuration
-		Nameservers []string `toml:"nameservers"`
+		Nameservers   []string `toml:"nameservers"`
 		SearchDomains []string `toml:"search_domains"`
 	} `toml:"network"`
 
@@ -134,6 +306,48 @@ type OSConfig struct {
 	// Custom scripts to run during installation
 	PreInstallScripts  []string `toml:"pre_install_scripts"`
 	PostInstallScripts []string `toml:"post_install_scripts"`
+
+	// Files and systemd units to create, for images configured with
+	// Ignition rather than an installer
+	Files []File        `toml:"files"`
+	Units []SystemdUnit `toml:"units"`
+
+	// Prebuilt image written to Disk.Device instead of running an installer
+	Image ImageConfig `toml:"image"`
+}
+
+// ImageConfig describes a disk image deployed by the deploy agent
+type ImageConfig struct {
+	// Path below the PXE root directory or HTTP(S) URL of the image.
+	// Remote images are cached by the PXE server.
+	URL string `toml:"url"`
+
+	// SHA-256 digest of the image file as served, required
+	SHA256 string `toml:"sha256"`
+
+	// Image format (raw or qcow2) and compression (none, gzip or zstd),
+	// inferred from the file name if empty
+	Format      string `toml:"format"`
+	Compression string `toml:"compression"`
+
+	// Partition grown to fill the disk (defaults to the last partition)
+	RootPartition int `toml:"root_partition"`
+}
+
+// File is a file written to a host
+type File struct {
+	Path     string `toml:"path"`
+	Contents string `toml:"contents"`
+
+	// Permissions (defaults to 0644)
+	Mode int `toml:"mode"`
+}
+
+// SystemdUnit is a systemd unit installed on a host
+type SystemdUnit struct {
+	Name     string `toml:"name"`
+	Enabled  bool   `toml:"enabled"`
+	Contents string `toml:"contents"`
 }
 
 // PostInstallConfig holds post-installation configuration
@@ -217,6 +431,17 @@ type Host struct {
 	// MAC address for PXE boot
 	MAC string `toml:"mac"`
 
+	// Switch port the host is cabled to, as reported by DHCP relay agents.
+	// The host's reserved address follows the port, so a replacement
+	// machine cabled to it takes over the host's identity.
+	SwitchPort struct {
+		CircuitID string `toml:"circuit_id"`
+		RemoteID  string `toml:"remote_id"`
+	} `toml:"switch_port"`
+
+	// Boot profile to use instead of the default
+	BootProfile string `toml:"boot_profile"`
+
 	// BMC configuration
 	BMC struct {
 		// IP address or hostname of the BMC
@@ -231,38 +456,55 @@ type Host struct {
 	} `toml:"bmc"`
 
 	// Hardware information
-	Hardware struct {
-		// CPU information
-		CPU struct {
-			Vendor  string `toml:"vendor"`
-			Model   string `toml:"model"`
-			Cores   int    `toml:"cores"`
-			Threads int    `toml:"threads"`
-		} `toml:"cpu"`
-
-		// Memory in MB
-		Memory int64 `toml:"memory"`
-
-		// Disks
-		Disks []struct {
-			Device string `toml:"device"`
-			SizeGB int64  `toml:"size_gb"`
-			Model  string `toml:"model"`
-		} `toml:"disks"`
+	Hardware Hardware `toml:"hardware"`
 
-		// Network interfaces
-		NICs []struct {
-			Name       string `toml:"name"`
-			MAC        string `toml:"mac"`
-			SpeedMbps  int    `toml:"speed_mbps"`
-			DuplexFull bool   `toml:"duplex_full"`
-		} `toml:"nics"`
-	} `toml:"hardware"`
+	// OS configuration for this host, overriding the global [os] section
+	OS *OSConfig `toml:"os"`
 
 	// Custom configuration for this host
 	Config map[string]interface{} `toml:"config"`
 }
 
+// Hardware describes a host's hardware
+type Hardware struct {
+	// System information
+	Manufacturer string `toml:"manufacturer"`
+	Product      string `toml:"product"`
+	SerialNumber string `toml:"serial_number"`
+
+	// CPU information
+	CPU struct {
+		Vendor  string `toml:"vendor"`
+		Model   string `toml:"model"`
+		Cores   int    `toml:"cores"`
+		Threads int    `toml:"threads"`
+	} `toml:"cpu"`
+
+	// Memory in MB
+	Memory int64 `toml:"memory"`
+
+	// Disks
+	Disks []Disk `toml:"disks"`
+
+	// Network interfaces
+	NICs []NIC `toml:"nics"`
+}
+
+// Disk describes a disk in a host
+type Disk struct {
+	Device string `toml:"device"`
+	SizeGB int64  `toml:"size_gb"`
+	Model  string `toml:"model"`
+}
+
+// NIC describes a network interface in a host
+type NIC struct {
+	Name       string `toml:"name"`
+	MAC        string `toml:"mac"`
+	SpeedMbps  int    `toml:"speed_mbps"`
+	DuplexFull bool   `toml:"duplex_full"`
+}
+
 // Validate validates the configuration
 func (c *Config) Validate() error {
 	// Validate network configuration
@@ -278,6 +520,30 @@ func (c *Config) Validate() error {
 		if c.PXE.Initrd == "" {
 			return fmt.Errorf("PXE initrd path is required")
 		}
+		if c.PXE.Discovery.Enabled && c.PXE.Discovery.Kernel == "" {
+			return fmt.Errorf("PXE discovery kernel path is required")
+		}
+		if c.PXE.Discovery.Enabled && c.PXE.RequireAuthorization {
+			return fmt.Errorf("PXE discovery cannot be enabled with require_authorization, which refuses the unlisted hosts discovery boots")
+		}
+	}
+
+	// Validate image deployment
+	for i := range c.Hosts {
+		host := &c.Hosts[i]
+		osCfg := c.HostOS(host)
+		if osCfg.Image.URL == "" {
+			continue
+		}
+		if err := osCfg.Image.validate(); err != nil {
+			return fmt.Errorf("host %s: %w", host.Hostname, err)
+		}
+		if osCfg.Disk.Device == "" {
+			return fmt.Errorf("host %s: disk device is required to deploy an image", host.Hostname)
+		}
+		if c.PXE.Enabled && c.PXE.Deploy.Kernel == "" {
+			return fmt.Errorf("host %s: PXE deploy kernel path is required to deploy an image", host.Hostname)
+		}
 	}
 
 	// Validate BMC configuration
@@ -288,92 +554,487 @@ func (c *Config) Validate() error {
 		return fmt.Errorf("unsupported BMC protocol: %s", c.BMC.Protocol)
 	}
 
+	if err := c.StateStore.validate(); err != nil {
+		return err
+	}
+	if err := c.Batch.validate(); err != nil {
+		return err
+	}
+	if err := c.Completion.validate(); err != nil {
+		return err
+	}
+
 	return nil
 }
 
-// Provisioner handles the provisioning of bare metal servers
-type Provisioner struct {
-	config *Config
+// PXEServerConfig builds the PXE server configuration from the network and
+// PXE sections
+func (c *Config) PXEServerConfig() (*pxe.Config, error) {
+	cfg := &pxe.Config{
+		InterfaceName:        c.Network.Interface,
+		NTP:                  c.Network.NTP,
+		LeaseTime:            time.Duration(c.Network.LeaseTime),
+		Kernel:               c.PXE.Kernel,
+		Initrd:               c.PXE.Initrd,
+		Cmdline:              c.PXE.Cmdline,
+		KernelSHA256:         c.PXE.KernelSHA256,
+		InitrdSHA256:         c.PXE.InitrdSHA256,
+		ArtifactCacheSize:    c.PXE.Artifacts.CacheSizeMB << 20,
+		ArtifactManifestURL:  c.PXE.Artifacts.ManifestURL,
+		ArtifactFetchTimeout: time.Duration(c.PXE.Artifacts.FetchTimeout),
+		HTTPAddr:             c.PXE.HTTPAddr,
+		TFTPAddr:             c.PXE.TFTPAddr,
+		DHCPAddr:             c.PXE.DHCPAddr,
+		DHCPv6:               c.PXE.DHCPv6,
+		DHCPv6Addr:           c.PXE.DHCPv6Addr,
+		ProxyDHCP:            c.PXE.ProxyDHCP,
+		ProxyDHCPAddr:        c.PXE.ProxyDHCPAddr,
+		IPXE:                 c.PXE.IPXE,
+		GRUB:                 c.PXE.GRUB,
+		RootDir:              c.PXE.RootDir,
+		LeaseFile:            c.PXE.LeaseFile,
+		ShutdownTimeout:      time.Duration(c.PXE.ShutdownTimeout),
+
+		RequireAuthorization: c.PXE.RequireAuthorization,
+		BootTokenTTL:         time.Duration(c.PXE.BootTokenTTL),
+	}
+
+	var err error
+	if c.PXE.Artifacts.ManifestKey != "" {
+		key, err := base64.StdEncoding.DecodeString(c.PXE.Artifacts.ManifestKey)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid artifact manifest key")
+		}
+		cfg.ArtifactManifestKey = ed25519.PublicKey(key)
+	}
+	if cfg.Gateway, err = parseIPv4(c.Network.Gateway); err != nil {
+		return nil, fmt.Errorf("invalid gateway: %w", err)
+	}
+	if c.Network.Netmask != "" {
+		mask, err := parseIPv4(c.Network.Netmask)
+		if err != nil {
+			return nil, fmt.Errorf("invalid netmask: %w", err)
+		}
+		cfg.Netmask = net.IPMask(mask)
+	}
+	for _, server := range c.Network.DNSServers {
+		ip, err := parseIPv4(server)
+		if err != nil {
+			return nil, fmt.Errorf("invalid DNS server: %w", err)
+		}
+		cfg.DNSServers = append(cfg.DNSServers, ip)
+	}
+
+	// Address assignment is left to the site's DHCP server in proxy mode
+	if !c.PXE.ProxyDHCP && (c.Network.DHCPRange.Start != "" || c.Network.DHCPRange.End != "") {
+		if cfg.DHCPRangeStart, err = parseIPv4(c.Network.DHCPRange.Start); err != nil {
+			return nil, fmt.Errorf("invalid DHCP range start: %w", err)
+		}
+		if cfg.DHCPRangeEnd, err = parseIPv4(c.Network.DHCPRange.End); err != nil {
+			return nil, fmt.Errorf("invalid DHCP range end: %w", err)
+		}
+	}
+
+	if !c.PXE.ProxyDHCP {
+		if cfg.Reservations, err = c.DHCPReservations(); err != nil {
+			return nil, err
+		}
+	}
+
+	if c.PXE.DHCPv6 {
+		if err := c.Network.IPv6.apply(cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	if !c.PXE.ProxyDHCP {
+		for _, sc := range c.Network.Subnets {
+			sn, err := sc.pxeSubnet()
+			if err != nil {
+				return nil, err
+			}
+			cfg.Subnets = append(cfg.Subnets, sn)
+		}
+	}
+
+	for _, p := range c.PXE.Profiles {
+		cfg.Profiles = append(cfg.Profiles, pxe.Profile{
+			Name:    p.Name,
+			Action:  pxe.BootAction(p.Action),
+			Kernel:  p.Kernel,
+			Initrd:  p.Initrd,
+			Cmdline: p.Cmdline,
+
+			KernelSHA256: p.KernelSHA256,
+			InitrdSHA256: p.InitrdSHA256,
+		})
+	}
+	if d := c.PXE.Discovery; d.Enabled {
+		cfg.Discovery = &pxe.Profile{
+			Kernel:  d.Kernel,
+			Initrd:  d.Initrd,
+			Cmdline: d.Cmdline,
+
+			KernelSHA256: d.KernelSHA256,
+			InitrdSHA256: d.InitrdSHA256,
+		}
+	}
+	if c.PXE.Discovery.Enabled || c.PXE.RequireAuthorization {
+		for _, host := range c.Hosts {
+			if host.MAC != "" {
+				cfg.KnownHosts = append(cfg.KnownHosts, host.MAC)
+			}
+		}
+	}
+
+	if d := c.PXE.Deploy; d.Kernel != "" {
+		cfg.Profiles = append(cfg.Profiles, pxe.Profile{
+			Name:    DeployProfile,
+			Action:  pxe.ActionInstall,
+			Kernel:  d.Kernel,
+			Initrd:  d.Initrd,
+			Cmdline: d.Cmdline,
+
+			KernelSHA256: d.KernelSHA256,
+			InitrdSHA256: d.InitrdSHA256,
+		})
+	}
+
+	if !c.hasProfile(LocalBootProfile) {
+		cfg.Profiles = append(cfg.Profiles, pxe.Profile{
+			Name:   LocalBootProfile,
+			Action: pxe.ActionLocalBoot,
+		})
+	}
+
+	for i := range c.Hosts {
+		host := &c.Hosts[i]
+		profile := c.installProfile(host)
+		if host.MAC == "" || profile == "" {
+			continue
+		}
+		if cfg.HostProfiles == nil {
+			cfg.HostProfiles = make(map[string]string)
+		}
+		cfg.HostProfiles[host.MAC] = profile
+	}
+
+	return cfg, nil
 }
 
-// NewProvisioner creates a new bare metal provisioner
-func NewProvisioner(cfg *Config) (*Provisioner, error) {
-	if err := cfg.Validate(); err != nil {
-		return nil, fmt.Errorf("invalid configuration: %w", err)
+// installProfile returns the PXE boot profile a host installs with, or ""
+// for the default profile. Hosts deploying an image boot the deploy agent
+// unless told otherwise.
+func (c *Config) installProfile(host *Host) string {
+	if host.BootProfile != "" {
+		return host.BootProfile
+	}
+	if c.PXE.Deploy.Kernel != "" && c.InstallerFormat(host) == InstallerImage {
+		return DeployProfile
 	}
+	return ""
+}
 
-	return &Provisioner{
-		config: cfg,
-	}, nil
+// hasProfile reports whether [[pxe.profiles]] defines a profile
+func (c *Config) hasProfile(name string) bool {
+	for _, p := range c.PXE.Profiles {
+		if p.Name == name {
+			return true
+		}
+	}
+	return false
 }
 
-// Provision provisions a bare metal server
-func (p *Provisioner) Provision(ctx context.Context, host *Host) error {
-	// Set default timeout if not specified
-	if p.config.Timeout == 0 {
-		p.config.Timeout = Duration(30 * time.Minute)
+// HostOS returns the effective OS configuration for a host: the global [os]
+// section with any fields set in the host's own os section taking precedence
+func (c *Config) HostOS(host *Host) *OSConfig {
+	merged := c.OS
+	if host.OS == nil {
+		return &merged
+	}
+	o := host.OS
+
+	if o.Type != "" {
+		merged.Type = o.Type
+	}
+	if o.Version != "" {
+		merged.Version = o.Version
+	}
+	if o.Source != "" {
+		merged.Source = o.Source
+	}
+	if o.Installer != "" {
+		merged.Installer = o.Installer
+	}
+	if o.RootPassword != "" {
+		merged.RootPassword = o.RootPassword
+	}
+	if len(o.SSHKeys) > 0 {
+		merged.SSHKeys = o.SSHKeys
+	}
+	if o.Disk.Device != "" {
+		merged.Disk = o.Disk
+	}
+	if o.Network.Hostname != "" {
+		merged.Network.Hostname = o.Network.Hostname
 	}
+	if len(o.Network.Interfaces) > 0 {
+		merged.Network.Interfaces = o.Network.Interfaces
+	}
+	if len(o.Network.Nameservers) > 0 {
+		merged.Network.Nameservers = o.Network.Nameservers
+	}
+	if len(o.Network.SearchDomains) > 0 {
+		merged.Network.SearchDomains = o.Network.SearchDomains
+	}
+	if len(o.Packages) > 0 {
+		merged.Packages = o.Packages
+	}
+	if len(o.PreInstallScripts) > 0 {
+		merged.PreInstallScripts = o.PreInstallScripts
+	}
+	if len(o.PostInstallScripts) > 0 {
+		merged.PostInstallScripts = o.PostInstallScripts
+	}
+	if len(o.Files) > 0 {
+		merged.Files = o.Files
+	}
+	if len(o.Units) > 0 {
+		merged.Units = o.Units
+	}
+	if o.Image.URL != "" {
+		merged.Image = o.Image
+	}
+
+	return &merged
+}
+
+// DHCPReservations derives static DHCP reservations from hosts that have a
+// MAC address or switch port and a static interface address in their own OS
+// configuration. The global [os] section is shared by all hosts, so its
+// addresses are never used for reservations.
+func (c *Config) DHCPReservations() ([]pxe.Reservation, error) {
+	var reservations []pxe.Reservation
+	for i := range c.Hosts {
+		host := &c.Hosts[i]
+		port := host.SwitchPort.CircuitID != "" || host.SwitchPort.RemoteID != ""
+		if (host.MAC == "" && !port) || host.OS == nil {
+			continue
+		}
+
+		var mac net.HardwareAddr
+		if host.MAC != "" {
+			var err error
+			if mac, err = net.ParseMAC(host.MAC); err != nil {
+				return nil, fmt.Errorf("host %s: invalid MAC address: %w", host.Hostname, err)
+			}
+		}
 
-	// Create a context with timeout
-	ctx, cancel := context.WithTimeout(ctx, time.Duration(p.config.Timeout))
-	defer cancel()
+		iface := host.bootInterface()
+		if iface == nil {
+			continue
+		}
+		ip, err := parseIPv4(iface.Address)
+		if err != nil {
+			return nil, fmt.Errorf("host %s: invalid address for interface %s: %w", host.Hostname, iface.Name, err)
+		}
+
+		hostname := host.Hostname
+		if hostname == "" {
+			hostname = host.OS.Network.Hostname
+		}
+
+		reservations = append(reservations, pxe.Reservation{
+			MAC:      mac,
+			IP:       ip,
+			Hostname: hostname,
+
+			CircuitID: host.SwitchPort.CircuitID,
+			RemoteID:  host.SwitchPort.RemoteID,
+		})
+	}
+	return reservations, nil
+}
 
-	// Step 1: Power off the host if it's running
-	if err := p.powerOffHost(ctx, host); err != nil {
-		return fmt.Errorf("failed to power off host: %w", err)
+// pxeSubnet converts the subnet into its PXE server form
+func (sc *SubnetConfig) pxeSubnet() (pxe.Subnet, error) {
+	_, network, err := net.ParseCIDR(sc.Network)
+	if err != nil || network.IP.To4() == nil {
+		return pxe.Subnet{}, fmt.Errorf("invalid subnet %q", sc.Network)
 	}
 
-	// Step 2: Configure PXE boot
-	if p.config.PXE.Enabled {
-		if err := p.configurePXEBoot(ctx, host); err != nil {
-			return fmt.Errorf("failed to configure PXE boot: %w", err)
+	sn := pxe.Subnet{
+		Network:    network,
+		CircuitIDs: sc.CircuitIDs,
+		RemoteIDs:  sc.RemoteIDs,
+	}
+	if sn.RangeStart, err = parseIPv4(sc.DHCPRange.Start); err != nil {
+		return pxe.Subnet{}, fmt.Errorf("subnet %s: invalid DHCP range start: %w", sc.Network, err)
+	}
+	if sn.RangeEnd, err = parseIPv4(sc.DHCPRange.End); err != nil {
+		return pxe.Subnet{}, fmt.Errorf("subnet %s: invalid DHCP range end: %w", sc.Network, err)
+	}
+	if sn.Gateway, err = parseIPv4(sc.Gateway); err != nil {
+		return pxe.Subnet{}, fmt.Errorf("subnet %s: invalid gateway: %w", sc.Network, err)
+	}
+	for _, server := range sc.DNSServers {
+		ip, err := parseIPv4(server)
+		if err != nil {
+			return pxe.Subnet{}, fmt.Errorf("subnet %s: invalid DNS server: %w", sc.Network, err)
 		}
+		sn.DNSServers = append(sn.DNSServers, ip)
 	}
+	return sn, nil
+}
 
-	// Step 3: Power on the host
-	if err := p.powerOnHost(ctx, host); err != nil {
-		return fmt.Errorf("failed to power on host: %w", err)
+// bootInterface returns the statically addressed interface of the host's own
+// OS configuration that corresponds to its PXE MAC address. The interface is
+// matched by name through the hardware NIC list, falling back to the default
+// route interface and then to the first static interface.
+func (h *Host) bootInterface() *NetworkInterface {
+	if h.OS == nil {
+		return nil
 	}
 
-	// Step 4: Monitor installation progress
-	if err := p.monitorInstallation(ctx, host); err != nil {
-		return fmt.Errorf("installation failed: %w", err)
+	var nicName string
+	for _, nic := range h.Hardware.NICs {
+		if strings.EqualFold(nic.MAC, h.MAC) {
+			nicName = nic.Name
+			break
+		}
 	}
 
-	// Step 5: Configure post-installation settings
-	if err := p.configurePostInstall(ctx, host); err != nil {
-		return fmt.Errorf("post-installation configuration failed: %w", err)
+	var byRoute, first *NetworkInterface
+	for i := range h.OS.Network.Interfaces {
+		iface := &h.OS.Network.Interfaces[i]
+		if iface.DHCP || iface.Address == "" {
+			continue
+		}
+		if nicName != "" && iface.Name == nicName {
+			return iface
+		}
+		if iface.DefaultRoute && byRoute == nil {
+			byRoute = iface
+		}
+		if first == nil {
+			first = iface
+		}
 	}
 
-	return nil
+	if byRoute != nil {
+		return byRoute
+	}
+	return first
 }
 
-// powerOffHost powers off a host using IPMI/Redfish
-func (p *Provisioner) powerOffHost(ctx context.Context, host *Host) error {
-	// TODO: Implement power off using IPMI/Redfish
+// apply sets the server's IPv6 address, DHCPv6 range and IPv6 DNS servers
+// on a PXE server configuration
+func (ic *IPv6Config) apply(cfg *pxe.Config) error {
+	var err error
+	if cfg.IPv6, err = parseIPv6(ic.Address); err != nil {
+		return fmt.Errorf("invalid IPv6 address: %w", err)
+	}
+	if ic.DHCPRange.Start != "" || ic.DHCPRange.End != "" {
+		if cfg.DHCPv6RangeStart, err = parseIPv6(ic.DHCPRange.Start); err != nil {
+			return fmt.Errorf("invalid DHCPv6 range start: %w", err)
+		}
+		if cfg.DHCPv6RangeEnd, err = parseIPv6(ic.DHCPRange.End); err != nil {
+			return fmt.Errorf("invalid DHCPv6 range end: %w", err)
+		}
+	}
+	for _, server := range ic.DNSServers {
+		ip, err := parseIPv6(server)
+		if err != nil || ip == nil {
+			return fmt.Errorf("invalid IPv6 DNS server %q", server)
+		}
+		cfg.DNSServers = append(cfg.DNSServers, ip)
+	}
 	return nil
 }
 
-// configurePXEBoot configures PXE boot for a host
-func (p *Provisioner) configurePXEBoot(ctx context.Context, host *Host) error {
-	// TODO: Implement PXE boot configuration
-	return nil
+// parseIPv6 parses an optional IPv6 address
+func parseIPv6(s string) (net.IP, error) {
+	if s == "" {
+		return nil, nil
+	}
+	ip := net.ParseIP(s)
+	if ip == nil || ip.To4() != nil {
+		return nil, fmt.Errorf("%q is not an IPv6 address", s)
+	}
+	return ip, nil
 }
 
-// powerOnHost powers on a host using IPMI/Redfish
-func (p *Provisioner) powerOnHost(ctx context.Context, host *Host) error {
-	// TODO: Implement power on using IPMI/Redfish
-	return nil
+// parseIPv4 parses an optional IPv4 address
+func parseIPv4(s string) (net.IP, error) {
+	if s == "" {
+		return nil, nil
+	}
+	ip := net.ParseIP(s).To4()
+	if ip == nil {
+		return nil, fmt.Errorf("%q is not an IPv4 address", s)
+	}
+	return ip, nil
 }
 
-// monitorInstallation monitors the installation progress
-func (p *Provisioner) monitorInstallation(ctx context.Context, host *Host) error {
-	// TODO: Implement installation monitoring
-	return nil
+// Provisioner handles the provisioning of bare metal servers
+type Provisioner struct {
+	config *Config
+
+	// Network boot events, nil if boot progress is not tracked
+	bootEvents BootEventSource
+
+	// Hosts found by hardware discovery that await approval, keyed by MAC
+	discovery DiscoveryServer
+	pending   map[string]*pendingHost
+
+	// Serves cloud-init data, and the one-time tokens hosts fetch it with
+	metadata MetadataServer
+	tokens   map[string]*metadataToken
+
+	// Phone-home watches of runs awaiting their installer, keyed by token
+	installs map[string]*installWatch
+
+	// Grants hosts being provisioned tickets to network boot
+	authorizer BootAuthorizer
+
+	// Switches hosts between their install profile and local boot
+	selector BootSelector
+
+	// Reaches hosts' BMCs, nil if power is not managed
+	dialBMC BMCDialer
+
+	// Where each host is in the provisioning state machine, keyed by
+	// hostname
+	status map[string]*HostStatus
+
+	// Hosts with a provisioning run in progress
+	running map[string]bool
+
+	// Persists host statuses, nil if they are kept in memory only
+	store StateStore
+
+	// Delivers progress events to subscribers and status callbacks
+	progress progressBus
+
+	mu sync.Mutex
 }
 
-// configurePostInstall configures post-installation settings
-func (p *Provisioner) configurePostInstall(ctx context.Context, host *Host) error {
-	// TODO: Implement post-installation configuration
-	return nil
+// NewProvisioner creates a new bare metal provisioner
+func NewProvisioner(cfg *Config) (*Provisioner, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	// Set default timeout if not specified
+	if cfg.Timeout == 0 {
+		cfg.Timeout = Duration(30 * time.Minute)
+	}
+
+	return &Provisioner{
+		config:   cfg,
+		pending:  make(map[string]*pendingHost),
+		status:   make(map[string]*HostStatus),
+		running:  make(map[string]bool),
+		installs: make(map[string]*installWatch),
+	}, nil
 }
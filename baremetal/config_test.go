@@ -0,0 +1,40 @@
+package baremetal
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+)
+
+func TestExampleConfig(t *testing.T) {
+	var c Config
+	if _, err := toml.DecodeFile("../examples/baremetal.toml", &c); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("example configuration is invalid: %v", err)
+	}
+	if !c.PXE.RequireAuthorization {
+		t.Error("example no longer requires authorization")
+	}
+}
+
+func TestValidateDiscoveryWithAuthorization(t *testing.T) {
+	c := Config{}
+	c.Network.Interface = "eth0"
+	c.PXE.Enabled = true
+	c.PXE.Kernel = "vmlinuz"
+	c.PXE.Initrd = "initrd.img"
+	c.PXE.Discovery.Enabled = true
+	c.PXE.Discovery.Kernel = "discovery/vmlinuz"
+	if err := c.Validate(); err != nil {
+		t.Fatalf("discovery without authorization: %v", err)
+	}
+
+	c.PXE.RequireAuthorization = true
+	err := c.Validate()
+	if err == nil || !strings.Contains(err.Error(), "require_authorization") {
+		t.Fatalf("err = %v, want discovery rejected with require_authorization", err)
+	}
+}
@@ -0,0 +1,212 @@
+package baremetal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/nimbus-project/nimbus/pxe"
+)
+
+const (
+	// maxPendingHosts bounds the number of discovered hosts awaiting
+	// approval
+	maxPendingHosts = 256
+
+	// pendingHostTTL is how long a pending host that stops reporting its
+	// inventory is kept
+	pendingHostTTL = 24 * time.Hour
+)
+
+// ErrTooManyPendingHosts is returned for an inventory from a new host while
+// maxPendingHosts hosts already await approval
+var ErrTooManyPendingHosts = errors.New("too many hosts awaiting approval")
+
+// pendingHost is a discovered host awaiting approval
+type pendingHost struct {
+	host     Host
+	lastSeen time.Time
+}
+
+// DiscoveryServer boots unknown hosts into the hardware discovery agent and
+// delivers the inventories it posts. It is implemented by *pxe.Server.
+type DiscoveryServer interface {
+	SetInventoryHandler(h pxe.InventoryHandler)
+	SetHostKnown(mac string, known bool) error
+}
+
+// EnableDiscovery makes the provisioner record hosts reported by the
+// discovery agent as pending hosts
+func (p *Provisioner) EnableDiscovery(srv DiscoveryServer) {
+	p.mu.Lock()
+	p.discovery = srv
+	p.mu.Unlock()
+
+	srv.SetInventoryHandler(p.HandleInventory)
+}
+
+// HandleInventory records the hardware reported by the discovery agent.
+// Listed hosts have their hardware updated; any other host becomes a pending
+// host awaiting approval. Pending hosts that have not reported for
+// pendingHostTTL are dropped, and no more than maxPendingHosts are kept.
+func (p *Provisioner) HandleInventory(ctx context.Context, inv pxe.Inventory) error {
+	mac, err := net.ParseMAC(inv.MAC)
+	if err != nil {
+		return fmt.Errorf("invalid MAC address in inventory: %w", err)
+	}
+	hw := inventoryHardware(inv)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if host := p.findHost(mac); host != nil {
+		host.Hardware = hw
+		log.Info().Str("host", host.Hostname).Str("mac", mac.String()).Msg("Updated host hardware from discovery")
+		return nil
+	}
+
+	p.expirePendingLocked(time.Now())
+	pending, ok := p.pending[mac.String()]
+	if !ok {
+		if len(p.pending) >= maxPendingHosts {
+			log.Warn().Str("mac", mac.String()).Msg("Ignoring discovered host, too many hosts await approval")
+			return ErrTooManyPendingHosts
+		}
+		pending = &pendingHost{host: Host{
+			Hostname: "host-" + strings.ReplaceAll(mac.String(), ":", ""),
+			MAC:      mac.String(),
+		}}
+		p.pending[mac.String()] = pending
+		log.Info().Str("mac", mac.String()).Str("product", inv.Product).Msg("Discovered new host")
+	}
+	pending.host.Hardware = hw
+	pending.lastSeen = time.Now()
+	return nil
+}
+
+// expirePendingLocked drops pending hosts that have not reported their
+// inventory for pendingHostTTL. Callers must hold p.mu.
+func (p *Provisioner) expirePendingLocked(now time.Time) {
+	for mac, pending := range p.pending {
+		if now.Sub(pending.lastSeen) > pendingHostTTL {
+			log.Info().Str("mac", mac).Msg("Dropping discovered host that stopped reporting")
+			delete(p.pending, mac)
+		}
+	}
+}
+
+// PendingHosts returns the discovered hosts awaiting approval, ordered by
+// MAC address
+func (p *Provisioner) PendingHosts() []Host {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.expirePendingLocked(time.Now())
+	hosts := make([]Host, 0, len(p.pending))
+	for _, pending := range p.pending {
+		hosts = append(hosts, pending.host)
+	}
+	sort.Slice(hosts, func(i, j int) bool { return hosts[i].MAC < hosts[j].MAC })
+	return hosts
+}
+
+// ApproveHost enrolls a pending host under the given hostname, or the
+// generated one if hostname is empty. Once approved the host no longer boots
+// the discovery agent.
+func (p *Provisioner) ApproveHost(mac, hostname string) (*Host, error) {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return nil, fmt.Errorf("invalid MAC address: %w", err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pending, ok := p.pending[hw.String()]
+	if !ok {
+		return nil, fmt.Errorf("no pending host with MAC address %s", hw)
+	}
+	host := pending.host
+	if hostname != "" {
+		host.Hostname = hostname
+	}
+
+	if p.discovery != nil {
+		if err := p.discovery.SetHostKnown(host.MAC, true); err != nil {
+			return nil, err
+		}
+	}
+
+	p.config.Hosts = append(p.config.Hosts, host)
+	delete(p.pending, hw.String())
+
+	log.Info().Str("host", host.Hostname).Str("mac", host.MAC).Msg("Approved discovered host")
+	return &p.config.Hosts[len(p.config.Hosts)-1], nil
+}
+
+// RejectHost discards a pending host. It is recorded again if it boots the
+// discovery agent another time.
+func (p *Provisioner) RejectHost(mac string) error {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return fmt.Errorf("invalid MAC address: %w", err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, ok := p.pending[hw.String()]; !ok {
+		return fmt.Errorf("no pending host with MAC address %s", hw)
+	}
+	delete(p.pending, hw.String())
+	return nil
+}
+
+// findHost returns the configured host with the given MAC address. Callers
+// must hold p.mu.
+func (p *Provisioner) findHost(mac net.HardwareAddr) *Host {
+	for i := range p.config.Hosts {
+		host := &p.config.Hosts[i]
+		if hw, err := net.ParseMAC(host.MAC); err == nil && hw.String() == mac.String() {
+			return host
+		}
+	}
+	return nil
+}
+
+// inventoryHardware converts an inventory posted by the discovery agent
+func inventoryHardware(inv pxe.Inventory) Hardware {
+	var hw Hardware
+	hw.Manufacturer = inv.Manufacturer
+	hw.Product = inv.Product
+	hw.SerialNumber = inv.SerialNumber
+
+	hw.CPU.Vendor = inv.CPU.Vendor
+	hw.CPU.Model = inv.CPU.Model
+	hw.CPU.Cores = inv.CPU.Cores
+	hw.CPU.Threads = inv.CPU.Threads
+	hw.Memory = inv.MemoryMB
+
+	for _, d := range inv.Disks {
+		hw.Disks = append(hw.Disks, Disk{
+			Device: d.Device,
+			SizeGB: d.SizeBytes / 1e9,
+			Model:  d.Model,
+		})
+	}
+	for _, n := range inv.NICs {
+		hw.NICs = append(hw.NICs, NIC{
+			Name:       n.Name,
+			MAC:        n.MAC,
+			SpeedMbps:  n.SpeedMbps,
+			DuplexFull: n.DuplexFull,
+		})
+	}
+	return hw
+}
@@ -0,0 +1,85 @@
+package baremetal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nimbus-project/nimbus/pxe"
+)
+
+func newDiscoveryProvisioner() *Provisioner {
+	return &Provisioner{
+		config:  &Config{Hosts: []Host{{Hostname: "n1", MAC: "52:54:00:00:00:01"}}},
+		pending: make(map[string]*pendingHost),
+		status:  make(map[string]*HostStatus),
+	}
+}
+
+func TestHandleInventory(t *testing.T) {
+	p := newDiscoveryProvisioner()
+	ctx := context.Background()
+
+	if err := p.HandleInventory(ctx, pxe.Inventory{MAC: "52:54:00:00:00:01", Product: "Listed", MemoryMB: 1024}); err != nil {
+		t.Fatal(err)
+	}
+	if got := p.config.Hosts[0].Hardware.Product; got != "Listed" {
+		t.Errorf("listed host hardware product = %q", got)
+	}
+	if n := len(p.PendingHosts()); n != 0 {
+		t.Fatalf("listed host pending: %d pending hosts", n)
+	}
+
+	if err := p.HandleInventory(ctx, pxe.Inventory{MAC: "52:54:00:00:00:02", Product: "New"}); err != nil {
+		t.Fatal(err)
+	}
+	pending := p.PendingHosts()
+	if len(pending) != 1 || pending[0].Hostname != "host-525400000002" || pending[0].Hardware.Product != "New" {
+		t.Fatalf("pending hosts = %+v", pending)
+	}
+
+	host, err := p.ApproveHost("52:54:00:00:00:02", "n2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host.Hostname != "n2" || len(p.PendingHosts()) != 0 || len(p.config.Hosts) != 2 {
+		t.Fatalf("approved %+v, %d pending, %d hosts", host, len(p.PendingHosts()), len(p.config.Hosts))
+	}
+}
+
+func TestPendingHostLimits(t *testing.T) {
+	p := newDiscoveryProvisioner()
+	ctx := context.Background()
+
+	mac := func(i int) string { return fmt.Sprintf("52:54:01:00:%02x:%02x", i>>8, i&0xff) }
+	for i := 0; i < maxPendingHosts; i++ {
+		if err := p.HandleInventory(ctx, pxe.Inventory{MAC: mac(i)}); err != nil {
+			t.Fatalf("host %d: %v", i, err)
+		}
+	}
+	if err := p.HandleInventory(ctx, pxe.Inventory{MAC: mac(maxPendingHosts)}); !errors.Is(err, ErrTooManyPendingHosts) {
+		t.Fatalf("err = %v, want ErrTooManyPendingHosts", err)
+	}
+	// Hosts already pending keep reporting
+	if err := p.HandleInventory(ctx, pxe.Inventory{MAC: mac(0), Product: "Updated"}); err != nil {
+		t.Fatalf("pending host refused: %v", err)
+	}
+
+	// Hosts that stopped reporting make room for new ones
+	p.mu.Lock()
+	for key, pending := range p.pending {
+		if key != mac(0) {
+			pending.lastSeen = pending.lastSeen.Add(-pendingHostTTL - time.Minute)
+		}
+	}
+	p.mu.Unlock()
+	if err := p.HandleInventory(ctx, pxe.Inventory{MAC: mac(maxPendingHosts)}); err != nil {
+		t.Fatalf("new host refused after others expired: %v", err)
+	}
+	pending := p.PendingHosts()
+	if len(pending) != 2 || pending[0].MAC != mac(0) || pending[0].Hardware.Product != "Updated" || pending[1].MAC != mac(maxPendingHosts) {
+		t.Fatalf("pending hosts = %+v", pending)
+	}
+}
@@ -0,0 +1,117 @@
+package baremetal
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+)
+
+// update rewrites the golden files with the current output:
+//
+//	go test ./baremetal -run Render -update
+var update = flag.Bool("update", false, "update golden files in testdata")
+
+// checkGolden compares got with testdata/<name>.golden
+func checkGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+
+	path := filepath.Join("testdata", name+".golden")
+	if *update {
+		if err := os.MkdirAll("testdata", 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v (run with -update to create it)", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s differs from %s (run with -update to accept the change)\ngot:\n%s\nwant:\n%s", name, path, got, want)
+	}
+}
+
+// rendererConfig is the configuration the renderers are tested with. Each
+// test case overrides the OS of the host it renders for.
+const rendererConfig = `
+[network]
+interface = "eth0"
+gateway = "10.0.0.254"
+netmask = "255.255.255.0"
+dns_servers = ["10.0.0.53", "10.0.0.54"]
+ntp = "10.0.0.123"
+
+[os]
+root_password = "$6$rounds=4096$salt$hash"
+ssh_keys = ["ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIExample admin@example.com"]
+packages = ["curl", "vim"]
+post_install_scripts = ["echo installed > /etc/motd"]
+
+[os.disk]
+device = "/dev/sda"
+filesystem = "ext4"
+partition_scheme = "gpt"
+
+[[os.disk.partitions]]
+mount_point = "/boot/efi"
+size_mb = 512
+filesystem = "vfat"
+bootable = true
+
+[[os.disk.partitions]]
+mount_point = "swap"
+size_mb = 4096
+
+[[os.disk.partitions]]
+mount_point = "/"
+size_mb = 0
+
+[os.network]
+nameservers = ["10.0.0.53"]
+search_domains = ["example.com"]
+
+[[os.network.interfaces]]
+name = "eno1"
+address = "10.0.0.21"
+netmask = "255.255.255.0"
+gateway = "10.0.0.254"
+on_boot = true
+default_route = true
+
+[post_install]
+enable_ssh = true
+permit_root_login = false
+timezone = "Europe/Berlin"
+locale = "en_US.UTF-8"
+commands = ["systemctl enable --now chronyd"]
+
+[completion]
+phone_home = true
+
+[[hosts]]
+hostname = "node1"
+mac = "52:54:00:00:00:01"
+`
+
+// rendererHost returns the configuration and host renderers are tested
+// with, with the host's OS version and installer set
+func rendererHost(t *testing.T, version, installer string, lvm bool) (*Config, *Host) {
+	t.Helper()
+
+	var cfg Config
+	if _, err := toml.Decode(rendererConfig, &cfg); err != nil {
+		t.Fatalf("invalid test configuration: %v", err)
+	}
+	cfg.OS.Version = version
+	cfg.OS.Installer = installer
+	cfg.OS.Disk.UseLVM = lvm
+	return &cfg, &cfg.Hosts[0]
+}
@@ -0,0 +1,312 @@
+package baremetal
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ignitionVersion is the Ignition spec version rendered, which both Flatcar
+// and Fedora CoreOS accept
+const ignitionVersion = "3.3.0"
+
+// ignitionUser is the account Flatcar and Fedora CoreOS are managed through
+const ignitionUser = "core"
+
+// ignitionPostInstallScript is where the post-installation commands are
+// written for the unit that runs them on first boot
+const ignitionPostInstallScript = "/etc/nimbus/post-install.sh"
+
+// isFlatcar reports whether an OS configuration installs Flatcar rather than
+// Fedora CoreOS
+func isFlatcar(osCfg *OSConfig) bool {
+	return strings.HasPrefix(strings.ToLower(osCfg.Version), "flatcar")
+}
+
+// ignitionArgs returns the kernel arguments making a live image fetch its
+// Ignition config from url. Fedora CoreOS is installed to the configured
+// disk by coreos-installer, which hands the same config to the installed
+// system.
+func ignitionArgs(osCfg *OSConfig, url string) string {
+	args := []string{"ignition.firstboot", "ignition.platform.id=metal", "ignition.config.url=" + url}
+	switch {
+	case isFlatcar(osCfg):
+		args = append([]string{"flatcar.first_boot=1"}, args...)
+	case osCfg.Disk.Device != "":
+		args = append(args, "coreos.inst.install_dev="+osCfg.Disk.Device, "coreos.inst.ignition_url="+url)
+	}
+	return strings.Join(args, " ")
+}
+
+// ignitionFile is a file entry of an Ignition config
+type ignitionFile struct {
+	Path      string `json:"path"`
+	Mode      int    `json:"mode"`
+	Overwrite bool   `json:"overwrite"`
+	Contents  struct {
+		Source string `json:"source"`
+	} `json:"contents"`
+}
+
+// newIgnitionFile creates a file entry with inline contents
+func newIgnitionFile(path, contents string, mode int) ignitionFile {
+	if mode == 0 {
+		mode = 0o644
+	}
+	f := ignitionFile{Path: path, Mode: mode, Overwrite: true}
+	f.Contents.Source = "data:;base64," + base64.StdEncoding.EncodeToString([]byte(contents))
+	return f
+}
+
+// ignitionUnit is a systemd unit entry of an Ignition config
+type ignitionUnit struct {
+	Name     string `json:"name"`
+	Enabled  *bool  `json:"enabled,omitempty"`
+	Contents string `json:"contents,omitempty"`
+}
+
+// RenderIgnition renders an Ignition v3 config for Flatcar or Fedora CoreOS.
+// The OS image provides the root and boot partitions, so only the other
+// configured partitions are created, each mounted by a systemd unit.
+// Packages are ignored since these images are immutable.
+func (c *Config) RenderIgnition(host *Host) ([]byte, error) {
+	osCfg := c.HostOS(host)
+	hostname := hostHostname(host)
+
+	core := map[string]interface{}{
+		"name":              ignitionUser,
+		"sshAuthorizedKeys": nonNil(osCfg.SSHKeys),
+	}
+	users := []interface{}{core}
+	if osCfg.RootPassword != "" {
+		users = append(users, map[string]interface{}{
+			"name":         "root",
+			"passwordHash": osCfg.RootPassword,
+		})
+	}
+
+	files := []ignitionFile{newIgnitionFile("/etc/hostname", hostname+"\n", 0o644)}
+	files = append(files, c.ignitionNetworkFiles(host, osCfg)...)
+	for _, f := range osCfg.Files {
+		if f.Path == "" {
+			return nil, fmt.Errorf("file without a path in OS configuration")
+		}
+		files = append(files, newIgnitionFile(f.Path, f.Contents, f.Mode))
+	}
+
+	var units []ignitionUnit
+	for _, u := range osCfg.Units {
+		if u.Name == "" {
+			return nil, fmt.Errorf("systemd unit without a name in OS configuration")
+		}
+		enabled := u.Enabled
+		units = append(units, ignitionUnit{Name: u.Name, Enabled: &enabled, Contents: u.Contents})
+	}
+
+	storage := map[string]interface{}{}
+	disks, filesystems, mountUnits := ignitionStorage(osCfg)
+	if len(disks) > 0 {
+		storage["disks"] = disks
+		storage["filesystems"] = filesystems
+		units = append(units, mountUnits...)
+	}
+
+	// Post-installation commands run once from a oneshot unit
+	if cmds := append(append([]string(nil), osCfg.PostInstallScripts...), c.PostInstall.Commands...); len(cmds) > 0 {
+		script := "#!/bin/sh\nset -e\n" + strings.Join(cmds, "\n") + "\n"
+		files = append(files, newIgnitionFile(ignitionPostInstallScript, script, 0o755))
+
+		enabled := true
+		units = append(units, ignitionUnit{
+			Name:    "nimbus-post-install.service",
+			Enabled: &enabled,
+			Contents: "[Unit]\nDescription=Nimbus post-installation commands\n" +
+				"ConditionFirstBoot=yes\nWants=network-online.target\nAfter=network-online.target\n\n" +
+				"[Service]\nType=oneshot\nRemainAfterExit=yes\nExecStart=" + ignitionPostInstallScript + "\n\n" +
+				"[Install]\nWantedBy=multi-user.target\n",
+		})
+	}
+	storage["files"] = files
+
+	config := map[string]interface{}{
+		"ignition": map[string]interface{}{"version": ignitionVersion},
+		"passwd":   map[string]interface{}{"users": users},
+		"storage":  storage,
+	}
+	if len(units) > 0 {
+		config["systemd"] = map[string]interface{}{"units": units}
+	}
+
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// ignitionStorage renders the configured partitions other than the root and
+// boot partitions, returning the disks, filesystems and the units mounting
+// them. A size for / limits the image's root partition, which otherwise
+// grows to fill the disk.
+func ignitionStorage(osCfg *OSConfig) ([]interface{}, []interface{}, []ignitionUnit) {
+	disk := osCfg.Disk
+	if disk.Device == "" {
+		return nil, nil, nil
+	}
+
+	// The root partition is number 4 labelled "root" on Fedora CoreOS and
+	// number 9 labelled "ROOT" on Flatcar
+	rootNumber, rootLabel := 4, "root"
+	if isFlatcar(osCfg) {
+		rootNumber, rootLabel = 9, "ROOT"
+	}
+
+	var (
+		partitions  []interface{}
+		filesystems []interface{}
+		units       []ignitionUnit
+	)
+	for _, part := range disk.Partitions {
+		if part.MountPoint == "/" {
+			if part.SizeMB > 0 {
+				partitions = append(partitions, map[string]interface{}{
+					"number":  rootNumber,
+					"label":   rootLabel,
+					"sizeMiB": part.SizeMB,
+					"resize":  true,
+				})
+			}
+			continue
+		}
+		if isBootPartition(part) {
+			continue
+		}
+
+		label := lvName(part)
+		partitions = append(partitions, map[string]interface{}{
+			"label":   label,
+			"sizeMiB": part.SizeMB,
+		})
+
+		device := "/dev/disk/by-partlabel/" + label
+		fs := map[string]interface{}{
+			"device":         device,
+			"format":         partitionFilesystem(part, disk.Filesystem),
+			"label":          label,
+			"wipeFilesystem": true,
+		}
+		enabled := true
+		if isSwap(part) {
+			fs["format"] = "swap"
+			units = append(units, ignitionUnit{
+				Name:     systemdEscapePath(device) + ".swap",
+				Enabled:  &enabled,
+				Contents: "[Swap]\nWhat=" + device + "\n\n[Install]\nWantedBy=swap.target\n",
+			})
+		} else {
+			fs["path"] = part.MountPoint
+			units = append(units, ignitionUnit{
+				Name:    systemdEscapePath(part.MountPoint) + ".mount",
+				Enabled: &enabled,
+				Contents: "[Unit]\nBefore=local-fs.target\n\n[Mount]\nWhat=" + device +
+					"\nWhere=" + part.MountPoint + "\nType=" + fs["format"].(string) +
+					"\n\n[Install]\nRequiredBy=local-fs.target\n",
+			})
+		}
+		filesystems = append(filesystems, fs)
+	}
+
+	if len(partitions) == 0 {
+		return nil, nil, nil
+	}
+	disks := []interface{}{map[string]interface{}{
+		"device":     disk.Device,
+		"partitions": partitions,
+	}}
+	return disks, filesystems, units
+}
+
+// ignitionNetworkFiles renders a host's static interfaces as
+// NetworkManager keyfiles on Fedora CoreOS and systemd-networkd files on
+// Flatcar. Interfaces using DHCP need no configuration.
+func (c *Config) ignitionNetworkFiles(host *Host, osCfg *OSConfig) []ignitionFile {
+	nameservers := c.hostNameservers(osCfg)
+	search := osCfg.Network.SearchDomains
+
+	var files []ignitionFile
+	for _, iface := range osCfg.Network.Interfaces {
+		if iface.DHCP || iface.Address == "" {
+			continue
+		}
+
+		prefix := 24
+		if mask, err := parseIPv4(iface.Netmask); err == nil && mask != nil {
+			prefix, _ = net.IPMask(mask).Size()
+		}
+		gateway := iface.Gateway
+		if gateway == "" && iface.DefaultRoute {
+			gateway = c.Network.Gateway
+		}
+
+		var b strings.Builder
+		if isFlatcar(osCfg) {
+			fmt.Fprintf(&b, "[Match]\nName=%s\n\n[Network]\nAddress=%s/%d\n", iface.Name, iface.Address, prefix)
+			if gateway != "" {
+				fmt.Fprintf(&b, "Gateway=%s\n", gateway)
+			}
+			for _, ns := range nameservers {
+				fmt.Fprintf(&b, "DNS=%s\n", ns)
+			}
+			if len(search) > 0 {
+				fmt.Fprintf(&b, "Domains=%s\n", strings.Join(search, " "))
+			}
+			files = append(files, newIgnitionFile("/etc/systemd/network/10-"+iface.Name+".network", b.String(), 0o644))
+			continue
+		}
+
+		fmt.Fprintf(&b, "[connection]\nid=%s\ntype=ethernet\ninterface-name=%s\n", iface.Name, iface.Name)
+		if !iface.OnBoot {
+			b.WriteString("autoconnect=false\n")
+		}
+		fmt.Fprintf(&b, "\n[ipv4]\nmethod=manual\naddress1=%s/%d", iface.Address, prefix)
+		if gateway != "" {
+			fmt.Fprintf(&b, ",%s", gateway)
+		}
+		b.WriteString("\n")
+		if len(nameservers) > 0 {
+			fmt.Fprintf(&b, "dns=%s;\n", strings.Join(nameservers, ";"))
+		}
+		if len(search) > 0 {
+			fmt.Fprintf(&b, "dns-search=%s;\n", strings.Join(search, ";"))
+		}
+		// Keyfiles with other permissions are ignored
+		files = append(files, newIgnitionFile("/etc/NetworkManager/system-connections/"+iface.Name+".nmconnection", b.String(), 0o600))
+	}
+	return files
+}
+
+// systemdEscapePath escapes a path for use in a unit name the way
+// systemd-escape --path does
+func systemdEscapePath(path string) string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return "-"
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		ch := path[i]
+		switch {
+		case ch == '/':
+			b.WriteByte('-')
+		case ch >= 'a' && ch <= 'z', ch >= 'A' && ch <= 'Z', ch >= '0' && ch <= '9',
+			ch == '_', ch == '.' && i > 0, ch == ':':
+			b.WriteByte(ch)
+		default:
+			fmt.Fprintf(&b, `\x%02x`, ch)
+		}
+	}
+	return b.String()
+}
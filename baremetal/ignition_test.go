@@ -0,0 +1,40 @@
+package baremetal
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestRenderIgnition(t *testing.T) {
+	tests := []struct {
+		name    string
+		version string
+		files   []File
+		units   []SystemdUnit
+	}{
+		{name: "ignition-flatcar", version: "flatcar-stable"},
+		{
+			name:    "ignition-fcos",
+			version: "fedora-coreos-40",
+			files:   []File{{Path: "/etc/motd", Contents: "managed by nimbus\n"}, {Path: "/usr/local/bin/hello", Contents: "#!/bin/sh\necho hello\n", Mode: 0o755}},
+			units:   []SystemdUnit{{Name: "hello.service", Enabled: true, Contents: "[Service]\nExecStart=/usr/local/bin/hello\n"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, host := rendererHost(t, tt.version, "", false)
+			cfg.OS.Files = tt.files
+			cfg.OS.Units = tt.units
+
+			got, err := cfg.RenderIgnition(host)
+			if err != nil {
+				t.Fatalf("RenderIgnition: %v", err)
+			}
+			if !json.Valid(got) {
+				t.Fatalf("invalid JSON:\n%s", got)
+			}
+			checkGolden(t, tt.name, got)
+		})
+	}
+}
@@ -0,0 +1,180 @@
+package baremetal
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// DeployProfile is the name of the PXE boot profile that runs the deploy
+// agent
+const DeployProfile = "deploy"
+
+// deployURLArg is the kernel argument telling the deploy agent where to
+// fetch its manifest
+const deployURLArg = "nimbus.deploy_url"
+
+// cloudInitSeedDir is where cloud-init looks for NoCloud data on a local
+// filesystem
+const cloudInitSeedDir = "/var/lib/cloud/seed/nocloud/"
+
+// Image formats and compressions understood by the deploy agent
+var (
+	imageFormats      = []string{"raw", "qcow2"}
+	imageCompressions = []string{"none", "gzip", "zstd"}
+)
+
+// DeployManifest tells the deploy agent which image to write to which disk
+// and which per-host files to write into the deployed system. The agent
+// streams and decompresses the image onto the disk while verifying its
+// digest, grows the root partition and its filesystem to fill the disk,
+// writes the files below the root partition's mount point and reboots.
+// Files are inlined since writing the image can outlast the host's
+// metadata token.
+//
+// The agent itself is not part of Nimbus: it is the ramdisk configured as
+// [pxe.deploy], and this manifest is the whole of its contract with the
+// provisioner.
+type DeployManifest struct {
+	Image         DeployImage  `json:"image"`
+	Device        string       `json:"device"`
+	RootPartition int          `json:"root_partition,omitempty"`
+	Files         []DeployFile `json:"files,omitempty"`
+
+	// URL the agent reports its start, progress and completion to, in the
+	// same form as installers post to the nimbus.phone_home kernel argument
+	PhoneHome string `json:"phone_home,omitempty"`
+}
+
+// DeployImage is the image in a deploy manifest
+type DeployImage struct {
+	URL         string `json:"url"`
+	SHA256      string `json:"sha256"`
+	Format      string `json:"format"`
+	Compression string `json:"compression"`
+}
+
+// DeployFile is a file the deploy agent writes into the deployed system
+type DeployFile struct {
+	Path     string `json:"path"`
+	Contents string `json:"contents"`
+	Mode     int    `json:"mode"`
+}
+
+// format returns the image format, inferred from the file name if not set
+func (i *ImageConfig) format() string {
+	if i.Format != "" {
+		return i.Format
+	}
+	name := path.Base(i.URL)
+	switch path.Ext(name) {
+	case ".gz", ".zst", ".zstd":
+		name = strings.TrimSuffix(name, path.Ext(name))
+	}
+	if path.Ext(name) == ".qcow2" {
+		return "qcow2"
+	}
+	return "raw"
+}
+
+// compression returns the image compression, inferred from the file name if
+// not set
+func (i *ImageConfig) compression() string {
+	if i.Compression != "" {
+		return i.Compression
+	}
+	switch path.Ext(i.URL) {
+	case ".gz":
+		return "gzip"
+	case ".zst", ".zstd":
+		return "zstd"
+	default:
+		return "none"
+	}
+}
+
+// validate checks that the deploy agent can write the image
+func (i *ImageConfig) validate() error {
+	if !contains(imageFormats, i.format()) {
+		return fmt.Errorf("unsupported image format %q", i.format())
+	}
+	if !contains(imageCompressions, i.compression()) {
+		return fmt.Errorf("unsupported image compression %q", i.compression())
+	}
+	// The agent cannot tell a corrupted or replaced image from a good one
+	// without a digest, wherever the image is served from
+	if b, err := hex.DecodeString(i.SHA256); err != nil || len(b) != sha256.Size {
+		return fmt.Errorf("SHA-256 digest is required for image %s", i.URL)
+	}
+	if i.RootPartition < 0 {
+		return fmt.Errorf("invalid root partition %d", i.RootPartition)
+	}
+	return nil
+}
+
+// deployManifest builds the deploy manifest for a host, injecting its
+// cloud-init data as a NoCloud seed so that the image configures itself on
+// first boot
+func (p *Provisioner) deployManifest(ctx context.Context, host *Host) ([]byte, error) {
+	osCfg := p.config.HostOS(host)
+	img := osCfg.Image
+	if err := img.validate(); err != nil {
+		return nil, err
+	}
+
+	// Remote images are cached and served by the PXE server, so that all
+	// hosts do not download them from the source
+	imagePath := img.URL
+	if strings.Contains(imagePath, "://") {
+		var err error
+		if imagePath, err = p.metadata.CacheArtifact(ctx, img.URL, img.SHA256); err != nil {
+			return nil, err
+		}
+	}
+
+	manifest := DeployManifest{
+		Image: DeployImage{
+			URL:         p.metadata.URL("/" + strings.TrimPrefix(imagePath, "/")),
+			SHA256:      strings.ToLower(img.SHA256),
+			Format:      img.format(),
+			Compression: img.compression(),
+		},
+		Device:        osCfg.Disk.Device,
+		RootPartition: img.RootPartition,
+	}
+	p.mu.Lock()
+	manifest.PhoneHome = p.phoneHomeURL(host.Hostname)
+	p.mu.Unlock()
+	for _, name := range []string{"meta-data", "user-data", "network-config"} {
+		data, err := p.config.renderCloudInit(host, name)
+		if err != nil {
+			return nil, err
+		}
+		manifest.Files = append(manifest.Files, DeployFile{
+			Path:     cloudInitSeedDir + name,
+			Contents: string(data) + "\n",
+			// user-data carries password hashes
+			Mode: 0o600,
+		})
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// contains reports whether s is in list
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
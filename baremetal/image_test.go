@@ -0,0 +1,104 @@
+package baremetal
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/nimbus-project/nimbus/pxe"
+)
+
+const testImageDigest = "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+
+func TestImageConfigValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		image ImageConfig
+		ok    bool
+	}{
+		{name: "remote", image: ImageConfig{URL: "https://images.example.com/disk.qcow2.zst", SHA256: testImageDigest}, ok: true},
+		{name: "local", image: ImageConfig{URL: "images/disk.raw", SHA256: strings.ToUpper(testImageDigest)}, ok: true},
+		{name: "remote without digest", image: ImageConfig{URL: "https://images.example.com/disk.raw"}},
+		{name: "local without digest", image: ImageConfig{URL: "images/disk.raw"}},
+		{name: "short digest", image: ImageConfig{URL: "images/disk.raw", SHA256: testImageDigest[:32]}},
+		{name: "invalid digest", image: ImageConfig{URL: "images/disk.raw", SHA256: strings.Repeat("z", 64)}},
+		{name: "format", image: ImageConfig{URL: "images/disk.vmdk", Format: "vmdk", SHA256: testImageDigest}},
+		{name: "compression", image: ImageConfig{URL: "images/disk.raw.xz", Compression: "xz", SHA256: testImageDigest}},
+		{name: "root partition", image: ImageConfig{URL: "images/disk.raw", SHA256: testImageDigest, RootPartition: -1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.image.validate()
+			if tt.ok && err != nil {
+				t.Fatalf("validate: %v", err)
+			}
+			if !tt.ok && err == nil {
+				t.Fatal("invalid image accepted")
+			}
+		})
+	}
+}
+
+// artifactMetadata is a MetadataServer that records cached artifacts
+type artifactMetadata struct {
+	cached map[string]string
+}
+
+func (m *artifactMetadata) AddPXEHandler(string, http.Handler, ...pxe.Middleware) {}
+func (m *artifactMetadata) SetHostCmdline(string, string) error                   { return nil }
+func (m *artifactMetadata) ClientMAC(net.IP) net.HardwareAddr                     { return nil }
+func (m *artifactMetadata) URL(path string) string                                { return "http://pxe.test" + path }
+
+func (m *artifactMetadata) CacheArtifact(ctx context.Context, url, sha256 string) (string, error) {
+	m.cached[url] = sha256
+	return "artifacts/0123456789abcdef/disk.qcow2.zst", nil
+}
+
+func TestDeployManifest(t *testing.T) {
+	cfg, host := rendererHost(t, "ubuntu-24.04", "", false)
+	cfg.OS.Image = ImageConfig{URL: "https://images.example.com/disk.qcow2.zst", SHA256: strings.ToUpper(testImageDigest), RootPartition: 1}
+	meta := &artifactMetadata{cached: make(map[string]string)}
+	p := &Provisioner{config: cfg, metadata: meta, installs: make(map[string]*installWatch)}
+
+	data, err := p.deployManifest(context.Background(), host)
+	if err != nil {
+		t.Fatalf("deployManifest: %v", err)
+	}
+	var m DeployManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		t.Fatalf("invalid manifest: %v", err)
+	}
+
+	if _, ok := meta.cached[cfg.OS.Image.URL]; !ok {
+		t.Errorf("remote image not cached")
+	}
+	want := DeployImage{
+		URL:         "http://pxe.test/artifacts/0123456789abcdef/disk.qcow2.zst",
+		SHA256:      testImageDigest,
+		Format:      "qcow2",
+		Compression: "zstd",
+	}
+	if m.Image != want {
+		t.Errorf("image = %+v, want %+v", m.Image, want)
+	}
+	if m.Device != "/dev/sda" || m.RootPartition != 1 {
+		t.Errorf("device %s partition %d", m.Device, m.RootPartition)
+	}
+	var paths []string
+	for _, f := range m.Files {
+		paths = append(paths, f.Path)
+	}
+	if got := strings.Join(paths, " "); got != cloudInitSeedDir+"meta-data "+cloudInitSeedDir+"user-data "+cloudInitSeedDir+"network-config" {
+		t.Errorf("files = %s", got)
+	}
+
+	// Images without a digest are refused rather than deployed unverified
+	cfg.OS.Image.SHA256 = ""
+	if _, err := p.deployManifest(context.Background(), host); err == nil {
+		t.Fatal("manifest built for an image without a digest")
+	}
+}
@@ -0,0 +1,855 @@
+package baremetal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// installerPath is the HTTP path prefix installer answer files are served
+// under
+const installerPath = "/installer/"
+
+// InstallerFormat is the answer file format of an OS installer
+type InstallerFormat string
+
+// Installer formats
+const (
+	// InstallerAutoinstall is Ubuntu's autoinstall, delivered as cloud-init
+	// user-data
+	InstallerAutoinstall InstallerFormat = "autoinstall"
+
+	// InstallerPreseed is the Debian installer's preseed file
+	InstallerPreseed InstallerFormat = "preseed"
+
+	// InstallerKickstart is Anaconda's kickstart file used by RHEL and its
+	// derivatives
+	InstallerKickstart InstallerFormat = "kickstart"
+
+	// InstallerIgnition is the Ignition config read on first boot by
+	// Flatcar and Fedora CoreOS
+	InstallerIgnition InstallerFormat = "ignition"
+
+	// InstallerImage writes a prebuilt disk image with the deploy agent,
+	// which reads a deploy manifest instead of an answer file
+	InstallerImage InstallerFormat = "image"
+)
+
+// installerFiles maps each format to the name its file is served as
+var installerFiles = map[InstallerFormat]string{
+	InstallerPreseed:   "preseed.cfg",
+	InstallerKickstart: "ks.cfg",
+	InstallerIgnition:  "config.ign",
+	InstallerImage:     "deploy.json",
+}
+
+// kickstartDistros are version prefixes of distributions installed with
+// kickstart
+var kickstartDistros = []string{"rhel", "rocky", "alma", "centos", "fedora", "oracle"}
+
+// ignitionDistros are version prefixes of distributions configured with
+// Ignition. They are checked before kickstartDistros, which include
+// "fedora".
+var ignitionDistros = []string{"flatcar", "fedora-coreos", "fcos", "rhcos"}
+
+// InstallerFormat returns the installer format for a host: the one set in
+// its OS configuration, image deployment if it has an image, or else the
+// one used by the distribution named in the version. It is empty if the
+// installer is not known.
+func (c *Config) InstallerFormat(host *Host) InstallerFormat {
+	osCfg := c.HostOS(host)
+	if osCfg.Installer != "" {
+		return InstallerFormat(osCfg.Installer)
+	}
+	if osCfg.Image.URL != "" {
+		return InstallerImage
+	}
+
+	version := strings.ToLower(osCfg.Version)
+	switch {
+	case strings.HasPrefix(version, "ubuntu"):
+		return InstallerAutoinstall
+	case strings.HasPrefix(version, "debian"):
+		return InstallerPreseed
+	}
+	for _, distro := range ignitionDistros {
+		if strings.HasPrefix(version, distro) {
+			return InstallerIgnition
+		}
+	}
+	for _, distro := range kickstartDistros {
+		if strings.HasPrefix(version, distro) {
+			return InstallerKickstart
+		}
+	}
+	return ""
+}
+
+// RenderInstallerConfig renders the answer file for a host's installer
+func (c *Config) RenderInstallerConfig(host *Host) ([]byte, error) {
+	switch format := c.InstallerFormat(host); format {
+	case InstallerAutoinstall:
+		return c.RenderAutoinstall(host)
+	case InstallerPreseed:
+		return c.RenderPreseed(host)
+	case InstallerKickstart:
+		return c.RenderKickstart(host)
+	case InstallerIgnition:
+		return c.RenderIgnition(host)
+	case InstallerImage:
+		return nil, fmt.Errorf("image deployments have no installer configuration")
+	case "":
+		return nil, fmt.Errorf("no installer known for OS version %q", c.HostOS(host).Version)
+	default:
+		return nil, fmt.Errorf("unsupported installer %q", format)
+	}
+}
+
+// installerArgs returns the kernel arguments pointing an installer at its
+// answer file below baseURL
+func installerArgs(format InstallerFormat, osCfg *OSConfig, baseURL string) string {
+	switch format {
+	case InstallerAutoinstall:
+		// The configuration itself is read from cloud-init user-data
+		return "autoinstall"
+	case InstallerPreseed:
+		return "auto=true priority=critical url=" + baseURL + installerFiles[format]
+	case InstallerKickstart:
+		return "inst.ks=" + baseURL + installerFiles[format]
+	case InstallerIgnition:
+		return ignitionArgs(osCfg, baseURL+installerFiles[format])
+	case InstallerImage:
+		return deployURLArg + "=" + baseURL + installerFiles[format]
+	default:
+		return ""
+	}
+}
+
+// serveInstallerConfig serves the answer file for the host identified by the
+// token in the path or by the client's address
+func (p *Provisioner) serveInstallerConfig(w http.ResponseWriter, r *http.Request) {
+	host, file, err := p.requestHost(r, installerPath)
+	if err != nil {
+		log.Debug().Err(err).Str("remote", r.RemoteAddr).Msg("Refusing installer request")
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	format := p.config.InstallerFormat(host)
+	if name, ok := installerFiles[format]; !ok || name != file {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	var data []byte
+	if format == InstallerImage {
+		data, err = p.deployManifest(r.Context(), host)
+	} else {
+		data, err = p.config.RenderInstallerConfig(host)
+	}
+	if err != nil {
+		log.Error().Err(err).Str("host", host.Hostname).Msg("Failed to render installer configuration")
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Debug().Str("host", host.Hostname).Str("file", file).Str("remote", r.RemoteAddr).Msg("Serving installer configuration")
+
+	if format == InstallerIgnition || format == InstallerImage {
+		w.Header().Set("Content-Type", "application/json")
+	} else {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	w.Write(data)
+}
+
+// RenderAutoinstall renders an Ubuntu autoinstall configuration, wrapped in
+// the cloud-config the live installer reads it from. The installed system
+// receives the same cloud-init user-data as other hosts.
+func (c *Config) RenderAutoinstall(host *Host) ([]byte, error) {
+	osCfg := c.HostOS(host)
+	post := c.PostInstall
+
+	ai := map[string]interface{}{
+		"version":   1,
+		"storage":   autoinstallStorage(osCfg),
+		"network":   c.cloudInitNetworkConfig(host),
+		"user-data": c.cloudInitUserData(host),
+		"ssh": map[string]interface{}{
+			"install-server":  post.EnableSSH,
+			"allow-pw":        post.PasswordAuthentication,
+			"authorized-keys": nonNil(osCfg.SSHKeys),
+		},
+	}
+	if post.Locale != "" {
+		ai["locale"] = post.Locale
+	}
+	if len(osCfg.Packages) > 0 {
+		ai["packages"] = osCfg.Packages
+	}
+	if mirror := mirrorURL(osCfg.Source); mirror != "" {
+		ai["apt"] = map[string]interface{}{
+			"primary": []map[string]interface{}{
+				{"arches": []string{"default"}, "uri": mirror},
+			},
+		}
+	}
+	early := append([]string(nil), osCfg.PreInstallScripts...)
+	var late []string
+	if c.Completion.PhoneHome {
+		early = append([]string{phoneHomeCommand(false, InstallStarted, 0, "")}, early...)
+		late = append(late, phoneHomeCommand(false, InstallProgress, installProgressMilestone, "Running post-install scripts"))
+		ai["error-commands"] = []string{phoneHomeCommand(false, InstallFailed, 0, "Autoinstall failed")}
+	}
+	if len(early) > 0 {
+		ai["early-commands"] = early
+	}
+
+	for _, script := range osCfg.PostInstallScripts {
+		late = append(late, "curtin in-target -- sh -c "+shellQuote(script))
+	}
+	if c.Completion.PhoneHome {
+		late = append(late, phoneHomeCommand(false, InstallCompleted, 100, ""))
+	}
+	if len(late) > 0 {
+		ai["late-commands"] = late
+	}
+
+	data, err := json.MarshalIndent(map[string]interface{}{"autoinstall": ai}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]byte("#cloud-config\n"), data...), '\n'), nil
+}
+
+// autoinstallStorage renders the disk layout as curtin storage actions, or
+// as one of the installer's guided layouts if no partitions are configured
+func autoinstallStorage(osCfg *OSConfig) map[string]interface{} {
+	disk := osCfg.Disk
+
+	match := map[string]interface{}{"size": "largest"}
+	if disk.Device != "" {
+		match = map[string]interface{}{"path": disk.Device}
+	}
+
+	if len(disk.Partitions) == 0 {
+		layout := map[string]interface{}{"name": "direct", "match": match}
+		if disk.UseLVM {
+			layout["name"] = "lvm"
+		}
+		return map[string]interface{}{"layout": layout}
+	}
+
+	ptable := disk.PartitionScheme
+	if ptable == "" {
+		ptable = "gpt"
+	}
+
+	actions := []map[string]interface{}{{
+		"type":        "disk",
+		"id":          "disk0",
+		"match":       match,
+		"ptable":      ptable,
+		"wipe":        "superblock-recursive",
+		"preserve":    false,
+		"grub_device": ptable == "msdos",
+	}}
+
+	// Formats and mounts a volume
+	mount := func(id string, part Partition) {
+		fstype := partitionFilesystem(part, disk.Filesystem)
+		if fstype == "vfat" {
+			fstype = "fat32"
+		}
+		path := part.MountPoint
+		if isSwap(part) {
+			fstype, path = "swap", ""
+		}
+		actions = append(actions,
+			map[string]interface{}{"type": "format", "id": id + "-format", "volume": id, "fstype": fstype, "preserve": false},
+			map[string]interface{}{"type": "mount", "id": id + "-mount", "device": id + "-format", "path": path},
+		)
+	}
+
+	var lvs []Partition
+	number := 0
+	for _, part := range disk.Partitions {
+		if disk.UseLVM && !isBootPartition(part) {
+			lvs = append(lvs, part)
+			continue
+		}
+
+		number++
+		id := fmt.Sprintf("part%d", number)
+		action := map[string]interface{}{
+			"type":     "partition",
+			"id":       id,
+			"device":   "disk0",
+			"number":   number,
+			"size":     curtinSize(part.SizeMB),
+			"preserve": false,
+		}
+		if isEFIPartition(part) {
+			action["flag"] = "boot"
+			action["grub_device"] = true
+		} else if part.Bootable {
+			action["flag"] = "boot"
+		}
+		actions = append(actions, action)
+		mount(id, part)
+	}
+
+	if len(lvs) > 0 {
+		number++
+		actions = append(actions,
+			map[string]interface{}{"type": "partition", "id": "pv0", "device": "disk0", "number": number, "size": -1, "preserve": false},
+			map[string]interface{}{"type": "lvm_volgroup", "id": "vg0", "name": "vg0", "devices": []string{"pv0"}, "preserve": false},
+		)
+		for i, part := range lvs {
+			id := fmt.Sprintf("lv%d", i)
+			action := map[string]interface{}{
+				"type":     "lvm_partition",
+				"id":       id,
+				"volgroup": "vg0",
+				"name":     lvName(part),
+				"preserve": false,
+			}
+			// A volume without a size takes the rest of the group
+			if part.SizeMB > 0 {
+				action["size"] = curtinSize(part.SizeMB)
+			}
+			actions = append(actions, action)
+			mount(id, part)
+		}
+	}
+
+	return map[string]interface{}{"config": actions}
+}
+
+// RenderPreseed renders a Debian installer preseed file
+func (c *Config) RenderPreseed(host *Host) ([]byte, error) {
+	osCfg := c.HostOS(host)
+	post := c.PostInstall
+	hostname := hostHostname(host)
+
+	var b bytes.Buffer
+	line := func(format string, args ...interface{}) {
+		fmt.Fprintf(&b, format+"\n", args...)
+	}
+
+	fmt.Fprintf(&b, "# Generated by Nimbus for %s\n\n", hostname)
+
+	// Localization
+	locale := post.Locale
+	if locale == "" {
+		locale = "en_US.UTF-8"
+	}
+	line("d-i debian-installer/locale string %s", locale)
+	line("d-i keyboard-configuration/xkb-keymap select us")
+
+	// Network
+	line("\nd-i netcfg/choose_interface select auto")
+	line("d-i netcfg/get_hostname string %s", hostname)
+	line("d-i netcfg/hostname string %s", hostname)
+	domain := ""
+	if len(osCfg.Network.SearchDomains) > 0 {
+		domain = osCfg.Network.SearchDomains[0]
+	}
+	line("d-i netcfg/get_domain string %s", domain)
+	if iface := host.bootInterface(); iface != nil {
+		gateway := iface.Gateway
+		if gateway == "" {
+			gateway = c.Network.Gateway
+		}
+		line("d-i netcfg/disable_autoconfig boolean true")
+		line("d-i netcfg/get_ipaddress string %s", iface.Address)
+		line("d-i netcfg/get_netmask string %s", iface.Netmask)
+		line("d-i netcfg/get_gateway string %s", gateway)
+		line("d-i netcfg/get_nameservers string %s", strings.Join(c.hostNameservers(osCfg), " "))
+		line("d-i netcfg/confirm_static boolean true")
+	}
+
+	// Mirror
+	if mirror := mirrorURL(osCfg.Source); mirror != "" {
+		scheme, rest, _ := strings.Cut(mirror, "://")
+		mirrorHost, dir, _ := strings.Cut(rest, "/")
+		line("\nd-i mirror/country string manual")
+		line("d-i mirror/protocol string %s", scheme)
+		line("d-i mirror/%s/hostname string %s", scheme, mirrorHost)
+		line("d-i mirror/%s/directory string /%s", scheme, dir)
+		line("d-i mirror/%s/proxy string", scheme)
+	}
+
+	// Accounts
+	line("\nd-i passwd/root-login boolean true")
+	line("d-i passwd/make-user boolean false")
+	if osCfg.RootPassword != "" {
+		line("d-i passwd/root-password-crypted password %s", osCfg.RootPassword)
+	} else {
+		// An unusable hash leaves the account locked
+		line("d-i passwd/root-password-crypted password !")
+	}
+
+	// Clock
+	timezone := post.Timezone
+	if timezone == "" {
+		timezone = "UTC"
+	}
+	line("\nd-i clock-setup/utc boolean true")
+	line("d-i time/zone string %s", timezone)
+
+	// Partitioning
+	b.WriteString("\n")
+	preseedPartitioning(&b, osCfg)
+
+	// Packages
+	packages := append([]string(nil), osCfg.Packages...)
+	if post.EnableSSH {
+		packages = append(packages, "openssh-server")
+	}
+	line("\ntasksel tasksel/first multiselect standard")
+	line("d-i pkgsel/include string %s", strings.Join(packages, " "))
+	line("popularity-contest popularity-contest/participate boolean false")
+
+	// Boot loader
+	line("\nd-i grub-installer/only_debian boolean true")
+	if osCfg.Disk.Device != "" {
+		line("d-i grub-installer/bootdev string %s", osCfg.Disk.Device)
+	} else {
+		line("d-i grub-installer/bootdev string default")
+	}
+
+	// Scripts. The Debian installer has no hook for failures, so only
+	// completion is reported.
+	early := append([]string(nil), osCfg.PreInstallScripts...)
+	var late []string
+	if c.Completion.PhoneHome {
+		early = append([]string{phoneHomeCommand(true, InstallStarted, 0, "")}, early...)
+		late = append(late, phoneHomeCommand(true, InstallProgress, installProgressMilestone, "Running post-install scripts"))
+	}
+	if len(early) > 0 {
+		line("\nd-i preseed/early_command string %s", strings.Join(early, "; "))
+	}
+	for _, cmd := range postInstallCommands(osCfg, &post) {
+		late = append(late, "in-target sh -c "+shellQuote(cmd))
+	}
+	if c.Completion.PhoneHome {
+		late = append(late, phoneHomeCommand(true, InstallCompleted, 100, ""))
+	}
+	if len(late) > 0 {
+		line("\nd-i preseed/late_command string %s", strings.Join(late, "; "))
+	}
+
+	line("\nd-i finish-install/reboot_in_progress note")
+	return b.Bytes(), nil
+}
+
+// preseedPartitioning writes the partman answers for a disk layout, using a
+// custom expert recipe if partitions are configured
+func preseedPartitioning(b *bytes.Buffer, osCfg *OSConfig) {
+	disk := osCfg.Disk
+	method := "regular"
+	if disk.UseLVM {
+		method = "lvm"
+	}
+	if disk.Device != "" {
+		fmt.Fprintf(b, "d-i partman-auto/disk string %s\n", disk.Device)
+	}
+	fmt.Fprintf(b, "d-i partman-auto/method string %s\n", method)
+	if disk.PartitionScheme != "" {
+		fmt.Fprintf(b, "d-i partman-partitioning/choose_label select %s\n", disk.PartitionScheme)
+		fmt.Fprintf(b, "d-i partman-partitioning/default_label string %s\n", disk.PartitionScheme)
+	}
+
+	if len(disk.Partitions) == 0 {
+		b.WriteString("d-i partman-auto/choose_recipe select atomic\n")
+	} else {
+		b.WriteString("d-i partman-auto/expert_recipe string nimbus ::")
+		for _, part := range disk.Partitions {
+			b.WriteString(" \\\n  " + preseedRecipePartition(part, disk.Filesystem, disk.UseLVM) + " .")
+		}
+		b.WriteString("\nd-i partman-auto/choose_recipe select nimbus\n")
+	}
+
+	if disk.UseLVM {
+		b.WriteString("d-i partman-lvm/device_remove_lvm boolean true\n")
+		b.WriteString("d-i partman-lvm/confirm boolean true\n")
+		b.WriteString("d-i partman-lvm/confirm_nooverwrite boolean true\n")
+		b.WriteString("d-i partman-auto-lvm/guided_size string max\n")
+	}
+	b.WriteString("d-i partman-md/device_remove_md boolean true\n")
+	b.WriteString("d-i partman-partitioning/confirm_write_new_label boolean true\n")
+	b.WriteString("d-i partman/choose_partition select finish\n")
+	b.WriteString("d-i partman/confirm boolean true\n")
+	b.WriteString("d-i partman/confirm_nooverwrite boolean true\n")
+}
+
+// preseedRecipePartition renders one partition of a partman expert recipe
+// as "<min> <priority> <max> <fs> <options>"
+func preseedRecipePartition(part Partition, defaultFS string, lvm bool) string {
+	size := fmt.Sprintf("%d %d %d", part.SizeMB, part.SizeMB, part.SizeMB)
+	if part.SizeMB == 0 {
+		size = "1024 10000 -1"
+	}
+
+	fstype := partitionFilesystem(part, defaultFS)
+	var opts []string
+	if isBootPartition(part) {
+		opts = append(opts, "$primary{ }")
+	} else if lvm {
+		opts = append(opts, "$lvmok{ }", "lv_name{ "+lvName(part)+" }")
+	}
+	if part.Bootable {
+		opts = append(opts, "$bootable{ }")
+	}
+
+	switch {
+	case isEFIPartition(part):
+		fstype = "fat32"
+		opts = append(opts, "method{ efi }", "format{ }")
+	case isSwap(part):
+		fstype = "linux-swap"
+		opts = append(opts, "method{ swap }", "format{ }")
+	default:
+		opts = append(opts, "method{ format }", "format{ }", "use_filesystem{ }",
+			"filesystem{ "+fstype+" }", "mountpoint{ "+part.MountPoint+" }")
+	}
+
+	return size + " " + fstype + " " + strings.Join(opts, " ")
+}
+
+// RenderKickstart renders an Anaconda kickstart file
+func (c *Config) RenderKickstart(host *Host) ([]byte, error) {
+	osCfg := c.HostOS(host)
+	post := c.PostInstall
+	hostname := hostHostname(host)
+
+	var b bytes.Buffer
+	line := func(format string, args ...interface{}) {
+		fmt.Fprintf(&b, format+"\n", args...)
+	}
+
+	fmt.Fprintf(&b, "# Generated by Nimbus for %s\n\n", hostname)
+
+	line("text")
+	locale := post.Locale
+	if locale == "" {
+		locale = "en_US.UTF-8"
+	}
+	line("lang %s", locale)
+	line("keyboard us")
+	timezone := post.Timezone
+	if timezone == "" {
+		timezone = "UTC"
+	}
+	line("timezone %s --utc", timezone)
+	if osCfg.Source != "" {
+		line("url --url=%s", osCfg.Source)
+	}
+
+	// Network
+	b.WriteString("\n")
+	nameservers := strings.Join(c.hostNameservers(osCfg), ",")
+	for i, iface := range osCfg.Network.Interfaces {
+		args := []string{"network", "--device=" + iface.Name}
+		if iface.DHCP || iface.Address == "" {
+			args = append(args, "--bootproto=dhcp")
+		} else {
+			args = append(args, "--bootproto=static", "--ip="+iface.Address, "--netmask="+iface.Netmask)
+			gateway := iface.Gateway
+			if gateway == "" && iface.DefaultRoute {
+				gateway = c.Network.Gateway
+			}
+			if gateway != "" {
+				args = append(args, "--gateway="+gateway)
+			}
+			if nameservers != "" {
+				args = append(args, "--nameserver="+nameservers)
+			}
+		}
+		if !iface.OnBoot {
+			args = append(args, "--onboot=no")
+		}
+		if !iface.DefaultRoute && len(osCfg.Network.Interfaces) > 1 {
+			args = append(args, "--nodefroute")
+		}
+		if i == 0 {
+			args = append(args, "--hostname="+hostname)
+		}
+		line("%s", strings.Join(args, " "))
+	}
+	if len(osCfg.Network.Interfaces) == 0 {
+		line("network --bootproto=dhcp --device=link --activate --hostname=%s", hostname)
+	}
+
+	// Accounts
+	b.WriteString("\n")
+	if osCfg.RootPassword != "" {
+		line("rootpw --iscrypted %s", osCfg.RootPassword)
+	} else {
+		line("rootpw --lock")
+	}
+	for _, key := range osCfg.SSHKeys {
+		line("sshkey --username=root %q", key)
+	}
+	if post.EnableSSH {
+		line("services --enabled=sshd")
+	} else {
+		line("services --disabled=sshd")
+	}
+
+	// Partitioning
+	b.WriteString("\n")
+	kickstartPartitioning(&b, osCfg)
+
+	line("\nreboot")
+
+	phoneHome := c.Completion.PhoneHome
+	if len(osCfg.PreInstallScripts) > 0 || phoneHome {
+		line("\n%%pre")
+		if phoneHome {
+			line("%s", phoneHomeCommand(false, InstallStarted, 0, ""))
+		}
+		for _, script := range osCfg.PreInstallScripts {
+			line("%s", script)
+		}
+		line("%%end")
+	}
+
+	line("\n%%packages")
+	line("@^minimal-environment")
+	for _, pkg := range osCfg.Packages {
+		line("%s", pkg)
+	}
+	if post.EnableSSH {
+		line("openssh-server")
+	}
+	line("%%end")
+
+	// Reports run outside the installed system, with the installer's curl
+	if phoneHome {
+		line("\n%%post --nochroot")
+		line("%s", phoneHomeCommand(false, InstallProgress, installProgressMilestone, "Running post-install scripts"))
+		line("%%end")
+	}
+
+	if cmds := postInstallCommands(osCfg, &post); len(cmds) > 0 {
+		line("\n%%post")
+		for _, cmd := range cmds {
+			line("%s", cmd)
+		}
+		line("%%end")
+	}
+
+	if phoneHome {
+		line("\n%%post --nochroot")
+		line("%s", phoneHomeCommand(false, InstallCompleted, 100, ""))
+		line("%%end")
+		line("\n%%onerror")
+		line("%s", phoneHomeCommand(false, InstallFailed, 0, "Kickstart installation failed"))
+		line("%%end")
+	}
+
+	return b.Bytes(), nil
+}
+
+// kickstartPartitioning writes the partitioning commands for a disk layout,
+// using automatic partitioning if no partitions are configured
+func kickstartPartitioning(b *bytes.Buffer, osCfg *OSConfig) {
+	disk := osCfg.Disk
+	drive := strings.TrimPrefix(disk.Device, "/dev/")
+
+	if drive != "" {
+		fmt.Fprintf(b, "ignoredisk --only-use=%s\n", drive)
+		fmt.Fprintf(b, "bootloader --boot-drive=%s\n", drive)
+	} else {
+		b.WriteString("bootloader\n")
+	}
+	b.WriteString("zerombr\n")
+	clearpart := "clearpart --all --initlabel"
+	if disk.PartitionScheme != "" {
+		clearpart += " --disklabel=" + disk.PartitionScheme
+	}
+	b.WriteString(clearpart + "\n")
+
+	if len(disk.Partitions) == 0 {
+		autopart := "autopart --type=plain"
+		if disk.UseLVM {
+			autopart = "autopart --type=lvm"
+		}
+		if disk.Filesystem != "" {
+			autopart += " --fstype=" + disk.Filesystem
+		}
+		b.WriteString(autopart + "\n")
+		return
+	}
+
+	ondisk := ""
+	if drive != "" {
+		ondisk = " --ondisk=" + drive
+	}
+
+	var lvs []Partition
+	for _, part := range disk.Partitions {
+		if disk.UseLVM && !isBootPartition(part) {
+			lvs = append(lvs, part)
+			continue
+		}
+		fmt.Fprintf(b, "part %s --fstype=%s %s%s\n", kickstartMount(part), kickstartFilesystem(part, disk.Filesystem), kickstartSize(part.SizeMB), ondisk)
+	}
+
+	if len(lvs) > 0 {
+		fmt.Fprintf(b, "part pv.01 --size=1 --grow%s\n", ondisk)
+		b.WriteString("volgroup vg0 pv.01\n")
+		for _, part := range lvs {
+			fmt.Fprintf(b, "logvol %s --vgname=vg0 --name=%s --fstype=%s %s\n", kickstartMount(part), lvName(part), kickstartFilesystem(part, disk.Filesystem), kickstartSize(part.SizeMB))
+		}
+	}
+}
+
+// kickstartMount returns the mount point of a partition as kickstart names
+// it
+func kickstartMount(part Partition) string {
+	if isSwap(part) {
+		return "swap"
+	}
+	return part.MountPoint
+}
+
+// kickstartFilesystem returns the filesystem of a partition as kickstart
+// names it
+func kickstartFilesystem(part Partition, defaultFS string) string {
+	switch {
+	case isEFIPartition(part):
+		return "efi"
+	case isSwap(part):
+		return "swap"
+	default:
+		return partitionFilesystem(part, defaultFS)
+	}
+}
+
+// kickstartSize returns the size options of a partition, which takes the
+// remaining space if its size is zero
+func kickstartSize(sizeMB int64) string {
+	if sizeMB == 0 {
+		return "--size=1 --grow"
+	}
+	return fmt.Sprintf("--size=%d", sizeMB)
+}
+
+// postInstallCommands returns the shell commands run in the installed system:
+// the SSH configuration, post-install scripts and post-installation
+// commands
+func postInstallCommands(osCfg *OSConfig, post *PostInstallConfig) []string {
+	var cmds []string
+
+	if len(osCfg.SSHKeys) > 0 {
+		cmds = append(cmds, "mkdir -p -m 700 /root/.ssh")
+		for _, key := range osCfg.SSHKeys {
+			cmds = append(cmds, "echo "+shellQuote(key)+" >> /root/.ssh/authorized_keys")
+		}
+		cmds = append(cmds, "chmod 600 /root/.ssh/authorized_keys")
+	}
+
+	if post.EnableSSH {
+		rootLogin := "prohibit-password"
+		if post.PermitRootLogin && post.PasswordAuthentication {
+			rootLogin = "yes"
+		} else if !post.PermitRootLogin {
+			rootLogin = "no"
+		}
+		passwordAuth := "no"
+		if post.PasswordAuthentication {
+			passwordAuth = "yes"
+		}
+		cmds = append(cmds,
+			"mkdir -p /etc/ssh/sshd_config.d",
+			fmt.Sprintf("printf 'PermitRootLogin %s\\nPasswordAuthentication %s\\n' > /etc/ssh/sshd_config.d/50-nimbus.conf", rootLogin, passwordAuth),
+		)
+	}
+
+	cmds = append(cmds, osCfg.PostInstallScripts...)
+	cmds = append(cmds, post.Commands...)
+	return cmds
+}
+
+// partitionFilesystem returns the filesystem of a partition, defaulting to
+// the disk's filesystem and then ext4
+func partitionFilesystem(part Partition, defaultFS string) string {
+	switch {
+	case part.Filesystem != "":
+		return part.Filesystem
+	case defaultFS != "":
+		return defaultFS
+	default:
+		return "ext4"
+	}
+}
+
+// isSwap reports whether a partition is used as swap
+func isSwap(part Partition) bool {
+	return part.MountPoint == "swap" || part.Filesystem == "swap"
+}
+
+// isEFIPartition reports whether a partition is the EFI system partition
+func isEFIPartition(part Partition) bool {
+	return part.MountPoint == "/boot/efi"
+}
+
+// isBootPartition reports whether a partition must stay outside LVM
+func isBootPartition(part Partition) bool {
+	return part.MountPoint == "/boot" || isEFIPartition(part) || part.Bootable
+}
+
+// lvName returns the logical volume name for a partition, such as "root"
+// for / and "var_log" for /var/log
+func lvName(part Partition) string {
+	if isSwap(part) {
+		return "swap"
+	}
+	name := strings.ReplaceAll(strings.Trim(part.MountPoint, "/"), "/", "_")
+	if name == "" {
+		return "root"
+	}
+	return name
+}
+
+// curtinSize returns a partition size in curtin's notation, where -1 takes
+// the remaining space
+func curtinSize(sizeMB int64) interface{} {
+	if sizeMB == 0 {
+		return -1
+	}
+	return fmt.Sprintf("%dM", sizeMB)
+}
+
+// mirrorURL returns the package mirror for an installation source, which
+// may point into the mirror's dists directory
+func mirrorURL(source string) string {
+	if !strings.Contains(source, "://") {
+		return ""
+	}
+	if i := strings.Index(source, "/dists/"); i >= 0 {
+		source = source[:i]
+	}
+	return strings.TrimSuffix(source, "/")
+}
+
+// shellQuote quotes s for use as a single POSIX shell word
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// nonNil returns s, or an empty slice if it is nil, so that it is rendered
+// as an empty list rather than null
+func nonNil(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
@@ -0,0 +1,47 @@
+package baremetal
+
+import "testing"
+
+func TestRenderInstallerConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		version string
+		lvm     bool
+		render  func(*Config, *Host) ([]byte, error)
+	}{
+		{name: "autoinstall", version: "ubuntu-24.04", render: (*Config).RenderAutoinstall},
+		{name: "autoinstall-lvm", version: "ubuntu-24.04", lvm: true, render: (*Config).RenderAutoinstall},
+		{name: "preseed", version: "debian-12", render: (*Config).RenderPreseed},
+		{name: "preseed-lvm", version: "debian-12", lvm: true, render: (*Config).RenderPreseed},
+		{name: "kickstart", version: "rocky-9", render: (*Config).RenderKickstart},
+		{name: "kickstart-lvm", version: "rocky-9", lvm: true, render: (*Config).RenderKickstart},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, host := rendererHost(t, tt.version, "", tt.lvm)
+
+			got, err := tt.render(cfg, host)
+			if err != nil {
+				t.Fatalf("render: %v", err)
+			}
+			checkGolden(t, tt.name, got)
+
+			// The installer is chosen from the OS version
+			dispatched, err := cfg.RenderInstallerConfig(host)
+			if err != nil {
+				t.Fatalf("RenderInstallerConfig: %v", err)
+			}
+			if string(dispatched) != string(got) {
+				t.Errorf("RenderInstallerConfig rendered a different answer file for %s", tt.version)
+			}
+		})
+	}
+}
+
+func TestRenderInstallerConfigUnknown(t *testing.T) {
+	cfg, host := rendererHost(t, "plan9", "", false)
+	if _, err := cfg.RenderInstallerConfig(host); err == nil {
+		t.Fatal("rendered an answer file for an unknown OS")
+	}
+}
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS baremetal_state_transitions;
+DROP TABLE IF EXISTS baremetal_host_states;
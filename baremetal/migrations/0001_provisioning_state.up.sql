@@ -0,0 +1,19 @@
+CREATE TABLE IF NOT EXISTS baremetal_host_states (
+    hostname   TEXT PRIMARY KEY,
+    mac        TEXT NOT NULL DEFAULT '',
+    state      TEXT NOT NULL,
+    since      TIMESTAMPTZ NOT NULL,
+    percent    INTEGER NOT NULL DEFAULT 0,
+    error      TEXT NOT NULL DEFAULT '',
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS baremetal_state_transitions (
+    hostname   TEXT NOT NULL REFERENCES baremetal_host_states (hostname) ON DELETE CASCADE,
+    seq        INTEGER NOT NULL,
+    from_state TEXT NOT NULL DEFAULT '',
+    to_state   TEXT NOT NULL,
+    at         TIMESTAMPTZ NOT NULL,
+    error      TEXT NOT NULL DEFAULT '',
+    PRIMARY KEY (hostname, seq)
+);
@@ -0,0 +1,3 @@
+ALTER TABLE baremetal_host_states
+    DROP COLUMN IF EXISTS metadata_token,
+    DROP COLUMN IF EXISTS phone_home_token;
@@ -0,0 +1,3 @@
+ALTER TABLE baremetal_host_states
+    ADD COLUMN IF NOT EXISTS phone_home_token TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS metadata_token   TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,193 @@
+package baremetal
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// phoneHomePath is the HTTP path prefix installers report their
+	// progress under
+	phoneHomePath = "/phone-home/"
+
+	// phoneHomeArg is the kernel argument telling installers where to
+	// report their progress
+	phoneHomeArg = "nimbus.phone_home"
+)
+
+// InstallEvent is a step an installer reports to the phone-home endpoint
+type InstallEvent string
+
+// Installer events
+const (
+	InstallStarted   InstallEvent = "start"
+	InstallProgress  InstallEvent = "progress"
+	InstallCompleted InstallEvent = "complete"
+	InstallFailed    InstallEvent = "failed"
+)
+
+// ErrInstallFailed is returned when a host's installer reports that it
+// failed
+var ErrInstallFailed = errors.New("installer reported failure")
+
+// installReport is a report posted by an installer
+type installReport struct {
+	event   InstallEvent
+	percent int
+	message string
+}
+
+// installWatch receives the reports of the installer of one provisioning
+// run. The token in its URL is only valid for the run.
+type installWatch struct {
+	hostname string
+	reports  chan installReport
+}
+
+// issueInstallToken creates the phone-home token of a host's provisioning
+// run, replacing any earlier one, and records it in the host's status. A
+// resumed run passes the token it had issued, so that an installer that
+// was already running can still report; otherwise token is empty and a new
+// one is generated. It returns nil if phone-home is disabled or metadata is
+// not served.
+func (p *Provisioner) issueInstallToken(host *Host, token string) (*installWatch, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.config.Completion.PhoneHome || p.metadata == nil {
+		return nil, nil
+	}
+
+	if token == "" {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			return nil, fmt.Errorf("failed to generate phone-home token: %w", err)
+		}
+		token = hex.EncodeToString(b)
+	}
+
+	p.revokeInstallTokenLocked(host.Hostname)
+	w := &installWatch{hostname: host.Hostname, reports: make(chan installReport, 64)}
+	p.installs[token] = w
+	if st, ok := p.status[host.Hostname]; ok {
+		st.Tokens.PhoneHome = token
+	}
+	return w, nil
+}
+
+// revokeInstallToken withdraws the phone-home token of a host's run
+func (p *Provisioner) revokeInstallToken(host *Host) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.revokeInstallTokenLocked(host.Hostname)
+}
+
+// revokeInstallTokenLocked withdraws the phone-home token of a host's run.
+// The caller must hold mu.
+func (p *Provisioner) revokeInstallTokenLocked(hostname string) {
+	for token, w := range p.installs {
+		if w.hostname == hostname {
+			delete(p.installs, token)
+		}
+	}
+}
+
+// phoneHomeURL returns the URL a host's installer reports to, or "" if the
+// host has no phone-home token. The caller must hold mu.
+func (p *Provisioner) phoneHomeURL(hostname string) string {
+	for token, w := range p.installs {
+		if w.hostname == hostname {
+			return p.metadata.URL(phoneHomePath + token)
+		}
+	}
+	return ""
+}
+
+// servePhoneHome accepts an installer report. Reports are POSTed to
+// /phone-home/<token> as a form with an event of start, progress, complete
+// or failed, and optionally a percent and a message.
+func (p *Provisioner) servePhoneHome(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token := strings.TrimPrefix(r.URL.Path, phoneHomePath)
+	p.mu.Lock()
+	watch, ok := p.installs[token]
+	p.mu.Unlock()
+	if !ok {
+		log.Debug().Str("remote", r.RemoteAddr).Msg("Refusing phone-home with unknown token")
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, 64<<10)
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "invalid form", http.StatusBadRequest)
+		return
+	}
+
+	report := installReport{
+		event:   InstallEvent(r.PostForm.Get("event")),
+		message: r.PostForm.Get("message"),
+	}
+	switch report.event {
+	case InstallStarted, InstallProgress, InstallCompleted, InstallFailed:
+	default:
+		http.Error(w, "unknown event", http.StatusBadRequest)
+		return
+	}
+	if s := r.PostForm.Get("percent"); s != "" {
+		percent, err := strconv.Atoi(s)
+		if err != nil || percent < 0 || percent > 100 {
+			http.Error(w, "invalid percent", http.StatusBadRequest)
+			return
+		}
+		report.percent = percent
+	}
+
+	log.Debug().
+		Str("host", watch.hostname).
+		Str("event", string(report.event)).
+		Int("percent", report.percent).
+		Str("message", report.message).
+		Msg("Installer reported in")
+
+	select {
+	case watch.reports <- report:
+	default:
+		log.Warn().Str("host", watch.hostname).Str("event", string(report.event)).Msg("Dropping installer report")
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// phoneHomeCommand returns a shell command that reports an installer event
+// to the URL in the nimbus.phone_home kernel argument. The Debian installer
+// only has wget; other installers use curl. The command never fails, so
+// that an undeliverable report does not abort the installation.
+func phoneHomeCommand(wget bool, event InstallEvent, percent int, message string) string {
+	form := url.Values{"event": {string(event)}}
+	if percent > 0 {
+		form.Set("percent", strconv.Itoa(percent))
+	}
+	if message != "" {
+		form.Set("message", message)
+	}
+	body := shellQuote(form.Encode())
+
+	post := "curl -fsS -m 10 -o /dev/null -d " + body + ` "$u"`
+	if wget {
+		post = "wget -q -T 10 -O /dev/null --post-data " + body + ` "$u"`
+	}
+	return `u=$(sed -n 's/.*` + strings.ReplaceAll(phoneHomeArg, ".", `\.`) + `=\([^ ]*\).*/\1/p' /proc/cmdline); [ -z "$u" ] || ` + post + " || true"
+}
@@ -0,0 +1,194 @@
+package baremetal_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nimbus-project/nimbus/baremetal"
+)
+
+// phoneHome enables installer phone-home
+func phoneHome(c *baremetal.Config) {
+	c.Completion.PhoneHome = true
+}
+
+// installer makes a host's installer post reports once it has booted
+func installer(t *testing.T, tb *testbed, bmc string, reports func()) {
+	t.Helper()
+	b := tb.bmcs.Get(bmc)
+	boot := b.OnPowerOn
+	b.OnPowerOn = func() {
+		boot()
+		reports()
+	}
+}
+
+// report posts an installer report and checks its response status
+func report(t *testing.T, tb *testbed, mac string, event baremetal.InstallEvent, percent int, message string, want int) {
+	t.Helper()
+	code, err := tb.pxe.PhoneHome(mac, event, percent, message)
+	if err != nil {
+		t.Errorf("phone home %s: %v", event, err)
+		return
+	}
+	if code != want {
+		t.Errorf("phone home %s: status %d, want %d", event, code, want)
+	}
+}
+
+func TestPhoneHome(t *testing.T) {
+	const mac = "52:54:00:00:00:01"
+	tb := newTestbed(t, []baremetal.Host{testHost("n1", mac, "10.0.1.1")}, phoneHome)
+	installer(t, tb, "10.0.1.1", func() {
+		report(t, tb, mac, baremetal.InstallStarted, 0, "", http.StatusNoContent)
+		report(t, tb, mac, baremetal.InstallProgress, 50, "Installing packages", http.StatusNoContent)
+		report(t, tb, mac, "rebooted", 0, "", http.StatusBadRequest)
+		report(t, tb, mac, baremetal.InstallCompleted, 100, "", http.StatusNoContent)
+	})
+	events, unsubscribe := tb.p.Subscribe(256)
+
+	if err := tb.p.Provision(context.Background(), tb.host(t, "n1")); err != nil {
+		t.Fatalf("Provision: %v", err)
+	}
+	unsubscribe()
+
+	var progress bool
+	for e := range events {
+		if e.Type == baremetal.ProgressPercent && e.Message == "Installing packages" {
+			progress = true
+			if e.State != baremetal.StateInstalling || e.Percent != 57 {
+				t.Errorf("installer progress in %s at %d%%, want installing at 57%%", e.State, e.Percent)
+			}
+		}
+	}
+	if !progress {
+		t.Error("installer progress not reported")
+	}
+
+	// The token is only valid for the run
+	report(t, tb, mac, baremetal.InstallCompleted, 100, "", http.StatusNotFound)
+}
+
+func TestPhoneHomeFailed(t *testing.T) {
+	const mac = "52:54:00:00:00:01"
+	tb := newTestbed(t, []baremetal.Host{testHost("n1", mac, "10.0.1.1")}, phoneHome)
+	installer(t, tb, "10.0.1.1", func() {
+		report(t, tb, mac, baremetal.InstallStarted, 0, "", http.StatusNoContent)
+		report(t, tb, mac, baremetal.InstallFailed, 0, "no disk found", http.StatusNoContent)
+	})
+
+	err := tb.p.Provision(context.Background(), tb.host(t, "n1"))
+	if !errors.Is(err, baremetal.ErrInstallFailed) {
+		t.Fatalf("err = %v, want %v", err, baremetal.ErrInstallFailed)
+	}
+	var se *baremetal.StateError
+	if !errors.As(err, &se) || se.State != baremetal.StateInstalling {
+		t.Errorf("err = %v, want a failure in installing", err)
+	}
+	if !strings.Contains(err.Error(), "no disk found") {
+		t.Errorf("err = %v, want the installer's message", err)
+	}
+}
+
+func TestPhoneHomeTimeout(t *testing.T) {
+	const mac = "52:54:00:00:00:01"
+	tb := newTestbed(t, []baremetal.Host{testHost("n1", mac, "10.0.1.1")}, func(c *baremetal.Config) {
+		phoneHome(c)
+		c.StateTimeouts.Installing = baremetal.Duration(50 * time.Millisecond)
+	})
+
+	err := tb.p.Provision(context.Background(), tb.host(t, "n1"))
+	if !errors.Is(err, baremetal.ErrStateTimeout) {
+		t.Fatalf("err = %v, want %v", err, baremetal.ErrStateTimeout)
+	}
+	if !strings.Contains(err.Error(), "installer never reported in") {
+		t.Errorf("err = %v, want it to say the installer never reported", err)
+	}
+}
+
+func TestPhoneHomeRequests(t *testing.T) {
+	tb := newTestbed(t, nil, phoneHome)
+
+	tests := []struct {
+		method, path string
+		want         int
+	}{
+		{http.MethodGet, "/phone-home/0123456789abcdef", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/phone-home/0123456789abcdef", http.StatusNotFound},
+		{http.MethodPost, "/phone-home/", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.path, strings.NewReader("event=complete"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		tb.pxe.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("%s %s: status %d, want %d", tt.method, tt.path, rec.Code, tt.want)
+		}
+	}
+}
+
+func TestPhoneHomeAfterResume(t *testing.T) {
+	const mac = "52:54:00:00:00:01"
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "state.json")
+	hosts := []baremetal.Host{testHost("n1", mac, "10.0.1.1")}
+
+	// The first run dies while its installer is running
+	first := newTestbed(t, hosts, func(c *baremetal.Config) {
+		phoneHome(c)
+		c.StateTimeouts.Installing = baremetal.Duration(10 * time.Millisecond)
+	})
+	if err := first.p.SetStateStore(ctx, &crashStore{StateStore: baremetal.NewFileStore(path), at: baremetal.StateInstalling}); err != nil {
+		t.Fatalf("SetStateStore: %v", err)
+	}
+	first.p.Provision(ctx, first.host(t, "n1"))
+	cmdline := first.pxe.HostCmdline(mac)
+
+	stored, err := baremetal.NewFileStore(path).Load(ctx)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	tokens := stored[0].Tokens
+	if tokens.PhoneHome == "" || tokens.Metadata == "" {
+		t.Fatalf("stored tokens = %+v, want both recorded", tokens)
+	}
+	if !strings.Contains(cmdline, tokens.PhoneHome) || !strings.Contains(cmdline, tokens.Metadata) {
+		t.Errorf("stored tokens %+v are not the ones on the kernel command line %q", tokens, cmdline)
+	}
+
+	second := newTestbed(t, hosts, phoneHome)
+	if err := second.p.SetStateStore(ctx, baremetal.NewFileStore(path)); err != nil {
+		t.Fatalf("SetStateStore: %v", err)
+	}
+	if st, _ := second.p.Status("n1"); st.Tokens != (baremetal.RunTokens{}) {
+		t.Errorf("Status returned the run's tokens %+v", st.Tokens)
+	}
+
+	// The installer still running from before the restart reports in
+	second.p.OnStatusUpdate(func(host *baremetal.Host, status, message string) {
+		if strings.HasPrefix(message, "Resuming") {
+			report(t, second, mac, baremetal.InstallCompleted, 100, "", http.StatusNoContent)
+		}
+	})
+	if err := second.p.Provision(ctx, second.host(t, "n1")); err != nil {
+		t.Fatalf("resumed Provision: %v", err)
+	}
+	if got := second.pxe.HostCmdline(mac); got != cmdline {
+		t.Errorf("resumed kernel command line = %q, want the original %q", got, cmdline)
+	}
+
+	stored, err = baremetal.NewFileStore(path).Load(ctx)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if stored[0].State != baremetal.StateReady || stored[0].Tokens != (baremetal.RunTokens{}) {
+		t.Errorf("stored %s with tokens %+v, want ready without tokens", stored[0].State, stored[0].Tokens)
+	}
+}
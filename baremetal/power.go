@@ -0,0 +1,111 @@
+package baremetal
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Boot devices passed to BMC.SetBootDevice, named as Redfish boot source
+// override targets
+const (
+	BootDevicePXE  = "Pxe"
+	BootDeviceDisk = "Hdd"
+)
+
+// powerPollInterval is how often a host's power state is checked while
+// waiting for it to power off
+const powerPollInterval = 2 * time.Second
+
+// BMC controls a host's power and boot device. It is implemented by
+// *ipmi.Client.
+type BMC interface {
+	Connect(ctx context.Context) error
+	PowerOn() error
+	PowerOff() error
+	SetBootDevice(device string) error
+	GetPowerState() (string, error)
+	Close() error
+}
+
+// BMCDialer creates a BMC client for a host's BMC. ipmi.NewClient can be
+// used as one by wrapping it to return a BMC.
+type BMCDialer func(address, username, password, protocol string) (BMC, error)
+
+// SetBMCDialer makes the provisioner power hosts off and on and set their
+// boot device through their BMCs, using dial to reach them. Without a
+// dialer, hosts that have a BMC address cannot be provisioned.
+func (p *Provisioner) SetBMCDialer(dial BMCDialer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.dialBMC = dial
+}
+
+// connectBMC connects to a host's BMC, using the [bmc] credentials and
+// protocol where the host does not set its own. It returns nil if the host
+// has no BMC address, in which case its power is left to the operator.
+func (p *Provisioner) connectBMC(ctx context.Context, host *Host) (BMC, error) {
+	if host.BMC.Address == "" {
+		log.Warn().Str("host", host.Hostname).Msg("Host has no BMC address, it must be power cycled by hand")
+		return nil, nil
+	}
+
+	p.mu.Lock()
+	dial := p.dialBMC
+	p.mu.Unlock()
+	if dial == nil {
+		return nil, fmt.Errorf("no BMC dialer configured for BMC %s", host.BMC.Address)
+	}
+
+	username, password, protocol := host.BMC.Username, host.BMC.Password, host.BMC.Protocol
+	if username == "" {
+		username, password = p.config.BMC.Username, p.config.BMC.Password
+	}
+	if protocol == "" {
+		protocol = p.config.BMC.Protocol
+	}
+	if protocol == "" {
+		protocol = "ipmi"
+	}
+
+	bmc, err := dial(host.BMC.Address, username, password, protocol)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create BMC client for %s: %w", host.BMC.Address, err)
+	}
+	if err := bmc.Connect(ctx); err != nil {
+		bmc.Close()
+		return nil, fmt.Errorf("failed to connect to BMC %s: %w", host.BMC.Address, err)
+	}
+	return bmc, nil
+}
+
+// waitForPowerOff polls a BMC until it reports the host powered off
+func waitForPowerOff(ctx context.Context, bmc BMC) error {
+	ticker := time.NewTicker(powerPollInterval)
+	defer ticker.Stop()
+
+	for {
+		state, err := bmc.GetPowerState()
+		if err != nil {
+			return fmt.Errorf("failed to get power state: %w", err)
+		}
+		if isPowerOff(state) {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("host still powered %s: %w", state, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// isPowerOff reports whether a power state reported by a BMC means the host
+// is off
+func isPowerOff(state string) bool {
+	return strings.EqualFold(state, "off")
+}
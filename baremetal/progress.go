@@ -0,0 +1,224 @@
+package baremetal
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ProgressType identifies what a progress event reports
+type ProgressType string
+
+// Progress event types
+const (
+	// ProgressStepStarted is emitted when a host enters a provisioning
+	// state
+	ProgressStepStarted ProgressType = "step_started"
+
+	// ProgressStepFinished is emitted when a host completes the work of a
+	// provisioning state
+	ProgressStepFinished ProgressType = "step_finished"
+
+	// ProgressPercent is emitted when a host's overall progress advances
+	// within a state, and with 100 percent once it is ready
+	ProgressPercent ProgressType = "progress"
+
+	// ProgressLog carries a message about what is happening to a host
+	ProgressLog ProgressType = "log"
+
+	// ProgressError is emitted when provisioning a host fails
+	ProgressError ProgressType = "error"
+)
+
+// ProgressEvent reports a host's progress through provisioning
+type ProgressEvent struct {
+	Type ProgressType
+	Time time.Time
+
+	Hostname string
+	MAC      string
+
+	// State the host is in, or the state that finished for
+	// ProgressStepFinished
+	State State
+
+	// Percent is the host's overall progress, from 0 to 100
+	Percent int
+
+	Message string
+
+	// Err is why provisioning failed, for ProgressError
+	Err error
+}
+
+// StatusFunc is called with a host, the state it is in and a message
+// describing what happened
+type StatusFunc func(host *Host, status string, message string)
+
+// statePercent is the range of overall progress each state covers. The
+// installer usually takes far longer than everything else.
+var statePercent = map[State][2]int{
+	StateRegistered:     {0, 0},
+	StatePoweringOff:    {0, 5},
+	StateBootConfigured: {5, 10},
+	StateBooting:        {10, 25},
+	StateInstalling:     {25, 90},
+	StatePostInstall:    {90, 100},
+	StateReady:          {100, 100},
+}
+
+// progressBus fans progress events out to subscribers and status callbacks.
+// Subscribers that fall behind miss events, so a slow consumer never holds
+// up provisioning.
+type progressBus struct {
+	mu        sync.Mutex
+	subs      map[chan ProgressEvent]struct{}
+	callbacks []StatusFunc
+}
+
+// Subscribe returns a channel receiving the progress events of every host
+// being provisioned and a function that ends the subscription and closes
+// the channel. Events are dropped for a subscriber whose buffer is full.
+func (p *Provisioner) Subscribe(buffer int) (<-chan ProgressEvent, func()) {
+	ch := make(chan ProgressEvent, buffer)
+
+	p.progress.mu.Lock()
+	defer p.progress.mu.Unlock()
+	if p.progress.subs == nil {
+		p.progress.subs = make(map[chan ProgressEvent]struct{})
+	}
+	p.progress.subs[ch] = struct{}{}
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			p.progress.mu.Lock()
+			defer p.progress.mu.Unlock()
+			delete(p.progress.subs, ch)
+			close(ch)
+		})
+	}
+}
+
+// OnStatusUpdate registers a callback for every progress event, called with
+// the host's state as the status and the event's message. Callbacks run on
+// the goroutine provisioning the host and hold it up until they return.
+func (p *Provisioner) OnStatusUpdate(fn StatusFunc) {
+	p.progress.mu.Lock()
+	defer p.progress.mu.Unlock()
+	p.progress.callbacks = append(p.progress.callbacks, fn)
+}
+
+// emitProgress delivers a progress event about host to all subscribers and
+// callbacks. It must not be called with p.mu held, since callbacks may
+// query the provisioner.
+func (p *Provisioner) emitProgress(host *Host, e ProgressEvent) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	e.Hostname, e.MAC = host.Hostname, host.MAC
+
+	p.progress.mu.Lock()
+	for ch := range p.progress.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+	callbacks := append([]StatusFunc(nil), p.progress.callbacks...)
+	p.progress.mu.Unlock()
+
+	for _, fn := range callbacks {
+		fn(host, string(e.State), e.Message)
+	}
+}
+
+// reportProgress records that a host is the given fraction of the way
+// through its current state and emits a ProgressPercent event
+func (p *Provisioner) reportProgress(host *Host, fraction float64, format string, args ...interface{}) {
+	p.mu.Lock()
+	st, ok := p.status[host.Hostname]
+	if !ok {
+		p.mu.Unlock()
+		return
+	}
+	r := statePercent[st.State]
+	percent := r[0] + int(fraction*float64(r[1]-r[0]))
+	if percent > st.Percent {
+		st.Percent = percent
+	}
+	state, percent := st.State, st.Percent
+	p.mu.Unlock()
+
+	p.emitProgress(host, ProgressEvent{
+		Type:    ProgressPercent,
+		State:   state,
+		Percent: percent,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// logProgress emits a ProgressLog event about a host
+func (p *Provisioner) logProgress(host *Host, format string, args ...interface{}) {
+	p.mu.Lock()
+	st, ok := p.status[host.Hostname]
+	if !ok {
+		p.mu.Unlock()
+		return
+	}
+	state, percent := st.State, st.Percent
+	p.mu.Unlock()
+
+	p.emitProgress(host, ProgressEvent{
+		Type:    ProgressLog,
+		State:   state,
+		Percent: percent,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// transitionEvents returns the progress events of a host moving from one
+// state to another. percent is the host's progress after the transition.
+func transitionEvents(from, to State, percent int, err error) []ProgressEvent {
+	var events []ProgressEvent
+	if _, ok := statePercent[from]; ok && from != StateRegistered && to != StateFailed {
+		events = append(events, ProgressEvent{
+			Type:    ProgressStepFinished,
+			State:   from,
+			Percent: statePercent[from][1],
+			Message: fmt.Sprintf("Finished %s", from),
+		})
+	}
+
+	switch to {
+	case StateRegistered:
+		events = append(events, ProgressEvent{
+			Type:    ProgressLog,
+			State:   to,
+			Message: "Registered for provisioning",
+		})
+	case StateReady:
+		events = append(events, ProgressEvent{
+			Type:    ProgressPercent,
+			State:   to,
+			Percent: 100,
+			Message: "Host is ready",
+		})
+	case StateFailed:
+		events = append(events, ProgressEvent{
+			Type:    ProgressError,
+			State:   to,
+			Percent: percent,
+			Message: err.Error(),
+			Err:     err,
+		})
+	default:
+		events = append(events, ProgressEvent{
+			Type:    ProgressStepStarted,
+			State:   to,
+			Percent: percent,
+			Message: fmt.Sprintf("Started %s", to),
+		})
+	}
+	return events
+}
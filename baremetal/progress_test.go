@@ -0,0 +1,150 @@
+package baremetal_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/nimbus-project/nimbus/baremetal"
+)
+
+// collect drains a progress subscription after it has been ended
+func collect(events <-chan baremetal.ProgressEvent) []baremetal.ProgressEvent {
+	var got []baremetal.ProgressEvent
+	for e := range events {
+		got = append(got, e)
+	}
+	return got
+}
+
+// eventStates returns the states of the events of the given type
+func eventStates(events []baremetal.ProgressEvent, typ baremetal.ProgressType) []baremetal.State {
+	var states []baremetal.State
+	for _, e := range events {
+		if e.Type == typ {
+			states = append(states, e.State)
+		}
+	}
+	return states
+}
+
+func TestProgressEvents(t *testing.T) {
+	tb := newTestbed(t, []baremetal.Host{testHost("n1", "52:54:00:00:00:01", "10.0.1.1")}, nil)
+	events, unsubscribe := tb.p.Subscribe(256)
+
+	if err := tb.p.Provision(context.Background(), tb.host(t, "n1")); err != nil {
+		t.Fatalf("Provision: %v", err)
+	}
+	unsubscribe()
+	got := collect(events)
+	if len(got) == 0 {
+		t.Fatal("no progress events")
+	}
+
+	steps := []baremetal.State{
+		baremetal.StatePoweringOff,
+		baremetal.StateBootConfigured,
+		baremetal.StateBooting,
+		baremetal.StateInstalling,
+		baremetal.StatePostInstall,
+	}
+	if started := eventStates(got, baremetal.ProgressStepStarted); !reflect.DeepEqual(started, steps) {
+		t.Errorf("steps started = %v, want %v", started, steps)
+	}
+	if finished := eventStates(got, baremetal.ProgressStepFinished); !reflect.DeepEqual(finished, steps) {
+		t.Errorf("steps finished = %v, want %v", finished, steps)
+	}
+
+	percent := 0
+	for _, e := range got {
+		if e.Hostname != "n1" || e.MAC != "52:54:00:00:00:01" {
+			t.Errorf("event for %s %s, want n1", e.Hostname, e.MAC)
+		}
+		if e.Type == baremetal.ProgressStepFinished {
+			continue
+		}
+		if e.Percent < percent {
+			t.Errorf("%s event in %s went back to %d%% from %d%%", e.Type, e.State, e.Percent, percent)
+		}
+		percent = e.Percent
+	}
+
+	last := got[len(got)-1]
+	if last.Type != baremetal.ProgressPercent || last.State != baremetal.StateReady || last.Percent != 100 {
+		t.Errorf("last event = %s in %s at %d%%, want progress in ready at 100%%", last.Type, last.State, last.Percent)
+	}
+}
+
+func TestProgressError(t *testing.T) {
+	errBMC := errors.New("BMC unreachable")
+	tb := newTestbed(t, []baremetal.Host{testHost("n1", "52:54:00:00:00:01", "10.0.1.1")}, nil)
+	tb.bmcs.Get("10.0.1.1").Fail("PowerOn", errBMC)
+	events, unsubscribe := tb.p.Subscribe(256)
+
+	if err := tb.p.Provision(context.Background(), tb.host(t, "n1")); err == nil {
+		t.Fatal("Provision succeeded with a failing BMC")
+	}
+	unsubscribe()
+	got := collect(events)
+
+	last := got[len(got)-1]
+	if last.Type != baremetal.ProgressError || last.State != baremetal.StateFailed || !errors.Is(last.Err, errBMC) {
+		t.Errorf("last event = %s in %s with %v, want error in failed wrapping %v", last.Type, last.State, last.Err, errBMC)
+	}
+	for _, e := range got {
+		if e.Type == baremetal.ProgressStepFinished && e.State == baremetal.StateBooting {
+			t.Error("failed step reported as finished")
+		}
+	}
+}
+
+func TestStatusCallbacks(t *testing.T) {
+	tb := newTestbed(t, []baremetal.Host{testHost("n1", "52:54:00:00:00:01", "10.0.1.1")}, nil)
+
+	var statuses []string
+	tb.p.OnStatusUpdate(func(host *baremetal.Host, status, message string) {
+		if host.Hostname != "n1" {
+			t.Errorf("callback for host %s", host.Hostname)
+		}
+		// Callbacks may query the provisioner
+		if _, ok := tb.p.Status(host.Hostname); !ok {
+			t.Error("no status in callback")
+		}
+		if len(statuses) == 0 || statuses[len(statuses)-1] != status {
+			statuses = append(statuses, status)
+		}
+	})
+
+	if err := tb.p.Provision(context.Background(), tb.host(t, "n1")); err != nil {
+		t.Fatalf("Provision: %v", err)
+	}
+
+	want := []string{
+		string(baremetal.StateRegistered),
+		string(baremetal.StatePoweringOff),
+		string(baremetal.StateBootConfigured),
+		string(baremetal.StateBooting),
+		string(baremetal.StateInstalling),
+		string(baremetal.StatePostInstall),
+		string(baremetal.StateReady),
+	}
+	if !reflect.DeepEqual(statuses, want) {
+		t.Errorf("callback statuses = %v, want %v", statuses, want)
+	}
+}
+
+func TestSlowSubscriber(t *testing.T) {
+	tb := newTestbed(t, []baremetal.Host{testHost("n1", "52:54:00:00:00:01", "10.0.1.1")}, nil)
+
+	// A subscriber that never reads must not hold up provisioning
+	events, unsubscribe := tb.p.Subscribe(1)
+	defer unsubscribe()
+
+	if err := tb.p.Provision(context.Background(), tb.host(t, "n1")); err != nil {
+		t.Fatalf("Provision: %v", err)
+	}
+	if n := len(events); n != 1 {
+		t.Errorf("%d events buffered, want 1", n)
+	}
+}
@@ -0,0 +1,407 @@
+package baremetal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/nimbus-project/nimbus/pxe"
+)
+
+// provisionRun holds what a host's provisioning run acquires along the way
+type provisionRun struct {
+	host *Host
+
+	// BMC of the host once connected, nil if it has none
+	bmc       BMC
+	bmcDialed bool
+
+	// Network boot events, nil if boot progress is not tracked
+	events      <-chan pxe.Event
+	unsubscribe func()
+
+	// Slots limiting how many hosts network boot at once, nil if not
+	// limited
+	bootSlots chan struct{}
+	holdsSlot bool
+
+	// Phone-home watch of the host's installer, nil if it does not report
+	install *installWatch
+
+	// Address the host was leased while network booting
+	bootIP net.IP
+
+	// State the run was resumed in after a restart, "" for a new run
+	resumed State
+}
+
+// releaseBootSlot gives up the run's network boot slot, if it holds one
+func (r *provisionRun) releaseBootSlot() {
+	if r.holdsSlot {
+		<-r.bootSlots
+		r.holdsSlot = false
+	}
+}
+
+// close releases the BMC connection, boot event subscription and network
+// boot slot
+func (r *provisionRun) close() {
+	r.releaseBootSlot()
+	if r.unsubscribe != nil {
+		r.unsubscribe()
+	}
+	if r.bmc != nil {
+		if err := r.bmc.Close(); err != nil {
+			log.Debug().Err(err).Str("host", r.host.Hostname).Msg("Failed to close BMC connection")
+		}
+	}
+}
+
+// provisionStep is the work done while a host is in a state. Steps are
+// idempotent, so that a run interrupted part way through a step can resume
+// by running it again.
+type provisionStep struct {
+	state State
+	run   func(p *Provisioner, ctx context.Context, r *provisionRun) error
+
+	// replay is set for steps whose effects are lost when the process
+	// restarts but are needed until the host has been installed. They are
+	// run again when resuming at a later step before StatePostInstall.
+	replay bool
+}
+
+// provisionSteps are run in order, moving the host into each step's state
+// as it starts
+var provisionSteps = []provisionStep{
+	{state: StatePoweringOff, run: (*Provisioner).powerOffHost},
+	{state: StateBootConfigured, run: (*Provisioner).configurePXEBoot, replay: true},
+	{state: StateBooting, run: (*Provisioner).powerOnHost},
+	{state: StateInstalling, run: (*Provisioner).monitorInstallation},
+	{state: StatePostInstall, run: (*Provisioner).configurePostInstall},
+}
+
+// Provision provisions a bare metal server, taking it through the states
+// from StateRegistered to StateReady. Each state is bounded by its timeout
+// in [state_timeouts] and the whole run by the provisioning timeout. If
+// provisioning fails the host ends in StateFailed and the error is a
+// *StateError naming the state it failed in.
+//
+// If ctx is cancelled, for example when the process shuts down, the host is
+// left in the state it was in rather than failed. With a state store, a run
+// that was interrupted that way or by the process exiting is resumed: the steps it completed are skipped and the step it was in is run
+// again. Boot configuration, which the PXE server only keeps in memory, is
+// restored first if the host may still network boot, reusing the stored
+// phone-home and metadata tokens of the run.
+func (p *Provisioner) Provision(ctx context.Context, host *Host) error {
+	return p.provision(ctx, host, nil)
+}
+
+// provision runs a host's provisioning. If bootSlots is not nil, the host
+// holds a slot in it from network booting until it has been installed.
+func (p *Provisioner) provision(parent context.Context, host *Host, bootSlots chan struct{}) error {
+	// Create a context with timeout
+	ctx, cancel := context.WithTimeout(parent, time.Duration(p.config.Timeout))
+	defer cancel()
+
+	resume, err := p.register(ctx, host)
+	if err != nil {
+		return err
+	}
+	defer p.finish(host)
+
+	r := &provisionRun{host: host, resumed: resume}
+	if p.config.PXE.Enabled {
+		r.bootSlots = bootSlots
+	}
+	defer r.close()
+	if p.config.PXE.Enabled {
+		defer p.revokeBootTicket(host)
+		defer p.revokeInstallToken(host)
+	}
+
+	fail := func(state State, err error) error {
+		err = &StateError{Host: host.Hostname, State: state, Err: err}
+		// A run stopped by its caller has not failed and resumes later
+		if parent.Err() != nil {
+			log.Warn().Err(err).Str("host", host.Hostname).Str("state", string(state)).Msg("Provisioning interrupted")
+			return err
+		}
+		p.transition(ctx, host, StateFailed, err)
+		return err
+	}
+
+	resuming := resume != ""
+	current := StateRegistered
+	for _, step := range provisionSteps {
+		if resuming && step.state != resume {
+			if step.replay && stepIndex(resume) < stepIndex(StatePostInstall) {
+				p.logProgress(host, "Restoring %s after restart", step.state)
+				if err := p.runStep(ctx, step, r); err != nil {
+					return fail(resume, err)
+				}
+			}
+			continue
+		}
+
+		// Network booting and installing load the PXE server
+		if step.state == StateBooting || step.state == StateInstalling {
+			if err := p.acquireBootSlot(ctx, r); err != nil {
+				return fail(current, err)
+			}
+		}
+
+		if resuming {
+			resuming = false
+			p.logProgress(host, "Resuming %s after restart", step.state)
+		} else {
+			p.transition(ctx, host, step.state, nil)
+		}
+		current = step.state
+
+		if err := p.runStep(ctx, step, r); err != nil {
+			return fail(step.state, err)
+		}
+		if step.state == StateInstalling {
+			r.releaseBootSlot()
+		}
+	}
+
+	p.transition(ctx, host, StateReady, nil)
+	return nil
+}
+
+// acquireBootSlot waits for a slot to network boot from the PXE server, if
+// the run is limited and does not hold one yet
+func (p *Provisioner) acquireBootSlot(ctx context.Context, r *provisionRun) error {
+	if r.bootSlots == nil || r.holdsSlot {
+		return nil
+	}
+
+	select {
+	case r.bootSlots <- struct{}{}:
+	default:
+		p.logProgress(r.host, "Waiting for the PXE server to have room")
+		select {
+		case r.bootSlots <- struct{}{}:
+		case <-ctx.Done():
+			return fmt.Errorf("waiting for PXE server: %w", ctx.Err())
+		}
+	}
+	r.holdsSlot = true
+	return nil
+}
+
+// stepIndex returns the position of a state's step in provisionSteps, or -1
+// for states without a step
+func stepIndex(state State) int {
+	for i, step := range provisionSteps {
+		if step.state == state {
+			return i
+		}
+	}
+	return -1
+}
+
+// runStep runs a step under its state's timeout
+func (p *Provisioner) runStep(ctx context.Context, step provisionStep, r *provisionRun) error {
+	timeout := p.config.StateTimeouts.timeout(step.state)
+	stepCtx := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		stepCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	err := step.run(p, stepCtx, r)
+	if err != nil && ctx.Err() == nil && errors.Is(stepCtx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%w after %s: %v", ErrStateTimeout, timeout, err)
+	}
+	return err
+}
+
+// powerOffHost powers off a host through its BMC and waits until it is off
+func (p *Provisioner) powerOffHost(ctx context.Context, r *provisionRun) error {
+	bmc, err := p.runBMC(ctx, r)
+	if err != nil || bmc == nil {
+		return err
+	}
+
+	state, err := bmc.GetPowerState()
+	if err != nil {
+		return fmt.Errorf("failed to get power state: %w", err)
+	}
+	if isPowerOff(state) {
+		p.logProgress(r.host, "Host is already powered off")
+		return nil
+	}
+
+	p.logProgress(r.host, "Powering off host through BMC %s", r.host.BMC.Address)
+	if err := bmc.PowerOff(); err != nil {
+		return fmt.Errorf("failed to power off host: %w", err)
+	}
+	return waitForPowerOff(ctx, bmc)
+}
+
+// configurePXEBoot lets a host network boot its install profile and sets
+// its BMC to boot from the network
+func (p *Provisioner) configurePXEBoot(ctx context.Context, r *provisionRun) error {
+	host := r.host
+	if p.config.PXE.Enabled {
+		if err := p.grantBootTicket(host); err != nil {
+			return err
+		}
+
+		// The installer reports back with a token of this run. A resumed
+		// run reuses the tokens it had stored, since an installer that is
+		// already running holds them.
+		tokens := p.runTokens(host)
+		install, err := p.issueInstallToken(host, tokens.PhoneHome)
+		if err != nil {
+			return err
+		}
+		r.install = install
+
+		// Point the host at its cloud-init data
+		if err := p.issueMetadataToken(host, tokens.Metadata); err != nil {
+			return err
+		}
+		p.saveHostStatus(ctx, host)
+
+		// A previous run may have left the host on local boot
+		profile := p.config.installProfile(host)
+		if profile == "" {
+			profile = pxe.DefaultProfile
+		}
+		if err := p.selectProfile(host, profile); err != nil {
+			return err
+		}
+		p.logProgress(host, "Host will network boot profile %s", profile)
+	}
+
+	bmc, err := p.runBMC(ctx, r)
+	if err != nil {
+		return err
+	}
+	if bmc != nil {
+		if err := bmc.SetBootDevice(BootDevicePXE); err != nil {
+			return fmt.Errorf("failed to set boot device: %w", err)
+		}
+	}
+	return nil
+}
+
+// powerOnHost powers on a host and follows its network boot until it has
+// loaded its kernel. A host that is already running, for example because
+// the run is resuming, is powered off first so that its whole network boot
+// is seen.
+func (p *Provisioner) powerOnHost(ctx context.Context, r *provisionRun) error {
+	bmc, err := p.runBMC(ctx, r)
+	if err != nil {
+		return err
+	}
+	if bmc != nil {
+		state, err := bmc.GetPowerState()
+		if err != nil {
+			return fmt.Errorf("failed to get power state: %w", err)
+		}
+		if !isPowerOff(state) {
+			p.logProgress(r.host, "Host is already powered on, power cycling it")
+			if err := bmc.PowerOff(); err != nil {
+				return fmt.Errorf("failed to power off host: %w", err)
+			}
+			if err := waitForPowerOff(ctx, bmc); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Subscribe before powering on so that no boot events are missed
+	if p.config.PXE.Enabled && p.bootEvents != nil && r.events == nil {
+		r.events, r.unsubscribe = p.bootEvents.Subscribe(64)
+	}
+
+	if bmc != nil {
+		p.logProgress(r.host, "Powering on host through BMC %s", r.host.BMC.Address)
+		if err := bmc.PowerOn(); err != nil {
+			return fmt.Errorf("failed to power on host: %w", err)
+		}
+	}
+
+	if r.events != nil {
+		r.bootIP, err = p.waitForBoot(ctx, r.host, r.events)
+		return err
+	}
+	return nil
+}
+
+// configurePostInstall switches a host over to booting from its disk, so
+// that the reboot at the end of installation does not install it again
+func (p *Provisioner) configurePostInstall(ctx context.Context, r *provisionRun) error {
+	if p.config.PXE.Enabled {
+		if err := p.selectProfile(r.host, LocalBootProfile); err != nil {
+			return err
+		}
+		p.logProgress(r.host, "Host will boot from its disk")
+	}
+
+	bmc, err := p.runBMC(ctx, r)
+	if err != nil {
+		return err
+	}
+	if bmc != nil {
+		if err := bmc.SetBootDevice(BootDeviceDisk); err != nil {
+			return fmt.Errorf("failed to set boot device: %w", err)
+		}
+	}
+	return nil
+}
+
+// runTokens returns the tokens recorded for a host's current run, which
+// are only set if the run is resuming
+func (p *Provisioner) runTokens(host *Host) RunTokens {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if st, ok := p.status[host.Hostname]; ok {
+		return st.Tokens
+	}
+	return RunTokens{}
+}
+
+// runBMC returns the run's connection to the host's BMC, connecting on
+// first use. It returns nil if the host has no BMC.
+func (p *Provisioner) runBMC(ctx context.Context, r *provisionRun) (BMC, error) {
+	if r.bmcDialed {
+		return r.bmc, nil
+	}
+	bmc, err := p.connectBMC(ctx, r.host)
+	if err != nil {
+		return nil, err
+	}
+	r.bmc, r.bmcDialed = bmc, true
+	return bmc, nil
+}
+
+// selectProfile sets the profile a host network boots with, if boot
+// selection is enabled
+func (p *Provisioner) selectProfile(host *Host, profile string) error {
+	p.mu.Lock()
+	srv := p.selector
+	p.mu.Unlock()
+
+	if srv == nil || host.MAC == "" {
+		return nil
+	}
+	mac, err := net.ParseMAC(host.MAC)
+	if err != nil {
+		return fmt.Errorf("invalid MAC address for host %s: %w", host.Hostname, err)
+	}
+	if err := srv.SetHostProfile(mac.String(), profile); err != nil {
+		return fmt.Errorf("failed to set boot profile %s: %w", profile, err)
+	}
+	return nil
+}
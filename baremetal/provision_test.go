@@ -0,0 +1,236 @@
+package baremetal_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/nimbus-project/nimbus/baremetal"
+	"github.com/nimbus-project/nimbus/baremetal/baremetaltest"
+)
+
+// testbed is a provisioner wired to fake BMCs and a fake PXE server
+type testbed struct {
+	cfg  *baremetal.Config
+	p    *baremetal.Provisioner
+	bmcs *baremetaltest.FakeBMCs
+	pxe  *baremetaltest.FakePXE
+}
+
+// newTestbed creates a provisioner for the given hosts. Each BMC simulates
+// the network boot of its hosts when it is powered on. configure, if not nil,
+// adjusts the configuration before the provisioner is created.
+func newTestbed(t *testing.T, hosts []baremetal.Host, configure func(*baremetal.Config)) *testbed {
+	t.Helper()
+
+	cfg := &baremetal.Config{Hosts: hosts}
+	cfg.Network.Interface = "eth0"
+	cfg.PXE.Enabled = true
+	cfg.PXE.Kernel = "vmlinuz"
+	cfg.PXE.Initrd = "initrd.img"
+	cfg.Timeout = baremetal.Duration(10 * time.Second)
+	if configure != nil {
+		configure(cfg)
+	}
+
+	p, err := baremetal.NewProvisioner(cfg)
+	if err != nil {
+		t.Fatalf("NewProvisioner: %v", err)
+	}
+
+	tb := &testbed{cfg: cfg, p: p, bmcs: baremetaltest.NewFakeBMCs(), pxe: baremetaltest.NewFakePXE()}
+	p.SetBMCDialer(tb.bmcs.Dial)
+	p.SetBootEvents(tb.pxe)
+	p.EnableBootSelection(tb.pxe)
+	p.EnableBootAuthorization(tb.pxe)
+	p.EnableMetadata(tb.pxe)
+
+	// Hosts sharing a BMC, like the blades of a chassis, all boot when it
+	// powers on; only those being provisioned are listening
+	macs := make(map[string][]string)
+	for _, host := range cfg.Hosts {
+		if host.BMC.Address != "" {
+			macs[host.BMC.Address] = append(macs[host.BMC.Address], host.MAC)
+		}
+	}
+	for addr, list := range macs {
+		tb.bmcs.Get(addr).OnPowerOn = func() {
+			for _, mac := range list {
+				tb.pxe.Boot(mac)
+			}
+		}
+	}
+	return tb
+}
+
+// host returns the configured host with the given name
+func (tb *testbed) host(t *testing.T, hostname string) *baremetal.Host {
+	t.Helper()
+	for i := range tb.cfg.Hosts {
+		if tb.cfg.Hosts[i].Hostname == hostname {
+			return &tb.cfg.Hosts[i]
+		}
+	}
+	t.Fatalf("no host %s", hostname)
+	return nil
+}
+
+// testHost returns a host with a BMC
+func testHost(hostname, mac, bmc string) baremetal.Host {
+	h := baremetal.Host{Hostname: hostname, MAC: mac}
+	h.BMC.Address = bmc
+	return h
+}
+
+// transitionStates returns the states a host's transitions moved it to
+func transitionStates(st baremetal.HostStatus) []baremetal.State {
+	var states []baremetal.State
+	for _, tr := range st.Transitions {
+		states = append(states, tr.To)
+	}
+	return states
+}
+
+func TestProvisionStates(t *testing.T) {
+	tb := newTestbed(t, []baremetal.Host{testHost("n1", "52:54:00:00:00:01", "10.0.1.1")}, nil)
+	host := tb.host(t, "n1")
+
+	if err := tb.p.Provision(context.Background(), host); err != nil {
+		t.Fatalf("Provision: %v", err)
+	}
+
+	st, ok := tb.p.Status("n1")
+	if !ok {
+		t.Fatal("no status for n1")
+	}
+	want := []baremetal.State{
+		baremetal.StateRegistered,
+		baremetal.StatePoweringOff,
+		baremetal.StateBootConfigured,
+		baremetal.StateBooting,
+		baremetal.StateInstalling,
+		baremetal.StatePostInstall,
+		baremetal.StateReady,
+	}
+	if got := transitionStates(st); !reflect.DeepEqual(got, want) {
+		t.Errorf("transitions = %v, want %v", got, want)
+	}
+	if st.State != baremetal.StateReady || st.Percent != 100 || st.Err != nil {
+		t.Errorf("status = %s %d%% %v, want ready at 100%%", st.State, st.Percent, st.Err)
+	}
+
+	bmc := tb.bmcs.Get("10.0.1.1")
+	wantCalls := []string{
+		"Connect",
+		"GetPowerState",
+		"PowerOff",
+		"GetPowerState",
+		"SetBootDevice Pxe",
+		"GetPowerState",
+		"PowerOn",
+		"SetBootDevice Hdd",
+		"Close",
+	}
+	if got := bmc.Calls(); !reflect.DeepEqual(got, wantCalls) {
+		t.Errorf("BMC calls = %v, want %v", got, wantCalls)
+	}
+	if got := tb.pxe.HostProfile(host.MAC); got != baremetal.LocalBootProfile {
+		t.Errorf("boot profile = %q, want %q", got, baremetal.LocalBootProfile)
+	}
+	if tb.pxe.HasTicket(host.MAC) {
+		t.Error("boot ticket not revoked after provisioning")
+	}
+}
+
+func TestProvisionBMCFailure(t *testing.T) {
+	errBMC := errors.New("BMC unreachable")
+
+	tests := []struct {
+		method string
+		state  baremetal.State
+	}{
+		{method: "Connect", state: baremetal.StatePoweringOff},
+		{method: "PowerOff", state: baremetal.StatePoweringOff},
+		{method: "SetBootDevice", state: baremetal.StateBootConfigured},
+		{method: "PowerOn", state: baremetal.StateBooting},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			tb := newTestbed(t, []baremetal.Host{testHost("n1", "52:54:00:00:00:01", "10.0.1.1")}, nil)
+			tb.bmcs.Get("10.0.1.1").Fail(tt.method, errBMC)
+
+			err := tb.p.Provision(context.Background(), tb.host(t, "n1"))
+			var se *baremetal.StateError
+			if !errors.As(err, &se) {
+				t.Fatalf("err = %v, want a *StateError", err)
+			}
+			if se.State != tt.state || se.Host != "n1" {
+				t.Errorf("failed in %s on %s, want %s on n1", se.State, se.Host, tt.state)
+			}
+			if !errors.Is(err, errBMC) {
+				t.Errorf("err = %v, want it to wrap %v", err, errBMC)
+			}
+
+			st, _ := tb.p.Status("n1")
+			if st.State != baremetal.StateFailed || st.Err == nil {
+				t.Errorf("status = %s %v, want failed with an error", st.State, st.Err)
+			}
+			last := st.Transitions[len(st.Transitions)-1]
+			if last.From != tt.state || last.To != baremetal.StateFailed || last.Err == nil {
+				t.Errorf("last transition = %+v, want %s to failed with an error", last, tt.state)
+			}
+		})
+	}
+}
+
+func TestProvisionStateTimeout(t *testing.T) {
+	const timeout = baremetal.Duration(50 * time.Millisecond)
+
+	tests := []struct {
+		name      string
+		configure func(*baremetal.Config)
+		bmc       func(*baremetaltest.FakeBMC)
+		state     baremetal.State
+	}{
+		{
+			name:      "host never powers off",
+			configure: func(c *baremetal.Config) { c.StateTimeouts.PowerOff = timeout },
+			bmc:       func(b *baremetaltest.FakeBMC) { b.PowerOffPolls = 1000 },
+			state:     baremetal.StatePoweringOff,
+		},
+		{
+			name:      "host never network boots",
+			configure: func(c *baremetal.Config) { c.StateTimeouts.Booting = timeout },
+			bmc:       func(b *baremetaltest.FakeBMC) { b.OnPowerOn = nil },
+			state:     baremetal.StateBooting,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tb := newTestbed(t, []baremetal.Host{testHost("n1", "52:54:00:00:00:01", "10.0.1.1")}, tt.configure)
+			tt.bmc(tb.bmcs.Get("10.0.1.1"))
+
+			start := time.Now()
+			err := tb.p.Provision(context.Background(), tb.host(t, "n1"))
+			if !errors.Is(err, baremetal.ErrStateTimeout) {
+				t.Fatalf("err = %v, want %v", err, baremetal.ErrStateTimeout)
+			}
+			var se *baremetal.StateError
+			if !errors.As(err, &se) || se.State != tt.state {
+				t.Errorf("err = %v, want a failure in %s", err, tt.state)
+			}
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Errorf("provisioning took %s, state timeout not applied", elapsed)
+			}
+
+			st, _ := tb.p.Status("n1")
+			if st.State != baremetal.StateFailed {
+				t.Errorf("state = %s, want %s", st.State, baremetal.StateFailed)
+			}
+		})
+	}
+}
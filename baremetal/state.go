@@ -0,0 +1,290 @@
+package baremetal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// State is a host's position in the provisioning state machine. A host
+// moves through the states in the order they are declared, entering each
+// one as the provisioner starts on it, and ends in StateReady or
+// StateFailed.
+type State string
+
+// Provisioning states
+const (
+	// StateRegistered is a host that has been handed to Provision
+	StateRegistered State = "registered"
+
+	// StatePoweringOff is a host being powered off through its BMC
+	StatePoweringOff State = "powering_off"
+
+	// StateBootConfigured is a host whose network boot is being set up: its
+	// boot ticket, cloud-init data, install profile and BMC boot device
+	StateBootConfigured State = "boot_configured"
+
+	// StateBooting is a host that has been powered on and is network
+	// booting, until it has loaded its kernel
+	StateBooting State = "booting"
+
+	// StateInstalling is a host running its installer or deploy agent
+	StateInstalling State = "installing"
+
+	// StatePostInstall is a host being switched over to boot from its disk
+	StatePostInstall State = "post_install"
+
+	// StateReady is a host that has been provisioned
+	StateReady State = "ready"
+
+	// StateFailed is a host whose provisioning failed
+	StateFailed State = "failed"
+)
+
+// Terminal reports whether provisioning has ended in the state
+func (s State) Terminal() bool {
+	return s == StateReady || s == StateFailed
+}
+
+// ErrStateTimeout is returned when a host stays in a state for longer than
+// the state's timeout
+var ErrStateTimeout = errors.New("state timed out")
+
+// Default state timeouts, used for states without one in [state_timeouts].
+// Installing has none by default and is only bounded by the overall
+// provisioning timeout, since installation times vary too much.
+const (
+	defaultPowerOffTimeout    = 5 * time.Minute
+	defaultBootConfigTimeout  = 1 * time.Minute
+	defaultBootingTimeout     = 15 * time.Minute
+	defaultPostInstallTimeout = 10 * time.Minute
+)
+
+// StateTimeouts limits how long a host may stay in each provisioning state.
+// The overall provisioning timeout still applies on top of them.
+type StateTimeouts struct {
+	PowerOff    Duration `toml:"power_off"`
+	BootConfig  Duration `toml:"boot_config"`
+	Booting     Duration `toml:"booting"`
+	Installing  Duration `toml:"installing"`
+	PostInstall Duration `toml:"post_install"`
+}
+
+// timeout returns the timeout of a state, or 0 if it has none
+func (t *StateTimeouts) timeout(state State) time.Duration {
+	pick := func(d Duration, def time.Duration) time.Duration {
+		if d != 0 {
+			return time.Duration(d)
+		}
+		return def
+	}
+
+	switch state {
+	case StatePoweringOff:
+		return pick(t.PowerOff, defaultPowerOffTimeout)
+	case StateBootConfigured:
+		return pick(t.BootConfig, defaultBootConfigTimeout)
+	case StateBooting:
+		return pick(t.Booting, defaultBootingTimeout)
+	case StateInstalling:
+		return pick(t.Installing, 0)
+	case StatePostInstall:
+		return pick(t.PostInstall, defaultPostInstallTimeout)
+	}
+	return 0
+}
+
+// StateError is returned by Provision when provisioning fails, recording the
+// state the host failed in
+type StateError struct {
+	Host  string
+	State State
+	Err   error
+}
+
+func (e *StateError) Error() string {
+	return fmt.Sprintf("host %s failed in state %s: %v", e.Host, e.State, e.Err)
+}
+
+func (e *StateError) Unwrap() error {
+	return e.Err
+}
+
+// Transition records a host moving from one state to another
+type Transition struct {
+	From State
+	To   State
+	Time time.Time
+
+	// Err is why provisioning failed, for transitions to StateFailed
+	Err error
+}
+
+// HostStatus is where a host is in the provisioning state machine
+type HostStatus struct {
+	Hostname string
+	MAC      string
+
+	State State
+	Since time.Time
+
+	// Percent is the host's overall progress, from 0 to 100
+	Percent int
+
+	// Err is why provisioning failed, if State is StateFailed
+	Err error
+
+	// Transitions of the host's most recent provisioning run, oldest first
+	Transitions []Transition
+
+	// Tokens handed to the host by its current run. They are only passed
+	// to the state store, so that a resumed run keeps accepting the
+	// installer that is already running; Status and Statuses leave them
+	// empty.
+	Tokens RunTokens
+}
+
+// RunTokens are the secrets a provisioning run puts on a host's kernel
+// command line. They are cleared once the run ends.
+type RunTokens struct {
+	// PhoneHome is the token the installer reports its progress with
+	PhoneHome string
+
+	// Metadata is the token the host fetches its cloud-init data and
+	// answer file with
+	Metadata string
+}
+
+// Status returns the provisioning status of a host, or false if it has not
+// been provisioned since the provisioner was created
+func (p *Provisioner) Status(hostname string) (HostStatus, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	st, ok := p.status[hostname]
+	if !ok {
+		return HostStatus{}, false
+	}
+	return st.redacted(), true
+}
+
+// Statuses returns the provisioning status of every host that has been
+// provisioned, ordered by hostname
+func (p *Provisioner) Statuses() []HostStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	statuses := make([]HostStatus, 0, len(p.status))
+	for _, st := range p.status {
+		statuses = append(statuses, st.redacted())
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Hostname < statuses[j].Hostname })
+	return statuses
+}
+
+// register starts a provisioning run for a host. A host can only be
+// provisioned by one run at a time. If the host's last run was interrupted
+// before it ended, register returns the state it was in so that the run can
+// resume there; otherwise the host is put into StateRegistered and ""
+// returned.
+func (p *Provisioner) register(ctx context.Context, host *Host) (State, error) {
+	p.mu.Lock()
+	if p.running[host.Hostname] {
+		p.mu.Unlock()
+		return "", fmt.Errorf("host %s is already being provisioned", host.Hostname)
+	}
+	p.running[host.Hostname] = true
+
+	if st, ok := p.status[host.Hostname]; ok && !st.State.Terminal() && st.State != StateRegistered && st.MAC == host.MAC {
+		state := st.State
+		p.mu.Unlock()
+
+		log.Info().Str("host", host.Hostname).Str("state", string(state)).Msg("Resuming interrupted provisioning")
+		return state, nil
+	}
+
+	now := time.Now()
+	st := &HostStatus{
+		Hostname:    host.Hostname,
+		MAC:         host.MAC,
+		State:       StateRegistered,
+		Since:       now,
+		Transitions: []Transition{{To: StateRegistered, Time: now}},
+	}
+	p.status[host.Hostname] = st
+	snapshot := st.copy()
+	p.mu.Unlock()
+
+	log.Info().Str("host", host.Hostname).Str("state", string(StateRegistered)).Msg("Host registered for provisioning")
+	p.saveStatus(ctx, snapshot)
+	for _, e := range transitionEvents("", StateRegistered, 0, nil) {
+		p.emitProgress(host, e)
+	}
+	return "", nil
+}
+
+// finish ends a host's provisioning run
+func (p *Provisioner) finish(host *Host) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.running, host.Hostname)
+}
+
+// transition moves a host to a new state, records it in the state store and
+// emits the progress events of the move. err is the reason for moving to
+// StateFailed.
+func (p *Provisioner) transition(ctx context.Context, host *Host, to State, err error) {
+	p.mu.Lock()
+	st, ok := p.status[host.Hostname]
+	if !ok {
+		p.mu.Unlock()
+		return
+	}
+
+	now := time.Now()
+	from, elapsed := st.State, now.Sub(st.Since)
+	st.State, st.Since, st.Err = to, now, err
+	if to.Terminal() {
+		st.Tokens = RunTokens{}
+	}
+	st.Transitions = append(st.Transitions, Transition{From: from, To: to, Time: now, Err: err})
+	if r, ok := statePercent[to]; ok && r[0] > st.Percent {
+		st.Percent = r[0]
+	}
+	percent := st.Percent
+	snapshot := st.copy()
+	p.mu.Unlock()
+
+	ev := log.Info()
+	if err != nil {
+		ev = log.Error().Err(err)
+	}
+	ev.Str("host", host.Hostname).
+		Str("from", string(from)).
+		Str("to", string(to)).
+		Dur("elapsed", elapsed).
+		Msg("Host changed provisioning state")
+
+	p.saveStatus(ctx, snapshot)
+	for _, e := range transitionEvents(from, to, percent, err) {
+		p.emitProgress(host, e)
+	}
+}
+
+// copy returns a copy of the status that shares no memory with it
+func (st *HostStatus) copy() HostStatus {
+	c := *st
+	c.Transitions = append([]Transition(nil), st.Transitions...)
+	return c
+}
+
+// redacted returns a copy of the status without the run's tokens
+func (st *HostStatus) redacted() HostStatus {
+	c := st.copy()
+	c.Tokens = RunTokens{}
+	return c
+}
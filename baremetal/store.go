@@ -0,0 +1,321 @@
+package baremetal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/nimbus-project/nimbus/internal/atomicfile"
+)
+
+// storeTimeout bounds each write to the state store, which is made even
+// when the provisioning context has been cancelled
+const storeTimeout = 10 * time.Second
+
+// StateStore persists where each host is in the provisioning state
+// machine, so that provisioning can resume after the process restarts
+type StateStore interface {
+	// Save records a host's status and transition history, replacing any
+	// earlier record of the host
+	Save(ctx context.Context, status HostStatus) error
+
+	// Load returns the recorded status of every host
+	Load(ctx context.Context) ([]HostStatus, error)
+
+	// Close releases the store's resources
+	Close() error
+}
+
+// StateStoreConfig selects where provisioning state is persisted
+type StateStoreConfig struct {
+	// Type of store: "file" or "postgres". Empty keeps state in memory only.
+	Type string `toml:"type"`
+
+	// Path of the JSON document for the file store
+	Path string `toml:"path"`
+
+	// Connection string for the PostgreSQL store
+	DSN string `toml:"dsn"`
+}
+
+// validate checks the store configuration
+func (c *StateStoreConfig) validate() error {
+	switch c.Type {
+	case "":
+	case "file":
+		if c.Path == "" {
+			return fmt.Errorf("state store path is required")
+		}
+	case "postgres":
+		if c.DSN == "" {
+			return fmt.Errorf("state store dsn is required")
+		}
+	default:
+		return fmt.Errorf("unsupported state store type: %s", c.Type)
+	}
+	return nil
+}
+
+// OpenStateStore opens the state store described by cfg, or returns nil if
+// cfg does not name one
+func OpenStateStore(ctx context.Context, cfg StateStoreConfig) (StateStore, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	switch cfg.Type {
+	case "file":
+		return NewFileStore(cfg.Path), nil
+	case "postgres":
+		return OpenPostgresStore(ctx, cfg.DSN)
+	}
+	return nil, nil
+}
+
+// SetStateStore makes the provisioner record every state transition in
+// store and loads the statuses recorded there. Hosts whose last run had not
+// ended when it was recorded are resumed by the next Provision call for
+// them.
+func (p *Provisioner) SetStateStore(ctx context.Context, store StateStore) error {
+	statuses, err := store.Load(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to load provisioning state: %w", err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.store = store
+	for i := range statuses {
+		st := statuses[i]
+		if p.running[st.Hostname] {
+			continue
+		}
+		p.status[st.Hostname] = &st
+		if !st.State.Terminal() {
+			log.Info().Str("host", st.Hostname).Str("state", string(st.State)).Msg("Found interrupted provisioning run")
+		}
+	}
+	return nil
+}
+
+// saveStatus records a host's status in the state store, if there is one.
+// Failures are logged rather than failing provisioning, which only loses
+// the ability to resume.
+func (p *Provisioner) saveStatus(ctx context.Context, st HostStatus) {
+	p.mu.Lock()
+	store := p.store
+	p.mu.Unlock()
+
+	if store == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), storeTimeout)
+	defer cancel()
+	if err := store.Save(ctx, st); err != nil {
+		log.Error().Err(err).Str("host", st.Hostname).Str("state", string(st.State)).Msg("Failed to save provisioning state")
+	}
+}
+
+// saveHostStatus records a host's current status in the state store, for
+// changes made within a state
+func (p *Provisioner) saveHostStatus(ctx context.Context, host *Host) {
+	p.mu.Lock()
+	st, ok := p.status[host.Hostname]
+	if !ok {
+		p.mu.Unlock()
+		return
+	}
+	snapshot := st.copy()
+	p.mu.Unlock()
+
+	p.saveStatus(ctx, snapshot)
+}
+
+// statusRecord is the stored representation of a host status
+type statusRecord struct {
+	Hostname    string             `json:"hostname"`
+	MAC         string             `json:"mac,omitempty"`
+	State       State              `json:"state"`
+	Since       time.Time          `json:"since"`
+	Percent     int                `json:"percent"`
+	Error       string             `json:"error,omitempty"`
+	Transitions []transitionRecord `json:"transitions"`
+
+	PhoneHomeToken string `json:"phone_home_token,omitempty"`
+	MetadataToken  string `json:"metadata_token,omitempty"`
+}
+
+// transitionRecord is the stored representation of a transition
+type transitionRecord struct {
+	From  State     `json:"from,omitempty"`
+	To    State     `json:"to"`
+	Time  time.Time `json:"time"`
+	Error string    `json:"error,omitempty"`
+}
+
+// newStatusRecord converts a status into its stored form. Errors are kept
+// as their messages.
+func newStatusRecord(st HostStatus) statusRecord {
+	r := statusRecord{
+		Hostname:    st.Hostname,
+		MAC:         st.MAC,
+		State:       st.State,
+		Since:       st.Since.UTC(),
+		Percent:     st.Percent,
+		Error:       errorString(st.Err),
+		Transitions: make([]transitionRecord, 0, len(st.Transitions)),
+
+		PhoneHomeToken: st.Tokens.PhoneHome,
+		MetadataToken:  st.Tokens.Metadata,
+	}
+	for _, t := range st.Transitions {
+		r.Transitions = append(r.Transitions, transitionRecord{
+			From:  t.From,
+			To:    t.To,
+			Time:  t.Time.UTC(),
+			Error: errorString(t.Err),
+		})
+	}
+	return r
+}
+
+// status converts a stored status back
+func (r statusRecord) status() HostStatus {
+	st := HostStatus{
+		Hostname: r.Hostname,
+		MAC:      r.MAC,
+		State:    r.State,
+		Since:    r.Since,
+		Percent:  r.Percent,
+		Err:      stringError(r.Error),
+		Tokens: RunTokens{
+			PhoneHome: r.PhoneHomeToken,
+			Metadata:  r.MetadataToken,
+		},
+	}
+	for _, t := range r.Transitions {
+		st.Transitions = append(st.Transitions, Transition{
+			From: t.From,
+			To:   t.To,
+			Time: t.Time,
+			Err:  stringError(t.Error),
+		})
+	}
+	return st
+}
+
+// errorString returns the message of err, or "" if it is nil
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// stringError returns an error with the message s, or nil if s is empty
+func stringError(s string) error {
+	if s == "" {
+		return nil
+	}
+	return errors.New(s)
+}
+
+// FileStore is a StateStore keeping every host's status in a single JSON
+// document. Each save is written to a temporary file, synced and renamed
+// over the previous version, so a crash leaves either the old or the new
+// document on disk, never a mix. The document holds the tokens of runs in
+// progress and is only readable by its owner.
+type FileStore struct {
+	path string
+
+	mu      sync.Mutex
+	records map[string]statusRecord
+}
+
+// NewFileStore creates a file store at path. The file is created on the
+// first save.
+func NewFileStore(path string) *FileStore {
+	return &FileStore{path: path}
+}
+
+// Load implements StateStore. A missing file holds no statuses.
+func (f *FileStore) Load(ctx context.Context) ([]HostStatus, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.load(); err != nil {
+		return nil, err
+	}
+
+	statuses := make([]HostStatus, 0, len(f.records))
+	for _, r := range f.records {
+		statuses = append(statuses, r.status())
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Hostname < statuses[j].Hostname })
+	return statuses, nil
+}
+
+// Save implements StateStore
+func (f *FileStore) Save(ctx context.Context, st HostStatus) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.load(); err != nil {
+		return err
+	}
+	f.records[st.Hostname] = newStatusRecord(st)
+
+	records := make([]statusRecord, 0, len(f.records))
+	for _, r := range f.records {
+		records = append(records, r)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Hostname < records[j].Hostname })
+
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := atomicfile.WriteFile(f.path, data, 0o600); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	return nil
+}
+
+// Close implements StateStore
+func (f *FileStore) Close() error {
+	return nil
+}
+
+// load reads the document into memory the first time it is needed. The
+// caller must hold mu.
+func (f *FileStore) load() error {
+	if f.records != nil {
+		return nil
+	}
+
+	records := make(map[string]statusRecord)
+	data, err := os.ReadFile(f.path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read state file: %w", err)
+	}
+	if err == nil {
+		var list []statusRecord
+		if err := json.Unmarshal(data, &list); err != nil {
+			return fmt.Errorf("failed to parse state file %s: %w", f.path, err)
+		}
+		for _, r := range list {
+			records[r.Hostname] = r
+		}
+	}
+
+	f.records = records
+	return nil
+}
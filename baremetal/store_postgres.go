@@ -0,0 +1,199 @@
+package baremetal
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/golang-migrate/migrate/v4"
+	"github.com/golang-migrate/migrate/v4/database/postgres"
+	"github.com/golang-migrate/migrate/v4/source/iofs"
+	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq"
+)
+
+// migrationsTable records which of the store's migrations have been
+// applied, kept apart from the migrations of other components sharing the
+// database
+const migrationsTable = "baremetal_schema_migrations"
+
+//go:embed migrations/*.sql
+var migrations embed.FS
+
+// PostgresStore is a StateStore keeping host statuses and their transition
+// history in PostgreSQL
+type PostgresStore struct {
+	db *sqlx.DB
+}
+
+// hostStateRow is a row of baremetal_host_states
+type hostStateRow struct {
+	Hostname string    `db:"hostname"`
+	MAC      string    `db:"mac"`
+	State    string    `db:"state"`
+	Since    time.Time `db:"since"`
+	Percent  int       `db:"percent"`
+	Error    string    `db:"error"`
+
+	PhoneHomeToken string `db:"phone_home_token"`
+	MetadataToken  string `db:"metadata_token"`
+}
+
+// transitionRow is a row of baremetal_state_transitions
+type transitionRow struct {
+	Hostname string    `db:"hostname"`
+	Seq      int       `db:"seq"`
+	From     string    `db:"from_state"`
+	To       string    `db:"to_state"`
+	At       time.Time `db:"at"`
+	Error    string    `db:"error"`
+}
+
+// OpenPostgresStore connects to the database at dsn and brings its schema
+// up to date
+func OpenPostgresStore(ctx context.Context, dsn string) (*PostgresStore, error) {
+	db, err := sqlx.ConnectContext(ctx, "postgres", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to state database: %w", err)
+	}
+	if err := migrateSchema(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &PostgresStore{db: db}, nil
+}
+
+// migrateSchema applies the embedded migrations
+func migrateSchema(db *sqlx.DB) error {
+	src, err := iofs.New(migrations, "migrations")
+	if err != nil {
+		return fmt.Errorf("failed to read migrations: %w", err)
+	}
+	driver, err := postgres.WithInstance(db.DB, &postgres.Config{MigrationsTable: migrationsTable})
+	if err != nil {
+		return fmt.Errorf("failed to prepare migrations: %w", err)
+	}
+	m, err := migrate.NewWithInstance("iofs", src, "postgres", driver)
+	if err != nil {
+		return fmt.Errorf("failed to prepare migrations: %w", err)
+	}
+	if err := m.Up(); err != nil && !errors.Is(err, migrate.ErrNoChange) {
+		return fmt.Errorf("failed to migrate state database: %w", err)
+	}
+	return nil
+}
+
+// Save implements StateStore. The host's transitions are replaced as a
+// whole, since a new run starts a new history.
+func (s *PostgresStore) Save(ctx context.Context, st HostStatus) error {
+	r := newStatusRecord(st)
+
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.NamedExecContext(ctx, `
+		INSERT INTO baremetal_host_states (hostname, mac, state, since, percent, error, phone_home_token, metadata_token, updated_at)
+		VALUES (:hostname, :mac, :state, :since, :percent, :error, :phone_home_token, :metadata_token, now())
+		ON CONFLICT (hostname) DO UPDATE SET
+			mac = EXCLUDED.mac,
+			state = EXCLUDED.state,
+			since = EXCLUDED.since,
+			percent = EXCLUDED.percent,
+			error = EXCLUDED.error,
+			phone_home_token = EXCLUDED.phone_home_token,
+			metadata_token = EXCLUDED.metadata_token,
+			updated_at = EXCLUDED.updated_at`,
+		hostStateRow{
+			Hostname:       r.Hostname,
+			MAC:            r.MAC,
+			State:          string(r.State),
+			Since:          r.Since,
+			Percent:        r.Percent,
+			Error:          r.Error,
+			PhoneHomeToken: r.PhoneHomeToken,
+			MetadataToken:  r.MetadataToken,
+		})
+	if err != nil {
+		return fmt.Errorf("failed to save host state: %w", err)
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM baremetal_state_transitions WHERE hostname = $1`, r.Hostname); err != nil {
+		return fmt.Errorf("failed to save state transitions: %w", err)
+	}
+	if len(r.Transitions) > 0 {
+		rows := make([]transitionRow, 0, len(r.Transitions))
+		for i, t := range r.Transitions {
+			rows = append(rows, transitionRow{
+				Hostname: r.Hostname,
+				Seq:      i,
+				From:     string(t.From),
+				To:       string(t.To),
+				At:       t.Time,
+				Error:    t.Error,
+			})
+		}
+		_, err = tx.NamedExecContext(ctx, `
+			INSERT INTO baremetal_state_transitions (hostname, seq, from_state, to_state, at, error)
+			VALUES (:hostname, :seq, :from_state, :to_state, :at, :error)`, rows)
+		if err != nil {
+			return fmt.Errorf("failed to save state transitions: %w", err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Load implements StateStore
+func (s *PostgresStore) Load(ctx context.Context) ([]HostStatus, error) {
+	var hosts []hostStateRow
+	if err := s.db.SelectContext(ctx, &hosts, `
+		SELECT hostname, mac, state, since, percent, error, phone_home_token, metadata_token
+		FROM baremetal_host_states
+		ORDER BY hostname`); err != nil {
+		return nil, fmt.Errorf("failed to load host states: %w", err)
+	}
+
+	var transitions []transitionRow
+	if err := s.db.SelectContext(ctx, &transitions, `
+		SELECT hostname, seq, from_state, to_state, at, error
+		FROM baremetal_state_transitions
+		ORDER BY hostname, seq`); err != nil {
+		return nil, fmt.Errorf("failed to load state transitions: %w", err)
+	}
+	history := make(map[string][]transitionRecord)
+	for _, t := range transitions {
+		history[t.Hostname] = append(history[t.Hostname], transitionRecord{
+			From:  State(t.From),
+			To:    State(t.To),
+			Time:  t.At,
+			Error: t.Error,
+		})
+	}
+
+	statuses := make([]HostStatus, 0, len(hosts))
+	for _, h := range hosts {
+		statuses = append(statuses, statusRecord{
+			Hostname:    h.Hostname,
+			MAC:         h.MAC,
+			State:       State(h.State),
+			Since:       h.Since,
+			Percent:     h.Percent,
+			Error:       h.Error,
+			Transitions: history[h.Hostname],
+
+			PhoneHomeToken: h.PhoneHomeToken,
+			MetadataToken:  h.MetadataToken,
+		}.status())
+	}
+	return statuses, nil
+}
+
+// Close implements StateStore
+func (s *PostgresStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,243 @@
+package baremetal_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nimbus-project/nimbus/baremetal"
+)
+
+// crashStore stops saving once a host has reached a state, as if the
+// process had exited there
+type crashStore struct {
+	baremetal.StateStore
+	at baremetal.State
+
+	mu      sync.Mutex
+	crashed bool
+}
+
+func (s *crashStore) Save(ctx context.Context, st baremetal.HostStatus) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.crashed {
+		return nil
+	}
+	s.crashed = st.State == s.at
+	return s.StateStore.Save(ctx, st)
+}
+
+func TestFileStore(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "state.json")
+	now := time.Now().UTC().Truncate(time.Second)
+
+	want := baremetal.HostStatus{
+		Hostname: "n1",
+		MAC:      "52:54:00:00:00:01",
+		State:    baremetal.StateFailed,
+		Since:    now,
+		Percent:  10,
+		Err:      errors.New("BMC unreachable"),
+		Transitions: []baremetal.Transition{
+			{To: baremetal.StateRegistered, Time: now},
+			{From: baremetal.StateRegistered, To: baremetal.StatePoweringOff, Time: now},
+			{From: baremetal.StatePoweringOff, To: baremetal.StateFailed, Time: now, Err: errors.New("BMC unreachable")},
+		},
+	}
+	if err := baremetal.NewFileStore(path).Save(ctx, want); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	got, err := baremetal.NewFileStore(path).Load(ctx)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("loaded %d statuses, want 1", len(got))
+	}
+	st := got[0]
+	if st.Hostname != want.Hostname || st.MAC != want.MAC || st.State != want.State ||
+		!st.Since.Equal(want.Since) || st.Percent != want.Percent {
+		t.Errorf("loaded %+v, want %+v", st, want)
+	}
+	if st.Err == nil || st.Err.Error() != want.Err.Error() {
+		t.Errorf("loaded error %v, want %v", st.Err, want.Err)
+	}
+	if states := transitionStates(st); !reflect.DeepEqual(states, transitionStates(want)) {
+		t.Errorf("loaded transitions %v, want %v", states, transitionStates(want))
+	}
+	if last := st.Transitions[2]; last.Err == nil || last.From != baremetal.StatePoweringOff {
+		t.Errorf("loaded last transition %+v", last)
+	}
+
+	empty, err := baremetal.NewFileStore(filepath.Join(t.TempDir(), "missing.json")).Load(ctx)
+	if err != nil || len(empty) != 0 {
+		t.Errorf("missing file loaded %v, %v; want nothing", empty, err)
+	}
+}
+
+func TestProvisionResume(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "state.json")
+	hosts := []baremetal.Host{testHost("n1", "52:54:00:00:00:01", "10.0.1.1")}
+
+	// The first run dies once the host is booting
+	first := newTestbed(t, hosts, nil)
+	store := &crashStore{StateStore: baremetal.NewFileStore(path), at: baremetal.StateBooting}
+	if err := first.p.SetStateStore(ctx, store); err != nil {
+		t.Fatalf("SetStateStore: %v", err)
+	}
+	if err := first.p.Provision(ctx, first.host(t, "n1")); err != nil {
+		t.Fatalf("Provision: %v", err)
+	}
+
+	second := newTestbed(t, hosts, nil)
+	if err := second.p.SetStateStore(ctx, baremetal.NewFileStore(path)); err != nil {
+		t.Fatalf("SetStateStore: %v", err)
+	}
+	if st, _ := second.p.Status("n1"); st.State != baremetal.StateBooting {
+		t.Fatalf("restored state = %s, want %s", st.State, baremetal.StateBooting)
+	}
+	host := second.host(t, "n1")
+	if err := second.p.Provision(ctx, host); err != nil {
+		t.Fatalf("resumed Provision: %v", err)
+	}
+
+	st, _ := second.p.Status("n1")
+	want := []baremetal.State{
+		baremetal.StateRegistered,
+		baremetal.StatePoweringOff,
+		baremetal.StateBootConfigured,
+		baremetal.StateBooting,
+		baremetal.StateInstalling,
+		baremetal.StatePostInstall,
+		baremetal.StateReady,
+	}
+	if got := transitionStates(st); !reflect.DeepEqual(got, want) {
+		t.Errorf("transitions = %v, want %v", got, want)
+	}
+
+	// Boot configuration is restored and the running host power cycled
+	wantCalls := []string{
+		"Connect",
+		"SetBootDevice Pxe",
+		"GetPowerState",
+		"PowerOff",
+		"GetPowerState",
+		"PowerOn",
+		"SetBootDevice Hdd",
+		"Close",
+	}
+	if got := second.bmcs.Get("10.0.1.1").Calls(); !reflect.DeepEqual(got, wantCalls) {
+		t.Errorf("BMC calls = %v, want %v", got, wantCalls)
+	}
+	if got := second.pxe.HostProfile(host.MAC); got != baremetal.LocalBootProfile {
+		t.Errorf("boot profile = %q, want %q", got, baremetal.LocalBootProfile)
+	}
+
+	// The finished run is stored, so the next one starts over
+	third := newTestbed(t, hosts, nil)
+	if err := third.p.SetStateStore(ctx, baremetal.NewFileStore(path)); err != nil {
+		t.Fatalf("SetStateStore: %v", err)
+	}
+	if err := third.p.Provision(ctx, third.host(t, "n1")); err != nil {
+		t.Fatalf("Provision: %v", err)
+	}
+	if st, _ := third.p.Status("n1"); !reflect.DeepEqual(transitionStates(st), want) {
+		t.Errorf("transitions after completed run = %v, want a new run %v", transitionStates(st), want)
+	}
+}
+
+func TestProvisionResumeReplacedHost(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	first := newTestbed(t, []baremetal.Host{testHost("n1", "52:54:00:00:00:01", "10.0.1.1")}, nil)
+	store := &crashStore{StateStore: baremetal.NewFileStore(path), at: baremetal.StateInstalling}
+	if err := first.p.SetStateStore(ctx, store); err != nil {
+		t.Fatalf("SetStateStore: %v", err)
+	}
+	if err := first.p.Provision(ctx, first.host(t, "n1")); err != nil {
+		t.Fatalf("Provision: %v", err)
+	}
+
+	// A host with a new MAC address is a different machine and starts over
+	second := newTestbed(t, []baremetal.Host{testHost("n1", "52:54:00:00:00:02", "10.0.1.1")}, nil)
+	if err := second.p.SetStateStore(ctx, baremetal.NewFileStore(path)); err != nil {
+		t.Fatalf("SetStateStore: %v", err)
+	}
+	if err := second.p.Provision(ctx, second.host(t, "n1")); err != nil {
+		t.Fatalf("Provision: %v", err)
+	}
+	calls := second.bmcs.Get("10.0.1.1").Calls()
+	if len(calls) < 3 || calls[1] != "GetPowerState" || calls[2] != "PowerOff" {
+		t.Errorf("BMC calls = %v, want the host powered off first", calls)
+	}
+	st, _ := second.p.Status("n1")
+	if st.Transitions[0].To != baremetal.StateRegistered || len(st.Transitions) != 7 {
+		t.Errorf("transitions = %v, want a new run", transitionStates(st))
+	}
+}
+
+func TestProvisionResumeAfterCancel(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "state.json")
+	hosts := []baremetal.Host{testHost("n1", "52:54:00:00:00:01", "10.0.1.1")}
+
+	// The first run is stopped by its caller while the host is booting, as
+	// on a graceful shutdown
+	first := newTestbed(t, hosts, nil)
+	first.bmcs.Get("10.0.1.1").OnPowerOn = nil
+	if err := first.p.SetStateStore(ctx, baremetal.NewFileStore(path)); err != nil {
+		t.Fatalf("SetStateStore: %v", err)
+	}
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	first.p.OnStatusUpdate(func(host *baremetal.Host, status, message string) {
+		if status == string(baremetal.StateBooting) {
+			cancel()
+		}
+	})
+
+	err := first.p.Provision(runCtx, first.host(t, "n1"))
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want %v", err, context.Canceled)
+	}
+	if st, _ := first.p.Status("n1"); st.State != baremetal.StateBooting {
+		t.Errorf("state after cancel = %s, want %s", st.State, baremetal.StateBooting)
+	}
+	stored, err := baremetal.NewFileStore(path).Load(ctx)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if stored[0].State != baremetal.StateBooting {
+		t.Fatalf("stored state after cancel = %s, want %s", stored[0].State, baremetal.StateBooting)
+	}
+
+	second := newTestbed(t, hosts, nil)
+	if err := second.p.SetStateStore(ctx, baremetal.NewFileStore(path)); err != nil {
+		t.Fatalf("SetStateStore: %v", err)
+	}
+	if err := second.p.Provision(ctx, second.host(t, "n1")); err != nil {
+		t.Fatalf("resumed Provision: %v", err)
+	}
+	st, _ := second.p.Status("n1")
+	want := []baremetal.State{
+		baremetal.StateRegistered,
+		baremetal.StatePoweringOff,
+		baremetal.StateBootConfigured,
+		baremetal.StateBooting,
+		baremetal.StateInstalling,
+		baremetal.StatePostInstall,
+		baremetal.StateReady,
+	}
+	if got := transitionStates(st); !reflect.DeepEqual(got, want) {
+		t.Errorf("transitions = %v, want %v", got, want)
+	}
+}
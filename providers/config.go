@@ -1,6 +1,8 @@
 package providers
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"strings"
 )
@@ -47,6 +49,10 @@ type PXEConfig struct {
 	KernelURL   string `toml:"kernel_url,omitempty"`
 	InitrdURL   string `toml:"initrd_url,omitempty"`
 	Cmdline     string `toml:"cmdline,omitempty"`
+
+	// SHA-256 digests the downloaded kernel and initrd are verified against
+	KernelSHA256 string `toml:"kernel_sha256,omitempty"`
+	InitrdSHA256 string `toml:"initrd_sha256,omitempty"`
 }
 
 // BMCConfig holds Baseboard Management Controller configuration
@@ -101,8 +107,23 @@ func (c *Config) Validate() error {
 			if provider.PXE.InitrdURL == "" {
 				return fmt.Errorf("provider %s: pxe.initrd_url is required when pxe is enabled", key)
 			}
+			if !validSHA256(provider.PXE.KernelSHA256) {
+				return fmt.Errorf("provider %s: pxe.kernel_sha256 is not a valid SHA-256 digest", key)
+			}
+			if !validSHA256(provider.PXE.InitrdSHA256) {
+				return fmt.Errorf("provider %s: pxe.initrd_sha256 is not a valid SHA-256 digest", key)
+			}
 		}
 	}
 
 	return nil
-}
\ No newline at end of file
+}
+
+// validSHA256 reports whether s is empty or a hex encoded SHA-256 digest
+func validSHA256(s string) bool {
+	if s == "" {
+		return true
+	}
+	b, err := hex.DecodeString(s)
+	return err == nil && len(b) == sha256.Size
+}
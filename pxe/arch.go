@@ -0,0 +1,155 @@
+package pxe
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/nimbus-project/nimbus/pxe/dhcp4"
+)
+
+// Arch is a client system architecture as sent in DHCP option 93 (RFC 4578)
+type Arch uint16
+
+// Client architectures
+const (
+	ArchBIOS     Arch = 0
+	ArchEFIIA32  Arch = 6
+	ArchEFIX64   Arch = 7
+	ArchEFIBC    Arch = 9
+	ArchEFIARM32 Arch = 10
+	ArchEFIARM64 Arch = 11
+
+	// UEFI HTTP Boot clients
+	ArchEFIIA32HTTP  Arch = 15
+	ArchEFIX64HTTP   Arch = 16
+	ArchEFIBCHTTP    Arch = 17
+	ArchEFIARM32HTTP Arch = 18
+	ArchEFIARM64HTTP Arch = 19
+)
+
+// String returns a short name for the architecture
+func (a Arch) String() string {
+	switch a {
+	case ArchBIOS:
+		return "bios"
+	case ArchEFIIA32:
+		return "efi-ia32"
+	case ArchEFIX64:
+		return "efi-x64"
+	case ArchEFIBC:
+		return "efi-bc"
+	case ArchEFIARM32:
+		return "efi-arm32"
+	case ArchEFIARM64:
+		return "efi-arm64"
+	case ArchEFIIA32HTTP:
+		return "efi-ia32-http"
+	case ArchEFIX64HTTP:
+		return "efi-x64-http"
+	case ArchEFIBCHTTP:
+		return "efi-bc-http"
+	case ArchEFIARM32HTTP:
+		return "efi-arm32-http"
+	case ArchEFIARM64HTTP:
+		return "efi-arm64-http"
+	default:
+		return "arch-" + strconv.Itoa(int(a))
+	}
+}
+
+// IsEFI reports whether the architecture uses UEFI firmware
+func (a Arch) IsEFI() bool {
+	return a != ArchBIOS
+}
+
+// IsHTTP reports whether the architecture is a UEFI HTTP Boot client
+func (a Arch) IsHTTP() bool {
+	return a >= ArchEFIIA32HTTP && a <= ArchEFIARM64HTTP
+}
+
+// baseArch returns the PXE architecture an HTTP Boot client runs the same
+// loaders as
+func (a Arch) baseArch() Arch {
+	switch a {
+	case ArchEFIIA32HTTP:
+		return ArchEFIIA32
+	case ArchEFIX64HTTP:
+		return ArchEFIX64
+	case ArchEFIBCHTTP:
+		return ArchEFIBC
+	case ArchEFIARM32HTTP:
+		return ArchEFIARM32
+	case ArchEFIARM64HTTP:
+		return ArchEFIARM64
+	default:
+		return a
+	}
+}
+
+// defaultBootFiles maps each architecture to the file handed out when
+// Config.BootFiles has no entry for it
+var defaultBootFiles = map[Arch]string{
+	ArchBIOS:     "pxelinux.0",
+	ArchEFIIA32:  "bootia32.efi",
+	ArchEFIX64:   "bootx64.efi",
+	ArchEFIBC:    "bootx64.efi",
+	ArchEFIARM32: "bootarm.efi",
+	ArchEFIARM64: "bootaa64.efi",
+}
+
+// clientArch determines the architecture of a DHCP client from option 93,
+// falling back to the "PXEClient:Arch:xxxxx" vendor class sent by older ROMs
+func clientArch(req *dhcp4.Packet) Arch {
+	if v, ok := req.Options.Uint16(dhcp4.OptionClientArch); ok {
+		return Arch(v)
+	}
+
+	class := req.Options.String(dhcp4.OptionClassID)
+	if i := strings.Index(class, ":Arch:"); i >= 0 && len(class) >= i+11 {
+		if n, err := strconv.ParseUint(class[i+6:i+11], 10, 16); err == nil {
+			return Arch(n)
+		}
+	}
+
+	return ArchBIOS
+}
+
+// bootFile returns the boot file for an architecture. HTTP Boot clients use
+// the files of the matching PXE architecture unless Config.BootFiles has an
+// entry for them, which may also point at an ISO image.
+func (s *Server) bootFile(arch Arch) string {
+	if file, ok := s.config.BootFiles[arch]; ok {
+		return file
+	}
+	arch = arch.baseArch()
+	if file, ok := s.config.BootFiles[arch]; ok {
+		return file
+	}
+
+	switch {
+	case s.config.IPXE:
+		if file, ok := defaultIPXEBootFiles[arch]; ok {
+			return file
+		}
+	case s.config.GRUB:
+		if file, ok := defaultGRUBBootFiles[arch]; ok {
+			return file
+		}
+	}
+	if file, ok := defaultBootFiles[arch]; ok {
+		return file
+	}
+	return defaultBootFiles[ArchBIOS]
+}
+
+// reportedArch returns the architecture a client reported in its last DHCP
+// request, assuming x86-64 UEFI for clients that have not been seen
+func (s *Server) reportedArch(mac net.HardwareAddr) Arch {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if arch, ok := s.clientArchs[mac.String()]; ok {
+		return arch
+	}
+	return ArchEFIX64
+}
@@ -0,0 +1,488 @@
+package pxe
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/nimbus-project/nimbus/pxe/tftp"
+)
+
+const (
+	// artifactPath is the path prefix remote artifacts are served under.
+	// Each artifact is available as artifacts/<key>/<name>, where key is
+	// derived from its URL and digest and name is the last segment of the
+	// URL.
+	artifactPath = "artifacts/"
+
+	// artifactStoreDir is the directory below RootDir that holds downloaded
+	// artifacts named by their SHA-256 digest
+	artifactStoreDir = "cache/sha256"
+
+	// maxManifestSize bounds the size of a downloaded artifact manifest
+	maxManifestSize = 1 << 20
+
+	// defaultArtifactFetchTimeout bounds a download when
+	// Config.ArtifactFetchTimeout is not set
+	defaultArtifactFetchTimeout = 30 * time.Minute
+
+	// manifestFetchTimeout bounds downloading the manifest and its signature
+	manifestFetchTimeout = 30 * time.Second
+
+	// manifestRefreshInterval is how long an artifact missing from the
+	// manifest is looked up in the loaded copy before the manifest is
+	// downloaded again
+	manifestRefreshInterval = time.Minute
+)
+
+// ErrChecksumMismatch is returned when a downloaded artifact does not match
+// its expected SHA-256 digest
+var ErrChecksumMismatch = errors.New("artifact checksum mismatch")
+
+// ArtifactManifest lists the SHA-256 digests of remote artifacts. A manifest
+// is trusted if its detached ed25519 signature, served base64 encoded at the
+// manifest URL with ".sig" appended, verifies against the configured key.
+type ArtifactManifest struct {
+	Artifacts []ManifestEntry `json:"artifacts"`
+}
+
+// ManifestEntry is a single artifact in a manifest
+type ManifestEntry struct {
+	URL    string `json:"url"`
+	SHA256 string `json:"sha256"`
+}
+
+// ArtifactCache downloads remote kernels, initrds and images the first time
+// a client requests them, verifies their SHA-256 digest and stores them by
+// digest below RootDir. Least recently used artifacts are evicted when the
+// cache grows beyond its size limit.
+type ArtifactCache struct {
+	dir          string
+	maxSize      int64
+	client       *http.Client
+	fetchTimeout time.Duration
+
+	manifestURL string
+	manifestKey ed25519.PublicKey
+
+	mu       sync.Mutex
+	sources  map[string]artifactSource
+	fetches  map[string]*artifactFetch
+	manifest map[string]string
+	// When the manifest was last downloaded
+	manifestLoaded time.Time
+	// Last use of each stored artifact since startup, keyed by digest
+	used map[string]time.Time
+}
+
+// artifactSource is a registered remote artifact
+type artifactSource struct {
+	url    string
+	sha256 string
+}
+
+// artifactFetch tracks a download in progress so that concurrent requests
+// for the same artifact share it
+type artifactFetch struct {
+	done chan struct{}
+	err  error
+}
+
+// NewArtifactCache creates a cache storing artifacts below root. A maxSize
+// of zero disables eviction. If manifestURL is set, artifacts registered
+// without a digest are verified against the signed manifest at that URL.
+func NewArtifactCache(root string, maxSize int64, manifestURL string, manifestKey ed25519.PublicKey) (*ArtifactCache, error) {
+	if manifestURL != "" && len(manifestKey) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("artifact manifest requires an ed25519 public key")
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = 30 * time.Second
+
+	return &ArtifactCache{
+		dir:          filepath.Join(root, filepath.FromSlash(artifactStoreDir)),
+		maxSize:      maxSize,
+		client:       &http.Client{Transport: transport},
+		fetchTimeout: defaultArtifactFetchTimeout,
+		manifestURL:  manifestURL,
+		manifestKey:  manifestKey,
+		sources:      make(map[string]artifactSource),
+		fetches:      make(map[string]*artifactFetch),
+		used:         make(map[string]time.Time),
+	}, nil
+}
+
+// Register adds a remote artifact to the cache and returns the path clients
+// fetch it from over TFTP or HTTP. digest is the expected hex encoded
+// SHA-256 of the artifact and may only be empty if a manifest is configured.
+func (c *ArtifactCache) Register(rawURL, digest string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("invalid artifact URL %q", rawURL)
+	}
+
+	digest = strings.ToLower(digest)
+	if digest != "" {
+		if !validDigest(digest) {
+			return "", fmt.Errorf("invalid SHA-256 digest for %s", rawURL)
+		}
+	} else if c.manifestURL == "" {
+		return "", fmt.Errorf("no SHA-256 digest for %s and no artifact manifest configured", rawURL)
+	}
+
+	// The same URL may be registered with different digests, for example
+	// by profiles pinning different releases behind a "latest" link
+	sum := sha256.Sum256([]byte(rawURL + "\x00" + digest))
+	key := hex.EncodeToString(sum[:8])
+
+	name := path.Base(u.Path)
+	if name == "." || name == "/" {
+		name = "artifact"
+	}
+
+	c.mu.Lock()
+	c.sources[key] = artifactSource{url: rawURL, sha256: digest}
+	c.mu.Unlock()
+
+	return artifactPath + key + "/" + name, nil
+}
+
+// CacheArtifact registers a remote file, such as a disk image, with the
+// server's artifact cache and returns the path it is served from. A file
+// registered without a digest is looked up in the manifest within ctx, so
+// that one missing from it is reported now rather than when a client
+// fetches it.
+func (s *Server) CacheArtifact(ctx context.Context, rawURL, digest string) (string, error) {
+	p, err := s.artifacts.Register(rawURL, digest)
+	if err != nil {
+		return "", err
+	}
+	if digest == "" {
+		if _, err := s.artifacts.digest(ctx, artifactSource{url: rawURL}); err != nil {
+			return "", err
+		}
+	}
+	return p, nil
+}
+
+// Open returns the artifact for a path below artifacts/, downloading it
+// first if it is not cached
+func (c *ArtifactCache) Open(ctx context.Context, name string) (*os.File, int64, error) {
+	key, _, _ := strings.Cut(name, "/")
+
+	c.mu.Lock()
+	src, ok := c.sources[key]
+	c.mu.Unlock()
+	if !ok {
+		return nil, 0, tftp.ErrNotFound
+	}
+
+	digest, err := c.digest(ctx, src)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	f, size, err := c.openBlob(digest)
+	if err == nil {
+		return f, size, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, 0, err
+	}
+
+	if err := c.fetch(ctx, src.url, digest); err != nil {
+		return nil, 0, err
+	}
+	return c.openBlob(digest)
+}
+
+// digest returns the expected digest of an artifact, consulting the manifest
+// if none was registered. An artifact missing from the manifest may have
+// been published since it was loaded, so the manifest is downloaded again,
+// at most once per manifestRefreshInterval.
+func (c *ArtifactCache) digest(ctx context.Context, src artifactSource) (string, error) {
+	if src.sha256 != "" {
+		return src.sha256, nil
+	}
+
+	c.mu.Lock()
+	manifest, loaded := c.manifest, c.manifestLoaded
+	c.mu.Unlock()
+
+	if digest, ok := manifest[src.url]; ok {
+		return digest, nil
+	}
+	if manifest == nil || time.Since(loaded) >= manifestRefreshInterval {
+		var err error
+		if manifest, err = c.loadManifest(ctx); err != nil {
+			return "", err
+		}
+		c.mu.Lock()
+		c.manifest, c.manifestLoaded = manifest, time.Now()
+		c.mu.Unlock()
+	}
+
+	digest, ok := manifest[src.url]
+	if !ok {
+		return "", fmt.Errorf("artifact %s is not listed in the manifest", src.url)
+	}
+	return digest, nil
+}
+
+// loadManifest downloads the manifest and verifies its signature
+func (c *ArtifactCache) loadManifest(ctx context.Context) (map[string]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, manifestFetchTimeout)
+	defer cancel()
+
+	data, err := c.get(ctx, c.manifestURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download artifact manifest: %w", err)
+	}
+	sig, err := c.get(ctx, c.manifestURL+".sig")
+	if err != nil {
+		return nil, fmt.Errorf("failed to download artifact manifest signature: %w", err)
+	}
+
+	sig, err = base64.StdEncoding.DecodeString(strings.TrimSpace(string(sig)))
+	if err != nil || !ed25519.Verify(c.manifestKey, data, sig) {
+		return nil, fmt.Errorf("artifact manifest signature verification failed")
+	}
+
+	var m ArtifactManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("failed to parse artifact manifest: %w", err)
+	}
+
+	digests := make(map[string]string, len(m.Artifacts))
+	for _, e := range m.Artifacts {
+		digest := strings.ToLower(e.SHA256)
+		if !validDigest(digest) {
+			return nil, fmt.Errorf("invalid SHA-256 digest for %s in artifact manifest", e.URL)
+		}
+		digests[e.URL] = digest
+	}
+	return digests, nil
+}
+
+// get downloads a small document
+func (c *ArtifactCache) get(ctx context.Context, rawURL string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxManifestSize))
+}
+
+// openBlob opens a stored artifact and marks it as recently used
+func (c *ArtifactCache) openBlob(digest string) (*os.File, int64, error) {
+	f, err := os.Open(filepath.Join(c.dir, digest))
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+
+	c.mu.Lock()
+	c.used[digest] = time.Now()
+	c.mu.Unlock()
+
+	return f, info.Size(), nil
+}
+
+// fetch downloads an artifact, sharing the download with concurrent callers
+// asking for the same digest
+func (c *ArtifactCache) fetch(ctx context.Context, rawURL, digest string) error {
+	c.mu.Lock()
+	if f, ok := c.fetches[digest]; ok {
+		c.mu.Unlock()
+		select {
+		case <-f.done:
+			return f.err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	f := &artifactFetch{done: make(chan struct{})}
+	c.fetches[digest] = f
+	c.mu.Unlock()
+
+	// The download is not tied to the first caller's context since other
+	// clients may be waiting for it, but it must not hang forever on a
+	// stalled source
+	dctx, cancel := context.WithTimeout(context.Background(), c.fetchTimeout)
+	f.err = c.download(dctx, rawURL, digest)
+	cancel()
+
+	c.mu.Lock()
+	delete(c.fetches, digest)
+	c.mu.Unlock()
+	close(f.done)
+
+	if f.err == nil {
+		c.evict(digest)
+	}
+	return f.err
+}
+
+// download fetches an artifact into the store, verifying its digest before
+// moving it into place
+func (c *ArtifactCache) download(ctx context.Context, rawURL, digest string) error {
+	if err := os.MkdirAll(c.dir, 0o755); err != nil {
+		return err
+	}
+
+	log.Info().Str("url", rawURL).Str("sha256", digest).Msg("Downloading boot artifact")
+	start := time.Now()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to download %s: %w", rawURL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to download %s: unexpected status %s", rawURL, resp.Status)
+	}
+
+	tmp, err := os.CreateTemp(c.dir, ".download-*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	defer os.Remove(tmpName)
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, h), resp.Body)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to download %s: %w", rawURL, err)
+	}
+
+	if got := hex.EncodeToString(h.Sum(nil)); got != digest {
+		log.Error().Str("url", rawURL).Str("expected", digest).Str("actual", got).Msg("Boot artifact checksum mismatch")
+		return fmt.Errorf("%w: %s", ErrChecksumMismatch, rawURL)
+	}
+
+	if err := os.Chmod(tmpName, 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpName, filepath.Join(c.dir, digest)); err != nil {
+		return err
+	}
+
+	log.Info().
+		Str("url", rawURL).
+		Int64("bytes", n).
+		Dur("duration", time.Since(start)).
+		Msg("Boot artifact cached")
+
+	return nil
+}
+
+// evict removes the least recently used artifacts until the cache fits its
+// size limit. keep is never evicted. Clients still reading an evicted file
+// are unaffected since they hold it open.
+func (c *ArtifactCache) evict(keep string) {
+	if c.maxSize <= 0 {
+		return
+	}
+
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return
+	}
+
+	type blob struct {
+		name string
+		size int64
+		used time.Time
+	}
+	var (
+		blobs []blob
+		total int64
+	)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		// Artifacts not used since startup are ordered by download time
+		used, ok := c.used[e.Name()]
+		if !ok {
+			used = info.ModTime()
+		}
+		blobs = append(blobs, blob{e.Name(), info.Size(), used})
+		total += info.Size()
+	}
+
+	sort.Slice(blobs, func(i, j int) bool { return blobs[i].used.Before(blobs[j].used) })
+	for _, b := range blobs {
+		if total <= c.maxSize {
+			break
+		}
+		if b.name == keep {
+			continue
+		}
+		if err := os.Remove(filepath.Join(c.dir, b.name)); err != nil {
+			log.Warn().Err(err).Str("sha256", b.name).Msg("Failed to evict boot artifact")
+			continue
+		}
+		log.Debug().Str("sha256", b.name).Int64("bytes", b.size).Msg("Evicted boot artifact")
+		delete(c.used, b.name)
+		total -= b.size
+	}
+}
+
+// isRemoteArtifact reports whether a boot file location is a URL that must
+// be fetched through the artifact cache
+func isRemoteArtifact(p string) bool {
+	return strings.HasPrefix(p, "http://") || strings.HasPrefix(p, "https://")
+}
+
+// validDigest reports whether s is a hex encoded SHA-256 digest
+func validDigest(s string) bool {
+	b, err := hex.DecodeString(s)
+	return err == nil && len(b) == sha256.Size
+}
@@ -0,0 +1,201 @@
+package pxe
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// artifactOrigin serves artifacts and a manifest signed with its own key
+type artifactOrigin struct {
+	*httptest.Server
+	key ed25519.PrivateKey
+
+	mu        sync.Mutex
+	files     map[string][]byte
+	listed    []ManifestEntry
+	manifests int
+}
+
+func newArtifactOrigin(t *testing.T) *artifactOrigin {
+	t.Helper()
+
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := &artifactOrigin{key: key, files: make(map[string][]byte)}
+	o.Server = httptest.NewServer(http.HandlerFunc(o.serve))
+	t.Cleanup(o.Close)
+	return o
+}
+
+func (o *artifactOrigin) serve(w http.ResponseWriter, r *http.Request) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	switch r.URL.Path {
+	case "/manifest.json", "/manifest.json.sig":
+		data, _ := json.Marshal(ArtifactManifest{Artifacts: o.listed})
+		if strings.HasSuffix(r.URL.Path, ".sig") {
+			io.WriteString(w, base64.StdEncoding.EncodeToString(ed25519.Sign(o.key, data)))
+			return
+		}
+		o.manifests++
+		w.Write(data)
+	default:
+		data, ok := o.files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+	}
+}
+
+// publish adds a file to the origin and lists it in the manifest
+func (o *artifactOrigin) publish(name string, data []byte) string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.files["/"+name] = data
+	sum := sha256.Sum256(data)
+	o.listed = append(o.listed, ManifestEntry{URL: o.URL + "/" + name, SHA256: hex.EncodeToString(sum[:])})
+	return o.URL + "/" + name
+}
+
+func (o *artifactOrigin) manifestLoads() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.manifests
+}
+
+func (o *artifactOrigin) cache(t *testing.T) *ArtifactCache {
+	t.Helper()
+
+	c, err := NewArtifactCache(t.TempDir(), 0, o.URL+"/manifest.json", o.key.Public().(ed25519.PublicKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func readArtifact(t *testing.T, c *ArtifactCache, p string) ([]byte, error) {
+	t.Helper()
+
+	f, _, err := c.Open(context.Background(), strings.TrimPrefix(p, artifactPath))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+func TestArtifactManifestRefreshedOnMiss(t *testing.T) {
+	o := newArtifactOrigin(t)
+	c := o.cache(t)
+
+	first := o.publish("vmlinuz-1", []byte("kernel 1"))
+	p, err := c.Register(first, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := readArtifact(t, c, p); err != nil || string(data) != "kernel 1" {
+		t.Fatalf("read %q, %v", data, err)
+	}
+
+	// An artifact published after the manifest was loaded is found once
+	// the loaded copy is old enough to be refreshed
+	second := o.publish("vmlinuz-2", []byte("kernel 2"))
+	p, err = c.Register(second, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readArtifact(t, c, p); err == nil {
+		t.Fatal("artifact found before the manifest could be refreshed")
+	}
+	if got := o.manifestLoads(); got != 1 {
+		t.Fatalf("manifest downloaded %d times within the refresh interval", got)
+	}
+
+	c.mu.Lock()
+	c.manifestLoaded = c.manifestLoaded.Add(-manifestRefreshInterval)
+	c.mu.Unlock()
+	if data, err := readArtifact(t, c, p); err != nil || string(data) != "kernel 2" {
+		t.Fatalf("read %q, %v after the manifest was refreshed", data, err)
+	}
+	if got := o.manifestLoads(); got != 2 {
+		t.Fatalf("manifest downloaded %d times, want 2", got)
+	}
+}
+
+func TestArtifactChecksumMismatch(t *testing.T) {
+	o := newArtifactOrigin(t)
+	c := o.cache(t)
+
+	u := o.publish("initrd.img", []byte("initrd"))
+	p, err := c.Register(u, strings.Repeat("0", 64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readArtifact(t, c, p); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("err = %v, want ErrChecksumMismatch", err)
+	}
+}
+
+func TestArtifactFetchTimeout(t *testing.T) {
+	release := make(chan struct{})
+	stalled := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		<-release
+	}))
+	defer stalled.Close()
+	defer close(release)
+
+	c, err := NewArtifactCache(t.TempDir(), 0, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.fetchTimeout = 100 * time.Millisecond
+
+	p, err := c.Register(stalled.URL+"/image.raw", strings.Repeat("0", 64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, err := readArtifact(t, c, p); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want a deadline error", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("stalled download took %s to give up", d)
+	}
+}
+
+func TestCacheArtifactChecksManifest(t *testing.T) {
+	o := newArtifactOrigin(t)
+	s := newTestServer(t, Config{
+		ArtifactManifestURL: o.URL + "/manifest.json",
+		ArtifactManifestKey: o.key.Public().(ed25519.PublicKey),
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	u := o.publish("disk.qcow2", []byte("image"))
+	if _, err := s.CacheArtifact(ctx, u, ""); err != nil {
+		t.Fatalf("listed artifact: %v", err)
+	}
+	if _, err := s.CacheArtifact(ctx, o.URL+"/missing.qcow2", ""); err == nil {
+		t.Fatal("artifact missing from the manifest accepted")
+	}
+}
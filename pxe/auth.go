@@ -0,0 +1,231 @@
+package pxe
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/nimbus-project/nimbus/pxe/dhcp4"
+)
+
+const (
+	// bootTokenParam is the query parameter boot tokens are passed in
+	bootTokenParam = "boot_token"
+
+	// defaultBootTokenTTL is used when Config.BootTokenTTL is not set
+	defaultBootTokenTTL = 5 * time.Minute
+)
+
+// bootToken is a single-use token for fetching one path over HTTP
+type bootToken struct {
+	mac     string
+	path    string
+	expires time.Time
+}
+
+// GrantTicket allows a host that is not known to network boot for ttl,
+// for example while it is being provisioned or discovered. Granting a
+// ticket again extends it.
+func (s *Server) GrantTicket(mac string, ttl time.Duration) error {
+	key, err := normalizeMAC(mac)
+	if err != nil || key == "" {
+		return fmt.Errorf("invalid MAC address %q", mac)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tickets[key] = time.Now().Add(ttl)
+	return nil
+}
+
+// RevokeTicket withdraws a host's provisioning ticket and any boot tokens
+// issued to it
+func (s *Server) RevokeTicket(mac string) error {
+	key, err := normalizeMAC(mac)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.tickets, key)
+	for token, bt := range s.bootTokens {
+		if bt.mac == key {
+			delete(s.bootTokens, token)
+		}
+	}
+	return nil
+}
+
+// Authorized reports whether a host may network boot: it is known, from
+// Config.KnownHosts, a reservation, a profile assignment or SetHostKnown,
+// or it holds an unexpired ticket. All hosts are authorized unless
+// Config.RequireAuthorization is set.
+func (s *Server) Authorized(mac string) bool {
+	if !s.config.RequireAuthorization {
+		return true
+	}
+	key, err := normalizeMAC(mac)
+	if err != nil || key == "" {
+		return false
+	}
+	if s.profiles.IsKnown(key) {
+		return true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	expires, ok := s.tickets[key]
+	if ok && time.Now().After(expires) {
+		delete(s.tickets, key)
+		return false
+	}
+	return ok
+}
+
+// authorizedClient reports whether the client last acknowledged with the
+// address of remote may network boot. Clients whose address was neither
+// assigned through this server nor, in proxy mode, seen being requested
+// cannot be identified and are refused.
+func (s *Server) authorizedClient(remote net.Addr) bool {
+	if !s.config.RequireAuthorization {
+		return true
+	}
+	mac := s.ClientMAC(addrIP(remote))
+	return mac != nil && s.Authorized(mac.String())
+}
+
+// requestedByHost reports whether a per-host boot configuration for mac may
+// be served to remote. The configurations carry the host's kernel arguments,
+// which may hold its tokens, so they are refused to an address known to
+// belong to another host. Addresses leased elsewhere, by an external DHCP
+// server or through SLAAC, cannot be attributed and are served unless
+// authorization is required.
+func (s *Server) requestedByHost(mac net.HardwareAddr, remote net.Addr) bool {
+	client := s.ClientMAC(addrIP(remote))
+	if client == nil {
+		return !s.config.RequireAuthorization
+	}
+	return client.String() == mac.String()
+}
+
+// authorizeDHCP reports whether a DHCP request may be answered
+func (s *Server) authorizeDHCP(req *dhcp4.Packet) bool {
+	if s.Authorized(req.CHAddr.String()) {
+		return true
+	}
+	log.Warn().Str("mac", req.CHAddr.String()).Msg("Ignoring DHCP request from unauthorized host")
+	return false
+}
+
+// authorizeHTTP is a Middleware refusing requests from clients that are not
+// authorized, unless they present a boot token for the requested path
+func (s *Server) authorizeHTTP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var remote net.Addr
+		if addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil {
+			remote = addr
+		}
+		if !s.authorizedClient(remote) && !s.validBootToken(r, false) {
+			log.Warn().Str("path", r.URL.Path).Str("remote", r.RemoteAddr).Msg("Refusing HTTP request from unauthorized host")
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// IssueBootToken returns a token that allows a single request for path on
+// the HTTP server. It expires after Config.BootTokenTTL. A host's unused
+// token for the same path is returned again with a renewed expiry, so
+// repeated DHCP exchanges do not pile up tokens.
+func (s *Server) IssueBootToken(mac, path string) (string, error) {
+	key, err := normalizeMAC(mac)
+	if err != nil || key == "" {
+		return "", fmt.Errorf("invalid MAC address %q", mac)
+	}
+
+	ttl := s.config.BootTokenTTL
+	if ttl == 0 {
+		ttl = defaultBootTokenTTL
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Tokens handed out in replies the client ignored are never used
+	now := time.Now()
+	token := ""
+	for t, bt := range s.bootTokens {
+		switch {
+		case now.After(bt.expires):
+			delete(s.bootTokens, t)
+		case bt.mac == key && bt.path == path:
+			token = t
+		}
+	}
+	if token == "" {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			return "", fmt.Errorf("failed to generate boot token: %w", err)
+		}
+		token = hex.EncodeToString(b)
+	}
+	s.bootTokens[token] = bootToken{mac: key, path: path, expires: now.Add(ttl)}
+	return token, nil
+}
+
+// BootTokenURL returns the URL of path on the HTTP server carrying a boot
+// token issued to the host with the given MAC address
+func (s *Server) BootTokenURL(mac, path string) (string, error) {
+	token, err := s.IssueBootToken(mac, path)
+	if err != nil {
+		return "", err
+	}
+	return s.hostURL(mac, path) + "?" + bootTokenParam + "=" + url.QueryEscape(token), nil
+}
+
+// RequireBootToken is a Middleware that serves each request only with a
+// boot token issued for its path, and consumes the token
+func (s *Server) RequireBootToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.validBootToken(r, true) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// validBootToken reports whether a request carries an unexpired boot token
+// for its path. The token is consumed if consume is set.
+func (s *Server) validBootToken(r *http.Request, consume bool) bool {
+	got := r.URL.Query().Get(bootTokenParam)
+	if got == "" {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bt, ok := s.bootTokens[got]
+	if !ok {
+		return false
+	}
+	if time.Now().After(bt.expires) {
+		delete(s.bootTokens, got)
+		return false
+	}
+	if bt.path != r.URL.Path {
+		return false
+	}
+	if consume {
+		delete(s.bootTokens, got)
+	}
+	return true
+}
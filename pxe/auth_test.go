@@ -0,0 +1,56 @@
+package pxe
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// bootTokenOf returns the boot token carried by u
+func bootTokenOf(t *testing.T, u string) string {
+	t.Helper()
+	parsed, err := url.Parse(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := parsed.Query().Get(bootTokenParam)
+	if token == "" {
+		t.Fatalf("%s carries no boot token", u)
+	}
+	return token
+}
+
+func TestBootTokenReused(t *testing.T) {
+	s := newTestServer(t, Config{Kernel: "vmlinuz", IPXE: true, RequireAuthorization: true, KnownHosts: []string{testMAC.String()}})
+
+	// Every DHCP reply carries the script URL, so repeated exchanges must
+	// not mint a token each
+	first := bootTokenOf(t, s.ipxeScriptURL(testMAC))
+	if again := bootTokenOf(t, s.ipxeScriptURL(testMAC)); again != first {
+		t.Errorf("second URL carries token %s, want %s", again, first)
+	}
+	if n := len(s.bootTokens); n != 1 {
+		t.Errorf("%d boot tokens issued, want 1", n)
+	}
+
+	other, err := s.IssueBootToken(testMAC.String(), "/other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other == first {
+		t.Error("token reused for another path")
+	}
+
+	// Once used the token is gone and a new one is issued
+	h := s.RequireBootToken(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	req := httptest.NewRequest(http.MethodGet, ipxeScriptPath+testMAC.String()+"?"+bootTokenParam+"="+first, nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d, want %d", rec.Code, http.StatusOK)
+	}
+	if next := bootTokenOf(t, s.ipxeScriptURL(testMAC)); next == first {
+		t.Error("used token issued again")
+	}
+}
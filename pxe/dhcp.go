@@ -0,0 +1,332 @@
+package pxe
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/nimbus-project/nimbus/pxe/dhcp4"
+)
+
+const (
+	// defaultLeaseTime is used when Config.LeaseTime is not set
+	defaultLeaseTime = time.Hour
+
+	// offerHoldTime is how long an offered address is reserved for a client
+	// that has not yet sent a DHCPREQUEST
+	offerHoldTime = time.Minute
+
+	// pxeClientClass is the vendor class identifier used by PXE clients
+	pxeClientClass = "PXEClient"
+)
+
+// ServeDHCP answers a DHCP request. It implements dhcp4.Handler so the
+// allocation and boot logic can be driven directly, without sockets.
+func (s *Server) ServeDHCP(req *dhcp4.Packet, peer net.Addr) *dhcp4.Packet {
+	if !s.authorizeDHCP(req) {
+		return nil
+	}
+	s.recordClient(req)
+	resp := s.handleDHCP(req)
+	s.emitDHCP(req, resp)
+	return resp
+}
+
+// handleDHCP dispatches a DHCP request by message type to the address pool
+// of the subnet it comes from
+func (s *Server) handleDHCP(req *dhcp4.Packet) *dhcp4.Packet {
+	if s.config.ProxyDHCP {
+		if req.MessageType() == dhcp4.Request {
+			s.handleProxyRequest(req)
+			return nil
+		}
+		return s.handleProxyDiscover(req)
+	}
+	if len(req.CHAddr) == 0 {
+		return nil
+	}
+	pool, sn := s.selectSubnet(req)
+	if pool == nil {
+		return nil
+	}
+	claimPortReservation(pool, req)
+
+	switch req.MessageType() {
+	case dhcp4.Discover:
+		return s.handleDiscover(req, pool, sn)
+	case dhcp4.Request:
+		return s.handleRequest(req, pool, sn)
+	case dhcp4.Release:
+		log.Debug().Str("mac", req.CHAddr.String()).Str("ip", req.CIAddr.String()).Msg("DHCP lease released")
+		pool.release(req.CHAddr, req.CIAddr)
+	case dhcp4.Decline:
+		ip := req.Options.IP(dhcp4.OptionRequestedIP)
+		log.Warn().Str("mac", req.CHAddr.String()).Str("ip", ip.String()).Msg("DHCP address declined by client")
+		pool.decline(req.CHAddr, ip)
+	case dhcp4.Inform:
+		return s.handleInform(req, sn)
+	}
+
+	return nil
+}
+
+// handleDiscover offers an address to a client
+func (s *Server) handleDiscover(req *dhcp4.Packet, pool *leasePool, sn *subnet) *dhcp4.Packet {
+	lease, err := pool.offer(req.CHAddr, req.Options.IP(dhcp4.OptionRequestedIP), offerHoldTime)
+	if err != nil {
+		log.Warn().Err(err).Str("mac", req.CHAddr.String()).Msg("Unable to offer DHCP lease")
+		return nil
+	}
+
+	resp := dhcp4.NewReply(req, dhcp4.Offer)
+	resp.YIAddr = lease.IP
+	s.addNetworkOptions(req, resp, sn)
+	addHostName(resp, lease)
+	s.addBootOptions(req, resp)
+
+	log.Debug().
+		Str("mac", req.CHAddr.String()).
+		Str("ip", lease.IP.String()).
+		Str("arch", clientArch(req).String()).
+		Msg("DHCP offer")
+
+	return resp
+}
+
+// handleRequest acknowledges or refuses a client's request for an address
+func (s *Server) handleRequest(req *dhcp4.Packet, pool *leasePool, sn *subnet) *dhcp4.Packet {
+	// A server identifier that is not ours means the client accepted another
+	// server's offer, so drop any address we were holding for it
+	if id := req.Options.IP(dhcp4.OptionServerID); id != nil && !id.Equal(s.serverIP()) {
+		if lease, ok := pool.lookup(req.CHAddr); ok && lease.State == LeaseOffered {
+			pool.release(req.CHAddr, lease.IP)
+		}
+		return nil
+	}
+
+	// Clients in SELECTING or INIT-REBOOT state send the address in option
+	// 50, while RENEWING and REBINDING clients fill in ciaddr
+	ip := req.Options.IP(dhcp4.OptionRequestedIP)
+	if ip == nil {
+		ip = req.CIAddr
+	}
+	if ip == nil || ip.IsUnspecified() {
+		return nil
+	}
+
+	// Stay silent for addresses outside our range so that another server
+	// on the segment can answer an INIT-REBOOT client
+	if !pool.owns(ip) {
+		if req.Options.Has(dhcp4.OptionServerID) {
+			return s.nak(req, "requested address is not in range")
+		}
+		return nil
+	}
+
+	lease, err := pool.bind(req.CHAddr, ip, req.Options.String(dhcp4.OptionHostName), s.leaseTime())
+	if err != nil {
+		log.Debug().Err(err).Str("mac", req.CHAddr.String()).Str("ip", ip.String()).Msg("DHCP request refused")
+		return s.nak(req, err.Error())
+	}
+
+	resp := dhcp4.NewReply(req, dhcp4.Ack)
+	resp.CIAddr = req.CIAddr
+	resp.YIAddr = lease.IP
+	s.addNetworkOptions(req, resp, sn)
+	addHostName(resp, lease)
+	s.addBootOptions(req, resp)
+
+	log.Info().
+		Str("mac", req.CHAddr.String()).
+		Str("ip", lease.IP.String()).
+		Time("expiry", lease.Expiry).
+		Msg("DHCP lease bound")
+
+	return resp
+}
+
+// handleInform returns configuration to a client that already has an address
+func (s *Server) handleInform(req *dhcp4.Packet, sn *subnet) *dhcp4.Packet {
+	resp := dhcp4.NewReply(req, dhcp4.Ack)
+	resp.CIAddr = req.CIAddr
+	s.addNetworkOptions(req, resp, sn)
+	// DHCPINFORM replies must not carry lease times (RFC 2131 section 4.3.5)
+	delete(resp.Options, dhcp4.OptionLeaseTime)
+	delete(resp.Options, dhcp4.OptionRenewalTime)
+	delete(resp.Options, dhcp4.OptionRebindingTime)
+	s.addBootOptions(req, resp)
+	return resp
+}
+
+// nak builds a DHCPNAK reply
+func (s *Server) nak(req *dhcp4.Packet, msg string) *dhcp4.Packet {
+	resp := dhcp4.NewReply(req, dhcp4.Nak)
+	resp.Options.SetIP(dhcp4.OptionServerID, s.serverIP())
+	resp.Options.SetString(dhcp4.OptionMessage, msg)
+	return resp
+}
+
+// addNetworkOptions sets the server identifier, lease times and network
+// configuration options on a reply. Clients on a relayed subnet get that
+// subnet's mask, router and DNS servers.
+func (s *Server) addNetworkOptions(req, resp *dhcp4.Packet, sn *subnet) {
+	leaseTime := s.leaseTime()
+
+	resp.Options.SetIP(dhcp4.OptionServerID, s.serverIP())
+	resp.Options.SetDuration(dhcp4.OptionLeaseTime, leaseTime)
+	resp.Options.SetDuration(dhcp4.OptionRenewalTime, leaseTime/2)
+	resp.Options.SetDuration(dhcp4.OptionRebindingTime, leaseTime*7/8)
+
+	mask, gateway, dns := s.config.Netmask, s.config.Gateway, s.config.DNSServers
+	if sn != nil {
+		mask, gateway = sn.Network.Mask, sn.Gateway
+		if gateway == nil && !req.GIAddr.IsUnspecified() {
+			gateway = req.GIAddr
+		}
+		if len(sn.DNSServers) > 0 {
+			dns = sn.DNSServers
+		}
+	}
+
+	if len(mask) == net.IPv6len {
+		mask = mask[12:]
+	}
+	if len(mask) == net.IPv4len {
+		resp.Options[dhcp4.OptionSubnetMask] = []byte(mask)
+	}
+	if gateway != nil {
+		resp.Options.SetIP(dhcp4.OptionRouter, gateway)
+	}
+	if len(dns) > 0 {
+		resp.Options.SetIPs(dhcp4.OptionDomainNameServer, dns)
+	}
+
+	s.mu.Lock()
+	ntp := s.ntpServers
+	s.mu.Unlock()
+	if len(ntp) > 0 {
+		resp.Options.SetIPs(dhcp4.OptionNTPServers, ntp)
+	}
+}
+
+// addHostName sets option 12 for clients with a reserved hostname
+func addHostName(resp *dhcp4.Packet, lease *Lease) {
+	if lease.Reserved && lease.Hostname != "" {
+		resp.Options.SetString(dhcp4.OptionHostName, lease.Hostname)
+	}
+}
+
+// addBootOptions sets the next-server and boot file options on replies to
+// PXE clients, choosing the boot file by client architecture. Clients that
+// are already running iPXE are handed the URL of their boot script instead,
+// and UEFI HTTP Boot clients the URL of their boot file.
+func (s *Server) addBootOptions(req, resp *dhcp4.Packet) {
+	httpBoot := isHTTPBootClient(req)
+	if !isPXEClient(req) && !httpBoot {
+		return
+	}
+
+	file := s.bootFile(clientArch(req))
+	if isIPXEClient(req) {
+		file = s.ipxeScriptURL(req.CHAddr)
+	}
+
+	// HTTP Boot clients only accept offers that identify as HTTPClient and
+	// never talk to a TFTP server
+	if httpBoot {
+		file = s.httpURL(file)
+		resp.File = file
+		resp.Options.SetString(dhcp4.OptionClassID, httpClientClass)
+		resp.Options.SetString(dhcp4.OptionBootFileName, file)
+		return
+	}
+
+	serverIP := s.serverIP()
+	resp.SIAddr = serverIP
+	resp.File = file
+	resp.Options.SetString(dhcp4.OptionClassID, pxeClientClass)
+	resp.Options.SetString(dhcp4.OptionTFTPServerName, serverIP.String())
+	resp.Options.SetString(dhcp4.OptionBootFileName, file)
+
+	// PXE clients expect the machine identifier to be echoed back
+	if v := req.Options.Get(dhcp4.OptionClientMachineID); v != nil {
+		resp.Options[dhcp4.OptionClientMachineID] = v
+	}
+}
+
+// recordClient remembers the SMBIOS UUID and architecture a PXE client
+// reported, and that it boots over IPv4, so they are known when it fetches
+// its boot configuration
+func (s *Server) recordClient(req *dhcp4.Packet) {
+	if v := req.Options.Get(dhcp4.OptionClientMachineID); v != nil {
+		s.recordClientUUID(req.CHAddr, v)
+	}
+	if isPXEClient(req) || isHTTPBootClient(req) {
+		s.mu.Lock()
+		s.clientArchs[req.CHAddr.String()] = clientArch(req).baseArch()
+		delete(s.ipv6Clients, req.CHAddr.String())
+		s.mu.Unlock()
+	}
+}
+
+// leaseTime returns the configured lease duration
+func (s *Server) leaseTime() time.Duration {
+	if s.config.LeaseTime > 0 {
+		return s.config.LeaseTime
+	}
+	return defaultLeaseTime
+}
+
+// serverIP returns the address the server identifies itself with
+func (s *Server) serverIP() net.IP {
+	if s.config.IP != nil {
+		return s.config.IP
+	}
+	return net.IPv4zero
+}
+
+// resolveNTP resolves the configured NTP server, which may be a hostname,
+// into the addresses required by option 42
+func (s *Server) resolveNTP(ctx context.Context) {
+	if s.config.NTP == "" {
+		return
+	}
+
+	var ips []net.IP
+	if ip := net.ParseIP(s.config.NTP); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		lookupCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		addrs, err := net.DefaultResolver.LookupIP(lookupCtx, "ip4", s.config.NTP)
+		if err != nil {
+			log.Warn().Err(err).Str("ntp", s.config.NTP).Msg("Failed to resolve NTP server, option 42 disabled")
+			return
+		}
+		ips = addrs
+	}
+
+	s.mu.Lock()
+	s.ntpServers = ips
+	s.mu.Unlock()
+}
+
+// interfaceIPv4 returns the first IPv4 address and netmask of an interface
+func interfaceIPv4(name string) (net.IP, net.IPMask, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+			return ipnet.IP.To4(), ipnet.Mask, nil
+		}
+	}
+	return nil, nil, &net.AddrError{Err: "no IPv4 address", Addr: name}
+}
@@ -0,0 +1,26 @@
+package dhcp4
+
+import (
+	"net"
+	"syscall"
+)
+
+// listenConfig returns a ListenConfig that binds the socket to iface using
+// SO_BINDTODEVICE
+func listenConfig(iface string) *net.ListenConfig {
+	return &net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+				if sockErr == nil && iface != "" {
+					sockErr = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, iface)
+				}
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+}
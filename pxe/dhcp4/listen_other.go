@@ -0,0 +1,11 @@
+//go:build !linux
+
+package dhcp4
+
+import "net"
+
+// listenConfig returns a default ListenConfig. Binding to an interface is only
+// supported on Linux, so iface is ignored.
+func listenConfig(iface string) *net.ListenConfig {
+	return &net.ListenConfig{}
+}
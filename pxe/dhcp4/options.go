@@ -0,0 +1,235 @@
+package dhcp4
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+)
+
+// OptionCode identifies a DHCP option
+type OptionCode uint8
+
+// DHCP options used by the PXE server
+const (
+	OptionPad                  OptionCode = 0
+	OptionSubnetMask           OptionCode = 1
+	OptionRouter               OptionCode = 3
+	OptionDomainNameServer     OptionCode = 6
+	OptionHostName             OptionCode = 12
+	OptionDomainName           OptionCode = 15
+	OptionBroadcastAddress     OptionCode = 28
+	OptionNTPServers           OptionCode = 42
+	OptionVendorSpecific       OptionCode = 43
+	OptionRequestedIP          OptionCode = 50
+	OptionLeaseTime            OptionCode = 51
+	OptionOverload             OptionCode = 52
+	OptionMessageType          OptionCode = 53
+	OptionServerID             OptionCode = 54
+	OptionParameterRequestList OptionCode = 55
+	OptionMessage              OptionCode = 56
+	OptionMaxMessageSize       OptionCode = 57
+	OptionRenewalTime          OptionCode = 58
+	OptionRebindingTime        OptionCode = 59
+	OptionClassID              OptionCode = 60
+	OptionClientID             OptionCode = 61
+	OptionTFTPServerName       OptionCode = 66
+	OptionBootFileName         OptionCode = 67
+	OptionUserClass            OptionCode = 77
+	OptionRelayAgentInfo       OptionCode = 82
+	OptionClientArch           OptionCode = 93
+	OptionClientNDI            OptionCode = 94
+	OptionClientMachineID      OptionCode = 97
+	OptionEnd                  OptionCode = 255
+)
+
+// Options holds the options of a DHCP message keyed by code
+type Options map[OptionCode][]byte
+
+// Get returns the raw value of an option, or nil if it is not present
+func (o Options) Get(code OptionCode) []byte {
+	if o == nil {
+		return nil
+	}
+	return o[code]
+}
+
+// Has reports whether an option is present
+func (o Options) Has(code OptionCode) bool {
+	_, ok := o[code]
+	return ok
+}
+
+// String returns the value of an option as a string
+func (o Options) String(code OptionCode) string {
+	return string(o.Get(code))
+}
+
+// IP returns the value of an option holding a single IPv4 address
+func (o Options) IP(code OptionCode) net.IP {
+	if v := o.Get(code); len(v) == net.IPv4len {
+		return net.IP(append([]byte(nil), v...))
+	}
+	return nil
+}
+
+// Uint16 returns the value of an option holding a 16-bit integer
+func (o Options) Uint16(code OptionCode) (uint16, bool) {
+	if v := o.Get(code); len(v) >= 2 {
+		return binary.BigEndian.Uint16(v), true
+	}
+	return 0, false
+}
+
+// SetString sets an option to a string value
+func (o Options) SetString(code OptionCode, s string) {
+	o[code] = []byte(s)
+}
+
+// SetIP sets an option to a single IPv4 address
+func (o Options) SetIP(code OptionCode, ip net.IP) {
+	o[code] = append([]byte(nil), ip4(ip)...)
+}
+
+// SetIPs sets an option to a list of IPv4 addresses
+func (o Options) SetIPs(code OptionCode, ips []net.IP) {
+	v := make([]byte, 0, len(ips)*net.IPv4len)
+	for _, ip := range ips {
+		if ip.To4() == nil {
+			continue
+		}
+		v = append(v, ip.To4()...)
+	}
+	if len(v) > 0 {
+		o[code] = v
+	}
+}
+
+// SetUint16 sets an option to a 16-bit integer
+func (o Options) SetUint16(code OptionCode, n uint16) {
+	v := make([]byte, 2)
+	binary.BigEndian.PutUint16(v, n)
+	o[code] = v
+}
+
+// SetDuration sets an option to a duration in seconds as a 32-bit integer
+func (o Options) SetDuration(code OptionCode, d time.Duration) {
+	v := make([]byte, 4)
+	binary.BigEndian.PutUint32(v, uint32(d/time.Second))
+	o[code] = v
+}
+
+// merge appends the values of other to o, concatenating repeated options
+func (o Options) merge(other Options) {
+	for code, v := range other {
+		o[code] = append(o[code], v...)
+	}
+}
+
+// parseOptions decodes an options field. Options that appear more than once
+// are concatenated as described in RFC 3396.
+func parseOptions(b []byte) (Options, error) {
+	opts := make(Options)
+	for i := 0; i < len(b); {
+		code := OptionCode(b[i])
+		switch code {
+		case OptionPad:
+			i++
+			continue
+		case OptionEnd:
+			return opts, nil
+		}
+
+		if i+1 >= len(b) {
+			return nil, fmt.Errorf("truncated option %d", code)
+		}
+		n := int(b[i+1])
+		if i+2+n > len(b) {
+			return nil, fmt.Errorf("option %d overflows packet", code)
+		}
+		opts[code] = append(opts[code], b[i+2:i+2+n]...)
+		i += 2 + n
+	}
+	return opts, nil
+}
+
+// marshal appends the encoded options to b. The message type is always
+// written first since some PXE ROMs expect it there; long values are split
+// across multiple instances of the option (RFC 3396).
+func (o Options) marshal(b []byte) []byte {
+	codes := make([]int, 0, len(o))
+	for code := range o {
+		if code == OptionPad || code == OptionEnd || code == OptionMessageType {
+			continue
+		}
+		codes = append(codes, int(code))
+	}
+	sort.Ints(codes)
+
+	if v, ok := o[OptionMessageType]; ok {
+		b = appendOption(b, OptionMessageType, v)
+	}
+	for _, code := range codes {
+		b = appendOption(b, OptionCode(code), o[OptionCode(code)])
+	}
+	return b
+}
+
+// appendOption appends a single option to b
+func appendOption(b []byte, code OptionCode, v []byte) []byte {
+	if len(v) == 0 {
+		return append(b, byte(code), 0)
+	}
+	for len(v) > 0 {
+		n := len(v)
+		if n > 255 {
+			n = 255
+		}
+		b = append(b, byte(code), byte(n))
+		b = append(b, v[:n]...)
+		v = v[n:]
+	}
+	return b
+}
+
+// Relay agent information sub-options (RFC 3046)
+const (
+	RelayCircuitID = 1
+	RelayRemoteID  = 2
+)
+
+// RelayAgentInfo identifies where a relayed request entered the network:
+// the circuit, typically a switch port, and the relay agent itself
+type RelayAgentInfo struct {
+	CircuitID []byte
+	RemoteID  []byte
+}
+
+// RelayAgentInfo decodes option 82. It returns false if the option is
+// absent or malformed.
+func (o Options) RelayAgentInfo() (RelayAgentInfo, bool) {
+	b, ok := o[OptionRelayAgentInfo]
+	if !ok {
+		return RelayAgentInfo{}, false
+	}
+
+	var info RelayAgentInfo
+	for i := 0; i < len(b); {
+		if i+1 >= len(b) {
+			return RelayAgentInfo{}, false
+		}
+		code, n := b[i], int(b[i+1])
+		if i+2+n > len(b) {
+			return RelayAgentInfo{}, false
+		}
+		switch code {
+		case RelayCircuitID:
+			info.CircuitID = b[i+2 : i+2+n]
+		case RelayRemoteID:
+			info.RemoteID = b[i+2 : i+2+n]
+		}
+		i += 2 + n
+	}
+	return info, true
+}
@@ -0,0 +1,240 @@
+// Package dhcp4 implements DHCPv4 message encoding (RFC 2131, RFC 2132) and a
+// minimal UDP server loop. Address allocation and boot policy are left to the
+// Handler.
+package dhcp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// BOOTP operation codes
+const (
+	BootRequest uint8 = 1
+	BootReply   uint8 = 2
+)
+
+// FlagBroadcast is set by clients that cannot receive unicast replies before
+// their IP address is configured
+const FlagBroadcast uint16 = 0x8000
+
+// Well known ports
+const (
+	ServerPort = 67
+	ClientPort = 68
+)
+
+// MessageType is the value of option 53
+type MessageType uint8
+
+// DHCP message types
+const (
+	Discover MessageType = 1
+	Offer    MessageType = 2
+	Request  MessageType = 3
+	Decline  MessageType = 4
+	Ack      MessageType = 5
+	Nak      MessageType = 6
+	Release  MessageType = 7
+	Inform   MessageType = 8
+)
+
+// String returns the name of the message type
+func (t MessageType) String() string {
+	switch t {
+	case Discover:
+		return "DHCPDISCOVER"
+	case Offer:
+		return "DHCPOFFER"
+	case Request:
+		return "DHCPREQUEST"
+	case Decline:
+		return "DHCPDECLINE"
+	case Ack:
+		return "DHCPACK"
+	case Nak:
+		return "DHCPNAK"
+	case Release:
+		return "DHCPRELEASE"
+	case Inform:
+		return "DHCPINFORM"
+	default:
+		return fmt.Sprintf("DHCP(%d)", uint8(t))
+	}
+}
+
+// magicCookie marks the start of the options field
+var magicCookie = []byte{99, 130, 83, 99}
+
+const (
+	// headerLen is the length of the fixed BOOTP header including the cookie
+	headerLen = 240
+
+	// minPacketLen is the minimum BOOTP message size some clients insist on
+	minPacketLen = 300
+)
+
+// Packet is a DHCPv4 message
+type Packet struct {
+	Op      uint8
+	HType   uint8
+	HLen    uint8
+	Hops    uint8
+	XID     uint32
+	Secs    uint16
+	Flags   uint16
+	CIAddr  net.IP
+	YIAddr  net.IP
+	SIAddr  net.IP
+	GIAddr  net.IP
+	CHAddr  net.HardwareAddr
+	SName   string
+	File    string
+	Options Options
+}
+
+// Unmarshal parses a DHCPv4 message
+func Unmarshal(b []byte) (*Packet, error) {
+	if len(b) < headerLen {
+		return nil, fmt.Errorf("packet too short: %d bytes", len(b))
+	}
+	if !bytes.Equal(b[236:240], magicCookie) {
+		return nil, fmt.Errorf("missing DHCP magic cookie")
+	}
+
+	p := &Packet{
+		Op:     b[0],
+		HType:  b[1],
+		HLen:   b[2],
+		Hops:   b[3],
+		XID:    binary.BigEndian.Uint32(b[4:8]),
+		Secs:   binary.BigEndian.Uint16(b[8:10]),
+		Flags:  binary.BigEndian.Uint16(b[10:12]),
+		CIAddr: net.IP(append([]byte(nil), b[12:16]...)),
+		YIAddr: net.IP(append([]byte(nil), b[16:20]...)),
+		SIAddr: net.IP(append([]byte(nil), b[20:24]...)),
+		GIAddr: net.IP(append([]byte(nil), b[24:28]...)),
+	}
+
+	hlen := int(p.HLen)
+	if hlen > 16 {
+		return nil, fmt.Errorf("invalid hardware address length %d", hlen)
+	}
+	p.CHAddr = net.HardwareAddr(append([]byte(nil), b[28:28+hlen]...))
+
+	opts, err := parseOptions(b[headerLen:])
+	if err != nil {
+		return nil, err
+	}
+
+	// Option 52 allows the sname and file fields to carry options
+	sname, file := b[44:108], b[108:236]
+	if overload := opts.Get(OptionOverload); len(overload) == 1 {
+		if overload[0]&1 != 0 {
+			extra, err := parseOptions(file)
+			if err != nil {
+				return nil, err
+			}
+			opts.merge(extra)
+			file = nil
+		}
+		if overload[0]&2 != 0 {
+			extra, err := parseOptions(sname)
+			if err != nil {
+				return nil, err
+			}
+			opts.merge(extra)
+			sname = nil
+		}
+	}
+	p.SName = cString(sname)
+	p.File = cString(file)
+	p.Options = opts
+
+	return p, nil
+}
+
+// Marshal encodes the message
+func (p *Packet) Marshal() []byte {
+	b := make([]byte, headerLen, minPacketLen)
+	b[0] = p.Op
+	b[1] = p.HType
+	b[2] = p.HLen
+	b[3] = p.Hops
+	binary.BigEndian.PutUint32(b[4:8], p.XID)
+	binary.BigEndian.PutUint16(b[8:10], p.Secs)
+	binary.BigEndian.PutUint16(b[10:12], p.Flags)
+	copy(b[12:16], ip4(p.CIAddr))
+	copy(b[16:20], ip4(p.YIAddr))
+	copy(b[20:24], ip4(p.SIAddr))
+	copy(b[24:28], ip4(p.GIAddr))
+	copy(b[28:44], p.CHAddr)
+	copy(b[44:107], p.SName)
+	copy(b[108:235], p.File)
+	copy(b[236:240], magicCookie)
+
+	b = p.Options.marshal(b)
+	b = append(b, byte(OptionEnd))
+	for len(b) < minPacketLen {
+		b = append(b, byte(OptionPad))
+	}
+	return b
+}
+
+// MessageType returns the value of option 53, or 0 for a plain BOOTP message
+func (p *Packet) MessageType() MessageType {
+	if v := p.Options.Get(OptionMessageType); len(v) == 1 {
+		return MessageType(v[0])
+	}
+	return 0
+}
+
+// String returns a short description of the packet for logging
+func (p *Packet) String() string {
+	return p.MessageType().String() + " xid=" + strconv.FormatUint(uint64(p.XID), 16) + " chaddr=" + p.CHAddr.String()
+}
+
+// NewReply creates a reply of type t to req, copying the fields a server is
+// required to echo
+func NewReply(req *Packet, t MessageType) *Packet {
+	resp := &Packet{
+		Op:      BootReply,
+		HType:   req.HType,
+		HLen:    req.HLen,
+		XID:     req.XID,
+		Flags:   req.Flags,
+		CIAddr:  net.IPv4zero,
+		YIAddr:  net.IPv4zero,
+		SIAddr:  net.IPv4zero,
+		GIAddr:  req.GIAddr,
+		CHAddr:  req.CHAddr,
+		Options: make(Options),
+	}
+	resp.Options[OptionMessageType] = []byte{byte(t)}
+
+	// Relay agent information must be echoed back to the relay (RFC 3046)
+	if v := req.Options.Get(OptionRelayAgentInfo); v != nil {
+		resp.Options[OptionRelayAgentInfo] = v
+	}
+
+	return resp
+}
+
+// ip4 returns the 4-byte form of ip, or zeros if ip is not an IPv4 address
+func ip4(ip net.IP) net.IP {
+	if v4 := ip.To4(); v4 != nil {
+		return v4
+	}
+	return net.IPv4zero.To4()
+}
+
+// cString returns b up to the first NUL byte
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
@@ -0,0 +1,144 @@
+package dhcp4
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ErrServerClosed is returned by Serve after a call to Close
+var ErrServerClosed = errors.New("dhcp4: server closed")
+
+// Handler answers DHCP requests
+type Handler interface {
+	// ServeDHCP returns the reply to req, or nil if the request should be
+	// ignored. peer is the address the request was received from.
+	ServeDHCP(req *Packet, peer net.Addr) *Packet
+}
+
+// HandlerFunc adapts an ordinary function to the Handler interface
+type HandlerFunc func(req *Packet, peer net.Addr) *Packet
+
+// ServeDHCP calls f(req, peer)
+func (f HandlerFunc) ServeDHCP(req *Packet, peer net.Addr) *Packet {
+	return f(req, peer)
+}
+
+// Server reads DHCP requests from a packet connection and sends the replies
+// produced by its Handler
+type Server struct {
+	// Handler answers requests
+	Handler Handler
+
+	// ReplyTo overrides the destination of replies. When nil, replies are
+	// addressed as described in RFC 2131 section 4.1. Setting it to return
+	// peer allows the server to be exercised over loopback without raw
+	// sockets or broadcast.
+	ReplyTo func(req, resp *Packet, peer net.Addr) net.Addr
+
+	mu     sync.Mutex
+	conn   net.PacketConn
+	closed bool
+}
+
+// NewServer creates a new DHCP server that answers requests using h
+func NewServer(h Handler) *Server {
+	return &Server{Handler: h}
+}
+
+// Listen opens a UDP socket on addr for serving DHCP. If iface is not empty
+// the socket is bound to that interface where the platform supports it, so
+// that broadcasts from other networks are not answered.
+func Listen(ctx context.Context, iface, addr string) (net.PacketConn, error) {
+	lc := listenConfig(iface)
+	return lc.ListenPacket(ctx, "udp4", addr)
+}
+
+// Serve answers requests received on conn until Close is called
+func (s *Server) Serve(conn net.PacketConn) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		conn.Close()
+		return ErrServerClosed
+	}
+	s.conn = conn
+	s.mu.Unlock()
+
+	buf := make([]byte, 1500)
+	for {
+		n, peer, err := conn.ReadFrom(buf)
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			return err
+		}
+
+		req, err := Unmarshal(buf[:n])
+		if err != nil {
+			log.Debug().Err(err).Str("remote", peer.String()).Msg("Invalid DHCP packet")
+			continue
+		}
+		if req.Op != BootRequest {
+			continue
+		}
+
+		resp := s.Handler.ServeDHCP(req, peer)
+		if resp == nil {
+			continue
+		}
+
+		dst := s.replyAddr(req, resp, peer)
+		if _, err := conn.WriteTo(resp.Marshal(), dst); err != nil {
+			log.Warn().Err(err).Str("dst", dst.String()).Msg("Failed to send DHCP reply")
+		}
+	}
+}
+
+// Close stops the server and closes its connection
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	if s.conn != nil {
+		return s.conn.Close()
+	}
+	return nil
+}
+
+// isClosed reports whether Close has been called
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// replyAddr returns the destination for a reply
+func (s *Server) replyAddr(req, resp *Packet, peer net.Addr) net.Addr {
+	if s.ReplyTo != nil {
+		return s.ReplyTo(req, resp, peer)
+	}
+
+	// Replies to relayed requests go back to the relay agent
+	if giaddr := req.GIAddr.To4(); giaddr != nil && !giaddr.IsUnspecified() {
+		return &net.UDPAddr{IP: giaddr, Port: ServerPort}
+	}
+
+	// Clients that already have an address can receive unicast, unless
+	// the server is refusing the address
+	if ciaddr := req.CIAddr.To4(); ciaddr != nil && !ciaddr.IsUnspecified() && resp.MessageType() != Nak {
+		return &net.UDPAddr{IP: ciaddr, Port: ClientPort}
+	}
+
+	// Unicasting to yiaddr would require injecting an ARP entry, so
+	// unconfigured clients are always answered by broadcast
+	return &net.UDPAddr{IP: net.IPv4bcast, Port: ClientPort}
+}
@@ -0,0 +1,73 @@
+package dhcp6
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// DUID types (RFC 8415 section 11, RFC 6355)
+const (
+	DUIDTypeLLT  uint16 = 1
+	DUIDTypeEN   uint16 = 2
+	DUIDTypeLL   uint16 = 3
+	DUIDTypeUUID uint16 = 4
+)
+
+// hardwareTypeEthernet is the ARP hardware type of Ethernet
+const hardwareTypeEthernet uint16 = 1
+
+// DUID is a DHCP Unique Identifier as sent in the client and server
+// identifier options
+type DUID []byte
+
+// NewDUIDLL returns a link-layer address DUID for an Ethernet address
+func NewDUIDLL(hw net.HardwareAddr) DUID {
+	d := binary.BigEndian.AppendUint16(nil, DUIDTypeLL)
+	d = binary.BigEndian.AppendUint16(d, hardwareTypeEthernet)
+	return append(d, hw...)
+}
+
+// NewDUIDUUID returns a UUID based DUID
+func NewDUIDUUID(uuid [16]byte) DUID {
+	d := binary.BigEndian.AppendUint16(nil, DUIDTypeUUID)
+	return append(d, uuid[:]...)
+}
+
+// Type returns the DUID type, or 0 if the DUID is too short
+func (d DUID) Type() uint16 {
+	if len(d) < 2 {
+		return 0
+	}
+	return binary.BigEndian.Uint16(d)
+}
+
+// HardwareAddr returns the link-layer address of a DUID-LLT or DUID-LL, or
+// nil for other types. Firmware usually derives it from the booting NIC.
+func (d DUID) HardwareAddr() net.HardwareAddr {
+	var addr []byte
+	switch d.Type() {
+	case DUIDTypeLLT:
+		if len(d) > 8 {
+			addr = d[8:]
+		}
+	case DUIDTypeLL:
+		if len(d) > 4 {
+			addr = d[4:]
+		}
+	}
+	if addr == nil {
+		return nil
+	}
+	return net.HardwareAddr(append([]byte(nil), addr...))
+}
+
+// UUID returns the UUID of a DUID-UUID in its canonical form, or "" for
+// other types. UEFI firmware uses the machine's SMBIOS UUID.
+func (d DUID) UUID() string {
+	if d.Type() != DUIDTypeUUID || len(d) != 18 {
+		return ""
+	}
+	u := d[2:]
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16])
+}
@@ -0,0 +1,45 @@
+package dhcp6
+
+import (
+	"net"
+	"testing"
+)
+
+func TestDUID(t *testing.T) {
+	mac := net.HardwareAddr{0x52, 0x54, 0x00, 0x12, 0x34, 0x56}
+	uuid := [16]byte{0x4c, 0x4c, 0x45, 0x44, 0x00, 0x32, 0x10, 0x80, 0x80, 0x36, 0xb4, 0xc0, 0x4f, 0x50, 0x32, 0x32}
+	llt := DUID{0x00, 0x01, 0x00, 0x01, 0x2a, 0x2b, 0x2c, 0x2d, 0x52, 0x54, 0x00, 0x12, 0x34, 0x56}
+
+	tests := []struct {
+		name string
+		duid DUID
+		typ  uint16
+		mac  string
+		uuid string
+	}{
+		{name: "link-layer", duid: NewDUIDLL(mac), typ: DUIDTypeLL, mac: mac.String()},
+		{name: "link-layer plus time", duid: llt, typ: DUIDTypeLLT, mac: mac.String()},
+		{name: "uuid", duid: NewDUIDUUID(uuid), typ: DUIDTypeUUID, uuid: "4c4c4544-0032-1080-8036-b4c04f503232"},
+		{name: "enterprise", duid: DUID{0x00, 0x02, 0x00, 0x00, 0x01, 0x57, 0xaa}, typ: DUIDTypeEN},
+		{name: "link-layer without address", duid: NewDUIDLL(nil), typ: DUIDTypeLL},
+		{name: "link-layer plus time without address", duid: llt[:8], typ: DUIDTypeLLT},
+		{name: "truncated uuid", duid: NewDUIDUUID(uuid)[:17], typ: DUIDTypeUUID},
+		{name: "type only", duid: DUID{0x00, 0x03}, typ: DUIDTypeLL},
+		{name: "too short", duid: DUID{0x00}},
+		{name: "empty"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.duid.Type(); got != tt.typ {
+				t.Errorf("Type = %d, want %d", got, tt.typ)
+			}
+			if got := tt.duid.HardwareAddr().String(); got != tt.mac {
+				t.Errorf("HardwareAddr = %q, want %q", got, tt.mac)
+			}
+			if got := tt.duid.UUID(); got != tt.uuid {
+				t.Errorf("UUID = %q, want %q", got, tt.uuid)
+			}
+		})
+	}
+}
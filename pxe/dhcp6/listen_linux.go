@@ -0,0 +1,44 @@
+package dhcp6
+
+import (
+	"context"
+	"net"
+	"syscall"
+)
+
+// listen binds a UDP socket to addr, restricted to iface using
+// SO_BINDTODEVICE, and joins the All_DHCP_Relay_Agents_and_Servers group on
+// that interface
+func listen(ctx context.Context, iface, addr string) (net.PacketConn, error) {
+	var ifindex int
+	if iface != "" {
+		ifi, err := net.InterfaceByName(iface)
+		if err != nil {
+			return nil, err
+		}
+		ifindex = ifi.Index
+	}
+
+	mreq := &syscall.IPv6Mreq{Interface: uint32(ifindex)}
+	copy(mreq.Multiaddr[:], AllRelayAgentsAndServers)
+
+	lc := &net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+				if sockErr == nil && iface != "" {
+					sockErr = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, iface)
+				}
+				if sockErr == nil {
+					sockErr = syscall.SetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_JOIN_GROUP, mreq)
+				}
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+	return lc.ListenPacket(ctx, "udp6", addr)
+}
@@ -0,0 +1,26 @@
+//go:build !linux
+
+package dhcp6
+
+import (
+	"context"
+	"net"
+)
+
+// listen joins the All_DHCP_Relay_Agents_and_Servers group on iface, or the
+// system's default multicast interface if iface is empty. Only the port of
+// addr is used.
+func listen(ctx context.Context, iface, addr string) (net.PacketConn, error) {
+	var ifi *net.Interface
+	if iface != "" {
+		var err error
+		if ifi, err = net.InterfaceByName(iface); err != nil {
+			return nil, err
+		}
+	}
+	laddr, err := net.ResolveUDPAddr("udp6", addr)
+	if err != nil {
+		return nil, err
+	}
+	return net.ListenMulticastUDP("udp6", ifi, &net.UDPAddr{IP: AllRelayAgentsAndServers, Port: laddr.Port})
+}
@@ -0,0 +1,305 @@
+package dhcp6
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+// OptionCode identifies a DHCPv6 option
+type OptionCode uint16
+
+// DHCPv6 options used by the PXE server
+const (
+	OptionClientID            OptionCode = 1
+	OptionServerID            OptionCode = 2
+	OptionIANA                OptionCode = 3
+	OptionIAAddr              OptionCode = 5
+	OptionORO                 OptionCode = 6
+	OptionPreference          OptionCode = 7
+	OptionElapsedTime         OptionCode = 8
+	OptionRelayMessage        OptionCode = 9
+	OptionStatusCode          OptionCode = 13
+	OptionRapidCommit         OptionCode = 14
+	OptionUserClass           OptionCode = 15
+	OptionVendorClass         OptionCode = 16
+	OptionInterfaceID         OptionCode = 18
+	OptionDNSServers          OptionCode = 23
+	OptionBootFileURL         OptionCode = 59
+	OptionBootFileParam       OptionCode = 60
+	OptionClientArchType      OptionCode = 61
+	OptionNII                 OptionCode = 62
+	OptionClientLinkLayerAddr OptionCode = 79
+)
+
+// Status codes carried in OptionStatusCode
+const (
+	StatusSuccess      uint16 = 0
+	StatusUnspecFail   uint16 = 1
+	StatusNoAddrsAvail uint16 = 2
+	StatusNoBinding    uint16 = 3
+	StatusNotOnLink    uint16 = 4
+	StatusUseMulticast uint16 = 5
+)
+
+// Option is a single encoded option
+type Option struct {
+	Code OptionCode
+	Data []byte
+}
+
+// Options holds the options of a DHCPv6 message in the order they appear.
+// Unlike DHCPv4 options, some (IA_NA, IAADDR) may legitimately repeat.
+type Options []Option
+
+// Get returns the value of the first instance of an option, or nil if it is
+// not present
+func (o Options) Get(code OptionCode) []byte {
+	for _, opt := range o {
+		if opt.Code == code {
+			if opt.Data == nil {
+				return []byte{}
+			}
+			return opt.Data
+		}
+	}
+	return nil
+}
+
+// GetAll returns the values of all instances of an option
+func (o Options) GetAll(code OptionCode) [][]byte {
+	var values [][]byte
+	for _, opt := range o {
+		if opt.Code == code {
+			values = append(values, opt.Data)
+		}
+	}
+	return values
+}
+
+// Has reports whether an option is present
+func (o Options) Has(code OptionCode) bool {
+	return o.Get(code) != nil
+}
+
+// String returns the value of an option as a string
+func (o Options) String(code OptionCode) string {
+	return string(o.Get(code))
+}
+
+// Add appends an option
+func (o *Options) Add(code OptionCode, v []byte) {
+	*o = append(*o, Option{Code: code, Data: v})
+}
+
+// Set replaces all instances of an option with a single value
+func (o *Options) Set(code OptionCode, v []byte) {
+	o.Del(code)
+	o.Add(code, v)
+}
+
+// Del removes all instances of an option
+func (o *Options) Del(code OptionCode) {
+	kept := (*o)[:0]
+	for _, opt := range *o {
+		if opt.Code != code {
+			kept = append(kept, opt)
+		}
+	}
+	*o = kept
+}
+
+// SetString sets an option to a string value
+func (o *Options) SetString(code OptionCode, s string) {
+	o.Set(code, []byte(s))
+}
+
+// SetIPs sets an option to a list of IPv6 addresses. IPv4 addresses are
+// skipped and the option is left unset if none remain.
+func (o *Options) SetIPs(code OptionCode, ips []net.IP) {
+	var v []byte
+	for _, ip := range ips {
+		if ip.To4() != nil || ip.To16() == nil {
+			continue
+		}
+		v = append(v, ip.To16()...)
+	}
+	if len(v) > 0 {
+		o.Set(code, v)
+	}
+}
+
+// RequestedOptions returns the option codes listed in the Option Request
+// option
+func (o Options) RequestedOptions() []OptionCode {
+	v := o.Get(OptionORO)
+	codes := make([]OptionCode, 0, len(v)/2)
+	for i := 0; i+1 < len(v); i += 2 {
+		codes = append(codes, OptionCode(binary.BigEndian.Uint16(v[i:])))
+	}
+	return codes
+}
+
+// Requested reports whether the client listed code in its Option Request
+// option
+func (o Options) Requested(code OptionCode) bool {
+	for _, c := range o.RequestedOptions() {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientArchTypes returns the architectures listed in option 61, most
+// preferred first. They use the same values as DHCPv4 option 93.
+func (o Options) ClientArchTypes() []uint16 {
+	v := o.Get(OptionClientArchType)
+	archs := make([]uint16, 0, len(v)/2)
+	for i := 0; i+1 < len(v); i += 2 {
+		archs = append(archs, binary.BigEndian.Uint16(v[i:]))
+	}
+	return archs
+}
+
+// UserClasses returns the user class data of option 15
+func (o Options) UserClasses() []string {
+	return splitOpaque(o.Get(OptionUserClass))
+}
+
+// VendorClasses returns the vendor class data of option 16, without the
+// enterprise number
+func (o Options) VendorClasses() []string {
+	var classes []string
+	for _, v := range o.GetAll(OptionVendorClass) {
+		if len(v) < 4 {
+			continue
+		}
+		classes = append(classes, splitOpaque(v[4:])...)
+	}
+	return classes
+}
+
+// SetVendorClass sets option 16 to a single vendor class for an enterprise
+// number
+func (o *Options) SetVendorClass(enterprise uint32, class string) {
+	v := binary.BigEndian.AppendUint32(nil, enterprise)
+	v = binary.BigEndian.AppendUint16(v, uint16(len(class)))
+	o.Set(OptionVendorClass, append(v, class...))
+}
+
+// LinkLayerAddr decodes option 79, which relay agents add with the client's
+// hardware address (RFC 6939)
+func (o Options) LinkLayerAddr() net.HardwareAddr {
+	v := o.Get(OptionClientLinkLayerAddr)
+	if len(v) <= 2 {
+		return nil
+	}
+	return net.HardwareAddr(append([]byte(nil), v[2:]...))
+}
+
+// SetStatus sets the status code option
+func (o *Options) SetStatus(code uint16, msg string) {
+	v := binary.BigEndian.AppendUint16(nil, code)
+	o.Set(OptionStatusCode, append(v, msg...))
+}
+
+// IANA is an Identity Association for Non-temporary Addresses
+type IANA struct {
+	IAID    uint32
+	T1      time.Duration
+	T2      time.Duration
+	Options Options
+}
+
+// IANAs decodes all IA_NA options
+func (o Options) IANAs() ([]IANA, error) {
+	var ias []IANA
+	for _, v := range o.GetAll(OptionIANA) {
+		if len(v) < 12 {
+			return nil, fmt.Errorf("IA_NA option too short: %d bytes", len(v))
+		}
+		opts, err := parseOptions(v[12:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid IA_NA option: %w", err)
+		}
+		ias = append(ias, IANA{
+			IAID:    binary.BigEndian.Uint32(v[0:4]),
+			T1:      time.Duration(binary.BigEndian.Uint32(v[4:8])) * time.Second,
+			T2:      time.Duration(binary.BigEndian.Uint32(v[8:12])) * time.Second,
+			Options: opts,
+		})
+	}
+	return ias, nil
+}
+
+// Addresses returns the addresses listed in the IA's IAADDR options
+func (ia IANA) Addresses() []net.IP {
+	var ips []net.IP
+	for _, v := range ia.Options.GetAll(OptionIAAddr) {
+		if len(v) >= 24 {
+			ips = append(ips, net.IP(append([]byte(nil), v[:16]...)))
+		}
+	}
+	return ips
+}
+
+// AddAddress adds an IAADDR option with the given lifetimes
+func (ia *IANA) AddAddress(ip net.IP, preferred, valid time.Duration) {
+	v := append([]byte(nil), ip16(ip)...)
+	v = binary.BigEndian.AppendUint32(v, uint32(preferred/time.Second))
+	v = binary.BigEndian.AppendUint32(v, uint32(valid/time.Second))
+	ia.Options.Add(OptionIAAddr, v)
+}
+
+// Marshal encodes the IA as the value of an IA_NA option
+func (ia IANA) Marshal() []byte {
+	v := binary.BigEndian.AppendUint32(nil, ia.IAID)
+	v = binary.BigEndian.AppendUint32(v, uint32(ia.T1/time.Second))
+	v = binary.BigEndian.AppendUint32(v, uint32(ia.T2/time.Second))
+	return ia.Options.marshal(v)
+}
+
+// splitOpaque splits a list of length prefixed values as used by the user
+// and vendor class options
+func splitOpaque(b []byte) []string {
+	var values []string
+	for len(b) >= 2 {
+		n := int(binary.BigEndian.Uint16(b))
+		if 2+n > len(b) {
+			break
+		}
+		values = append(values, string(b[2:2+n]))
+		b = b[2+n:]
+	}
+	return values
+}
+
+// parseOptions decodes a list of options
+func parseOptions(b []byte) (Options, error) {
+	var opts Options
+	for i := 0; i < len(b); {
+		if i+4 > len(b) {
+			return nil, fmt.Errorf("truncated option header")
+		}
+		code := OptionCode(binary.BigEndian.Uint16(b[i:]))
+		n := int(binary.BigEndian.Uint16(b[i+2:]))
+		if i+4+n > len(b) {
+			return nil, fmt.Errorf("option %d overflows message", code)
+		}
+		opts = append(opts, Option{Code: code, Data: append([]byte{}, b[i+4:i+4+n]...)})
+		i += 4 + n
+	}
+	return opts, nil
+}
+
+// marshal appends the encoded options to b
+func (o Options) marshal(b []byte) []byte {
+	for _, opt := range o {
+		b = binary.BigEndian.AppendUint16(b, uint16(opt.Code))
+		b = binary.BigEndian.AppendUint16(b, uint16(len(opt.Data)))
+		b = append(b, opt.Data...)
+	}
+	return b
+}
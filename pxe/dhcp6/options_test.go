@@ -0,0 +1,151 @@
+package dhcp6
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestIANAs(t *testing.T) {
+	ia := IANA{IAID: 1, T1: time.Hour, T2: 90 * time.Minute}
+	ia.AddAddress(net.ParseIP("2001:db8::100"), time.Hour, 2*time.Hour)
+
+	tests := []struct {
+		name    string
+		values  [][]byte
+		want    int
+		wantErr bool
+	}{
+		{name: "none"},
+		{name: "one", values: [][]byte{ia.Marshal()}, want: 1},
+		{name: "two", values: [][]byte{ia.Marshal(), ia.Marshal()}, want: 2},
+		{name: "without options", values: [][]byte{make([]byte, 12)}, want: 1},
+		{name: "too short", values: [][]byte{make([]byte, 11)}, wantErr: true},
+		{name: "truncated option", values: [][]byte{ia.Marshal()[:20]}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var opts Options
+			for _, v := range tt.values {
+				opts.Add(OptionIANA, v)
+			}
+			ias, err := opts.IANAs()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("IANAs: %v, want error %v", err, tt.wantErr)
+			}
+			if len(ias) != tt.want {
+				t.Errorf("%d IAs, want %d", len(ias), tt.want)
+			}
+		})
+	}
+}
+
+func TestIANAAddresses(t *testing.T) {
+	var ia IANA
+	ia.AddAddress(net.ParseIP("2001:db8::100"), time.Hour, time.Hour)
+	// An IAADDR too short to hold its lifetimes is skipped
+	ia.Options.Add(OptionIAAddr, net.ParseIP("2001:db8::200"))
+
+	if got := ia.Addresses(); len(got) != 1 || !got[0].Equal(net.ParseIP("2001:db8::100")) {
+		t.Errorf("addresses = %v, want [2001:db8::100]", got)
+	}
+}
+
+func TestOptionDecoders(t *testing.T) {
+	tests := []struct {
+		name string
+		opts Options
+		get  func(Options) any
+		want any
+	}{
+		{
+			name: "option request",
+			opts: Options{{Code: OptionORO, Data: []byte{0, 59, 0, 23}}},
+			get:  func(o Options) any { return o.RequestedOptions() },
+			want: []OptionCode{OptionBootFileURL, OptionDNSServers},
+		},
+		{
+			name: "option request with odd length",
+			opts: Options{{Code: OptionORO, Data: []byte{0, 59, 0}}},
+			get:  func(o Options) any { return o.RequestedOptions() },
+			want: []OptionCode{OptionBootFileURL},
+		},
+		{
+			name: "client architectures",
+			opts: Options{{Code: OptionClientArchType, Data: []byte{0, 7, 0, 16, 0}}},
+			get:  func(o Options) any { return o.ClientArchTypes() },
+			want: []uint16{7, 16},
+		},
+		{
+			name: "user classes",
+			opts: Options{{Code: OptionUserClass, Data: []byte("\x00\x04iPXE\x00\x03foo")}},
+			get:  func(o Options) any { return o.UserClasses() },
+			want: []string{"iPXE", "foo"},
+		},
+		{
+			name: "user class overflowing the option",
+			opts: Options{{Code: OptionUserClass, Data: []byte("\x00\x04iPXE\x00\x09foo")}},
+			get:  func(o Options) any { return o.UserClasses() },
+			want: []string{"iPXE"},
+		},
+		{
+			name: "vendor classes",
+			opts: Options{
+				{Code: OptionVendorClass, Data: []byte("\x00\x00\x01\x57\x00\x0aHTTPClient")},
+				{Code: OptionVendorClass, Data: []byte("\x00\x00")},
+				{Code: OptionVendorClass, Data: []byte("\x00\x00\x01\x57\x00\x09PXEClient")},
+			},
+			get:  func(o Options) any { return o.VendorClasses() },
+			want: []string{"HTTPClient", "PXEClient"},
+		},
+		{
+			name: "link-layer address",
+			opts: Options{{Code: OptionClientLinkLayerAddr, Data: []byte{0, 1, 0x52, 0x54, 0, 0x12, 0x34, 0x56}}},
+			get:  func(o Options) any { return o.LinkLayerAddr().String() },
+			want: "52:54:00:12:34:56",
+		},
+		{
+			name: "link-layer address without address",
+			opts: Options{{Code: OptionClientLinkLayerAddr, Data: []byte{0, 1}}},
+			get:  func(o Options) any { return o.LinkLayerAddr() == nil },
+			want: true,
+		},
+		{
+			name: "empty option is present",
+			opts: Options{{Code: OptionRapidCommit}},
+			get:  func(o Options) any { return o.Has(OptionRapidCommit) },
+			want: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.get(tt.opts); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOptionsSet(t *testing.T) {
+	var opts Options
+	opts.Add(OptionIANA, []byte{1})
+	opts.Add(OptionIANA, []byte{2})
+	opts.Set(OptionIANA, []byte{3})
+	if got := opts.GetAll(OptionIANA); !reflect.DeepEqual(got, [][]byte{{3}}) {
+		t.Errorf("after Set: %v, want [[3]]", got)
+	}
+
+	// IPv4 addresses have no place in DHCPv6 options
+	opts.SetIPs(OptionDNSServers, []net.IP{net.IPv4(10, 0, 0, 53), net.ParseIP("2001:db8::53")})
+	if got := net.IP(opts.Get(OptionDNSServers)); !got.Equal(net.ParseIP("2001:db8::53")) {
+		t.Errorf("DNS servers = %x, want 2001:db8::53", []byte(got))
+	}
+	opts.Del(OptionDNSServers)
+	opts.SetIPs(OptionDNSServers, []net.IP{net.IPv4(10, 0, 0, 53)})
+	if opts.Has(OptionDNSServers) {
+		t.Error("DNS server option set without IPv6 addresses")
+	}
+}
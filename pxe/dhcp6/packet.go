@@ -0,0 +1,210 @@
+// Package dhcp6 implements DHCPv6 message encoding (RFC 8415) and a minimal
+// UDP server loop. Address allocation and boot policy are left to the
+// Handler.
+package dhcp6
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+)
+
+// Well known ports
+const (
+	ServerPort = 547
+	ClientPort = 546
+)
+
+// AllRelayAgentsAndServers is the link-scoped multicast address clients send
+// requests to
+var AllRelayAgentsAndServers = net.ParseIP("ff02::1:2")
+
+// MessageType identifies a DHCPv6 message
+type MessageType uint8
+
+// DHCPv6 message types
+const (
+	Solicit            MessageType = 1
+	Advertise          MessageType = 2
+	Request            MessageType = 3
+	Confirm            MessageType = 4
+	Renew              MessageType = 5
+	Rebind             MessageType = 6
+	Reply              MessageType = 7
+	Release            MessageType = 8
+	Decline            MessageType = 9
+	Reconfigure        MessageType = 10
+	InformationRequest MessageType = 11
+	RelayForward       MessageType = 12
+	RelayReply         MessageType = 13
+)
+
+// String returns the name of the message type
+func (t MessageType) String() string {
+	switch t {
+	case Solicit:
+		return "SOLICIT"
+	case Advertise:
+		return "ADVERTISE"
+	case Request:
+		return "REQUEST"
+	case Confirm:
+		return "CONFIRM"
+	case Renew:
+		return "RENEW"
+	case Rebind:
+		return "REBIND"
+	case Reply:
+		return "REPLY"
+	case Release:
+		return "RELEASE"
+	case Decline:
+		return "DECLINE"
+	case Reconfigure:
+		return "RECONFIGURE"
+	case InformationRequest:
+		return "INFORMATION-REQUEST"
+	case RelayForward:
+		return "RELAY-FORW"
+	case RelayReply:
+		return "RELAY-REPL"
+	default:
+		return fmt.Sprintf("DHCPv6(%d)", uint8(t))
+	}
+}
+
+// fromClient reports whether clients send messages of this type
+func (t MessageType) fromClient() bool {
+	switch t {
+	case Solicit, Request, Confirm, Renew, Rebind, Release, Decline, InformationRequest:
+		return true
+	default:
+		return false
+	}
+}
+
+const (
+	// headerLen is the length of the client/server message header
+	headerLen = 4
+
+	// relayHeaderLen is the length of the relay agent message header
+	relayHeaderLen = 34
+
+	// HopCountLimit is the maximum number of relay agents a message may
+	// pass through (RFC 8415 section 7.6)
+	HopCountLimit = 8
+)
+
+// Message is a DHCPv6 client/server message
+type Message struct {
+	Type          MessageType
+	TransactionID [3]byte
+	Options       Options
+}
+
+// Unmarshal parses a DHCPv6 client/server message
+func Unmarshal(b []byte) (*Message, error) {
+	if len(b) < headerLen {
+		return nil, fmt.Errorf("message too short: %d bytes", len(b))
+	}
+	if t := MessageType(b[0]); t == RelayForward || t == RelayReply {
+		return nil, fmt.Errorf("unexpected relay message %s", t)
+	}
+
+	opts, err := parseOptions(b[headerLen:])
+	if err != nil {
+		return nil, err
+	}
+	m := &Message{Type: MessageType(b[0]), Options: opts}
+	copy(m.TransactionID[:], b[1:4])
+	return m, nil
+}
+
+// Marshal encodes the message
+func (m *Message) Marshal() []byte {
+	b := []byte{byte(m.Type), m.TransactionID[0], m.TransactionID[1], m.TransactionID[2]}
+	return m.Options.marshal(b)
+}
+
+// String returns a short description of the message for logging
+func (m *Message) String() string {
+	return m.Type.String() + " xid=" + hex.EncodeToString(m.TransactionID[:])
+}
+
+// NewReply creates a reply of type t to req, copying the transaction ID and
+// the client identifier
+func NewReply(req *Message, t MessageType) *Message {
+	resp := &Message{Type: t, TransactionID: req.TransactionID}
+	if v := req.Options.Get(OptionClientID); v != nil {
+		resp.Options.Add(OptionClientID, v)
+	}
+	return resp
+}
+
+// RelayMessage is a Relay-forward or Relay-reply message exchanged with
+// relay agents
+type RelayMessage struct {
+	Type     MessageType
+	HopCount uint8
+	// LinkAddr identifies the link the client is on, PeerAddr is the
+	// address of the client or the previous relay
+	LinkAddr net.IP
+	PeerAddr net.IP
+	Options  Options
+}
+
+// UnmarshalRelay parses a relay agent message
+func UnmarshalRelay(b []byte) (*RelayMessage, error) {
+	if len(b) < relayHeaderLen {
+		return nil, fmt.Errorf("relay message too short: %d bytes", len(b))
+	}
+	if t := MessageType(b[0]); t != RelayForward && t != RelayReply {
+		return nil, fmt.Errorf("%s is not a relay message", t)
+	}
+
+	opts, err := parseOptions(b[relayHeaderLen:])
+	if err != nil {
+		return nil, err
+	}
+	return &RelayMessage{
+		Type:     MessageType(b[0]),
+		HopCount: b[1],
+		LinkAddr: net.IP(append([]byte(nil), b[2:18]...)),
+		PeerAddr: net.IP(append([]byte(nil), b[18:34]...)),
+		Options:  opts,
+	}, nil
+}
+
+// Marshal encodes the relay message
+func (r *RelayMessage) Marshal() []byte {
+	b := make([]byte, relayHeaderLen)
+	b[0] = byte(r.Type)
+	b[1] = r.HopCount
+	copy(b[2:18], ip16(r.LinkAddr))
+	copy(b[18:34], ip16(r.PeerAddr))
+	return r.Options.marshal(b)
+}
+
+// NewRelayReply wraps a reply to a message received through relay in a
+// Relay-reply message, echoing the relay's interface identifier
+func NewRelayReply(relay *RelayMessage, msg []byte) *RelayMessage {
+	resp := &RelayMessage{
+		Type:     RelayReply,
+		HopCount: relay.HopCount,
+		LinkAddr: relay.LinkAddr,
+		PeerAddr: relay.PeerAddr,
+	}
+	if v := relay.Options.Get(OptionInterfaceID); v != nil {
+		resp.Options.Add(OptionInterfaceID, v)
+	}
+	resp.Options.Add(OptionRelayMessage, msg)
+	return resp
+}
+
+// ip16 returns the 16-byte form of ip, or zeros if ip is not set
+func ip16(ip net.IP) net.IP {
+	if v6 := ip.To16(); v6 != nil {
+		return v6
+	}
+	return net.IPv6unspecified
+}
@@ -0,0 +1,215 @@
+package dhcp6
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+)
+
+// testMessage is a Solicit carrying a client identifier, an IA_NA with an
+// address and an Option Request option
+var testMessage = []byte{
+	0x01, 0xaa, 0xbb, 0xcc, // SOLICIT, xid
+	0x00, 0x01, 0x00, 0x0a, // client identifier
+	0x00, 0x03, 0x00, 0x01, 0x52, 0x54, 0x00, 0x12, 0x34, 0x56,
+	0x00, 0x03, 0x00, 0x28, // IA_NA
+	0x00, 0x00, 0x00, 0x07, 0x00, 0x00, 0x0e, 0x10, 0x00, 0x00, 0x15, 0x18,
+	0x00, 0x05, 0x00, 0x18, // IAADDR
+	0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x01, 0x00,
+	0x00, 0x00, 0x0e, 0x10, 0x00, 0x00, 0x1c, 0x20,
+	0x00, 0x06, 0x00, 0x04, 0x00, 0x3b, 0x00, 0x17, // ORO: 59, 23
+}
+
+func TestUnmarshal(t *testing.T) {
+	tests := []struct {
+		name    string
+		b       []byte
+		wantErr bool
+	}{
+		{name: "valid", b: testMessage},
+		{name: "header only", b: []byte{0x01, 0, 0, 1}},
+		{name: "empty", b: nil, wantErr: true},
+		{name: "short header", b: []byte{0x01, 0, 0}, wantErr: true},
+		{name: "relay message", b: append([]byte{byte(RelayForward)}, make([]byte, 40)...), wantErr: true},
+		{name: "truncated option header", b: []byte{0x01, 0, 0, 1, 0x00, 0x01, 0x00}, wantErr: true},
+		{name: "option overflows message", b: []byte{0x01, 0, 0, 1, 0x00, 0x01, 0x00, 0x05, 0xaa}, wantErr: true},
+		{name: "maximum option length", b: []byte{0x01, 0, 0, 1, 0x00, 0x01, 0xff, 0xff}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := Unmarshal(tt.b)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Unmarshal: %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && !bytes.Equal(m.Marshal(), tt.b) {
+				t.Errorf("Marshal = %x, want %x", m.Marshal(), tt.b)
+			}
+		})
+	}
+
+	m, err := Unmarshal(testMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Type != Solicit || m.TransactionID != [3]byte{0xaa, 0xbb, 0xcc} {
+		t.Errorf("header = %s, want SOLICIT xid=aabbcc", m)
+	}
+	if got := m.Options.RequestedOptions(); !reflect.DeepEqual(got, []OptionCode{OptionBootFileURL, OptionDNSServers}) {
+		t.Errorf("requested options = %v", got)
+	}
+	ias, err := m.Options.IANAs()
+	if err != nil || len(ias) != 1 {
+		t.Fatalf("IANAs = %v, %v; want one", ias, err)
+	}
+	if ias[0].IAID != 7 || ias[0].T1.Seconds() != 3600 || ias[0].T2.Seconds() != 5400 {
+		t.Errorf("IA_NA = %+v", ias[0])
+	}
+	if addrs := ias[0].Addresses(); len(addrs) != 1 || !addrs[0].Equal(net.ParseIP("2001:db8::100")) {
+		t.Errorf("addresses = %v, want [2001:db8::100]", addrs)
+	}
+}
+
+// TestUnmarshalTruncated checks that every prefix of a valid message is
+// either parsed or rejected, never panics
+func TestUnmarshalTruncated(t *testing.T) {
+	for n := range len(testMessage) {
+		m, err := Unmarshal(testMessage[:n])
+		if err != nil {
+			continue
+		}
+		m.Options.IANAs()
+		m.Options.RequestedOptions()
+		DUID(m.Options.Get(OptionClientID)).HardwareAddr()
+	}
+
+	relay := (&RelayMessage{Type: RelayForward, Options: Options{{Code: OptionRelayMessage, Data: testMessage}}}).Marshal()
+	for n := range len(relay) {
+		decode(relay[:n])
+	}
+}
+
+func TestUnmarshalRelay(t *testing.T) {
+	link := net.ParseIP("2001:db8:1::1")
+	peer := net.ParseIP("fe80::5054:ff:fe12:3456")
+	valid := (&RelayMessage{
+		Type:     RelayForward,
+		HopCount: 1,
+		LinkAddr: link,
+		PeerAddr: peer,
+		Options:  Options{{Code: OptionInterfaceID, Data: []byte("eth1")}, {Code: OptionRelayMessage, Data: testMessage}},
+	}).Marshal()
+
+	tests := []struct {
+		name    string
+		b       []byte
+		wantErr bool
+	}{
+		{name: "valid", b: valid},
+		{name: "short header", b: valid[:relayHeaderLen-1], wantErr: true},
+		{name: "not a relay message", b: testMessage, wantErr: true},
+		{name: "truncated option", b: valid[:len(valid)-1], wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := UnmarshalRelay(tt.b)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("UnmarshalRelay: %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if r.HopCount != 1 || !r.LinkAddr.Equal(link) || !r.PeerAddr.Equal(peer) {
+				t.Errorf("header = %+v", r)
+			}
+			if got := r.Options.String(OptionInterfaceID); got != "eth1" {
+				t.Errorf("interface id = %q, want eth1", got)
+			}
+			if !bytes.Equal(r.Marshal(), tt.b) {
+				t.Errorf("Marshal = %x, want %x", r.Marshal(), tt.b)
+			}
+		})
+	}
+}
+
+// relayForward wraps msg in n Relay-forward messages, as n relay agents
+// would
+func relayForward(msg []byte, n int) []byte {
+	for i := range n {
+		msg = (&RelayMessage{
+			Type:     RelayForward,
+			HopCount: uint8(i),
+			Options:  Options{{Code: OptionRelayMessage, Data: msg}},
+		}).Marshal()
+	}
+	return msg
+}
+
+func TestDecode(t *testing.T) {
+	noMessage := (&RelayMessage{Type: RelayForward, Options: Options{{Code: OptionInterfaceID, Data: []byte("eth1")}}}).Marshal()
+
+	tests := []struct {
+		name    string
+		b       []byte
+		relays  int
+		wantErr bool
+	}{
+		{name: "direct", b: testMessage},
+		{name: "relayed", b: relayForward(testMessage, 1), relays: 1},
+		{name: "relayed twice", b: relayForward(testMessage, 2), relays: 2},
+		{name: "hop count limit", b: relayForward(testMessage, HopCountLimit+1), relays: HopCountLimit + 1},
+		{name: "too many relays", b: relayForward(testMessage, HopCountLimit+2), wantErr: true},
+		{name: "relay without message", b: noMessage, wantErr: true},
+		{name: "relayed relay reply", b: relayForward([]byte{byte(RelayReply), 0}, 1), wantErr: true},
+		{name: "relayed garbage", b: relayForward([]byte{0x01}, 1), wantErr: true},
+		{name: "empty", b: nil, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, relays, err := decode(tt.b)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("decode: %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if len(relays) != tt.relays {
+				t.Errorf("%d relays, want %d", len(relays), tt.relays)
+			}
+			if msg.Type != Solicit {
+				t.Errorf("message type %s, want SOLICIT", msg.Type)
+			}
+		})
+	}
+}
+
+func TestEncodeRelayReply(t *testing.T) {
+	req, relays, err := decode(relayForward(testMessage, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	relays[1].Options.Add(OptionInterfaceID, []byte("eth1"))
+
+	b := encode(NewReply(req, Advertise), relays)
+	outer, err := UnmarshalRelay(b)
+	if err != nil || outer.Type != RelayReply || outer.HopCount != 1 {
+		t.Fatalf("outer relay = %+v, %v; want RELAY-REPL with hop count 1", outer, err)
+	}
+	inner, err := UnmarshalRelay(outer.Options.Get(OptionRelayMessage))
+	if err != nil || inner.Type != RelayReply || inner.HopCount != 0 {
+		t.Fatalf("inner relay = %+v, %v; want RELAY-REPL with hop count 0", inner, err)
+	}
+	if got := inner.Options.String(OptionInterfaceID); got != "eth1" {
+		t.Errorf("interface id = %q, want it echoed", got)
+	}
+	resp, err := Unmarshal(inner.Options.Get(OptionRelayMessage))
+	if err != nil || resp.Type != Advertise || resp.TransactionID != req.TransactionID {
+		t.Fatalf("reply = %v, %v; want ADVERTISE with the request's transaction ID", resp, err)
+	}
+	if !bytes.Equal(resp.Options.Get(OptionClientID), req.Options.Get(OptionClientID)) {
+		t.Error("client identifier not copied to the reply")
+	}
+}
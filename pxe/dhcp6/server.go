@@ -0,0 +1,157 @@
+package dhcp6
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ErrServerClosed is returned by Serve after a call to Close
+var ErrServerClosed = errors.New("dhcp6: server closed")
+
+// Handler answers DHCPv6 requests
+type Handler interface {
+	// ServeDHCPv6 returns the reply to req, or nil if the request should be
+	// ignored. relays holds the Relay-forward messages req arrived in,
+	// outermost first, and is empty for requests received directly from
+	// the client. peer is the address the request was received from.
+	ServeDHCPv6(req *Message, relays []*RelayMessage, peer net.Addr) *Message
+}
+
+// HandlerFunc adapts an ordinary function to the Handler interface
+type HandlerFunc func(req *Message, relays []*RelayMessage, peer net.Addr) *Message
+
+// ServeDHCPv6 calls f(req, relays, peer)
+func (f HandlerFunc) ServeDHCPv6(req *Message, relays []*RelayMessage, peer net.Addr) *Message {
+	return f(req, relays, peer)
+}
+
+// Server reads DHCPv6 requests from a packet connection and sends the
+// replies produced by its Handler. Replies to relayed requests are wrapped
+// in Relay-reply messages and sent back through the relay agents.
+type Server struct {
+	// Handler answers requests
+	Handler Handler
+
+	mu     sync.Mutex
+	conn   net.PacketConn
+	closed bool
+}
+
+// NewServer creates a new DHCPv6 server that answers requests using h
+func NewServer(h Handler) *Server {
+	return &Server{Handler: h}
+}
+
+// Listen opens a UDP socket on addr for serving DHCPv6 and joins the
+// All_DHCP_Relay_Agents_and_Servers multicast group. addr should not name a
+// host, since multicast from clients on the link is not delivered to
+// sockets bound to a unicast address. If iface is not empty the group is
+// joined on that interface.
+func Listen(ctx context.Context, iface, addr string) (net.PacketConn, error) {
+	return listen(ctx, iface, addr)
+}
+
+// Serve answers requests received on conn until Close is called
+func (s *Server) Serve(conn net.PacketConn) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		conn.Close()
+		return ErrServerClosed
+	}
+	s.conn = conn
+	s.mu.Unlock()
+
+	buf := make([]byte, 65536)
+	for {
+		n, peer, err := conn.ReadFrom(buf)
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			return err
+		}
+
+		req, relays, err := decode(buf[:n])
+		if err != nil {
+			log.Debug().Err(err).Str("remote", peer.String()).Msg("Invalid DHCPv6 message")
+			continue
+		}
+		if !req.Type.fromClient() {
+			continue
+		}
+
+		resp := s.Handler.ServeDHCPv6(req, relays, peer)
+		if resp == nil {
+			continue
+		}
+
+		// Both clients and relay agents expect the reply at the address
+		// and port they sent from
+		if _, err := conn.WriteTo(encode(resp, relays), peer); err != nil {
+			log.Warn().Err(err).Str("dst", peer.String()).Msg("Failed to send DHCPv6 reply")
+		}
+	}
+}
+
+// Close stops the server and closes its connection
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	if s.conn != nil {
+		return s.conn.Close()
+	}
+	return nil
+}
+
+// isClosed reports whether Close has been called
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// decode parses a message, unwrapping any Relay-forward messages it is
+// encapsulated in
+func decode(b []byte) (*Message, []*RelayMessage, error) {
+	var relays []*RelayMessage
+	for len(b) > 0 && MessageType(b[0]) == RelayForward {
+		if len(relays) > HopCountLimit {
+			return nil, nil, fmt.Errorf("message relayed through more than %d agents", HopCountLimit)
+		}
+		relay, err := UnmarshalRelay(b)
+		if err != nil {
+			return nil, nil, err
+		}
+		relays = append(relays, relay)
+		if b = relay.Options.Get(OptionRelayMessage); b == nil {
+			return nil, nil, fmt.Errorf("relay message without encapsulated message")
+		}
+	}
+
+	msg, err := Unmarshal(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	return msg, relays, nil
+}
+
+// encode encodes a reply, wrapping it in a Relay-reply for each relay agent
+// the request passed through
+func encode(resp *Message, relays []*RelayMessage) []byte {
+	b := resp.Marshal()
+	for i := len(relays) - 1; i >= 0; i-- {
+		b = NewRelayReply(relays[i], b).Marshal()
+	}
+	return b
+}
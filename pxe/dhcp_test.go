@@ -0,0 +1,301 @@
+package pxe
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nimbus-project/nimbus/pxe/dhcp4"
+)
+
+var (
+	testServerIP = net.IPv4(10, 0, 0, 1).To4()
+	testGateway  = net.IPv4(10, 0, 0, 254).To4()
+	testDNS      = net.IPv4(10, 0, 0, 53).To4()
+	testMAC      = net.HardwareAddr{0x52, 0x54, 0x00, 0x12, 0x34, 0x56}
+	testUUID     = []byte{0, 0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77, 0x88, 0x99, 0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff, 0x00}
+)
+
+// newTestServer creates a PXE server on 10.0.0.0/24 handing out
+// 10.0.0.100-10.0.0.110, with cfg applied on top
+func newTestServer(t *testing.T, cfg Config) *Server {
+	t.Helper()
+
+	cfg.IP = testServerIP
+	cfg.Netmask = net.CIDRMask(24, 32)
+	cfg.Gateway = testGateway
+	cfg.DNSServers = []net.IP{testDNS}
+	if cfg.DHCPRangeStart == nil && !cfg.ProxyDHCP {
+		cfg.DHCPRangeStart = net.IPv4(10, 0, 0, 100).To4()
+		cfg.DHCPRangeEnd = net.IPv4(10, 0, 0, 110).To4()
+	}
+	if cfg.RootDir == "" {
+		cfg.RootDir = t.TempDir()
+	}
+
+	s, err := NewServer(&cfg)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	return s
+}
+
+// loopbackDHCP serves h on a loopback UDP socket, replying to the sender
+// instead of broadcasting, and returns a client socket and the server's
+// address
+func loopbackDHCP(t *testing.T, h dhcp4.Handler) (net.PacketConn, net.Addr) {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	srv := dhcp4.NewServer(h)
+	srv.ReplyTo = replyToPeer
+	go srv.Serve(conn)
+	t.Cleanup(func() { srv.Close() })
+
+	client, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client, conn.LocalAddr()
+}
+
+// exchange sends req to the server and returns its reply
+func exchange(t *testing.T, client net.PacketConn, server net.Addr, req *dhcp4.Packet) *dhcp4.Packet {
+	t.Helper()
+
+	if _, err := client.WriteTo(req.Marshal(), server); err != nil {
+		t.Fatalf("send %s: %v", req, err)
+	}
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 1500)
+	n, _, err := client.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("no reply to %s: %v", req, err)
+	}
+	resp, err := dhcp4.Unmarshal(buf[:n])
+	if err != nil {
+		t.Fatalf("invalid reply to %s: %v", req, err)
+	}
+	return resp
+}
+
+// pxeRequest builds a request from a PXE client of the given architecture
+func pxeRequest(t dhcp4.MessageType, mac net.HardwareAddr, arch Arch) *dhcp4.Packet {
+	req := &dhcp4.Packet{
+		Op:      dhcp4.BootRequest,
+		HType:   1,
+		HLen:    6,
+		XID:     0x1234,
+		Flags:   dhcp4.FlagBroadcast,
+		CHAddr:  mac,
+		Options: make(dhcp4.Options),
+	}
+	req.Options[dhcp4.OptionMessageType] = []byte{byte(t)}
+	req.Options.SetString(dhcp4.OptionClassID, "PXEClient:Arch:00000:UNDI:002001")
+	req.Options.SetUint16(dhcp4.OptionClientArch, uint16(arch))
+	req.Options[dhcp4.OptionClientMachineID] = testUUID
+	return req
+}
+
+func TestDHCPDiscoverRequest(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+		arch Arch
+		file string
+	}{
+		{name: "bios", arch: ArchBIOS, file: "pxelinux.0"},
+		{name: "efi-x64", arch: ArchEFIX64, file: "bootx64.efi"},
+		{name: "efi-arm64", arch: ArchEFIARM64, file: "bootaa64.efi"},
+		{name: "ipxe", cfg: Config{IPXE: true}, arch: ArchEFIX64, file: "ipxe.efi"},
+		{name: "override", cfg: Config{BootFiles: map[Arch]string{ArchBIOS: "lpxelinux.0"}}, arch: ArchBIOS, file: "lpxelinux.0"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, tt.cfg)
+			client, addr := loopbackDHCP(t, s)
+
+			offer := exchange(t, client, addr, pxeRequest(dhcp4.Discover, testMAC, tt.arch))
+			if got := offer.MessageType(); got != dhcp4.Offer {
+				t.Fatalf("reply to discover is %s, want DHCPOFFER", got)
+			}
+			if !s.leases.contains(offer.YIAddr) {
+				t.Fatalf("offered %s outside the range", offer.YIAddr)
+			}
+			checkBootOptions(t, offer, tt.file)
+
+			req := pxeRequest(dhcp4.Request, testMAC, tt.arch)
+			req.Options.SetIP(dhcp4.OptionRequestedIP, offer.YIAddr)
+			req.Options.SetIP(dhcp4.OptionServerID, testServerIP)
+			ack := exchange(t, client, addr, req)
+			if got := ack.MessageType(); got != dhcp4.Ack {
+				t.Fatalf("reply to request is %s, want DHCPACK", got)
+			}
+			if !ack.YIAddr.Equal(offer.YIAddr) {
+				t.Errorf("acknowledged %s, offered %s", ack.YIAddr, offer.YIAddr)
+			}
+			checkBootOptions(t, ack, tt.file)
+
+			if got := ack.Options.IP(dhcp4.OptionRouter); !got.Equal(testGateway) {
+				t.Errorf("option 3 = %s, want %s", got, testGateway)
+			}
+			if got := ack.Options.IP(dhcp4.OptionDomainNameServer); !got.Equal(testDNS) {
+				t.Errorf("option 6 = %s, want %s", got, testDNS)
+			}
+			if got := binary.BigEndian.Uint32(ack.Options.Get(dhcp4.OptionLeaseTime)); got != uint32(defaultLeaseTime/time.Second) {
+				t.Errorf("option 51 = %d, want %d", got, uint32(defaultLeaseTime/time.Second))
+			}
+
+			leases := s.Leases()
+			if len(leases) != 1 || leases[0].State != LeaseBound || leases[0].MAC.String() != testMAC.String() {
+				t.Fatalf("leases = %+v, want one bound lease for %s", leases, testMAC)
+			}
+			if until := time.Until(leases[0].Expiry); until <= 0 || until > defaultLeaseTime {
+				t.Errorf("lease expires in %s", until)
+			}
+		})
+	}
+}
+
+// checkBootOptions checks the PXE options of a reply
+func checkBootOptions(t *testing.T, resp *dhcp4.Packet, file string) {
+	t.Helper()
+
+	if got := resp.Options.String(dhcp4.OptionClassID); got != pxeClientClass {
+		t.Errorf("option 60 = %q, want %q", got, pxeClientClass)
+	}
+	if got := resp.Options.String(dhcp4.OptionTFTPServerName); got != testServerIP.String() {
+		t.Errorf("option 66 = %q, want %q", got, testServerIP)
+	}
+	if got := resp.Options.String(dhcp4.OptionBootFileName); got != file {
+		t.Errorf("option 67 = %q, want %q", got, file)
+	}
+	if resp.File != file {
+		t.Errorf("file = %q, want %q", resp.File, file)
+	}
+	if !resp.SIAddr.Equal(testServerIP) {
+		t.Errorf("siaddr = %s, want %s", resp.SIAddr, testServerIP)
+	}
+	if got := resp.Options.Get(dhcp4.OptionClientMachineID); string(got) != string(testUUID) {
+		t.Errorf("option 97 = %x, want %x", got, testUUID)
+	}
+	if got := resp.Options.IP(dhcp4.OptionServerID); !got.Equal(testServerIP) {
+		t.Errorf("option 54 = %s, want %s", got, testServerIP)
+	}
+}
+
+func TestDHCPNonPXEClient(t *testing.T) {
+	s := newTestServer(t, Config{})
+	client, addr := loopbackDHCP(t, s)
+
+	req := pxeRequest(dhcp4.Discover, testMAC, ArchBIOS)
+	delete(req.Options, dhcp4.OptionClassID)
+	delete(req.Options, dhcp4.OptionClientArch)
+
+	offer := exchange(t, client, addr, req)
+	if got := offer.MessageType(); got != dhcp4.Offer {
+		t.Fatalf("reply is %s, want DHCPOFFER", got)
+	}
+	for _, code := range []dhcp4.OptionCode{dhcp4.OptionClassID, dhcp4.OptionTFTPServerName, dhcp4.OptionBootFileName} {
+		if offer.Options.Has(code) {
+			t.Errorf("option %d sent to a client that is not PXE booting", code)
+		}
+	}
+}
+
+func TestDHCPRequestOutOfRange(t *testing.T) {
+	s := newTestServer(t, Config{})
+
+	req := pxeRequest(dhcp4.Request, testMAC, ArchBIOS)
+	req.Options.SetIP(dhcp4.OptionRequestedIP, net.IPv4(10, 0, 0, 200))
+	req.Options.SetIP(dhcp4.OptionServerID, testServerIP)
+	if resp := s.ServeDHCP(req, nil); resp == nil || resp.MessageType() != dhcp4.Nak {
+		t.Fatalf("reply to request outside the range = %v, want DHCPNAK", resp)
+	}
+
+	// Without a server identifier the client may be talking to another
+	// server, which must be left to answer
+	delete(req.Options, dhcp4.OptionServerID)
+	if resp := s.ServeDHCP(req, nil); resp != nil {
+		t.Fatalf("reply to INIT-REBOOT request outside the range = %s, want none", resp)
+	}
+}
+
+func TestDHCPLeasePersistence(t *testing.T) {
+	dir := t.TempDir()
+	leaseFile := filepath.Join(dir, "leases.json")
+
+	s := newTestServer(t, Config{LeaseFile: leaseFile})
+	offer := s.ServeDHCP(pxeRequest(dhcp4.Discover, testMAC, ArchEFIX64), nil)
+	if offer == nil {
+		t.Fatal("no offer")
+	}
+
+	// Offers are not persisted
+	if _, err := os.Stat(leaseFile); !os.IsNotExist(err) {
+		t.Fatalf("lease file written for an offer: %v", err)
+	}
+
+	req := pxeRequest(dhcp4.Request, testMAC, ArchEFIX64)
+	req.Options.SetIP(dhcp4.OptionRequestedIP, offer.YIAddr)
+	req.Options.SetIP(dhcp4.OptionServerID, testServerIP)
+	req.Options.SetString(dhcp4.OptionHostName, "node1")
+	if ack := s.ServeDHCP(req, nil); ack == nil || ack.MessageType() != dhcp4.Ack {
+		t.Fatalf("reply to request = %v, want DHCPACK", ack)
+	}
+
+	data, err := os.ReadFile(leaseFile)
+	if err != nil {
+		t.Fatalf("lease file not written: %v", err)
+	}
+	var records []leaseRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		t.Fatalf("invalid lease file: %v", err)
+	}
+	if len(records) != 1 || records[0].MAC != testMAC.String() || records[0].IP != offer.YIAddr.String() || records[0].Hostname != "node1" {
+		t.Fatalf("lease file holds %+v", records)
+	}
+
+	// A restarted server offers the client the same address
+	restarted := newTestServer(t, Config{LeaseFile: leaseFile})
+	leases := restarted.Leases()
+	if len(leases) != 1 || !leases[0].IP.Equal(offer.YIAddr) || leases[0].State != LeaseBound {
+		t.Fatalf("restored leases = %+v", leases)
+	}
+	again := restarted.ServeDHCP(pxeRequest(dhcp4.Discover, testMAC, ArchEFIX64), nil)
+	if again == nil || !again.YIAddr.Equal(offer.YIAddr) {
+		t.Fatalf("restarted server offered %v, want %s", again, offer.YIAddr)
+	}
+
+	// Other clients are not given the address
+	other := net.HardwareAddr{0x52, 0x54, 0x00, 0x12, 0x34, 0x57}
+	if resp := restarted.ServeDHCP(pxeRequest(dhcp4.Discover, other, ArchEFIX64), nil); resp == nil || resp.YIAddr.Equal(offer.YIAddr) {
+		t.Fatalf("second client offered %v", resp)
+	}
+}
+
+func TestDHCPRelease(t *testing.T) {
+	s := newTestServer(t, Config{})
+	offer := s.ServeDHCP(pxeRequest(dhcp4.Discover, testMAC, ArchBIOS), nil)
+	req := pxeRequest(dhcp4.Request, testMAC, ArchBIOS)
+	req.Options.SetIP(dhcp4.OptionRequestedIP, offer.YIAddr)
+	s.ServeDHCP(req, nil)
+
+	rel := pxeRequest(dhcp4.Release, testMAC, ArchBIOS)
+	rel.CIAddr = offer.YIAddr
+	if resp := s.ServeDHCP(rel, nil); resp != nil {
+		t.Fatalf("reply to release = %s, want none", resp)
+	}
+	if leases := s.Leases(); len(leases) != 0 {
+		t.Fatalf("leases after release = %+v", leases)
+	}
+}
@@ -0,0 +1,361 @@
+package pxe
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/nimbus-project/nimbus/pxe/dhcp6"
+)
+
+// uefiEnterpriseNumber is the IANA enterprise number UEFI HTTP Boot clients
+// send their vendor class under
+const uefiEnterpriseNumber = 343
+
+// ServeDHCPv6 answers a DHCPv6 request. It implements dhcp6.Handler so the
+// allocation and boot logic can be driven directly, without sockets.
+func (s *Server) ServeDHCPv6(req *dhcp6.Message, relays []*dhcp6.RelayMessage, peer net.Addr) *dhcp6.Message {
+	// Requests naming another server are for that server alone
+	if id := req.Options.Get(dhcp6.OptionServerID); id != nil && !bytes.Equal(id, s.duid) {
+		return nil
+	}
+	if req.Type != dhcp6.InformationRequest && len(req.Options.Get(dhcp6.OptionClientID)) == 0 {
+		return nil
+	}
+
+	mac := s.dhcpv6ClientMAC(req, relays, peer)
+	if mac == nil {
+		log.Debug().Str("remote", peer.String()).Str("type", req.Type.String()).Msg("Ignoring DHCPv6 request from unidentified client")
+		return nil
+	}
+	if !s.Authorized(mac.String()) {
+		log.Warn().Str("mac", mac.String()).Msg("Ignoring DHCPv6 request from unauthorized host")
+		return nil
+	}
+
+	s.recordClientV6(req, mac)
+	resp := s.handleDHCPv6(req, mac)
+	s.emitDHCPv6(req, resp, mac)
+	return resp
+}
+
+// handleDHCPv6 dispatches a DHCPv6 request by message type
+func (s *Server) handleDHCPv6(req *dhcp6.Message, mac net.HardwareAddr) *dhcp6.Message {
+	switch req.Type {
+	case dhcp6.Solicit:
+		// Rapid commit skips the Advertise/Request exchange
+		if s.leases6 != nil && req.Options.Has(dhcp6.OptionRapidCommit) {
+			resp := s.dhcpv6Reply(req, dhcp6.Reply, mac)
+			resp.Options.Add(dhcp6.OptionRapidCommit, nil)
+			s.addIANAs(req, resp, mac, LeaseBound)
+			return resp
+		}
+		resp := s.dhcpv6Reply(req, dhcp6.Advertise, mac)
+		s.addIANAs(req, resp, mac, LeaseOffered)
+		return resp
+
+	case dhcp6.Request, dhcp6.Renew, dhcp6.Rebind:
+		resp := s.dhcpv6Reply(req, dhcp6.Reply, mac)
+		s.addIANAs(req, resp, mac, LeaseBound)
+		return resp
+
+	case dhcp6.Confirm:
+		return s.handleConfirm(req, mac)
+
+	case dhcp6.Release, dhcp6.Decline:
+		if s.leases6 != nil {
+			ias, _ := req.Options.IANAs()
+			for _, ia := range ias {
+				for _, ip := range ia.Addresses() {
+					if req.Type == dhcp6.Decline {
+						log.Warn().Str("mac", mac.String()).Str("ip", ip.String()).Msg("DHCPv6 address declined by client")
+						s.leases6.decline(iaKey(req, ia.IAID), ip)
+					} else {
+						log.Debug().Str("mac", mac.String()).Str("ip", ip.String()).Msg("DHCPv6 lease released")
+						s.leases6.release(iaKey(req, ia.IAID), ip)
+					}
+				}
+			}
+		}
+		resp := dhcp6.NewReply(req, dhcp6.Reply)
+		resp.Options.Add(dhcp6.OptionServerID, s.duid)
+		resp.Options.SetStatus(dhcp6.StatusSuccess, "")
+		return resp
+
+	case dhcp6.InformationRequest:
+		return s.dhcpv6Reply(req, dhcp6.Reply, mac)
+	}
+
+	return nil
+}
+
+// handleConfirm tells a client whether the addresses it holds are still
+// valid on its link. Without a DHCPv6 range the server knows nothing about
+// them and stays silent.
+func (s *Server) handleConfirm(req *dhcp6.Message, mac net.HardwareAddr) *dhcp6.Message {
+	if s.leases6 == nil {
+		return nil
+	}
+	ias, err := req.Options.IANAs()
+	if err != nil {
+		return nil
+	}
+
+	status := dhcp6.StatusSuccess
+	for _, ia := range ias {
+		for _, ip := range ia.Addresses() {
+			if !s.leases6.contains(ip) {
+				status = dhcp6.StatusNotOnLink
+			}
+		}
+	}
+
+	resp := dhcp6.NewReply(req, dhcp6.Reply)
+	resp.Options.Add(dhcp6.OptionServerID, s.duid)
+	resp.Options.SetStatus(status, "")
+	return resp
+}
+
+// dhcpv6Reply builds an Advertise or Reply carrying the server identifier,
+// DNS servers and, for netboot clients, boot options
+func (s *Server) dhcpv6Reply(req *dhcp6.Message, t dhcp6.MessageType, mac net.HardwareAddr) *dhcp6.Message {
+	resp := dhcp6.NewReply(req, t)
+	resp.Options.Add(dhcp6.OptionServerID, s.duid)
+	resp.Options.SetIPs(dhcp6.OptionDNSServers, s.config.DNSServers)
+	s.addBootOptionsV6(req, resp, mac)
+	return resp
+}
+
+// addIANAs assigns an address to each IA_NA in a request. Offered addresses
+// are held for offerHoldTime; bound ones for the lease time. Without a
+// DHCPv6 range every IA is answered with NoAddrsAvail, which leaves
+// address configuration to SLAAC.
+func (s *Server) addIANAs(req, resp *dhcp6.Message, mac net.HardwareAddr, state LeaseState) {
+	ias, err := req.Options.IANAs()
+	if err != nil {
+		log.Debug().Err(err).Str("mac", mac.String()).Msg("Invalid DHCPv6 IA_NA")
+		return
+	}
+
+	leaseTime := s.leaseTime()
+	duration := leaseTime
+	if state == LeaseOffered {
+		duration = offerHoldTime
+	}
+
+	for _, ia := range ias {
+		out := dhcp6.IANA{IAID: ia.IAID}
+		if s.leases6 == nil {
+			out.Options.SetStatus(dhcp6.StatusNoAddrsAvail, "no addresses available")
+			resp.Options.Add(dhcp6.OptionIANA, out.Marshal())
+			continue
+		}
+
+		var requested net.IP
+		if addrs := ia.Addresses(); len(addrs) > 0 {
+			requested = addrs[0]
+		}
+		lease, err := s.leases6.assign(iaKey(req, ia.IAID), mac, requested, state, duration)
+		if err != nil {
+			log.Warn().Err(err).Str("mac", mac.String()).Msg("Unable to assign DHCPv6 address")
+			out.Options.SetStatus(dhcp6.StatusNoAddrsAvail, err.Error())
+			resp.Options.Add(dhcp6.OptionIANA, out.Marshal())
+			continue
+		}
+
+		out.T1, out.T2 = leaseTime/2, leaseTime*7/8
+		out.AddAddress(lease.IP, leaseTime, leaseTime)
+		resp.Options.Add(dhcp6.OptionIANA, out.Marshal())
+
+		if state == LeaseBound {
+			log.Info().
+				Str("mac", mac.String()).
+				Str("ip", lease.IP.String()).
+				Time("expiry", lease.Expiry).
+				Msg("DHCPv6 lease bound")
+		}
+	}
+}
+
+// addBootOptionsV6 sets the boot file URL (option 59) on replies to netboot
+// clients. PXE clients are pointed at the boot file for their architecture
+// over TFTP, iPXE at its boot script and UEFI HTTP Boot clients at the boot
+// file on the HTTP server, all on the server's IPv6 address.
+func (s *Server) addBootOptionsV6(req, resp *dhcp6.Message, mac net.HardwareAddr) {
+	httpBoot := isHTTPBootClientV6(req)
+	if !httpBoot && !isPXEClientV6(req) {
+		return
+	}
+
+	file := s.bootFile(clientArchV6(req))
+	if isIPXEClientV6(req) {
+		file = s.ipxeScriptURL(mac)
+	}
+
+	var bootURL string
+	switch {
+	case httpBoot:
+		bootURL = s.hostURL(mac.String(), file)
+		resp.Options.SetVendorClass(uefiEnterpriseNumber, httpClientClass)
+	case strings.Contains(file, "://"):
+		bootURL = file
+	default:
+		bootURL = "tftp://" + hostLiteral(s.config.IPv6) + "/" + strings.TrimPrefix(file, "/")
+	}
+	resp.Options.SetString(dhcp6.OptionBootFileURL, bootURL)
+}
+
+// recordClientV6 remembers the architecture and SMBIOS UUID of a netboot
+// client and that it boots over IPv6, so that the URLs in its boot
+// configuration use the server's IPv6 address
+func (s *Server) recordClientV6(req *dhcp6.Message, mac net.HardwareAddr) {
+	if !isPXEClientV6(req) && !isHTTPBootClientV6(req) {
+		return
+	}
+
+	key := mac.String()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clientArchs[key] = clientArchV6(req).baseArch()
+	s.ipv6Clients[key] = true
+	if uuid := dhcp6.DUID(req.Options.Get(dhcp6.OptionClientID)).UUID(); uuid != "" {
+		s.clientUUIDs[key] = uuid
+	}
+}
+
+// dhcpv6ClientMAC identifies the MAC address of a DHCPv6 client. DHCPv6 has
+// no hardware address field, so it is taken from the link-layer address
+// option added by relay agents, the client's EUI-64 link-local address, its
+// DUID, or the SMBIOS UUID of a DUID-UUID seen earlier over DHCPv4.
+func (s *Server) dhcpv6ClientMAC(req *dhcp6.Message, relays []*dhcp6.RelayMessage, peer net.Addr) net.HardwareAddr {
+	peerIP := addrIP(peer)
+	if len(relays) > 0 {
+		inner := relays[len(relays)-1]
+		if mac := inner.Options.LinkLayerAddr(); len(mac) == 6 {
+			return mac
+		}
+		peerIP = inner.PeerAddr
+	}
+	if mac := eui64MAC(peerIP); mac != nil {
+		return mac
+	}
+
+	duid := dhcp6.DUID(req.Options.Get(dhcp6.OptionClientID))
+	if mac := duid.HardwareAddr(); len(mac) == 6 {
+		return mac
+	}
+	if uuid := duid.UUID(); uuid != "" {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for key, u := range s.clientUUIDs {
+			if u == uuid {
+				mac, _ := net.ParseMAC(key)
+				return mac
+			}
+		}
+	}
+	return nil
+}
+
+// eui64MAC returns the MAC address embedded in a link-local address formed
+// with modified EUI-64 (RFC 4291 appendix A), or nil
+func eui64MAC(ip net.IP) net.HardwareAddr {
+	ip = ip.To16()
+	if ip == nil || !ip.IsLinkLocalUnicast() || ip.To4() != nil || ip[11] != 0xff || ip[12] != 0xfe {
+		return nil
+	}
+	return net.HardwareAddr{ip[8] ^ 0x02, ip[9], ip[10], ip[13], ip[14], ip[15]}
+}
+
+// iaKey identifies an identity association by the client's DUID and IAID
+func iaKey(req *dhcp6.Message, iaid uint32) string {
+	return fmt.Sprintf("%x/%08x", req.Options.Get(dhcp6.OptionClientID), iaid)
+}
+
+// clientArchV6 determines the architecture of a DHCPv6 client from option
+// 61, which uses the same values as DHCPv4 option 93
+func clientArchV6(req *dhcp6.Message) Arch {
+	if archs := req.Options.ClientArchTypes(); len(archs) > 0 {
+		return Arch(archs[0])
+	}
+	return ArchEFIX64
+}
+
+// isPXEClientV6 reports whether a DHCPv6 request comes from netboot
+// firmware or iPXE: it reports its architecture or asks for a boot file URL
+func isPXEClientV6(req *dhcp6.Message) bool {
+	if req.Options.Has(dhcp6.OptionClientArchType) || req.Options.Requested(dhcp6.OptionBootFileURL) {
+		return true
+	}
+	for _, class := range req.Options.VendorClasses() {
+		if strings.HasPrefix(class, pxeClientClass) {
+			return true
+		}
+	}
+	return false
+}
+
+// isHTTPBootClientV6 reports whether a DHCPv6 request comes from UEFI HTTP
+// Boot firmware
+func isHTTPBootClientV6(req *dhcp6.Message) bool {
+	for _, class := range req.Options.VendorClasses() {
+		if strings.HasPrefix(class, httpClientClass) {
+			return true
+		}
+	}
+	return false
+}
+
+// isIPXEClientV6 reports whether a DHCPv6 request comes from iPXE
+func isIPXEClientV6(req *dhcp6.Message) bool {
+	for _, class := range req.Options.UserClasses() {
+		if class == ipxeUserClass {
+			return true
+		}
+	}
+	return false
+}
+
+// serverDUID returns the DUID the DHCPv6 server identifies itself with,
+// derived from the hardware address of iface if it has one so that it is
+// stable across restarts
+func serverDUID(iface string) dhcp6.DUID {
+	if iface != "" {
+		if ifi, err := net.InterfaceByName(iface); err == nil && len(ifi.HardwareAddr) == 6 {
+			return dhcp6.NewDUIDLL(ifi.HardwareAddr)
+		}
+	}
+	var uuid [16]byte
+	rand.Read(uuid[:])
+	return dhcp6.NewDUIDUUID(uuid)
+}
+
+// interfaceIPv6 returns the first global IPv6 address of an interface
+func interfaceIPv6(name string) (net.IP, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() == nil && ipnet.IP.IsGlobalUnicast() {
+			return ipnet.IP, nil
+		}
+	}
+	return nil, &net.AddrError{Err: "no global IPv6 address", Addr: name}
+}
+
+// hostLiteral formats an address for use as the host part of a URL
+func hostLiteral(ip net.IP) string {
+	if ip.To4() == nil {
+		return "[" + ip.String() + "]"
+	}
+	return ip.String()
+}
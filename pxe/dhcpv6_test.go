@@ -0,0 +1,204 @@
+package pxe
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/nimbus-project/nimbus/pxe/dhcp6"
+)
+
+var testServerIPv6 = net.ParseIP("2001:db8::1")
+
+// loopbackDHCPv6 serves h on a loopback UDP socket and returns a client
+// socket and the server's address. The server replies to the sender, so
+// IPv4 loopback works as well as IPv6.
+func loopbackDHCPv6(t *testing.T, h dhcp6.Handler) (net.PacketConn, net.Addr) {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	srv := dhcp6.NewServer(h)
+	go srv.Serve(conn)
+	t.Cleanup(func() { srv.Close() })
+
+	client, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client, conn.LocalAddr()
+}
+
+// exchangeV6 sends req to the server and returns its reply
+func exchangeV6(t *testing.T, client net.PacketConn, server net.Addr, req *dhcp6.Message) *dhcp6.Message {
+	t.Helper()
+
+	if _, err := client.WriteTo(req.Marshal(), server); err != nil {
+		t.Fatalf("send %s: %v", req, err)
+	}
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 1500)
+	n, _, err := client.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("no reply to %s: %v", req, err)
+	}
+	resp, err := dhcp6.Unmarshal(buf[:n])
+	if err != nil {
+		t.Fatalf("invalid reply to %s: %v", req, err)
+	}
+	return resp
+}
+
+// pxeRequestV6 builds a request from UEFI PXE firmware identified by a
+// link-layer DUID, with one IA_NA
+func pxeRequestV6(t dhcp6.MessageType, mac net.HardwareAddr, arch Arch) *dhcp6.Message {
+	req := &dhcp6.Message{Type: t, TransactionID: [3]byte{0x12, 0x34, 0x56}}
+	req.Options.Add(dhcp6.OptionClientID, dhcp6.NewDUIDLL(mac))
+	req.Options.Add(dhcp6.OptionORO, binary.BigEndian.AppendUint16(nil, uint16(dhcp6.OptionBootFileURL)))
+	req.Options.Add(dhcp6.OptionClientArchType, binary.BigEndian.AppendUint16(nil, uint16(arch)))
+	req.Options.Add(dhcp6.OptionIANA, dhcp6.IANA{IAID: 1}.Marshal())
+	return req
+}
+
+// replyIANA returns the single IA_NA of a reply
+func replyIANA(t *testing.T, resp *dhcp6.Message) dhcp6.IANA {
+	t.Helper()
+	ias, err := resp.Options.IANAs()
+	if err != nil || len(ias) != 1 {
+		t.Fatalf("IA_NAs = %v, %v; want one", ias, err)
+	}
+	return ias[0]
+}
+
+func TestDHCPv6SolicitRequest(t *testing.T) {
+	const bootURL = "tftp://[2001:db8::1]/bootx64.efi"
+
+	tests := []struct {
+		name   string
+		cfg    Config
+		leases bool
+	}{
+		{
+			name: "with range",
+			cfg: Config{
+				DHCPv6:           true,
+				IPv6:             testServerIPv6,
+				DHCPv6RangeStart: net.ParseIP("2001:db8::100"),
+				DHCPv6RangeEnd:   net.ParseIP("2001:db8::1ff"),
+			},
+			leases: true,
+		},
+		// Without a range the client is left to SLAAC for its address but
+		// still gets boot options
+		{name: "without range", cfg: Config{DHCPv6: true, IPv6: testServerIPv6}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, tt.cfg)
+			client, addr := loopbackDHCPv6(t, s)
+
+			adv := exchangeV6(t, client, addr, pxeRequestV6(dhcp6.Solicit, testMAC, ArchEFIX64))
+			if adv.Type != dhcp6.Advertise {
+				t.Fatalf("reply to solicit is %s, want ADVERTISE", adv.Type)
+			}
+			serverID := adv.Options.Get(dhcp6.OptionServerID)
+			if len(serverID) == 0 {
+				t.Fatal("advertise without server identifier")
+			}
+			if got := adv.Options.String(dhcp6.OptionBootFileURL); got != bootURL {
+				t.Errorf("advertised boot file URL %q, want %q", got, bootURL)
+			}
+			offered := replyIANA(t, adv).Addresses()
+			if tt.leases != (len(offered) == 1) {
+				t.Fatalf("advertised addresses %v", offered)
+			}
+
+			req := pxeRequestV6(dhcp6.Request, testMAC, ArchEFIX64)
+			req.Options.Add(dhcp6.OptionServerID, serverID)
+			if tt.leases {
+				ia := dhcp6.IANA{IAID: 1}
+				ia.AddAddress(offered[0], 0, 0)
+				req.Options.Set(dhcp6.OptionIANA, ia.Marshal())
+			}
+			reply := exchangeV6(t, client, addr, req)
+			if reply.Type != dhcp6.Reply || reply.TransactionID != req.TransactionID {
+				t.Fatalf("reply to request is %s, want REPLY xid=123456", reply)
+			}
+			if got := reply.Options.String(dhcp6.OptionBootFileURL); got != bootURL {
+				t.Errorf("boot file URL %q, want %q", got, bootURL)
+			}
+
+			ia := replyIANA(t, reply)
+			leases := s.Leases()
+			if !tt.leases {
+				status := ia.Options.Get(dhcp6.OptionStatusCode)
+				if len(status) < 2 || binary.BigEndian.Uint16(status) != dhcp6.StatusNoAddrsAvail {
+					t.Errorf("IA_NA status %x, want NoAddrsAvail", status)
+				}
+				if len(leases) != 0 {
+					t.Errorf("leases = %+v, want none", leases)
+				}
+				return
+			}
+
+			if addrs := ia.Addresses(); len(addrs) != 1 || !addrs[0].Equal(offered[0]) {
+				t.Fatalf("bound %v, advertised %s", addrs, offered[0])
+			}
+			if ia.T1 != defaultLeaseTime/2 || ia.T2 != defaultLeaseTime*7/8 {
+				t.Errorf("T1, T2 = %s, %s", ia.T1, ia.T2)
+			}
+			if len(leases) != 1 || leases[0].State != LeaseBound || !leases[0].IP.Equal(offered[0]) || leases[0].MAC.String() != testMAC.String() {
+				t.Errorf("leases = %+v, want %s bound to %s", leases, offered[0], testMAC)
+			}
+		})
+	}
+}
+
+func TestDHCPv6IgnoresOtherServers(t *testing.T) {
+	s := newTestServer(t, Config{DHCPv6: true, IPv6: testServerIPv6})
+
+	req := pxeRequestV6(dhcp6.Request, testMAC, ArchEFIX64)
+	req.Options.Add(dhcp6.OptionServerID, dhcp6.NewDUIDLL(net.HardwareAddr{0x52, 0x54, 0x00, 0xff, 0xff, 0xff}))
+	if resp := s.ServeDHCPv6(req, nil, &net.UDPAddr{IP: net.ParseIP("fe80::1")}); resp != nil {
+		t.Errorf("answered a request for another server with %s", resp)
+	}
+
+	// Without a client identifier the client cannot be told apart
+	req = pxeRequestV6(dhcp6.Solicit, testMAC, ArchEFIX64)
+	req.Options.Del(dhcp6.OptionClientID)
+	if resp := s.ServeDHCPv6(req, nil, &net.UDPAddr{IP: net.ParseIP("fe80::1")}); resp != nil {
+		t.Errorf("answered a solicit without client identifier with %s", resp)
+	}
+}
+
+func TestDHCPv6Relayed(t *testing.T) {
+	s := newTestServer(t, Config{DHCPv6: true, IPv6: testServerIPv6})
+
+	// The client is known by the link-layer address option the relay adds,
+	// even though its DUID carries no hardware address
+	req := pxeRequestV6(dhcp6.Solicit, testMAC, ArchEFIX64)
+	req.Options.Set(dhcp6.OptionClientID, dhcp6.NewDUIDUUID([16]byte{1, 2, 3}))
+	relay := &dhcp6.RelayMessage{
+		Type:     dhcp6.RelayForward,
+		LinkAddr: net.ParseIP("2001:db8:1::1"),
+		PeerAddr: net.ParseIP("fe80::1"),
+	}
+	relay.Options.Add(dhcp6.OptionClientLinkLayerAddr, append([]byte{0, 1}, testMAC...))
+
+	resp := s.ServeDHCPv6(req, []*dhcp6.RelayMessage{relay}, &net.UDPAddr{IP: net.ParseIP("2001:db8:1::1")})
+	if resp == nil || resp.Type != dhcp6.Advertise {
+		t.Fatalf("reply to relayed solicit = %v, want ADVERTISE", resp)
+	}
+	if !bytes.Equal(resp.Options.Get(dhcp6.OptionClientID), req.Options.Get(dhcp6.OptionClientID)) {
+		t.Error("client identifier not echoed")
+	}
+	if !s.isIPv6Client(testMAC.String()) {
+		t.Error("relayed client not recorded as booting over IPv6")
+	}
+}
@@ -0,0 +1,162 @@
+package pxe
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// discoveryInventoryPath is the HTTP path the discovery agent posts its
+	// inventory to
+	discoveryInventoryPath = "/discovery/inventory"
+
+	// discoveryURLArg is the kernel argument telling the discovery agent
+	// where to post its inventory
+	discoveryURLArg = "nimbus.inventory_url"
+
+	// discoveryTokenArg is the kernel argument holding the token the
+	// discovery agent authenticates its inventory with
+	discoveryTokenArg = "nimbus.discovery_token"
+
+	// maxInventorySize limits the size of a posted inventory
+	maxInventorySize = 1 << 20
+)
+
+// Inventory is the hardware inventory reported by the discovery agent, in
+// the JSON form it is posted in
+type Inventory struct {
+	// MAC address of the interface the host booted from
+	MAC string `json:"mac"`
+
+	// SMBIOS system information
+	UUID         string `json:"uuid,omitempty"`
+	Manufacturer string `json:"manufacturer,omitempty"`
+	Product      string `json:"product,omitempty"`
+	SerialNumber string `json:"serial_number,omitempty"`
+
+	CPU      InventoryCPU    `json:"cpu"`
+	MemoryMB int64           `json:"memory_mb"`
+	Disks    []InventoryDisk `json:"disks,omitempty"`
+	NICs     []InventoryNIC  `json:"nics,omitempty"`
+}
+
+// InventoryCPU describes a host's processors
+type InventoryCPU struct {
+	Vendor  string `json:"vendor"`
+	Model   string `json:"model"`
+	Sockets int    `json:"sockets,omitempty"`
+	Cores   int    `json:"cores"`
+	Threads int    `json:"threads"`
+}
+
+// InventoryDisk describes a block device
+type InventoryDisk struct {
+	Device       string `json:"device"`
+	Model        string `json:"model,omitempty"`
+	SerialNumber string `json:"serial_number,omitempty"`
+	SizeBytes    int64  `json:"size_bytes"`
+	Rotational   bool   `json:"rotational,omitempty"`
+}
+
+// InventoryNIC describes a network interface
+type InventoryNIC struct {
+	Name       string `json:"name"`
+	MAC        string `json:"mac"`
+	SpeedMbps  int    `json:"speed_mbps,omitempty"`
+	DuplexFull bool   `json:"duplex_full,omitempty"`
+}
+
+// InventoryHandler receives inventories posted by the discovery agent. An
+// error makes the agent retry later.
+type InventoryHandler func(ctx context.Context, inv Inventory) error
+
+// SetInventoryHandler sets the function that receives inventories posted by
+// the discovery agent
+func (s *Server) SetInventoryHandler(h InventoryHandler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.inventoryHandler = h
+}
+
+// discoveryToken returns the token the discovery agent booted by a host
+// posts its inventory with. It is derived from the host's MAC address, so
+// it stays the same across boots without being stored, and is only valid
+// for that host's inventory.
+func (s *Server) discoveryToken(mac string) string {
+	h := hmac.New(sha256.New, s.discoverySecret)
+	h.Write([]byte(mac))
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// serveInventory accepts an inventory from the discovery agent. A missing
+// MAC address is filled in from the address the client was acknowledged
+// with. The agent must pass the token from its kernel command line as a
+// bearer token in the Authorization header or in the "token" query
+// parameter.
+func (s *Server) serveInventory(w http.ResponseWriter, r *http.Request) {
+	var inv Inventory
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxInventorySize))
+	if err := dec.Decode(&inv); err != nil {
+		http.Error(w, "invalid inventory: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var ip net.IP
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		ip = net.ParseIP(host)
+	}
+
+	s.mu.Lock()
+	handler := s.inventoryHandler
+	if inv.MAC == "" && ip != nil {
+		if mac, ok := s.clientMACs[ip.String()]; ok {
+			inv.MAC = mac.String()
+		}
+	}
+	s.mu.Unlock()
+
+	mac, err := net.ParseMAC(inv.MAC)
+	if err != nil {
+		http.Error(w, "invalid MAC address", http.StatusBadRequest)
+		return
+	}
+	inv.MAC = mac.String()
+
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		token = r.URL.Query().Get("token")
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(s.discoveryToken(inv.MAC))) != 1 {
+		log.Warn().Str("mac", inv.MAC).Str("remote", r.RemoteAddr).Msg("Refusing hardware inventory with invalid discovery token")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if handler == nil {
+		http.Error(w, "inventory is not being collected", http.StatusServiceUnavailable)
+		return
+	}
+	if err := handler(r.Context(), inv); err != nil {
+		log.Error().Err(err).Str("mac", inv.MAC).Msg("Failed to handle hardware inventory")
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Info().
+		Str("mac", inv.MAC).
+		Str("remote", r.RemoteAddr).
+		Str("product", inv.Product).
+		Msg("Received hardware inventory")
+	s.emit(Event{Type: EventInventory, MAC: mac, IP: ip})
+
+	w.WriteHeader(http.StatusAccepted)
+}
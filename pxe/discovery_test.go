@@ -0,0 +1,106 @@
+package pxe
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDiscoveryToken(t *testing.T) {
+	s := newTestServer(t, Config{Discovery: &Profile{Kernel: "discovery/vmlinuz", Initrd: "discovery/initrd.img"}})
+	var got []Inventory
+	s.SetInventoryHandler(func(ctx context.Context, inv Inventory) error {
+		got = append(got, inv)
+		return nil
+	})
+
+	p, err := s.resolveProfile(testMAC.String())
+	if err != nil {
+		t.Fatalf("resolveProfile: %v", err)
+	}
+	if p.Action != ActionDiscover {
+		t.Fatalf("unknown host boots %s, want the discovery agent", p.Action)
+	}
+	var token string
+	for _, arg := range strings.Fields(p.Cmdline) {
+		if v, ok := strings.CutPrefix(arg, discoveryTokenArg+"="); ok {
+			token = v
+		}
+	}
+	if token == "" {
+		t.Fatalf("no discovery token in %q", p.Cmdline)
+	}
+	if !strings.Contains(p.Cmdline, discoveryURLArg+"=") {
+		t.Fatalf("no inventory URL in %q", p.Cmdline)
+	}
+
+	other := "52:54:00:12:34:57"
+	post := func(mac, query, auth string) int {
+		body := `{"mac":"` + mac + `","product":"Test"}`
+		req := httptest.NewRequest(http.MethodPost, discoveryInventoryPath+query, strings.NewReader(body))
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		rec := httptest.NewRecorder()
+		s.serveInventory(rec, req)
+		return rec.Code
+	}
+
+	tests := []struct {
+		name   string
+		mac    string
+		query  string
+		auth   string
+		status int
+	}{
+		{name: "no token", mac: testMAC.String(), status: http.StatusUnauthorized},
+		{name: "wrong token", mac: testMAC.String(), auth: "Bearer " + strings.Repeat("0", len(token)), status: http.StatusUnauthorized},
+		{name: "other host", mac: other, auth: "Bearer " + token, status: http.StatusUnauthorized},
+		{name: "bearer", mac: testMAC.String(), auth: "Bearer " + token, status: http.StatusAccepted},
+		{name: "query", mac: testMAC.String(), query: "?token=" + token, status: http.StatusAccepted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if status := post(tt.mac, tt.query, tt.auth); status != tt.status {
+				t.Fatalf("status = %d, want %d", status, tt.status)
+			}
+		})
+	}
+
+	if len(got) != 2 {
+		t.Fatalf("handler received %d inventories, want 2", len(got))
+	}
+	for _, inv := range got {
+		if inv.MAC != testMAC.String() {
+			t.Errorf("inventory for %s accepted", inv.MAC)
+		}
+	}
+
+	// Tokens stay the same across boots
+	again, _ := s.resolveProfile(testMAC.String())
+	if again.Cmdline != p.Cmdline {
+		t.Errorf("command line changed from %q to %q", p.Cmdline, again.Cmdline)
+	}
+}
+
+func TestDiscoveryHandlerError(t *testing.T) {
+	s := newTestServer(t, Config{Discovery: &Profile{Kernel: "discovery/vmlinuz"}})
+	s.SetInventoryHandler(func(ctx context.Context, inv Inventory) error {
+		return errors.New("write /var/lib/nimbus/inventory.json: no space left on device")
+	})
+
+	body := `{"mac":"` + testMAC.String() + `","product":"Test"}`
+	req := httptest.NewRequest(http.MethodPost, discoveryInventoryPath, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+s.discoveryToken(testMAC.String()))
+	rec := httptest.NewRecorder()
+	s.serveInventory(rec, req)
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("status %d, want %d", rec.Code, http.StatusInternalServerError)
+	}
+	if strings.Contains(rec.Body.String(), "inventory.json") {
+		t.Errorf("error served to the client: %q", rec.Body.String())
+	}
+}
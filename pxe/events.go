@@ -0,0 +1,361 @@
+package pxe
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/nimbus-project/nimbus/pxe/dhcp4"
+	"github.com/nimbus-project/nimbus/pxe/dhcp6"
+)
+
+// EventType identifies what happened in a boot event
+type EventType string
+
+// Boot event types
+const (
+	EventDHCPDiscover EventType = "dhcp_discover"
+	EventDHCPRequest  EventType = "dhcp_request"
+	EventDHCPOffer    EventType = "dhcp_offer"
+	EventDHCPAck      EventType = "dhcp_ack"
+	EventDHCPNak      EventType = "dhcp_nak"
+	EventDHCPRelease  EventType = "dhcp_release"
+	EventDHCPDecline  EventType = "dhcp_decline"
+
+	// EventTFTPFile is emitted when a TFTP transfer ends
+	EventTFTPFile EventType = "tftp_file"
+
+	// EventHTTPFile is emitted when a file, artifact or boot script has been
+	// served over HTTP
+	EventHTTPFile EventType = "http_file"
+
+	// EventInventory is emitted when the discovery agent has posted a
+	// host's hardware inventory
+	EventInventory EventType = "inventory"
+)
+
+// FileRole describes what a served file is used for in a host's boot
+// profile
+type FileRole string
+
+// File roles
+const (
+	RoleKernel FileRole = "kernel"
+	RoleInitrd FileRole = "initrd"
+)
+
+// Event describes a step a host took while network booting
+type Event struct {
+	Type EventType
+	Time time.Time
+
+	// Client identity. MAC is filled in for TFTP and HTTP events from the
+	// address the client was last acknowledged with, if any.
+	MAC  net.HardwareAddr
+	IP   net.IP
+	Arch Arch
+
+	// File is the boot file of a DHCP reply or the path of a file served
+	// over TFTP or HTTP. Role is set if the file is the kernel or initrd of
+	// the host's boot profile.
+	File string
+	Role FileRole
+
+	// Bytes sent for file events. Complete is false for transfers that
+	// ended before the whole file was sent.
+	Bytes    int64
+	Complete bool
+}
+
+// eventBus fans events out to subscribers without ever blocking the
+// servers. Subscribers that fall behind miss events.
+type eventBus struct {
+	mu     sync.Mutex
+	subs   map[chan Event]struct{}
+	closed bool
+}
+
+// Subscribe returns a channel receiving boot events and a function that ends
+// the subscription and closes the channel. Events are dropped for a
+// subscriber whose buffer is full.
+func (s *Server) Subscribe(buffer int) (<-chan Event, func()) {
+	ch := make(chan Event, buffer)
+
+	s.events.mu.Lock()
+	defer s.events.mu.Unlock()
+	if s.events.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	if s.events.subs == nil {
+		s.events.subs = make(map[chan Event]struct{})
+	}
+	s.events.subs[ch] = struct{}{}
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			s.events.mu.Lock()
+			defer s.events.mu.Unlock()
+			if _, ok := s.events.subs[ch]; ok {
+				delete(s.events.subs, ch)
+				close(ch)
+			}
+		})
+	}
+}
+
+// closeEvents ends all subscriptions
+func (s *Server) closeEvents() {
+	s.events.mu.Lock()
+	defer s.events.mu.Unlock()
+	for ch := range s.events.subs {
+		close(ch)
+	}
+	s.events.subs = nil
+	s.events.closed = true
+}
+
+// emit fills in what is known about the client and delivers e to all
+// subscribers
+func (s *Server) emit(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	s.mu.Lock()
+	if e.MAC == nil && e.IP != nil {
+		e.MAC = s.clientMACs[e.IP.String()]
+	}
+	if e.MAC != nil {
+		if arch, ok := s.clientArchs[e.MAC.String()]; ok {
+			e.Arch = arch
+		}
+	}
+	s.mu.Unlock()
+
+	if e.MAC != nil && e.File != "" && e.Role == "" {
+		if p, err := s.resolveProfile(e.MAC.String()); err == nil {
+			file := strings.TrimPrefix(e.File, "/")
+			switch {
+			case p.Kernel != "" && file == strings.TrimPrefix(p.Kernel, "/"):
+				e.Role = RoleKernel
+			case p.Initrd != "" && file == strings.TrimPrefix(p.Initrd, "/"):
+				e.Role = RoleInitrd
+			}
+		}
+	}
+
+	s.events.mu.Lock()
+	defer s.events.mu.Unlock()
+	for ch := range s.events.subs {
+		select {
+		case ch <- e:
+		default:
+			log.Warn().Str("type", string(e.Type)).Msg("Boot event dropped for slow subscriber")
+		}
+	}
+}
+
+// dhcpEventTypes maps DHCP message types to events
+var dhcpEventTypes = map[dhcp4.MessageType]EventType{
+	dhcp4.Discover: EventDHCPDiscover,
+	dhcp4.Request:  EventDHCPRequest,
+	dhcp4.Offer:    EventDHCPOffer,
+	dhcp4.Ack:      EventDHCPAck,
+	dhcp4.Nak:      EventDHCPNak,
+	dhcp4.Release:  EventDHCPRelease,
+	dhcp4.Decline:  EventDHCPDecline,
+}
+
+// emitDHCP emits events for a DHCP request and the reply to it, if any. The
+// address a client is acknowledged with is remembered so that later TFTP
+// and HTTP requests can be attributed to it.
+func (s *Server) emitDHCP(req, resp *dhcp4.Packet) {
+	arch := clientArch(req).baseArch()
+
+	if t, ok := dhcpEventTypes[req.MessageType()]; ok {
+		ip := req.Options.IP(dhcp4.OptionRequestedIP)
+		if ip == nil && req.CIAddr != nil && !req.CIAddr.IsUnspecified() {
+			ip = req.CIAddr
+		}
+		s.emit(Event{Type: t, MAC: req.CHAddr, IP: ip, Arch: arch})
+	}
+	if resp == nil {
+		return
+	}
+
+	t, ok := dhcpEventTypes[resp.MessageType()]
+	if !ok {
+		return
+	}
+	ip := resp.YIAddr
+	if ip == nil || ip.IsUnspecified() {
+		ip = resp.CIAddr
+	}
+	if ip != nil && ip.IsUnspecified() {
+		ip = nil
+	}
+
+	if t == EventDHCPAck && ip != nil {
+		s.rememberClient(ip, req.CHAddr)
+	}
+
+	s.emit(Event{Type: t, MAC: req.CHAddr, IP: ip, Arch: arch, File: resp.File})
+}
+
+// dhcpv6EventTypes maps DHCPv6 requests to the events of their DHCPv4
+// counterparts
+var dhcpv6EventTypes = map[dhcp6.MessageType]EventType{
+	dhcp6.Solicit: EventDHCPDiscover,
+	dhcp6.Request: EventDHCPRequest,
+	dhcp6.Renew:   EventDHCPRequest,
+	dhcp6.Rebind:  EventDHCPRequest,
+	dhcp6.Release: EventDHCPRelease,
+	dhcp6.Decline: EventDHCPDecline,
+}
+
+// emitDHCPv6 emits events for a DHCPv6 request and the reply to it. An
+// Advertise is reported as an offer and a Reply assigning an address as an
+// acknowledgement, whose address is remembered like a DHCPv4 one.
+func (s *Server) emitDHCPv6(req, resp *dhcp6.Message, mac net.HardwareAddr) {
+	arch := clientArchV6(req).baseArch()
+
+	if t, ok := dhcpv6EventTypes[req.Type]; ok {
+		s.emit(Event{Type: t, MAC: mac, Arch: arch})
+	}
+	if resp == nil {
+		return
+	}
+
+	var t EventType
+	switch {
+	case resp.Type == dhcp6.Advertise:
+		t = EventDHCPOffer
+	case resp.Type == dhcp6.Reply && req.Type != dhcp6.Release && req.Type != dhcp6.Decline:
+		t = EventDHCPAck
+	default:
+		return
+	}
+
+	var ip net.IP
+	if ias, err := resp.Options.IANAs(); err == nil {
+		for _, ia := range ias {
+			if addrs := ia.Addresses(); len(addrs) > 0 {
+				ip = addrs[0]
+				break
+			}
+		}
+	}
+
+	if t == EventDHCPAck && ip != nil {
+		s.rememberClient(ip, mac)
+	}
+
+	s.emit(Event{Type: t, MAC: mac, IP: ip, Arch: arch, File: resp.Options.String(dhcp6.OptionBootFileURL)})
+}
+
+// rememberClient records that ip belongs to the client with the given MAC
+// address
+func (s *Server) rememberClient(ip net.IP, mac net.HardwareAddr) {
+	s.mu.Lock()
+	s.clientMACs[ip.String()] = mac
+	s.mu.Unlock()
+}
+
+// ClientMAC returns the MAC address of the client last acknowledged with ip,
+// or in proxy mode last seen requesting it, or nil if there is none
+func (s *Server) ClientMAC(ip net.IP) net.HardwareAddr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.clientMACs[ip.String()]
+}
+
+// fileEventReader emits a file event when a transfer closes its file
+type fileEventReader struct {
+	io.ReadCloser
+	size  int64
+	read  int64
+	close func(read int64, complete bool)
+}
+
+// Read counts the bytes read
+func (r *fileEventReader) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	r.read += int64(n)
+	return n, err
+}
+
+// Close closes the file and emits the event
+func (r *fileEventReader) Close() error {
+	err := r.ReadCloser.Close()
+	r.close(r.read, r.read >= r.size)
+	return err
+}
+
+// tftpEvents wraps a file opened for a TFTP client so that an event is
+// emitted when its transfer ends
+func (s *Server) tftpEvents(rc io.ReadCloser, size int64, name string, remote net.Addr) io.ReadCloser {
+	return &fileEventReader{
+		ReadCloser: rc,
+		size:       size,
+		close: func(read int64, complete bool) {
+			s.emit(Event{
+				Type:     EventTFTPFile,
+				IP:       addrIP(remote),
+				File:     name,
+				Bytes:    read,
+				Complete: complete,
+			})
+		},
+	}
+}
+
+// httpEvents is a Middleware emitting an event for each file served
+func (s *Server) httpEvents(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		if rec.status < 200 || rec.status >= 300 {
+			return
+		}
+
+		var ip net.IP
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			ip = net.ParseIP(host)
+		}
+
+		// A range request transfers only part of the file, so whether the
+		// client now has all of it is not known
+		complete := rec.status == http.StatusOK && r.Method != http.MethodHead
+		if n, err := strconv.ParseInt(w.Header().Get("Content-Length"), 10, 64); err == nil && n != rec.bytes {
+			complete = false
+		}
+
+		s.emit(Event{
+			Type:     EventHTTPFile,
+			IP:       ip,
+			File:     r.URL.Path,
+			Bytes:    rec.bytes,
+			Complete: complete,
+		})
+	})
+}
+
+// addrIP returns the IP address of a UDP or TCP address
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	default:
+		return nil
+	}
+}
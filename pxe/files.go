@@ -0,0 +1,224 @@
+package pxe
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/nimbus-project/nimbus/pxe/tftp"
+)
+
+// FileGenerator generates the contents of a file on demand. name is the
+// requested path relative to the prefix the generator was registered with and
+// remote is the address of the requesting client. Generators should return
+// tftp.ErrNotFound for names they do not handle.
+type FileGenerator func(name string, remote net.Addr) ([]byte, error)
+
+// AddTFTPGenerator registers a generator for all TFTP paths beginning with
+// prefix. Generated files take precedence over files in RootDir.
+func (s *Server) AddTFTPGenerator(prefix string, gen FileGenerator) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tftpGenerators[strings.TrimPrefix(prefix, "/")] = gen
+}
+
+// generatorHandler serves the files produced by gen over HTTP for all paths
+// beginning with prefix
+func generatorHandler(prefix string, gen FileGenerator) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, err := cleanPath(strings.TrimPrefix(r.URL.Path, prefix))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		var remote net.Addr
+		if addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil {
+			remote = addr
+		}
+
+		data, err := gen(name, remote)
+		switch {
+		case errors.Is(err, tftp.ErrNotFound):
+			http.NotFound(w, r)
+			return
+		case errors.Is(err, tftp.ErrAccess):
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		case err != nil:
+			log.Error().Err(err).Str("path", r.URL.Path).Msg("Failed to generate file")
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write(data)
+	})
+}
+
+// serveTFTPFile resolves a TFTP read request to a generated file or a file
+// below RootDir
+func (s *Server) serveTFTPFile(filename string, remote net.Addr) (io.ReadCloser, int64, error) {
+	name, err := cleanPath(filename)
+	if err != nil {
+		log.Warn().Str("file", filename).Str("remote", remote.String()).Msg("Rejected TFTP path outside root directory")
+		return nil, 0, err
+	}
+	if !s.authorizedClient(remote) {
+		log.Warn().Str("file", name).Str("remote", remote.String()).Msg("Refusing TFTP request from unauthorized host")
+		return nil, 0, tftp.ErrAccess
+	}
+
+	if gen, rest, ok := s.lookupGenerator(name); ok {
+		data, err := gen(rest, remote)
+		if err != nil {
+			return nil, 0, err
+		}
+		size := int64(len(data))
+		return s.tftpEvents(io.NopCloser(bytes.NewReader(data)), size, name, remote), size, nil
+	}
+
+	f, size, err := s.openFile(context.Background(), name)
+	if err != nil {
+		return nil, 0, err
+	}
+	return s.tftpEvents(f, size, name, remote), size, nil
+}
+
+// openFile opens a file below RootDir or a remote artifact, which is
+// downloaded first if it is not yet cached
+func (s *Server) openFile(ctx context.Context, name string) (*os.File, int64, error) {
+	if rest, ok := strings.CutPrefix(name, artifactPath); ok {
+		return s.artifacts.Open(ctx, rest)
+	}
+	return openRootFile(s.config.RootDir, name)
+}
+
+// lookupGenerator returns the generator with the longest prefix matching name
+func (s *Server) lookupGenerator(name string) (FileGenerator, string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var (
+		best    FileGenerator
+		bestLen = -1
+	)
+	for prefix, gen := range s.tftpGenerators {
+		if strings.HasPrefix(name, prefix) && len(prefix) > bestLen {
+			best, bestLen = gen, len(prefix)
+		}
+	}
+	if best == nil {
+		return nil, "", false
+	}
+	return best, name[bestLen:], true
+}
+
+// cleanPath normalises a client supplied path into a slash separated path
+// relative to the root directory. Paths containing ".." segments are rejected
+// rather than resolved so that clients cannot probe outside the root.
+func cleanPath(name string) (string, error) {
+	if strings.ContainsRune(name, 0) {
+		return "", tftp.ErrAccess
+	}
+
+	// Some firmware sends DOS style separators
+	name = strings.ReplaceAll(name, "\\", "/")
+	for _, segment := range strings.Split(name, "/") {
+		if segment == ".." {
+			return "", tftp.ErrAccess
+		}
+	}
+
+	cleaned := strings.TrimPrefix(path.Clean("/"+name), "/")
+	if cleaned == "" {
+		return "", tftp.ErrNotFound
+	}
+	return cleaned, nil
+}
+
+// openRootFile opens the regular file name below root, refusing to follow
+// symlinks that point outside of it
+func openRootFile(root, name string) (*os.File, int64, error) {
+	rootPath, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to resolve root directory: %w", err)
+	}
+
+	full, err := filepath.EvalSymlinks(filepath.Join(rootPath, filepath.FromSlash(name)))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, 0, tftp.ErrNotFound
+		}
+		return nil, 0, err
+	}
+
+	rel, err := filepath.Rel(rootPath, full)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil, 0, tftp.ErrAccess
+	}
+
+	f, err := os.Open(full)
+	if err != nil {
+		if os.IsPermission(err) {
+			return nil, 0, tftp.ErrAccess
+		}
+		return nil, 0, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	if !info.Mode().IsRegular() {
+		f.Close()
+		return nil, 0, tftp.ErrNotFound
+	}
+
+	return f, info.Size(), nil
+}
+
+// pxelinuxConfig generates pxelinux.cfg/ files. PXELINUX requests
+// 01-<mac> with the MAC address in lower case hex separated by dashes before
+// falling back to default. A MAC address's file is not served to other
+// hosts.
+func (s *Server) pxelinuxConfig(name string, remote net.Addr) ([]byte, error) {
+	switch {
+	case name == "default":
+		cfg, err := s.GeneratePXEConfig("")
+		if err != nil {
+			return nil, err
+		}
+		return []byte(cfg), nil
+
+	case strings.HasPrefix(name, "01-"):
+		mac, err := net.ParseMAC(strings.ReplaceAll(name[3:], "-", ":"))
+		if err != nil {
+			return nil, tftp.ErrNotFound
+		}
+		if !s.requestedByHost(mac, remote) {
+			log.Warn().Str("file", name).Str("remote", addrIP(remote).String()).Msg("Refusing another host's boot configuration")
+			return nil, tftp.ErrAccess
+		}
+		cfg, err := s.GeneratePXEConfig(mac.String())
+		if err != nil {
+			return nil, err
+		}
+		return []byte(cfg), nil
+
+	default:
+		// UUID and IP based lookups fall through to the MAC or default file
+		return nil, tftp.ErrNotFound
+	}
+}
@@ -0,0 +1,313 @@
+package pxe
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nimbus-project/nimbus/pxe/dhcp4"
+	"github.com/nimbus-project/nimbus/pxe/tftp"
+)
+
+// bindLease takes a lease for mac through DHCP and returns its address
+func bindLease(t *testing.T, s *Server, mac net.HardwareAddr) net.IP {
+	t.Helper()
+
+	offer := s.ServeDHCP(pxeRequest(dhcp4.Discover, mac, ArchBIOS), nil)
+	if offer == nil {
+		t.Fatalf("no offer for %s", mac)
+	}
+	req := pxeRequest(dhcp4.Request, mac, ArchBIOS)
+	req.Options.SetIP(dhcp4.OptionRequestedIP, offer.YIAddr)
+	req.Options.SetIP(dhcp4.OptionServerID, testServerIP)
+	if ack := s.ServeDHCP(req, nil); ack == nil || ack.MessageType() != dhcp4.Ack {
+		t.Fatalf("no acknowledgement for %s", mac)
+	}
+	return offer.YIAddr
+}
+
+func TestPerHostConfigNotServedToOtherHosts(t *testing.T) {
+	s := newTestServer(t, Config{Kernel: "vmlinuz", Initrd: "initrd.img", Cmdline: "console=ttyS0"})
+	other := net.HardwareAddr{0x52, 0x54, 0x00, 0x12, 0x34, 0x57}
+	if err := s.SetHostCmdline(testMAC.String(), "nimbus.secret=abc"); err != nil {
+		t.Fatal(err)
+	}
+	hostIP := bindLease(t, s, testMAC)
+	otherIP := bindLease(t, s, other)
+
+	dashed := strings.ReplaceAll(testMAC.String(), ":", "-")
+	tests := []struct {
+		name string
+		gen  FileGenerator
+		file string
+	}{
+		{name: "pxelinux", gen: s.pxelinuxConfig, file: "01-" + dashed},
+		{name: "grub", gen: s.grubConfig, file: "grub.cfg-01-" + dashed},
+		{name: "grub platform", gen: s.grubConfig, file: "x86_64-efi/grub.cfg-01-" + dashed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := tt.gen(tt.file, &net.UDPAddr{IP: hostIP, Port: 2070})
+			if err != nil {
+				t.Fatalf("host refused its own configuration: %v", err)
+			}
+			if !strings.Contains(string(data), "nimbus.secret=abc") {
+				t.Errorf("configuration lacks the host's arguments:\n%s", data)
+			}
+
+			if data, err := tt.gen(tt.file, &net.UDPAddr{IP: otherIP, Port: 2070}); !errors.Is(err, tftp.ErrAccess) {
+				t.Errorf("configuration served to another host: %v\n%s", err, data)
+			}
+		})
+	}
+
+	// The shared default file is served to anyone
+	if _, err := s.pxelinuxConfig("default", &net.UDPAddr{IP: otherIP}); err != nil {
+		t.Errorf("default configuration refused: %v", err)
+	}
+
+	// Over HTTP the refusal is a 403
+	h := generatorHandler("/"+grubConfigPath, s.grubConfig)
+	for _, tc := range []struct {
+		ip     net.IP
+		status int
+	}{{hostIP, http.StatusOK}, {otherIP, http.StatusForbidden}} {
+		req := httptest.NewRequest(http.MethodGet, "/"+grubConfigPath+"grub.cfg-01-"+dashed, nil)
+		req.RemoteAddr = net.JoinHostPort(tc.ip.String(), "40000")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tc.status {
+			t.Errorf("HTTP request from %s: status %d, want %d", tc.ip, rec.Code, tc.status)
+		}
+	}
+}
+
+func TestPerHostConfigLeasedElsewhere(t *testing.T) {
+	dashed := strings.ReplaceAll(testMAC.String(), ":", "-")
+	external := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 99), Port: 2070}
+	slaac := &net.UDPAddr{IP: net.ParseIP("2001:db8::5054:ff:fe12:3456"), Port: 2070}
+
+	tests := []struct {
+		name   string
+		config Config
+		remote net.Addr
+		err    error
+	}{
+		{name: "external DHCP", config: Config{ProxyDHCP: true}, remote: external},
+		{name: "unleased address", remote: external},
+		{name: "SLAAC", remote: slaac},
+		{name: "authorization required", config: Config{RequireAuthorization: true}, remote: external, err: tftp.ErrAccess},
+		{name: "SLAAC with authorization required", config: Config{RequireAuthorization: true}, remote: slaac, err: tftp.ErrAccess},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := tt.config
+			cfg.Kernel, cfg.Initrd = "vmlinuz", "initrd.img"
+			s := newTestServer(t, cfg)
+			if err := s.SetHostCmdline(testMAC.String(), "nimbus.secret=abc"); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, file := range []string{"01-" + dashed, "grub.cfg-01-" + dashed} {
+				gen := s.pxelinuxConfig
+				if strings.HasPrefix(file, "grub") {
+					gen = s.grubConfig
+				}
+				data, err := gen(file, tt.remote)
+				if tt.err != nil {
+					if !errors.Is(err, tt.err) {
+						t.Errorf("%s: err = %v, want %v", file, err, tt.err)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("%s refused: %v", file, err)
+				}
+				if !strings.Contains(string(data), "nimbus.secret=abc") {
+					t.Errorf("%s lacks the host's arguments:\n%s", file, data)
+				}
+			}
+		})
+	}
+}
+
+func TestIPXEScriptLeasedElsewhere(t *testing.T) {
+	s := newTestServer(t, Config{Kernel: "vmlinuz", Initrd: "initrd.img", IPXE: true})
+
+	for _, ip := range []string{"10.0.0.99", "2001:db8::5054:ff:fe12:3456"} {
+		req := httptest.NewRequest(http.MethodGet, ipxeScriptPath+testMAC.String(), nil)
+		req.RemoteAddr = net.JoinHostPort(ip, "40000")
+		rec := httptest.NewRecorder()
+		s.serveIPXEScript(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Errorf("request from %s: status %d, want %d", ip, rec.Code, http.StatusOK)
+		}
+	}
+}
+
+func TestIPXEScriptNotServedToOtherHosts(t *testing.T) {
+	s := newTestServer(t, Config{Kernel: "vmlinuz", Initrd: "initrd.img", IPXE: true})
+	hostIP := bindLease(t, s, testMAC)
+	otherIP := bindLease(t, s, net.HardwareAddr{0x52, 0x54, 0x00, 0x12, 0x34, 0x57})
+
+	for _, tc := range []struct {
+		ip     net.IP
+		status int
+	}{{hostIP, http.StatusOK}, {otherIP, http.StatusForbidden}} {
+		req := httptest.NewRequest(http.MethodGet, ipxeScriptPath+testMAC.String(), nil)
+		req.RemoteAddr = net.JoinHostPort(tc.ip.String(), "40000")
+		rec := httptest.NewRecorder()
+		s.serveIPXEScript(rec, req)
+		if rec.Code != tc.status {
+			t.Errorf("request from %s: status %d, want %d", tc.ip, rec.Code, tc.status)
+		}
+	}
+}
+
+func TestGeneratorErrorNotServed(t *testing.T) {
+	h := generatorHandler("/gen/", func(name string, remote net.Addr) ([]byte, error) {
+		return nil, errors.New("open /var/lib/nimbus/secret: permission denied")
+	})
+	req := httptest.NewRequest(http.MethodGet, "/gen/file", nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("status %d, want %d", rec.Code, http.StatusInternalServerError)
+	}
+	if strings.Contains(rec.Body.String(), "secret") {
+		t.Errorf("error served to the client: %q", rec.Body.String())
+	}
+}
+
+func TestIPXEScriptErrorNotServed(t *testing.T) {
+	// Without a default profile there is no script for the host
+	s := newTestServer(t, Config{IPXE: true})
+	s.profiles.defaultProfile = ""
+	req := httptest.NewRequest(http.MethodGet, ipxeScriptPath+testMAC.String(), nil)
+	req.RemoteAddr = "10.0.0.99:40000"
+	rec := httptest.NewRecorder()
+	s.serveIPXEScript(rec, req)
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("status %d, want %d", rec.Code, http.StatusInternalServerError)
+	}
+	if strings.Contains(rec.Body.String(), testMAC.String()) {
+		t.Errorf("error served to the client: %q", rec.Body.String())
+	}
+}
+
+func TestDiscoveryRequiresOpenBoot(t *testing.T) {
+	_, err := NewServer(&Config{
+		IP:                   testServerIP,
+		RootDir:              t.TempDir(),
+		RequireAuthorization: true,
+		Discovery:            &Profile{Kernel: "discovery/vmlinuz"},
+	})
+	if err == nil {
+		t.Fatal("discovery accepted with authorization required")
+	}
+}
+
+func TestCleanPath(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+		err  error
+	}{
+		{name: "pxelinux.0", want: "pxelinux.0"},
+		{name: "/boot/vmlinuz", want: "boot/vmlinuz"},
+		{name: "boot//./vmlinuz", want: "boot/vmlinuz"},
+		{name: "\\EFI\\BOOT\\grubx64.efi", want: "EFI/BOOT/grubx64.efi"},
+		{name: "../etc/passwd", err: tftp.ErrAccess},
+		{name: "boot/../../etc/passwd", err: tftp.ErrAccess},
+		{name: "boot/..", err: tftp.ErrAccess},
+		{name: "..\\..\\etc\\passwd", err: tftp.ErrAccess},
+		{name: "pxelinux.0\x00.txt", err: tftp.ErrAccess},
+		{name: "/", err: tftp.ErrNotFound},
+		{name: ".", err: tftp.ErrNotFound},
+	}
+	for _, tt := range tests {
+		got, err := cleanPath(tt.name)
+		if !errors.Is(err, tt.err) || got != tt.want {
+			t.Errorf("cleanPath(%q) = %q, %v; want %q, %v", tt.name, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestOpenRootFile(t *testing.T) {
+	base := t.TempDir()
+	root := filepath.Join(base, "root")
+	for _, dir := range []string{root, filepath.Join(root, "boot"), filepath.Join(base, "rootkit")} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, data := range map[string]string{
+		filepath.Join(root, "boot", "vmlinuz"): "kernel",
+		filepath.Join(base, "secret"):          "secret",
+		filepath.Join(base, "rootkit", "file"): "outside",
+	} {
+		if err := os.WriteFile(name, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for link, target := range map[string]string{
+		"kernel":  "boot/vmlinuz",
+		"escape":  "../secret",
+		"abs":     filepath.Join(base, "secret"),
+		"outside": filepath.Join(base, "rootkit"),
+		"sibling": "../rootkit/file",
+		"dangle":  "missing",
+	} {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		want string
+		err  error
+	}{
+		{name: "boot/vmlinuz", want: "kernel"},
+		{name: "kernel", want: "kernel"},
+		{name: "escape", err: tftp.ErrAccess},
+		{name: "abs", err: tftp.ErrAccess},
+		{name: "outside/file", err: tftp.ErrAccess},
+		// A directory named like the root's prefix is still outside it
+		{name: "sibling", err: tftp.ErrAccess},
+		{name: "dangle", err: tftp.ErrNotFound},
+		{name: "missing", err: tftp.ErrNotFound},
+		{name: "boot", err: tftp.ErrNotFound},
+	}
+	for _, tt := range tests {
+		f, _, err := openRootFile(root, tt.name)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("openRootFile(%q) = %v, want %v", tt.name, err, tt.err)
+		}
+		if f == nil {
+			continue
+		}
+		data, _ := io.ReadAll(f)
+		f.Close()
+		if string(data) != tt.want {
+			t.Errorf("openRootFile(%q) read %q, want %q", tt.name, data, tt.want)
+		}
+	}
+
+	// A root reached through a symlink is resolved before the check
+	linked := filepath.Join(base, "linked")
+	if err := os.Symlink(root, linked); err != nil {
+		t.Fatal(err)
+	}
+	f, _, err := openRootFile(linked, "kernel")
+	if err != nil {
+		t.Fatalf("openRootFile through a linked root: %v", err)
+	}
+	f.Close()
+}
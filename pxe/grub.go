@@ -0,0 +1,174 @@
+package pxe
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/nimbus-project/nimbus/pxe/tftp"
+)
+
+// grubConfigPath is the directory signed network GRUB images use as their
+// prefix. Per-host files are named grub.cfg-01-<mac>, optionally inside a
+// directory named after the GRUB platform (x86_64-efi, arm64-efi).
+const grubConfigPath = "grub/"
+
+// defaultGRUBBootFiles maps each UEFI architecture to the shim first stage
+// loader handed out when Config.GRUB is set. Shim verifies and loads the
+// signed GRUB image from the same directory.
+var defaultGRUBBootFiles = map[Arch]string{
+	ArchEFIIA32:  "shimia32.efi",
+	ArchEFIX64:   "shimx64.efi",
+	ArchEFIBC:    "shimx64.efi",
+	ArchEFIARM64: "shimaa64.efi",
+}
+
+// grubPlatforms maps architectures to GRUB platform names
+var grubPlatforms = map[Arch]string{
+	ArchBIOS:     "i386-pc",
+	ArchEFIIA32:  "i386-efi",
+	ArchEFIX64:   "x86_64-efi",
+	ArchEFIBC:    "x86_64-efi",
+	ArchEFIARM32: "arm-efi",
+	ArchEFIARM64: "arm64-efi",
+}
+
+// efiRemovablePaths maps UEFI architectures to the loader path firmware
+// falls back to on a disk without boot entries
+var efiRemovablePaths = map[Arch]string{
+	ArchEFIIA32:  "/EFI/BOOT/BOOTIA32.EFI",
+	ArchEFIX64:   "/EFI/BOOT/BOOTX64.EFI",
+	ArchEFIBC:    "/EFI/BOOT/BOOTX64.EFI",
+	ArchEFIARM32: "/EFI/BOOT/BOOTARM.EFI",
+	ArchEFIARM64: "/EFI/BOOT/BOOTAA64.EFI",
+}
+
+// grubBootstrapConfig is served as grub.cfg to GRUB builds that do not look
+// for per-host files on their own
+const grubBootstrapConfig = `# Load the host specific configuration
+configfile $prefix/${grub_cpu}-${grub_platform}/grub.cfg-01-$net_default_mac
+`
+
+// GenerateGRUBConfig generates a grub.cfg for a machine from its boot
+// profile. arch selects the loader chained to when the profile boots from
+// the local disk.
+func (s *Server) GenerateGRUBConfig(mac string, arch Arch) (string, error) {
+	profile, err := s.resolveProfile(mac)
+	if err != nil {
+		return "", err
+	}
+
+	var b bytes.Buffer
+	b.WriteString("set default=0\nset timeout=0\n")
+
+	if profile.Action == ActionLocalBoot {
+		// Chain to the disk's fallback loader, or hand control back to the
+		// firmware's boot order if there is none
+		b.WriteString("set fallback=1\n\n")
+		if loader, ok := efiRemovablePaths[arch]; ok {
+			fmt.Fprintf(&b, "menuentry \"local\" {\n")
+			fmt.Fprintf(&b, "\tsearch --no-floppy --file --set=root %s\n", loader)
+			fmt.Fprintf(&b, "\tchainloader %s\n", loader)
+			b.WriteString("}\n\n")
+		}
+		b.WriteString("menuentry \"firmware\" {\n\texit\n}\n")
+		return b.String(), nil
+	}
+
+	fmt.Fprintf(&b, "\nmenuentry %q {\n", profile.Action)
+	fmt.Fprintf(&b, "\tlinux %s", grubPath(profile.Kernel))
+	if args := grubQuoteArgs(profile.Cmdline); args != "" {
+		b.WriteString(" " + args)
+	}
+	b.WriteString("\n")
+	if profile.Initrd != "" {
+		fmt.Fprintf(&b, "\tinitrd %s\n", grubPath(profile.Initrd))
+	}
+	b.WriteString("}\n")
+
+	return b.String(), nil
+}
+
+// grubQuoteArgs quotes kernel arguments containing characters that GRUB's
+// script parser would interpret, such as the ";" in "ds=nocloud;s=...".
+// GRUB removes the quotes before passing the arguments to the kernel.
+func grubQuoteArgs(args string) string {
+	fields := strings.Fields(args)
+	for i, f := range fields {
+		if strings.ContainsAny(f, ";&|<>$\\'\"{}()#*?[]") {
+			fields[i] = "'" + strings.ReplaceAll(f, "'", `'\''`) + "'"
+		}
+	}
+	return strings.Join(fields, " ")
+}
+
+// grubPath converts a boot file location into a GRUB path. Files are
+// relative to the server root, which GRUB reaches through $root when it was
+// loaded over the network; URLs are converted to GRUB's (http,host) form.
+func grubPath(p string) string {
+	if u, err := url.Parse(p); err == nil && u.Scheme == "http" {
+		return fmt.Sprintf("(http,%s)%s", u.Host, u.RequestURI())
+	}
+	return "/" + strings.TrimPrefix(p, "/")
+}
+
+// grubConfig generates grub/ files. name is either grub.cfg, grub.cfg-01-<mac>
+// or <platform>/grub.cfg-01-<mac>. Without a platform the architecture the
+// client reported over DHCP is used. A MAC address's file is not served to
+// other hosts.
+func (s *Server) grubConfig(name string, remote net.Addr) ([]byte, error) {
+	if name == "grub.cfg" {
+		return []byte(grubBootstrapConfig), nil
+	}
+
+	// The architecture comes from the platform directory if there is one
+	file := name
+	arch, hasPlatform := ArchEFIX64, false
+	if platform, rest, ok := strings.Cut(name, "/"); ok {
+		if arch, ok = grubArch(platform); !ok {
+			return nil, tftp.ErrNotFound
+		}
+		file, hasPlatform = rest, true
+	}
+
+	suffix, ok := strings.CutPrefix(file, "grub.cfg-01-")
+	if !ok {
+		// IP based lookups fall through to the MAC based file
+		return nil, tftp.ErrNotFound
+	}
+	mac, err := net.ParseMAC(strings.ReplaceAll(suffix, "-", ":"))
+	if err != nil {
+		return nil, tftp.ErrNotFound
+	}
+	if !s.requestedByHost(mac, remote) {
+		log.Warn().Str("file", name).Str("remote", addrIP(remote).String()).Msg("Refusing another host's boot configuration")
+		return nil, tftp.ErrAccess
+	}
+	if !hasPlatform {
+		arch = s.reportedArch(mac)
+	}
+
+	cfg, err := s.GenerateGRUBConfig(mac.String(), arch)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(cfg), nil
+}
+
+// grubArch returns the architecture for a GRUB platform name
+func grubArch(platform string) (Arch, bool) {
+	// EFI byte code shares the x86_64-efi platform
+	if platform == grubPlatforms[ArchEFIX64] {
+		return ArchEFIX64, true
+	}
+	for arch, p := range grubPlatforms {
+		if p == platform {
+			return arch, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,215 @@
+package pxe
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/nimbus-project/nimbus/pxe/dhcp4"
+	"github.com/nimbus-project/nimbus/pxe/tftp"
+)
+
+func TestGenerateGRUBConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		profile Profile
+		arch    Arch
+		want    string
+	}{
+		{
+			name:    "install",
+			profile: Profile{Name: "p", Action: ActionInstall, Kernel: "vmlinuz", Initrd: "/initrd.img", Cmdline: "console=ttyS0 ds=nocloud;s=http://10.0.0.1/ quiet"},
+			arch:    ArchEFIX64,
+			want: `set default=0
+set timeout=0
+
+menuentry "install" {
+	linux /vmlinuz console=ttyS0 'ds=nocloud;s=http://10.0.0.1/' quiet
+	initrd /initrd.img
+}
+`,
+		},
+		{
+			name:    "rescue without initrd",
+			profile: Profile{Name: "p", Action: ActionRescue, Kernel: "rescue/vmlinuz"},
+			arch:    ArchEFIARM64,
+			want: `set default=0
+set timeout=0
+
+menuentry "rescue" {
+	linux /rescue/vmlinuz
+}
+`,
+		},
+		{
+			name:    "localboot",
+			profile: Profile{Name: "p", Action: ActionLocalBoot},
+			arch:    ArchEFIX64,
+			want: `set default=0
+set timeout=0
+set fallback=1
+
+menuentry "local" {
+	search --no-floppy --file --set=root /EFI/BOOT/BOOTX64.EFI
+	chainloader /EFI/BOOT/BOOTX64.EFI
+}
+
+menuentry "firmware" {
+	exit
+}
+`,
+		},
+		{
+			name:    "localboot arm64",
+			profile: Profile{Name: "p", Action: ActionLocalBoot},
+			arch:    ArchEFIARM64,
+			want: `set default=0
+set timeout=0
+set fallback=1
+
+menuentry "local" {
+	search --no-floppy --file --set=root /EFI/BOOT/BOOTAA64.EFI
+	chainloader /EFI/BOOT/BOOTAA64.EFI
+}
+
+menuentry "firmware" {
+	exit
+}
+`,
+		},
+		{
+			// Without a removable media path there is nothing to chain to
+			name:    "localboot bios",
+			profile: Profile{Name: "p", Action: ActionLocalBoot},
+			arch:    ArchBIOS,
+			want: `set default=0
+set timeout=0
+set fallback=1
+
+menuentry "firmware" {
+	exit
+}
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, Config{GRUB: true, Profiles: []Profile{tt.profile}})
+			if err := s.SetHostProfile(testMAC.String(), "p"); err != nil {
+				t.Fatal(err)
+			}
+			got, err := s.GenerateGRUBConfig(testMAC.String(), tt.arch)
+			if err != nil {
+				t.Fatalf("GenerateGRUBConfig: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGRUBQuoteArgs(t *testing.T) {
+	tests := []struct {
+		args, want string
+	}{
+		{"", ""},
+		{"console=ttyS0,115200n8  quiet", "console=ttyS0,115200n8 quiet"},
+		{"ds=nocloud;s=http://x/", "'ds=nocloud;s=http://x/'"},
+		{"root=$root", "'root=$root'"},
+		{"msg=it's", `'msg=it'\''s'`},
+		{"a=(b) c=[d] e=*", "'a=(b)' 'c=[d]' 'e=*'"},
+	}
+	for _, tt := range tests {
+		if got := grubQuoteArgs(tt.args); got != tt.want {
+			t.Errorf("grubQuoteArgs(%q) = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestGRUBPath(t *testing.T) {
+	tests := []struct {
+		path, want string
+	}{
+		{"vmlinuz", "/vmlinuz"},
+		{"/images/initrd.img", "/images/initrd.img"},
+		{"http://10.0.0.1:8080/rescue/vmlinuz?v=2", "(http,10.0.0.1:8080)/rescue/vmlinuz?v=2"},
+		{"http://[2001:db8::1]/vmlinuz", "(http,[2001:db8::1])/vmlinuz"},
+	}
+	for _, tt := range tests {
+		if got := grubPath(tt.path); got != tt.want {
+			t.Errorf("grubPath(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestGRUBConfigFiles(t *testing.T) {
+	s := newTestServer(t, Config{GRUB: true, Profiles: []Profile{{Name: "local", Action: ActionLocalBoot}}})
+	if err := s.SetHostProfile(testMAC.String(), "local"); err != nil {
+		t.Fatal(err)
+	}
+	// The host reported itself as arm64 UEFI
+	s.ServeDHCP(pxeRequest(dhcp4.Discover, testMAC, ArchEFIARM64), nil)
+
+	dashed := strings.ReplaceAll(testMAC.String(), ":", "-")
+	tests := []struct {
+		file   string
+		loader string
+		err    error
+	}{
+		{file: "x86_64-efi/grub.cfg-01-" + dashed, loader: "BOOTX64.EFI"},
+		{file: "arm64-efi/grub.cfg-01-" + dashed, loader: "BOOTAA64.EFI"},
+		{file: "i386-efi/grub.cfg-01-" + dashed, loader: "BOOTIA32.EFI"},
+		{file: "grub.cfg-01-" + dashed, loader: "BOOTAA64.EFI"},
+		{file: "grub.cfg-01-" + strings.ToUpper(dashed), loader: "BOOTAA64.EFI"},
+		{file: "sparc64-ieee1275/grub.cfg-01-" + dashed, err: tftp.ErrNotFound},
+		{file: "grub.cfg-0A000064", err: tftp.ErrNotFound},
+		{file: "grub.cfg-01-52-54-00", err: tftp.ErrNotFound},
+		{file: "x86_64-efi/grub.cfg", err: tftp.ErrNotFound},
+	}
+	for _, tt := range tests {
+		data, err := s.grubConfig(tt.file, nil)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: %v, want %v", tt.file, err, tt.err)
+			continue
+		}
+		if err == nil && !strings.Contains(string(data), "chainloader /EFI/BOOT/"+tt.loader) {
+			t.Errorf("%s does not chain to %s:\n%s", tt.file, tt.loader, data)
+		}
+	}
+
+	// GRUB builds that only read grub.cfg are pointed at the per-host file
+	data, err := s.grubConfig("grub.cfg", nil)
+	if err != nil || !strings.Contains(string(data), "configfile $prefix/${grub_cpu}-${grub_platform}/grub.cfg-01-$net_default_mac") {
+		t.Errorf("grub.cfg = %q, %v; want the bootstrap configuration", data, err)
+	}
+}
+
+func TestGRUBBootFiles(t *testing.T) {
+	tests := []struct {
+		arch Arch
+		file string
+	}{
+		{ArchBIOS, "pxelinux.0"},
+		{ArchEFIIA32, "shimia32.efi"},
+		{ArchEFIX64, "shimx64.efi"},
+		{ArchEFIBC, "shimx64.efi"},
+		{ArchEFIARM64, "shimaa64.efi"},
+		{ArchEFIX64HTTP, "shimx64.efi"},
+	}
+
+	s := newTestServer(t, Config{GRUB: true})
+	for _, tt := range tests {
+		if got := s.bootFile(tt.arch); got != tt.file {
+			t.Errorf("boot file for %s = %q, want %q", tt.arch, got, tt.file)
+		}
+	}
+}
+
+func TestBootLoadersExclusive(t *testing.T) {
+	cfg := Config{IP: testServerIP, RootDir: t.TempDir(), ProxyDHCP: true, IPXE: true, GRUB: true}
+	if _, err := NewServer(&cfg); err == nil {
+		t.Error("NewServer accepted both iPXE and GRUB")
+	}
+}
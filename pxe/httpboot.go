@@ -0,0 +1,79 @@
+package pxe
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/nimbus-project/nimbus/pxe/dhcp4"
+	"github.com/nimbus-project/nimbus/pxe/tftp"
+)
+
+// httpClientClass is the vendor class identifier used by UEFI HTTP Boot
+// clients
+const httpClientClass = "HTTPClient"
+
+// efiMediaTypes are the content types UEFI HTTP Boot expects for the images
+// it can boot (UEFI specification section 24.7)
+var efiMediaTypes = map[string]string{
+	".efi": "application/efi",
+	".iso": "application/vnd.efi-iso",
+	".img": "application/vnd.efi-img",
+}
+
+// isHTTPBootClient reports whether a request comes from UEFI HTTP Boot
+// firmware
+func isHTTPBootClient(req *dhcp4.Packet) bool {
+	return strings.HasPrefix(req.Options.String(dhcp4.OptionClassID), httpClientClass)
+}
+
+// serveRootFile serves files below RootDir and cached artifacts over HTTP.
+// Range requests are answered by http.ServeContent, so clients can fetch
+// large images in parts and resume interrupted downloads, and the file body
+// is copied straight to the connection without buffering.
+func (s *Server) serveRootFile(w http.ResponseWriter, r *http.Request) {
+	name, err := cleanPath(r.URL.Path)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	f, size, err := s.openFile(r.Context(), name)
+	switch {
+	case errors.Is(err, tftp.ErrNotFound):
+		http.NotFound(w, r)
+		return
+	case errors.Is(err, tftp.ErrAccess):
+		http.Error(w, "access denied", http.StatusForbidden)
+		return
+	case err != nil:
+		log.Error().Err(err).Str("path", r.URL.Path).Msg("Failed to open file")
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if mediaType, ok := efiMediaTypes[strings.ToLower(path.Ext(name))]; ok {
+		w.Header().Set("Content-Type", mediaType)
+	}
+	// A validator lets clients resume with If-Range
+	w.Header().Set("ETag", fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), size))
+
+	log.Debug().
+		Str("path", name).
+		Str("remote", r.RemoteAddr).
+		Str("range", r.Header.Get("Range")).
+		Msg("Serving HTTP file")
+
+	http.ServeContent(w, r, name, info.ModTime(), f)
+}
@@ -0,0 +1,254 @@
+package pxe
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nimbus-project/nimbus/pxe/dhcp4"
+)
+
+// httpBootRequest builds a request from UEFI HTTP Boot firmware
+func httpBootRequest(t dhcp4.MessageType, arch Arch) *dhcp4.Packet {
+	req := pxeRequest(t, testMAC, arch)
+	req.Options.SetString(dhcp4.OptionClassID, fmt.Sprintf("HTTPClient:Arch:%05d:UNDI:003001", arch))
+	return req
+}
+
+func TestHTTPBootDHCP(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+		arch Arch
+		file string
+	}{
+		{name: "efi-x64", arch: ArchEFIX64HTTP, file: "http://10.0.0.1:8080/bootx64.efi"},
+		{name: "efi-arm64", arch: ArchEFIARM64HTTP, file: "http://10.0.0.1:8080/bootaa64.efi"},
+		{name: "grub", cfg: Config{GRUB: true}, arch: ArchEFIX64HTTP, file: "http://10.0.0.1:8080/shimx64.efi"},
+		{
+			name: "iso image",
+			cfg:  Config{BootFiles: map[Arch]string{ArchEFIX64HTTP: "images/install.iso"}},
+			arch: ArchEFIX64HTTP,
+			file: "http://10.0.0.1:8080/images/install.iso",
+		},
+		{
+			name: "absolute url",
+			cfg:  Config{BootFiles: map[Arch]string{ArchEFIX64HTTP: "https://mirror.example.com/boot.efi"}},
+			arch: ArchEFIX64HTTP,
+			file: "https://mirror.example.com/boot.efi",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, tt.cfg)
+			offer := s.ServeDHCP(httpBootRequest(dhcp4.Discover, tt.arch), nil)
+			if offer == nil || offer.MessageType() != dhcp4.Offer {
+				t.Fatalf("reply to discover = %v, want DHCPOFFER", offer)
+			}
+			// HTTP Boot firmware ignores offers not identified as HTTPClient
+			if got := offer.Options.String(dhcp4.OptionClassID); got != httpClientClass {
+				t.Errorf("option 60 = %q, want %q", got, httpClientClass)
+			}
+			if got := offer.Options.String(dhcp4.OptionBootFileName); got != tt.file {
+				t.Errorf("option 67 = %q, want %q", got, tt.file)
+			}
+			if offer.File != tt.file {
+				t.Errorf("file = %q, want %q", offer.File, tt.file)
+			}
+			if offer.Options.Has(dhcp4.OptionTFTPServerName) {
+				t.Error("TFTP server offered to an HTTP Boot client")
+			}
+			if got := s.reportedArch(testMAC); got != tt.arch.baseArch() {
+				t.Errorf("recorded architecture %s, want %s", got, tt.arch.baseArch())
+			}
+		})
+	}
+}
+
+func TestHTTPBootRange(t *testing.T) {
+	s := newTestServer(t, Config{})
+	image := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+	for name, data := range map[string][]byte{
+		"bootx64.efi":        image,
+		"images/install.iso": []byte("iso"),
+		"images/disk.img":    []byte("img"),
+		"README":             []byte("text"),
+	} {
+		p := filepath.Join(s.config.RootDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h := s.createHTTPHandler()
+
+	get := func(method, path string, header map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	full := get(http.MethodGet, "/bootx64.efi", nil)
+	if full.Code != http.StatusOK || !bytes.Equal(full.Body.Bytes(), image) {
+		t.Fatalf("GET: status %d with %d bytes, want 200 with %d", full.Code, full.Body.Len(), len(image))
+	}
+	if got := full.Header().Get("Accept-Ranges"); got != "bytes" {
+		t.Errorf("Accept-Ranges = %q, want bytes", got)
+	}
+	etag := full.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("no ETag to resume with")
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		header map[string]string
+		status int
+		body   []byte
+		check  func(*testing.T, *httptest.ResponseRecorder)
+	}{
+		{
+			name:   "range",
+			header: map[string]string{"Range": "bytes=100-199"},
+			status: http.StatusPartialContent,
+			body:   image[100:200],
+			check: func(t *testing.T, rec *httptest.ResponseRecorder) {
+				if got, want := rec.Header().Get("Content-Range"), fmt.Sprintf("bytes 100-199/%d", len(image)); got != want {
+					t.Errorf("Content-Range = %q, want %q", got, want)
+				}
+			},
+		},
+		{
+			name:   "resume to end",
+			header: map[string]string{"Range": fmt.Sprintf("bytes=%d-", len(image)-10)},
+			status: http.StatusPartialContent,
+			body:   image[len(image)-10:],
+		},
+		{
+			name:   "suffix",
+			header: map[string]string{"Range": "bytes=-16"},
+			status: http.StatusPartialContent,
+			body:   image[len(image)-16:],
+		},
+		{
+			name:   "resume unchanged file",
+			header: map[string]string{"Range": "bytes=10-", "If-Range": etag},
+			status: http.StatusPartialContent,
+			body:   image[10:],
+		},
+		{
+			// A changed file is sent whole rather than spliced
+			name:   "resume changed file",
+			header: map[string]string{"Range": "bytes=10-", "If-Range": `"stale"`},
+			status: http.StatusOK,
+			body:   image,
+		},
+		{
+			name:   "unsatisfiable",
+			header: map[string]string{"Range": fmt.Sprintf("bytes=%d-", len(image))},
+			status: http.StatusRequestedRangeNotSatisfiable,
+		},
+		{
+			name:   "multiple ranges",
+			header: map[string]string{"Range": "bytes=0-3,16-19"},
+			status: http.StatusPartialContent,
+			check: func(t *testing.T, rec *httptest.ResponseRecorder) {
+				mediaType, params, err := mime.ParseMediaType(rec.Header().Get("Content-Type"))
+				if err != nil || mediaType != "multipart/byteranges" {
+					t.Fatalf("Content-Type = %q, want multipart/byteranges", rec.Header().Get("Content-Type"))
+				}
+				mr := multipart.NewReader(rec.Body, params["boundary"])
+				var parts []string
+				for {
+					part, err := mr.NextPart()
+					if err == io.EOF {
+						break
+					}
+					if err != nil {
+						t.Fatal(err)
+					}
+					data, _ := io.ReadAll(part)
+					parts = append(parts, string(data))
+					if got := part.Header.Get("Content-Type"); got != "application/efi" {
+						t.Errorf("part Content-Type = %q, want application/efi", got)
+					}
+				}
+				if len(parts) != 2 || parts[0] != "0123" || parts[1] != "0123" {
+					t.Errorf("parts = %q, want two of 0123", parts)
+				}
+			},
+		},
+		{
+			name:   "head",
+			method: http.MethodHead,
+			status: http.StatusOK,
+			check: func(t *testing.T, rec *httptest.ResponseRecorder) {
+				if got, want := rec.Header().Get("Content-Length"), fmt.Sprint(len(image)); got != want {
+					t.Errorf("Content-Length = %q, want %q", got, want)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := tt.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			rec := get(method, "/bootx64.efi", tt.header)
+			if rec.Code != tt.status {
+				t.Fatalf("status %d, want %d", rec.Code, tt.status)
+			}
+			if tt.body != nil && !bytes.Equal(rec.Body.Bytes(), tt.body) {
+				t.Errorf("body has %d bytes, want %d", rec.Body.Len(), len(tt.body))
+			}
+			if tt.check != nil {
+				tt.check(t, rec)
+			}
+		})
+	}
+
+	// UEFI HTTP Boot only boots images served with an EFI media type
+	for path, want := range map[string]string{
+		"/bootx64.efi":        "application/efi",
+		"/images/install.iso": "application/vnd.efi-iso",
+		"/images/disk.img":    "application/vnd.efi-img",
+		"/README":             "text/plain; charset=utf-8",
+	} {
+		if got := get(http.MethodGet, path, nil).Header().Get("Content-Type"); got != want {
+			t.Errorf("%s: Content-Type = %q, want %q", path, got, want)
+		}
+	}
+
+	for _, path := range []string{"/missing.efi", "/images"} {
+		if rec := get(http.MethodGet, path, nil); rec.Code != http.StatusNotFound {
+			t.Errorf("%s: status %d, want %d", path, rec.Code, http.StatusNotFound)
+		}
+	}
+
+	// The router redirects unclean paths, so a traversal only reaches the
+	// handler when it is called directly
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.URL.Path = "/images/../../secret"
+	rec := httptest.NewRecorder()
+	s.serveRootFile(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("traversal: status %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
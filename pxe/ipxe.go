@@ -0,0 +1,215 @@
+package pxe
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/nimbus-project/nimbus/pxe/dhcp4"
+)
+
+const (
+	// ipxeUserClass is the user class (option 77) sent by iPXE
+	ipxeUserClass = "iPXE"
+
+	// ipxeScriptPath is the HTTP path prefix per-host iPXE scripts are
+	// served under, followed by the host's MAC address
+	ipxeScriptPath = "/ipxe/"
+)
+
+// defaultIPXEBootFiles maps each architecture to the iPXE binary that PXE
+// firmware chainloads when Config.IPXE is set
+var defaultIPXEBootFiles = map[Arch]string{
+	ArchBIOS:     "undionly.kpxe",
+	ArchEFIIA32:  "ipxe-i386.efi",
+	ArchEFIX64:   "ipxe.efi",
+	ArchEFIBC:    "ipxe.efi",
+	ArchEFIARM32: "ipxe-arm32.efi",
+	ArchEFIARM64: "ipxe-arm64.efi",
+}
+
+// isIPXEClient reports whether a request comes from iPXE rather than the
+// firmware's own PXE stack. iPXE sends its user class as a plain string
+// instead of the length prefixed list from RFC 3004, so both are accepted.
+func isIPXEClient(req *dhcp4.Packet) bool {
+	b := req.Options.Get(dhcp4.OptionUserClass)
+	if string(b) == ipxeUserClass {
+		return true
+	}
+	for len(b) > 0 {
+		n := int(b[0])
+		if 1+n > len(b) {
+			return false
+		}
+		if string(b[1:1+n]) == ipxeUserClass {
+			return true
+		}
+		b = b[1+n:]
+	}
+	return false
+}
+
+// GenerateIPXEScript generates an iPXE script for a machine from its boot
+// profile
+func (s *Server) GenerateIPXEScript(mac string) (string, error) {
+	profile, err := s.resolveProfile(mac)
+	if err != nil {
+		return "", err
+	}
+
+	var b bytes.Buffer
+	b.WriteString("#!ipxe\n")
+
+	if profile.Action == ActionLocalBoot {
+		// Returning from iPXE makes the firmware continue with the next
+		// boot device
+		b.WriteString("exit\n")
+		return b.String(), nil
+	}
+
+	// iPXE names images after the last path segment of their URL, which is
+	// what imgargs and the initrd= argument refer to
+	kernel := s.hostURL(mac, profile.Kernel)
+	fmt.Fprintf(&b, "kernel %s\n", kernel)
+
+	args := profile.Cmdline
+	if profile.Initrd != "" {
+		initrd := s.hostURL(mac, profile.Initrd)
+		fmt.Fprintf(&b, "initrd %s\n", initrd)
+		args = strings.TrimSpace("initrd=" + path.Base(initrd) + " " + args)
+	}
+	fmt.Fprintf(&b, "imgargs %s %s\n", path.Base(kernel), args)
+	b.WriteString("boot\n")
+
+	return b.String(), nil
+}
+
+// serveIPXEScript serves the iPXE script for the MAC address in the request
+// path. Unless authorization is required, in which case the script's boot
+// token identifies the host, it is not served to other hosts.
+func (s *Server) serveIPXEScript(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, ipxeScriptPath), ".ipxe")
+	mac, err := net.ParseMAC(name)
+	if err != nil {
+		http.Error(w, "invalid MAC address", http.StatusBadRequest)
+		return
+	}
+	if !s.config.RequireAuthorization {
+		var remote net.Addr
+		if addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil {
+			remote = addr
+		}
+		if !s.requestedByHost(mac, remote) {
+			log.Warn().Str("mac", mac.String()).Str("remote", r.RemoteAddr).Msg("Refusing another host's iPXE script")
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+	}
+
+	script, err := s.GenerateIPXEScript(mac.String())
+	if err != nil {
+		log.Error().Err(err).Str("mac", mac.String()).Msg("Failed to generate iPXE script")
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Debug().Str("mac", mac.String()).Str("remote", r.RemoteAddr).Msg("Serving iPXE script")
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(script))
+}
+
+// ipxeScriptURL returns the URL of the iPXE script for a MAC address,
+// carrying a boot token when authorization is required
+func (s *Server) ipxeScriptURL(mac net.HardwareAddr) string {
+	path := ipxeScriptPath + mac.String()
+	if !s.config.RequireAuthorization {
+		return s.hostURL(mac.String(), path)
+	}
+	u, err := s.BootTokenURL(mac.String(), path)
+	if err != nil {
+		log.Error().Err(err).Str("mac", mac.String()).Msg("Failed to issue boot token for iPXE script")
+		return s.hostURL(mac.String(), path)
+	}
+	return u
+}
+
+// URL returns the URL clients use to reach path on the HTTP server, such as
+// a handler added with AddPXEHandler
+func (s *Server) URL(path string) string {
+	return s.httpURL(path)
+}
+
+// httpURL returns the URL clients use to fetch p from the HTTP server. p is
+// relative to the HTTP root and is returned unchanged if it is already a URL.
+func (s *Server) httpURL(p string) string {
+	if strings.Contains(p, "://") {
+		return p
+	}
+	return s.httpBaseURL() + "/" + strings.TrimPrefix(p, "/")
+}
+
+// hostURL returns the URL a host fetches p from, on the server's IPv6
+// address if the host last network booted over DHCPv6
+func (s *Server) hostURL(mac, p string) string {
+	if strings.Contains(p, "://") {
+		return p
+	}
+	return s.hostBaseURL(mac) + "/" + strings.TrimPrefix(p, "/")
+}
+
+// hostBaseURL returns the base URL of the HTTP server as reachable by a host
+func (s *Server) hostBaseURL(mac string) string {
+	if s.isIPv6Client(mac) {
+		return s.httpBaseURLFor(true)
+	}
+	return s.httpBaseURL()
+}
+
+// isIPv6Client reports whether a host last network booted over DHCPv6
+func (s *Server) isIPv6Client(mac string) bool {
+	key, err := normalizeMAC(mac)
+	if err != nil || key == "" {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ipv6Clients[key]
+}
+
+// httpBaseURL returns the base URL of the HTTP server as reachable by clients
+func (s *Server) httpBaseURL() string {
+	return s.httpBaseURLFor(false)
+}
+
+// httpBaseURLFor returns the base URL of the HTTP server on the server's
+// IPv4 or IPv6 address
+func (s *Server) httpBaseURLFor(ipv6 bool) string {
+	bound := s.ListenAddrs()
+	addr := s.config.HTTPAddr
+	if bound.HTTP != nil {
+		addr = bound.HTTP.String()
+	}
+	host := s.serverIP()
+	if ipv6 {
+		host = s.config.IPv6
+		if bound.HTTP6 != nil {
+			addr = bound.HTTP6.String()
+		}
+	}
+
+	port := "80"
+	if _, p, err := net.SplitHostPort(addr); err == nil && p != "" {
+		port = p
+	}
+
+	if port == "80" {
+		return "http://" + hostLiteral(host)
+	}
+	return "http://" + net.JoinHostPort(host.String(), port)
+}
@@ -0,0 +1,597 @@
+package pxe
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	// ErrPoolExhausted is returned when no address is available for a client
+	ErrPoolExhausted = errors.New("no free addresses in DHCP range")
+
+	// ErrAddressUnavailable is returned when a client requests an address it
+	// cannot be given
+	ErrAddressUnavailable = errors.New("requested address is not available")
+)
+
+// declineHoldTime is how long an address declined by a client is kept out of
+// the pool, since another host is probably using it
+const declineHoldTime = 10 * time.Minute
+
+// LeaseState is the state of a DHCP lease
+type LeaseState int
+
+// Lease states
+const (
+	// LeaseOffered means the address was offered but not yet requested
+	LeaseOffered LeaseState = iota
+
+	// LeaseBound means the client has been acknowledged
+	LeaseBound
+)
+
+// String returns the name of the lease state
+func (s LeaseState) String() string {
+	switch s {
+	case LeaseOffered:
+		return "offered"
+	case LeaseBound:
+		return "bound"
+	default:
+		return fmt.Sprintf("LeaseState(%d)", int(s))
+	}
+}
+
+// Lease is an address assigned to a client
+type Lease struct {
+	MAC      net.HardwareAddr
+	IP       net.IP
+	Hostname string
+	State    LeaseState
+	Expiry   time.Time
+
+	// Reserved is set when the address comes from a static reservation
+	Reserved bool
+}
+
+// Reservation pins a MAC address to a fixed IPv4 address. Reserved addresses
+// may lie outside the dynamic DHCP range.
+type Reservation struct {
+	MAC      net.HardwareAddr
+	IP       net.IP
+	Hostname string
+
+	// CircuitID and RemoteID pin the address to a switch port, as reported
+	// by relay agents in option 82, instead of or as well as a MAC address.
+	// The address follows the port: whichever host requests an address
+	// through it receives the reservation.
+	CircuitID string
+	RemoteID  string
+}
+
+// port reports whether the reservation is pinned to a switch port
+func (r *Reservation) port() bool {
+	return r.CircuitID != "" || r.RemoteID != ""
+}
+
+// owner describes who the reservation is for in error messages
+func (r *Reservation) owner() string {
+	if len(r.MAC) > 0 {
+		return r.MAC.String()
+	}
+	return fmt.Sprintf("port %q/%q", r.RemoteID, r.CircuitID)
+}
+
+// portKey identifies a switch port by relay agent remote-id and circuit-id
+func portKey(remoteID, circuitID string) string {
+	return remoteID + "\x00" + circuitID
+}
+
+// leasePool allocates addresses from a contiguous IPv4 range and from static
+// reservations
+type leasePool struct {
+	mu       sync.Mutex
+	start    uint32
+	end      uint32
+	exclude  map[uint32]bool
+	byMAC    map[string]*Lease
+	byIP     map[uint32]*Lease
+	declined map[uint32]time.Time
+	now      func() time.Time
+
+	// Static reservations keyed by MAC, and the owning MAC of each
+	// reserved address. Addresses reserved for a switch port no host has
+	// been seen on yet have no owner.
+	reservations map[string]Reservation
+	reservedIPs  map[uint32]string
+
+	// Reservations pinned to switch ports, keyed by portKey
+	ports map[string]Reservation
+
+	// store persists bound leases, nil when leases are kept in memory only
+	store *leaseStore
+}
+
+// newLeasePool creates a pool for the inclusive range [start, end]. Addresses
+// in exclude, such as the server's own address, are never handed out. A pool
+// without a range only serves reservations.
+func newLeasePool(start, end net.IP, exclude ...net.IP) (*leasePool, error) {
+	p := &leasePool{
+		start:        1,
+		end:          0,
+		exclude:      make(map[uint32]bool),
+		byMAC:        make(map[string]*Lease),
+		byIP:         make(map[uint32]*Lease),
+		declined:     make(map[uint32]time.Time),
+		now:          time.Now,
+		reservations: make(map[string]Reservation),
+		reservedIPs:  make(map[uint32]string),
+		ports:        make(map[string]Reservation),
+	}
+
+	if start != nil || end != nil {
+		if start.To4() == nil || end.To4() == nil {
+			return nil, fmt.Errorf("DHCP range must be IPv4: %s-%s", start, end)
+		}
+		p.start, p.end = ipToUint32(start), ipToUint32(end)
+		if p.start > p.end {
+			return nil, fmt.Errorf("invalid DHCP range: %s is after %s", start, end)
+		}
+	}
+
+	for _, ip := range exclude {
+		if ip.To4() != nil {
+			p.exclude[ipToUint32(ip)] = true
+		}
+	}
+
+	return p, nil
+}
+
+// contains reports whether ip is inside the pool's range
+func (p *leasePool) contains(ip net.IP) bool {
+	if ip.To4() == nil {
+		return false
+	}
+	n := ipToUint32(ip)
+	return n >= p.start && n <= p.end
+}
+
+// owns reports whether ip is managed by the pool, either as part of the
+// dynamic range or as a reserved address
+func (p *leasePool) owns(ip net.IP) bool {
+	if p.contains(ip) {
+		return true
+	}
+	if ip.To4() == nil {
+		return false
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, ok := p.reservedIPs[ipToUint32(ip)]
+	return ok
+}
+
+// available reports whether n can be assigned to mac. The caller must hold mu.
+func (p *leasePool) available(n uint32, mac string, now time.Time) bool {
+	owner, reserved := p.reservedIPs[n]
+	switch {
+	case reserved && owner != mac:
+		return false
+	case !reserved && (n < p.start || n > p.end || p.exclude[n]):
+		return false
+	}
+
+	if until, ok := p.declined[n]; ok {
+		if now.Before(until) {
+			return false
+		}
+		delete(p.declined, n)
+	}
+
+	// A reservation takes precedence over any dynamic lease on its address
+	if reserved {
+		return true
+	}
+	lease, ok := p.byIP[n]
+	return !ok || lease.MAC.String() == mac || now.After(lease.Expiry)
+}
+
+// offer reserves an address for mac for the given hold time. A client's
+// existing lease is preferred, then the address it asked for, then the first
+// free address in the range.
+func (p *leasePool) offer(mac net.HardwareAddr, requested net.IP, hold time.Duration) (*Lease, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	key := mac.String()
+
+	// Reserved clients always receive their reserved address
+	if r, ok := p.reservations[key]; ok {
+		n := ipToUint32(r.IP)
+		if !p.available(n, key, now) {
+			return nil, ErrAddressUnavailable
+		}
+		if lease, ok := p.byMAC[key]; ok && lease.IP.Equal(r.IP) && lease.State == LeaseBound && !now.After(lease.Expiry) {
+			return copyLease(lease), nil
+		}
+		lease := p.assign(mac, n, LeaseOffered, now.Add(hold))
+		lease.Hostname = r.Hostname
+		lease.Reserved = true
+		return copyLease(lease), nil
+	}
+
+	if lease, ok := p.byMAC[key]; ok && p.available(ipToUint32(lease.IP), key, now) {
+		if lease.State != LeaseBound || now.After(lease.Expiry) {
+			lease.State = LeaseOffered
+			lease.Expiry = now.Add(hold)
+		}
+		return copyLease(lease), nil
+	}
+
+	if p.contains(requested) && p.available(ipToUint32(requested), key, now) {
+		return copyLease(p.assign(mac, ipToUint32(requested), LeaseOffered, now.Add(hold))), nil
+	}
+
+	for i := uint64(p.start); i <= uint64(p.end); i++ {
+		if n := uint32(i); p.available(n, key, now) {
+			return copyLease(p.assign(mac, n, LeaseOffered, now.Add(hold))), nil
+		}
+	}
+
+	return nil, ErrPoolExhausted
+}
+
+// bind confirms an address for mac for the given lease duration
+func (p *leasePool) bind(mac net.HardwareAddr, ip net.IP, hostname string, duration time.Duration) (*Lease, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	key := mac.String()
+	r, reserved := p.reservations[key]
+
+	switch {
+	case reserved && !r.IP.Equal(ip):
+		// Refuse other addresses so the client falls back to DISCOVER
+		// and picks up its reservation
+		return nil, ErrAddressUnavailable
+	case !reserved && !p.contains(ip):
+		return nil, ErrAddressUnavailable
+	case !p.available(ipToUint32(ip), key, now):
+		return nil, ErrAddressUnavailable
+	}
+
+	lease := p.assign(mac, ipToUint32(ip), LeaseBound, now.Add(duration))
+	lease.Hostname = hostname
+	if reserved {
+		lease.Reserved = true
+		if r.Hostname != "" {
+			lease.Hostname = r.Hostname
+		}
+	}
+	p.persist()
+	return copyLease(lease), nil
+}
+
+// release frees the lease held by mac on ip
+func (p *leasePool) release(mac net.HardwareAddr, ip net.IP) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	lease, ok := p.byMAC[mac.String()]
+	if !ok || (ip != nil && !ip.IsUnspecified() && !lease.IP.Equal(ip)) {
+		return
+	}
+	p.remove(lease)
+	if lease.State == LeaseBound {
+		p.persist()
+	}
+}
+
+// decline removes the lease held by mac on ip and keeps the address out of
+// the pool for a while
+func (p *leasePool) decline(mac net.HardwareAddr, ip net.IP) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if ip.To4() == nil {
+		return
+	}
+	n := ipToUint32(ip)
+	if _, reserved := p.reservedIPs[n]; !reserved && !p.contains(ip) {
+		return
+	}
+	if lease, ok := p.byMAC[mac.String()]; ok && lease.IP.Equal(ip) {
+		p.remove(lease)
+		p.persist()
+	}
+	p.declined[n] = p.now().Add(declineHoldTime)
+}
+
+// lookup returns the unexpired lease held by mac, if any
+func (p *leasePool) lookup(mac net.HardwareAddr) (*Lease, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	lease, ok := p.byMAC[mac.String()]
+	if !ok || p.now().After(lease.Expiry) {
+		return nil, false
+	}
+	return copyLease(lease), true
+}
+
+// list returns all unexpired leases ordered by address
+func (p *leasePool) list() []Lease {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	leases := make([]Lease, 0, len(p.byIP))
+	for _, lease := range p.byIP {
+		if now.After(lease.Expiry) {
+			continue
+		}
+		leases = append(leases, *copyLease(lease))
+	}
+	sort.Slice(leases, func(i, j int) bool {
+		return ipToUint32(leases[i].IP) < ipToUint32(leases[j].IP)
+	})
+	return leases
+}
+
+// setReservations replaces the static reservations
+func (p *leasePool) setReservations(reservations []Reservation) error {
+	byMAC := make(map[string]Reservation, len(reservations))
+	byIP := make(map[uint32]string, len(reservations))
+	byPort := make(map[string]Reservation)
+	owners := make(map[uint32]string, len(reservations))
+	for _, r := range reservations {
+		if len(r.MAC) == 0 && !r.port() {
+			return fmt.Errorf("reservation for %s has no MAC address or switch port", r.IP)
+		}
+		if r.IP.To4() == nil {
+			return fmt.Errorf("reservation for %s: %q is not an IPv4 address", r.owner(), r.IP)
+		}
+
+		n := ipToUint32(r.IP)
+		if owner, ok := owners[n]; ok {
+			return fmt.Errorf("address %s is reserved for both %s and %s", r.IP, owner, r.owner())
+		}
+		if p.exclude[n] {
+			return fmt.Errorf("reservation for %s uses excluded address %s", r.owner(), r.IP)
+		}
+		r.IP = r.IP.To4()
+		owners[n] = r.owner()
+		byIP[n] = ""
+
+		if r.port() {
+			key := portKey(r.RemoteID, r.CircuitID)
+			if _, ok := byPort[key]; ok {
+				return fmt.Errorf("duplicate reservation for port %q/%q", r.RemoteID, r.CircuitID)
+			}
+			byPort[key] = r
+		}
+		if len(r.MAC) > 0 {
+			key := r.MAC.String()
+			if _, ok := byMAC[key]; ok {
+				return fmt.Errorf("duplicate reservation for %s", key)
+			}
+			byMAC[key] = r
+			byIP[n] = key
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.reservations = byMAC
+	p.reservedIPs = byIP
+	p.ports = byPort
+	return nil
+}
+
+// claimPort gives mac the reservation of the switch port a relayed request
+// came through, taking it from the host last seen on that port. A
+// reservation for the MAC address itself takes precedence.
+func (p *leasePool) claimPort(mac net.HardwareAddr, remoteID, circuitID string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// The most specific reservation matching the port wins
+	r, ok := p.ports[portKey(remoteID, circuitID)]
+	if !ok {
+		r, ok = p.ports[portKey(remoteID, "")]
+	}
+	if !ok {
+		r, ok = p.ports[portKey("", circuitID)]
+	}
+	if !ok {
+		return
+	}
+
+	key := mac.String()
+	n := ipToUint32(r.IP)
+	if cur, ok := p.reservations[key]; ok {
+		if !cur.port() || cur.IP.Equal(r.IP) {
+			return
+		}
+		// The host moved to another port and gives up its old address
+		old := ipToUint32(cur.IP)
+		delete(p.reservations, key)
+		p.reservedIPs[old] = ""
+	}
+	if prev := p.reservedIPs[n]; prev != "" {
+		delete(p.reservations, prev)
+	}
+
+	r.MAC = append(net.HardwareAddr(nil), mac...)
+	p.reservations[key] = r
+	p.reservedIPs[n] = key
+
+	log.Info().
+		Str("mac", key).
+		Str("ip", r.IP.String()).
+		Str("circuit_id", r.CircuitID).
+		Str("remote_id", r.RemoteID).
+		Msg("Switch port reservation claimed")
+}
+
+// restore loads previously bound leases, skipping expired ones and those that
+// no longer fit the pool's range and reservations
+func (p *leasePool) restore(leases []Lease) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	for _, l := range leases {
+		if now.After(l.Expiry) || l.IP.To4() == nil {
+			continue
+		}
+
+		key := l.MAC.String()
+		n := ipToUint32(l.IP)
+		if r, ok := p.reservations[key]; ok && !r.IP.Equal(l.IP) {
+			continue
+		}
+		if _, ok := p.reservations[key]; !ok && (n < p.start || n > p.end) {
+			continue
+		}
+		if !p.available(n, key, now) {
+			continue
+		}
+
+		lease := p.assign(l.MAC, n, LeaseBound, l.Expiry)
+		lease.Hostname = l.Hostname
+		_, lease.Reserved = p.reservations[key]
+	}
+
+	if p.store != nil {
+		p.store.track(p, p.boundLeases())
+	}
+}
+
+// persist saves all bound leases. The caller must hold mu.
+func (p *leasePool) persist() {
+	if p.store == nil {
+		return
+	}
+	if err := p.store.save(p, p.boundLeases()); err != nil {
+		log.Error().Err(err).Str("file", p.store.path).Msg("Failed to persist DHCP leases")
+	}
+}
+
+// boundLeases returns copies of the bound leases. The caller must hold mu.
+func (p *leasePool) boundLeases() []Lease {
+	leases := make([]Lease, 0, len(p.byIP))
+	for _, lease := range p.byIP {
+		if lease.State == LeaseBound {
+			leases = append(leases, *copyLease(lease))
+		}
+	}
+	return leases
+}
+
+// assign records a lease of n to mac, dropping any previous lease held by
+// either. The caller must hold mu.
+func (p *leasePool) assign(mac net.HardwareAddr, n uint32, state LeaseState, expiry time.Time) *Lease {
+	if old, ok := p.byMAC[mac.String()]; ok {
+		p.remove(old)
+	}
+	if old, ok := p.byIP[n]; ok {
+		p.remove(old)
+	}
+
+	lease := &Lease{
+		MAC:    append(net.HardwareAddr(nil), mac...),
+		IP:     uint32ToIP(n),
+		State:  state,
+		Expiry: expiry,
+	}
+	p.byMAC[mac.String()] = lease
+	p.byIP[n] = lease
+	return lease
+}
+
+// remove deletes a lease from both indexes. The caller must hold mu.
+func (p *leasePool) remove(lease *Lease) {
+	delete(p.byMAC, lease.MAC.String())
+	n := ipToUint32(lease.IP)
+	if cur, ok := p.byIP[n]; ok && cur == lease {
+		delete(p.byIP, n)
+	}
+}
+
+// copyLease returns a copy of lease that callers may retain
+func copyLease(lease *Lease) *Lease {
+	c := *lease
+	c.MAC = append(net.HardwareAddr(nil), lease.MAC...)
+	c.IP = append(net.IP(nil), lease.IP...)
+	return &c
+}
+
+// ipToUint32 converts an IPv4 address to an integer
+func ipToUint32(ip net.IP) uint32 {
+	return binary.BigEndian.Uint32(ip.To4())
+}
+
+// uint32ToIP converts an integer to an IPv4 address
+func uint32ToIP(n uint32) net.IP {
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, n)
+	return ip
+}
+
+// Leases returns the active DHCP leases of all subnets, followed by the
+// bound DHCPv6 leases
+func (s *Server) Leases() []Lease {
+	var leases []Lease
+	for _, pool := range s.pools() {
+		leases = append(leases, pool.list()...)
+	}
+	if s.leases6 != nil {
+		leases = append(leases, s.leases6.list()...)
+	}
+	return leases
+}
+
+// SetReservations replaces the static DHCP reservations. Clients pick up a
+// changed reservation the next time they renew or rediscover.
+func (s *Server) SetReservations(reservations []Reservation) error {
+	local, bySubnet := s.splitReservations(reservations)
+	if s.leases == nil && len(local) > 0 {
+		return fmt.Errorf("DHCP server is not configured for %s", local[0].IP)
+	}
+	if len(s.pools()) == 0 {
+		return fmt.Errorf("DHCP server is not configured")
+	}
+
+	// Validate the reservations of every pool before replacing any, on
+	// scratch pools with the same excluded addresses
+	for _, pool := range s.pools() {
+		rs := local
+		for _, sn := range s.subnets {
+			if sn.leases == pool {
+				rs = bySubnet[sn]
+			}
+		}
+		if err := (&leasePool{exclude: pool.exclude}).setReservations(rs); err != nil {
+			return err
+		}
+	}
+	if s.leases != nil {
+		s.leases.setReservations(local)
+	}
+	for _, sn := range s.subnets {
+		sn.leases.setReservations(bySubnet[sn])
+	}
+	return nil
+}
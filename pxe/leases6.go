@@ -0,0 +1,204 @@
+package pxe
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxLease6Scan bounds the number of addresses examined when looking for a
+// free one, since IPv6 ranges are usually far larger than the number of
+// hosts on them
+const maxLease6Scan = 1 << 16
+
+// lease6Pool allocates addresses from an IPv6 range to DHCPv6 identity
+// associations. Leases are keyed by the client's DUID and IAID rather than
+// its MAC address, which a client may not reveal, and are kept in memory
+// only.
+type lease6Pool struct {
+	mu       sync.Mutex
+	start    net.IP
+	end      net.IP
+	exclude  map[string]bool
+	byIA     map[string]*Lease
+	byIP     map[string]string
+	declined map[string]time.Time
+	now      func() time.Time
+
+	// next is where the search for a free address resumes
+	next net.IP
+}
+
+// newLease6Pool creates a pool for the inclusive range [start, end].
+// Addresses in exclude are never handed out.
+func newLease6Pool(start, end net.IP, exclude ...net.IP) (*lease6Pool, error) {
+	if start.To16() == nil || start.To4() != nil || end.To16() == nil || end.To4() != nil {
+		return nil, fmt.Errorf("DHCPv6 range must be IPv6: %s-%s", start, end)
+	}
+	if bytes.Compare(start.To16(), end.To16()) > 0 {
+		return nil, fmt.Errorf("invalid DHCPv6 range: %s is after %s", start, end)
+	}
+
+	p := &lease6Pool{
+		start:    start.To16(),
+		end:      end.To16(),
+		exclude:  make(map[string]bool),
+		byIA:     make(map[string]*Lease),
+		byIP:     make(map[string]string),
+		declined: make(map[string]time.Time),
+		now:      time.Now,
+		next:     start.To16(),
+	}
+	for _, ip := range exclude {
+		if ip != nil {
+			p.exclude[ip.String()] = true
+		}
+	}
+	return p, nil
+}
+
+// contains reports whether ip is inside the pool's range
+func (p *lease6Pool) contains(ip net.IP) bool {
+	if ip.To16() == nil || ip.To4() != nil {
+		return false
+	}
+	return bytes.Compare(ip.To16(), p.start) >= 0 && bytes.Compare(ip.To16(), p.end) <= 0
+}
+
+// available reports whether ip can be assigned to the identity association
+// ia. The caller must hold mu.
+func (p *lease6Pool) available(ip net.IP, ia string, now time.Time) bool {
+	key := ip.String()
+	if !p.contains(ip) || p.exclude[key] {
+		return false
+	}
+	if until, ok := p.declined[key]; ok {
+		if now.Before(until) {
+			return false
+		}
+		delete(p.declined, key)
+	}
+	owner, ok := p.byIP[key]
+	return !ok || owner == ia || now.After(p.byIA[owner].Expiry)
+}
+
+// assign gives the identity association ia an address for the given
+// duration. Its existing address is preferred, then the one it asked for,
+// then the next free address in the range.
+func (p *lease6Pool) assign(ia string, mac net.HardwareAddr, requested net.IP, state LeaseState, duration time.Duration) (*Lease, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	ip := p.find(ia, requested, now)
+	if ip == nil {
+		return nil, ErrPoolExhausted
+	}
+
+	if lease, ok := p.byIA[ia]; ok && !lease.IP.Equal(ip) {
+		p.remove(ia)
+	}
+	// An offer never shortens a lease the client already holds
+	if lease, ok := p.byIA[ia]; ok && state == LeaseOffered && lease.State == LeaseBound && !now.After(lease.Expiry) {
+		return copyLease(lease), nil
+	}
+	if owner, ok := p.byIP[ip.String()]; ok && owner != ia {
+		p.remove(owner)
+	}
+
+	lease := &Lease{MAC: mac, IP: ip, State: state, Expiry: now.Add(duration)}
+	p.byIA[ia] = lease
+	p.byIP[ip.String()] = ia
+	return copyLease(lease), nil
+}
+
+// find returns the address to assign to ia, or nil if there is none. The
+// caller must hold mu.
+func (p *lease6Pool) find(ia string, requested net.IP, now time.Time) net.IP {
+	if lease, ok := p.byIA[ia]; ok && p.available(lease.IP, ia, now) {
+		return lease.IP
+	}
+	if requested != nil && p.available(requested, ia, now) {
+		return requested.To16()
+	}
+
+	ip := p.next
+	for i := 0; i < maxLease6Scan; i++ {
+		if p.available(ip, ia, now) {
+			p.next = nextIP(ip, p.start, p.end)
+			return ip
+		}
+		ip = nextIP(ip, p.start, p.end)
+	}
+	return nil
+}
+
+// release frees the lease ia holds on ip
+func (p *lease6Pool) release(ia string, ip net.IP) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if lease, ok := p.byIA[ia]; ok && lease.IP.Equal(ip) {
+		p.remove(ia)
+	}
+}
+
+// decline frees the lease ia holds on ip and keeps the address out of the
+// pool for a while
+func (p *lease6Pool) decline(ia string, ip net.IP) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.contains(ip) {
+		return
+	}
+	if lease, ok := p.byIA[ia]; ok && lease.IP.Equal(ip) {
+		p.remove(ia)
+	}
+	p.declined[ip.String()] = p.now().Add(declineHoldTime)
+}
+
+// list returns all unexpired bound leases ordered by address
+func (p *lease6Pool) list() []Lease {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	var leases []Lease
+	for _, lease := range p.byIA {
+		if lease.State != LeaseBound || now.After(lease.Expiry) {
+			continue
+		}
+		leases = append(leases, *copyLease(lease))
+	}
+	sort.Slice(leases, func(i, j int) bool {
+		return bytes.Compare(leases[i].IP, leases[j].IP) < 0
+	})
+	return leases
+}
+
+// remove deletes the lease of ia. The caller must hold mu.
+func (p *lease6Pool) remove(ia string) {
+	if lease, ok := p.byIA[ia]; ok {
+		delete(p.byIP, lease.IP.String())
+		delete(p.byIA, ia)
+	}
+}
+
+// nextIP returns the address after ip, wrapping around to start after end
+func nextIP(ip, start, end net.IP) net.IP {
+	if bytes.Compare(ip, end) >= 0 {
+		return start
+	}
+	next := append(net.IP(nil), ip...)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
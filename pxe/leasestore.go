@@ -0,0 +1,117 @@
+package pxe
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nimbus-project/nimbus/internal/atomicfile"
+)
+
+// leaseStore persists bound DHCP leases as a JSON document so that clients
+// keep their addresses across server restarts. Each save is written to a
+// temporary file, synced and renamed over the previous version, so a crash
+// leaves either the old or the new set of leases on disk, never a mix.
+type leaseStore struct {
+	path string
+
+	// The bound leases of each pool sharing the file
+	mu    sync.Mutex
+	pools map[*leasePool][]Lease
+}
+
+// leaseRecord is the on-disk representation of a lease
+type leaseRecord struct {
+	MAC      string    `json:"mac"`
+	IP       string    `json:"ip"`
+	Hostname string    `json:"hostname,omitempty"`
+	Expiry   time.Time `json:"expiry"`
+}
+
+// load reads the leases from disk. A missing file is not an error.
+func (f *leaseStore) load() ([]Lease, error) {
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read lease file: %w", err)
+	}
+
+	var records []leaseRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, fmt.Errorf("failed to parse lease file %s: %w", f.path, err)
+	}
+
+	leases := make([]Lease, 0, len(records))
+	for _, r := range records {
+		mac, err := net.ParseMAC(r.MAC)
+		if err != nil {
+			return nil, fmt.Errorf("invalid MAC address in lease file: %w", err)
+		}
+		ip := net.ParseIP(r.IP).To4()
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address in lease file: %q", r.IP)
+		}
+		leases = append(leases, Lease{
+			MAC:      mac,
+			IP:       ip,
+			Hostname: r.Hostname,
+			State:    LeaseBound,
+			Expiry:   r.Expiry,
+		})
+	}
+
+	return leases, nil
+}
+
+// track records the bound leases of a pool without writing them, so that
+// saves by other pools sharing the file keep them
+func (f *leaseStore) track(pool *leasePool, leases []Lease) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.pools == nil {
+		f.pools = make(map[*leasePool][]Lease)
+	}
+	f.pools[pool] = leases
+}
+
+// save replaces the bound leases of a pool and atomically rewrites the
+// lease file with those of all pools
+func (f *leaseStore) save(pool *leasePool, leases []Lease) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.pools == nil {
+		f.pools = make(map[*leasePool][]Lease)
+	}
+	f.pools[pool] = leases
+
+	var all []Lease
+	for _, poolLeases := range f.pools {
+		all = append(all, poolLeases...)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return ipToUint32(all[i].IP) < ipToUint32(all[j].IP)
+	})
+
+	records := make([]leaseRecord, 0, len(all))
+	for _, l := range all {
+		records = append(records, leaseRecord{
+			MAC:      l.MAC.String(),
+			IP:       l.IP.String(),
+			Hostname: l.Hostname,
+			Expiry:   l.Expiry.UTC(),
+		})
+	}
+
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return atomicfile.WriteFile(f.path, data, 0o644)
+}
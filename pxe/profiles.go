@@ -0,0 +1,414 @@
+package pxe
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// BootAction is what a host does when it network boots
+type BootAction string
+
+// Boot actions
+const (
+	// ActionInstall boots the OS installer
+	ActionInstall BootAction = "install"
+
+	// ActionRescue boots a rescue environment
+	ActionRescue BootAction = "rescue"
+
+	// ActionLocalBoot hands control back to the local disk
+	ActionLocalBoot BootAction = "localboot"
+
+	// ActionWipe boots an image that erases the host's disks
+	ActionWipe BootAction = "wipe"
+
+	// ActionDiscover boots an agent that reports the host's hardware
+	// inventory back to the server
+	ActionDiscover BootAction = "discover"
+)
+
+// DefaultProfile is the name of the profile built from Config.Kernel,
+// Config.Initrd and Config.Cmdline
+const DefaultProfile = "default"
+
+// DiscoveryProfile is the name of the profile built from Config.Discovery
+const DiscoveryProfile = "discovery"
+
+// Profile describes how a host network boots. Kernel and Initrd are paths
+// below RootDir or HTTP(S) URLs, which are downloaded through the artifact
+// cache and verified against KernelSHA256 and InitrdSHA256 or the artifact
+// manifest.
+type Profile struct {
+	Name    string
+	Action  BootAction
+	Kernel  string
+	Initrd  string
+	Cmdline string
+
+	KernelSHA256 string
+	InitrdSHA256 string
+}
+
+// Validate checks that the profile can be rendered
+func (p *Profile) Validate() error {
+	if p.Name == "" {
+		return fmt.Errorf("profile name is required")
+	}
+	switch p.Action {
+	case ActionInstall, ActionRescue, ActionWipe, ActionDiscover:
+		if p.Kernel == "" {
+			return fmt.Errorf("profile %s: kernel is required for action %s", p.Name, p.Action)
+		}
+	case ActionLocalBoot:
+	default:
+		return fmt.Errorf("profile %s: unknown boot action %q", p.Name, p.Action)
+	}
+	return nil
+}
+
+// ProfileRegistry maps hosts to boot profiles. A host's profile is looked up
+// by MAC address, then by SMBIOS UUID, then by group, and finally falls back
+// to the default profile. If a discovery profile is set, hosts that are not
+// known fall back to it instead.
+type ProfileRegistry struct {
+	mu               sync.RWMutex
+	profiles         map[string]Profile
+	byMAC            map[string]string
+	byUUID           map[string]string
+	byGroup          map[string]string
+	groups           map[string]string
+	known            map[string]bool
+	defaultProfile   string
+	discoveryProfile string
+
+	// artifacts caches remote kernels and initrds, nil if not configured
+	artifacts *ArtifactCache
+}
+
+// NewProfileRegistry creates an empty registry
+func NewProfileRegistry() *ProfileRegistry {
+	return &ProfileRegistry{
+		profiles: make(map[string]Profile),
+		byMAC:    make(map[string]string),
+		byUUID:   make(map[string]string),
+		byGroup:  make(map[string]string),
+		groups:   make(map[string]string),
+		known:    make(map[string]bool),
+	}
+}
+
+// Add adds or replaces a profile. Remote kernels and initrds are replaced by
+// the paths the artifact cache serves them from.
+func (r *ProfileRegistry) Add(p Profile) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	if err := r.cacheArtifacts(&p); err != nil {
+		return fmt.Errorf("profile %s: %w", p.Name, err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.profiles[p.Name] = p
+	return nil
+}
+
+// Remove deletes a profile. Profiles that are still assigned to hosts or
+// groups, or that are the default, cannot be removed.
+func (r *ProfileRegistry) Remove(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if name == r.defaultProfile {
+		return fmt.Errorf("profile %s is the default profile", name)
+	}
+	if name == r.discoveryProfile {
+		return fmt.Errorf("profile %s is the discovery profile", name)
+	}
+	for _, m := range []map[string]string{r.byMAC, r.byUUID, r.byGroup} {
+		for key, assigned := range m {
+			if assigned == name {
+				return fmt.Errorf("profile %s is still assigned to %s", name, key)
+			}
+		}
+	}
+	delete(r.profiles, name)
+	return nil
+}
+
+// cacheArtifacts registers a profile's remote boot files with the artifact
+// cache
+func (r *ProfileRegistry) cacheArtifacts(p *Profile) error {
+	if r.artifacts == nil {
+		return nil
+	}
+
+	var err error
+	if isRemoteArtifact(p.Kernel) {
+		if p.Kernel, err = r.artifacts.Register(p.Kernel, p.KernelSHA256); err != nil {
+			return err
+		}
+	}
+	if isRemoteArtifact(p.Initrd) {
+		if p.Initrd, err = r.artifacts.Register(p.Initrd, p.InitrdSHA256); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get returns a profile by name
+func (r *ProfileRegistry) Get(name string) (Profile, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	p, ok := r.profiles[name]
+	return p, ok
+}
+
+// List returns all profiles ordered by name
+func (r *ProfileRegistry) List() []Profile {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	profiles := make([]Profile, 0, len(r.profiles))
+	for _, p := range r.profiles {
+		profiles = append(profiles, p)
+	}
+	sort.Slice(profiles, func(i, j int) bool { return profiles[i].Name < profiles[j].Name })
+	return profiles
+}
+
+// SetDefault sets the profile used for hosts without an assignment
+func (r *ProfileRegistry) SetDefault(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.profiles[name]; !ok {
+		return fmt.Errorf("unknown profile %s", name)
+	}
+	r.defaultProfile = name
+	return nil
+}
+
+// SetDiscovery sets the profile used for hosts that are not known. An empty
+// name disables discovery.
+func (r *ProfileRegistry) SetDiscovery(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.profiles[name]; name != "" && !ok {
+		return fmt.Errorf("unknown profile %s", name)
+	}
+	r.discoveryProfile = name
+	return nil
+}
+
+// SetKnown marks the host with the given MAC address as known, so that it
+// boots with the default profile rather than the discovery profile
+func (r *ProfileRegistry) SetKnown(mac string, known bool) error {
+	key, err := normalizeMAC(mac)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if known {
+		r.known[key] = true
+	} else {
+		delete(r.known, key)
+	}
+	return nil
+}
+
+// IsKnown reports whether the host with the given MAC address is known or
+// has a profile assigned to it
+func (r *ProfileRegistry) IsKnown(mac string) bool {
+	key, err := normalizeMAC(mac)
+	if err != nil {
+		return false
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	_, assigned := r.byMAC[key]
+	return r.known[key] || assigned
+}
+
+// AssignMAC assigns a profile to the host with the given MAC address. An
+// empty profile name removes the assignment.
+func (r *ProfileRegistry) AssignMAC(mac, profile string) error {
+	key, err := normalizeMAC(mac)
+	if err != nil {
+		return err
+	}
+	return r.assign(r.byMAC, key, profile)
+}
+
+// AssignUUID assigns a profile to the host with the given SMBIOS UUID
+func (r *ProfileRegistry) AssignUUID(uuid, profile string) error {
+	return r.assign(r.byUUID, strings.ToLower(uuid), profile)
+}
+
+// AssignGroup assigns a profile to all members of a group
+func (r *ProfileRegistry) AssignGroup(group, profile string) error {
+	return r.assign(r.byGroup, group, profile)
+}
+
+// SetGroup makes the host with the given MAC address a member of group. An
+// empty group removes the membership.
+func (r *ProfileRegistry) SetGroup(mac, group string) error {
+	key, err := normalizeMAC(mac)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if group == "" {
+		delete(r.groups, key)
+	} else {
+		r.groups[key] = group
+	}
+	return nil
+}
+
+// assign records or removes an assignment in m
+func (r *ProfileRegistry) assign(m map[string]string, key, profile string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if profile == "" {
+		delete(m, key)
+		return nil
+	}
+	if _, ok := r.profiles[profile]; !ok {
+		return fmt.Errorf("unknown profile %s", profile)
+	}
+	m[key] = profile
+	return nil
+}
+
+// Resolve returns the profile for a host. uuid may be empty if the host's
+// SMBIOS UUID is not known.
+func (r *ProfileRegistry) Resolve(mac, uuid string) (Profile, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	key, _ := normalizeMAC(mac)
+	name, ok := r.byMAC[key]
+	if !ok && uuid != "" {
+		name, ok = r.byUUID[strings.ToLower(uuid)]
+	}
+	if !ok {
+		if group, member := r.groups[key]; member {
+			name, ok = r.byGroup[group]
+		}
+	}
+	if !ok {
+		name = r.defaultProfile
+		if r.discoveryProfile != "" && !r.known[key] {
+			name = r.discoveryProfile
+		}
+	}
+
+	p, ok := r.profiles[name]
+	if !ok {
+		return Profile{}, fmt.Errorf("no boot profile for %s", mac)
+	}
+	return p, nil
+}
+
+// normalizeMAC returns the canonical lower case, colon separated form of mac
+func normalizeMAC(mac string) (string, error) {
+	if mac == "" {
+		return "", nil
+	}
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return "", err
+	}
+	return hw.String(), nil
+}
+
+// Profiles returns the server's boot profile registry
+func (s *Server) Profiles() *ProfileRegistry {
+	return s.profiles
+}
+
+// SetHostProfile changes the profile a host boots with. The change applies
+// the next time the host requests its boot configuration.
+func (s *Server) SetHostProfile(mac, profile string) error {
+	return s.profiles.AssignMAC(mac, profile)
+}
+
+// SetHostKnown marks a host as known or unknown. Unknown hosts boot into
+// the discovery agent when Config.Discovery is set, and are refused when
+// Config.RequireAuthorization is set unless they hold a ticket.
+func (s *Server) SetHostKnown(mac string, known bool) error {
+	return s.profiles.SetKnown(mac, known)
+}
+
+// SetHostCmdline sets kernel arguments appended to the command line of
+// whatever profile a host boots, for example to point its installer at
+// per-host configuration. Empty args removes them.
+func (s *Server) SetHostCmdline(mac, args string) error {
+	key, err := normalizeMAC(mac)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if args == "" {
+		delete(s.hostArgs, key)
+	} else {
+		s.hostArgs[key] = args
+	}
+	return nil
+}
+
+// resolveProfile returns the boot profile for a MAC address with the host's
+// kernel arguments appended, using the SMBIOS UUID the client reported over
+// DHCP if one was seen
+func (s *Server) resolveProfile(mac string) (Profile, error) {
+	key, _ := normalizeMAC(mac)
+
+	s.mu.Lock()
+	uuid := s.clientUUIDs[key]
+	args := s.hostArgs[key]
+	s.mu.Unlock()
+
+	p, err := s.profiles.Resolve(mac, uuid)
+	if err != nil {
+		return Profile{}, err
+	}
+	if p.Action == ActionDiscover {
+		args = strings.TrimSpace(args + " " + discoveryURLArg + "=" + s.httpURL(discoveryInventoryPath) +
+			" " + discoveryTokenArg + "=" + s.discoveryToken(key))
+	}
+	if args != "" {
+		p.Cmdline = strings.TrimSpace(p.Cmdline + " " + args)
+	}
+	if s.isIPv6Client(key) {
+		p.Cmdline = strings.ReplaceAll(p.Cmdline, s.httpBaseURL()+"/", s.httpBaseURLFor(true)+"/")
+	}
+	return p, nil
+}
+
+// recordClientUUID remembers the SMBIOS UUID a client sent in DHCP option 97
+func (s *Server) recordClientUUID(mac net.HardwareAddr, machineID []byte) {
+	// Option 97 is a type byte of zero followed by a 16 byte GUID
+	if len(machineID) != 17 || machineID[0] != 0 {
+		return
+	}
+	g := machineID[1:]
+	uuid := fmt.Sprintf("%x-%x-%x-%x-%x", g[0:4], g[4:6], g[6:8], g[8:10], g[10:16])
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clientUUIDs[mac.String()] = uuid
+}
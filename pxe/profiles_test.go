@@ -0,0 +1,181 @@
+package pxe
+
+import (
+	"strings"
+	"testing"
+)
+
+const testProfileUUID = "4c4c4544-0032-1080-8036-b4c04f503232"
+
+// newTestRegistry returns a registry with a profile for each way a host can
+// be matched. testMAC is assigned the mac profile, testProfileUUID the uuid
+// profile and the rack group the group profile.
+func newTestRegistry(t *testing.T, discovery bool) *ProfileRegistry {
+	t.Helper()
+
+	r := NewProfileRegistry()
+	for _, name := range []string{DefaultProfile, DiscoveryProfile, "mac", "uuid", "group"} {
+		if err := r.Add(Profile{Name: name, Action: ActionInstall, Kernel: name + "/vmlinuz"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	steps := []error{
+		r.SetDefault(DefaultProfile),
+		r.AssignMAC(testMAC.String(), "mac"),
+		r.AssignUUID(testProfileUUID, "uuid"),
+		r.AssignGroup("rack", "group"),
+		r.SetGroup(testMAC.String(), "rack"),
+		r.SetGroup("52:54:00:00:00:02", "rack"),
+		r.SetGroup("52:54:00:00:00:03", "empty"),
+		r.SetKnown("52:54:00:00:00:04", true),
+	}
+	if discovery {
+		steps = append(steps, r.SetDiscovery(DiscoveryProfile))
+	}
+	for _, err := range steps {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return r
+}
+
+func TestProfileResolve(t *testing.T) {
+	tests := []struct {
+		name      string
+		mac       string
+		uuid      string
+		discovery bool
+		want      string
+	}{
+		{name: "mac before uuid and group", mac: testMAC.String(), uuid: testProfileUUID, want: "mac"},
+		{name: "mac in another notation", mac: strings.ToUpper(strings.ReplaceAll(testMAC.String(), ":", "-")), want: "mac"},
+		{name: "uuid before group", mac: "52:54:00:00:00:02", uuid: testProfileUUID, want: "uuid"},
+		{name: "uuid in upper case", mac: "52:54:00:00:00:09", uuid: strings.ToUpper(testProfileUUID), want: "uuid"},
+		{name: "group", mac: "52:54:00:00:00:02", want: "group"},
+		{name: "unassigned uuid", mac: "52:54:00:00:00:02", uuid: "00000000-0000-0000-0000-000000000001", want: "group"},
+		{name: "group without profile", mac: "52:54:00:00:00:03", want: DefaultProfile},
+		{name: "unassigned", mac: "52:54:00:00:00:09", want: DefaultProfile},
+		{name: "unknown with discovery", mac: "52:54:00:00:00:09", discovery: true, want: DiscoveryProfile},
+		{name: "group without profile with discovery", mac: "52:54:00:00:00:03", discovery: true, want: DiscoveryProfile},
+		{name: "known with discovery", mac: "52:54:00:00:00:04", discovery: true, want: DefaultProfile},
+		{name: "assigned with discovery", mac: "52:54:00:00:00:02", discovery: true, want: "group"},
+		{name: "invalid mac", mac: "not-a-mac", want: DefaultProfile},
+		{name: "invalid mac with discovery", mac: "not-a-mac", discovery: true, want: DiscoveryProfile},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestRegistry(t, tt.discovery)
+			p, err := r.Resolve(tt.mac, tt.uuid)
+			if err != nil {
+				t.Fatalf("Resolve: %v", err)
+			}
+			if p.Name != tt.want {
+				t.Errorf("resolved %s, want %s", p.Name, tt.want)
+			}
+		})
+	}
+}
+
+func TestProfileResolveWithoutDefault(t *testing.T) {
+	r := NewProfileRegistry()
+	if err := r.Add(Profile{Name: "mac", Action: ActionLocalBoot}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.AssignMAC(testMAC.String(), "mac"); err != nil {
+		t.Fatal(err)
+	}
+
+	if p, err := r.Resolve(testMAC.String(), ""); err != nil || p.Name != "mac" {
+		t.Errorf("Resolve = %s, %v; want mac", p.Name, err)
+	}
+	if p, err := r.Resolve("52:54:00:00:00:09", ""); err == nil {
+		t.Errorf("resolved %s for a host without profile", p.Name)
+	}
+}
+
+func TestProfileUnknown(t *testing.T) {
+	r := newTestRegistry(t, true)
+
+	for name, err := range map[string]error{
+		"AssignMAC":    r.AssignMAC("52:54:00:00:00:09", "missing"),
+		"AssignUUID":   r.AssignUUID(testProfileUUID, "missing"),
+		"AssignGroup":  r.AssignGroup("rack", "missing"),
+		"SetDefault":   r.SetDefault("missing"),
+		"SetDiscovery": r.SetDiscovery("missing"),
+	} {
+		if err == nil {
+			t.Errorf("%s accepted an unknown profile", name)
+		}
+	}
+	// The failed assignments left the existing ones in place
+	if p, _ := r.Resolve("52:54:00:00:00:02", testProfileUUID); p.Name != "uuid" {
+		t.Errorf("resolved %s, want uuid", p.Name)
+	}
+	if p, _ := r.Resolve("52:54:00:00:00:09", ""); p.Name != DiscoveryProfile {
+		t.Errorf("resolved %s, want %s", p.Name, DiscoveryProfile)
+	}
+
+	if err := r.Add(Profile{Name: "broken", Action: "reboot"}); err == nil {
+		t.Error("added a profile with an unknown action")
+	}
+	if err := r.Add(Profile{Name: "broken", Action: ActionInstall}); err == nil {
+		t.Error("added an install profile without kernel")
+	}
+	if _, ok := r.Get("broken"); ok {
+		t.Error("invalid profile registered")
+	}
+}
+
+func TestProfileRemove(t *testing.T) {
+	r := newTestRegistry(t, true)
+
+	for _, name := range []string{DefaultProfile, DiscoveryProfile, "mac", "uuid", "group"} {
+		if err := r.Remove(name); err == nil {
+			t.Errorf("removed profile %s while in use", name)
+		}
+	}
+
+	if err := r.AssignMAC(testMAC.String(), ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Remove("mac"); err != nil {
+		t.Errorf("Remove after unassigning: %v", err)
+	}
+	if p, _ := r.Resolve(testMAC.String(), ""); p.Name != "group" {
+		t.Errorf("resolved %s after removal, want group", p.Name)
+	}
+}
+
+func TestProfileDuplicate(t *testing.T) {
+	// Adding a profile under an existing name replaces it
+	r := newTestRegistry(t, false)
+	if err := r.Add(Profile{Name: "mac", Action: ActionLocalBoot}); err != nil {
+		t.Fatal(err)
+	}
+	if p, _ := r.Resolve(testMAC.String(), ""); p.Action != ActionLocalBoot {
+		t.Errorf("resolved action %s, want the replacement's %s", p.Action, ActionLocalBoot)
+	}
+	if n := len(r.List()); n != 5 {
+		t.Errorf("%d profiles listed, want 5", n)
+	}
+
+	// In the configuration a repeated name is a mistake
+	tests := []struct {
+		name     string
+		profiles []Profile
+	}{
+		{name: "repeated", profiles: []Profile{{Name: "rescue", Action: ActionLocalBoot}, {Name: "rescue", Action: ActionLocalBoot}}},
+		{name: "default", profiles: []Profile{{Name: DefaultProfile, Action: ActionLocalBoot}}},
+		{name: "discovery", profiles: []Profile{{Name: DiscoveryProfile, Action: ActionLocalBoot}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := Config{IP: testServerIP, RootDir: t.TempDir(), ProxyDHCP: true, Profiles: tt.profiles}
+			if _, err := NewServer(&cfg); err == nil {
+				t.Error("NewServer accepted the profiles")
+			}
+		})
+	}
+}
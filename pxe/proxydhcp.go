@@ -0,0 +1,147 @@
+package pxe
+
+import (
+	"net"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/nimbus-project/nimbus/pxe/dhcp4"
+)
+
+// PXE vendor sub-options carried in option 43 (PXE specification 2.1)
+const (
+	pxeDiscoveryControl = 6
+	pxeBootItem         = 71
+	pxeEnd              = 255
+)
+
+// pxeDiscoveryUseBootFile tells the client to download the boot file named in
+// the reply instead of performing boot server discovery
+const pxeDiscoveryUseBootFile = 0x08
+
+// handleProxyDiscover answers a DHCPDISCOVER from a PXE or HTTP Boot client
+// with boot information only. The address itself comes from the site's DHCP
+// server, so yiaddr is left empty and no lease is recorded.
+func (s *Server) handleProxyDiscover(req *dhcp4.Packet) *dhcp4.Packet {
+	if req.MessageType() != dhcp4.Discover || !(isPXEClient(req) || isHTTPBootClient(req)) {
+		return nil
+	}
+
+	log.Debug().
+		Str("mac", req.CHAddr.String()).
+		Str("arch", clientArch(req).String()).
+		Msg("ProxyDHCP offer")
+
+	return s.proxyReply(req, dhcp4.Offer)
+}
+
+// handleProxyRequest remembers the address a PXE or HTTP Boot client asks
+// the site's DHCP server for. Clients told to use the boot file of the
+// proxyDHCP offer never contact the boot server port, so this broadcast
+// DHCPREQUEST is the only time their MAC address is seen together with
+// their IP address, which later TFTP and HTTP requests are attributed by.
+// The request itself is left to the site's DHCP server to answer.
+func (s *Server) handleProxyRequest(req *dhcp4.Packet) {
+	if len(req.CHAddr) == 0 || !(isPXEClient(req) || isHTTPBootClient(req)) {
+		return
+	}
+	ip := req.Options.IP(dhcp4.OptionRequestedIP)
+	if ip == nil && req.CIAddr != nil && !req.CIAddr.IsUnspecified() {
+		ip = req.CIAddr
+	}
+	if ip == nil || ip.IsUnspecified() {
+		return
+	}
+
+	log.Debug().
+		Str("mac", req.CHAddr.String()).
+		Str("ip", ip.String()).
+		Msg("ProxyDHCP client requested address")
+
+	s.rememberClient(ip, req.CHAddr)
+}
+
+// serveBootServer answers requests sent to the proxyDHCP boot server port.
+// PXE clients send a DHCPREQUEST there after configuring the address they
+// were given by the site's DHCP server.
+func (s *Server) serveBootServer(req *dhcp4.Packet, peer net.Addr) *dhcp4.Packet {
+	switch req.MessageType() {
+	case dhcp4.Request, dhcp4.Inform:
+	default:
+		return nil
+	}
+	if !isPXEClient(req) || !s.authorizeDHCP(req) {
+		return nil
+	}
+	s.recordClient(req)
+
+	resp := s.proxyReply(req, dhcp4.Ack)
+	resp.CIAddr = req.CIAddr
+
+	log.Info().
+		Str("mac", req.CHAddr.String()).
+		Str("ip", req.CIAddr.String()).
+		Str("file", resp.File).
+		Msg("ProxyDHCP boot request answered")
+
+	s.emitDHCP(req, resp)
+	return resp
+}
+
+// proxyReply builds a proxyDHCP reply carrying only boot options
+func (s *Server) proxyReply(req *dhcp4.Packet, t dhcp4.MessageType) *dhcp4.Packet {
+	resp := dhcp4.NewReply(req, t)
+	resp.Options.SetIP(dhcp4.OptionServerID, s.serverIP())
+	s.addBootOptions(req, resp)
+	if isPXEClient(req) {
+		resp.Options[dhcp4.OptionVendorSpecific] = pxeVendorOptions(req)
+	}
+	return resp
+}
+
+// pxeVendorOptions encodes the option 43 sub-options for a proxyDHCP reply.
+// A boot item sent by the client must be echoed back for it to accept the
+// reply.
+func pxeVendorOptions(req *dhcp4.Packet) []byte {
+	b := []byte{pxeDiscoveryControl, 1, pxeDiscoveryUseBootFile}
+	if item := pxeSubOption(req.Options.Get(dhcp4.OptionVendorSpecific), pxeBootItem); item != nil {
+		b = append(b, pxeBootItem, byte(len(item)))
+		b = append(b, item...)
+	}
+	return append(b, pxeEnd)
+}
+
+// pxeSubOption returns the value of a sub-option encoded in option 43
+func pxeSubOption(b []byte, code byte) []byte {
+	for i := 0; i+1 < len(b); {
+		switch b[i] {
+		case 0:
+			i++
+			continue
+		case pxeEnd:
+			return nil
+		}
+		n := int(b[i+1])
+		if i+2+n > len(b) {
+			return nil
+		}
+		if b[i] == code {
+			return b[i+2 : i+2+n]
+		}
+		i += 2 + n
+	}
+	return nil
+}
+
+// isPXEClient reports whether a request comes from PXE firmware
+func isPXEClient(req *dhcp4.Packet) bool {
+	return strings.HasPrefix(req.Options.String(dhcp4.OptionClassID), pxeClientClass)
+}
+
+// replyToPeer sends replies back to the address a request came from. Clients
+// talking to the boot server port already have an address and expect a
+// unicast reply to their source port.
+func replyToPeer(req, resp *dhcp4.Packet, peer net.Addr) net.Addr {
+	return peer
+}
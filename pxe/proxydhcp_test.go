@@ -0,0 +1,108 @@
+package pxe
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/nimbus-project/nimbus/pxe/dhcp4"
+)
+
+func TestProxyDHCPAttributesClients(t *testing.T) {
+	s := newTestServer(t, Config{
+		ProxyDHCP:            true,
+		RequireAuthorization: true,
+		KnownHosts:           []string{testMAC.String()},
+	})
+	events, cancel := s.Subscribe(16)
+	defer cancel()
+
+	offer := s.ServeDHCP(pxeRequest(dhcp4.Discover, testMAC, ArchEFIX64), nil)
+	if offer == nil || offer.MessageType() != dhcp4.Offer {
+		t.Fatalf("reply to discover = %v, want DHCPOFFER", offer)
+	}
+	if offer.YIAddr != nil && !offer.YIAddr.IsUnspecified() {
+		t.Errorf("proxy offer assigns %s", offer.YIAddr)
+	}
+	checkBootOptions(t, offer, "bootx64.efi")
+	if got := pxeSubOption(offer.Options.Get(dhcp4.OptionVendorSpecific), pxeDiscoveryControl); len(got) != 1 || got[0] != pxeDiscoveryUseBootFile {
+		t.Errorf("discovery control = %x, want %x", got, pxeDiscoveryUseBootFile)
+	}
+
+	// The client takes its address from the site's DHCP server, which the
+	// proxy must not answer for, and downloads the boot file straight away
+	clientIP := net.IPv4(10, 0, 0, 150).To4()
+	req := pxeRequest(dhcp4.Request, testMAC, ArchEFIX64)
+	req.Options.SetIP(dhcp4.OptionRequestedIP, clientIP)
+	req.Options.SetIP(dhcp4.OptionServerID, net.IPv4(10, 0, 0, 2))
+	if resp := s.ServeDHCP(req, nil); resp != nil {
+		t.Fatalf("proxy answered a request to the site server with %s", resp)
+	}
+
+	if got := s.ClientMAC(clientIP); got.String() != testMAC.String() {
+		t.Fatalf("ClientMAC(%s) = %v, want %s", clientIP, got, testMAC)
+	}
+	remote := &net.UDPAddr{IP: clientIP, Port: 2070}
+	if !s.authorizedClient(remote) {
+		t.Errorf("known client at %s refused", clientIP)
+	}
+	if s.authorizedClient(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 151), Port: 2070}) {
+		t.Errorf("unidentified client authorized")
+	}
+
+	// File transfers from the address are attributed to the client
+	s.emit(Event{Type: EventTFTPFile, IP: clientIP, File: "bootx64.efi"})
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case e := <-events:
+			if e.Type != EventTFTPFile {
+				continue
+			}
+			if e.MAC.String() != testMAC.String() {
+				t.Fatalf("TFTP event MAC = %v, want %s", e.MAC, testMAC)
+			}
+			return
+		case <-timeout:
+			t.Fatal("no TFTP event")
+		}
+	}
+}
+
+func TestProxyDHCPIgnoresOtherClients(t *testing.T) {
+	s := newTestServer(t, Config{ProxyDHCP: true})
+
+	req := pxeRequest(dhcp4.Discover, testMAC, ArchBIOS)
+	delete(req.Options, dhcp4.OptionClassID)
+	if resp := s.ServeDHCP(req, nil); resp != nil {
+		t.Fatalf("proxy answered a client that is not PXE booting with %s", resp)
+	}
+
+	req = pxeRequest(dhcp4.Request, testMAC, ArchBIOS)
+	delete(req.Options, dhcp4.OptionClassID)
+	req.Options.SetIP(dhcp4.OptionRequestedIP, net.IPv4(10, 0, 0, 150))
+	s.ServeDHCP(req, nil)
+	if got := s.ClientMAC(net.IPv4(10, 0, 0, 150)); got != nil {
+		t.Fatalf("address of a client that is not PXE booting attributed to %s", got)
+	}
+}
+
+func TestProxyBootServer(t *testing.T) {
+	s := newTestServer(t, Config{ProxyDHCP: true})
+	client, addr := loopbackDHCP(t, dhcp4.HandlerFunc(s.serveBootServer))
+
+	clientIP := net.IPv4(10, 0, 0, 150).To4()
+	req := pxeRequest(dhcp4.Request, testMAC, ArchBIOS)
+	req.CIAddr = clientIP
+	ack := exchange(t, client, addr, req)
+	if got := ack.MessageType(); got != dhcp4.Ack {
+		t.Fatalf("reply is %s, want DHCPACK", got)
+	}
+	if !ack.CIAddr.Equal(clientIP) {
+		t.Errorf("ciaddr = %s, want %s", ack.CIAddr, clientIP)
+	}
+	checkBootOptions(t, ack, "pxelinux.0")
+	if got := s.ClientMAC(clientIP); got.String() != testMAC.String() {
+		t.Errorf("ClientMAC(%s) = %v, want %s", clientIP, got, testMAC)
+	}
+}
@@ -0,0 +1,209 @@
+package pxe
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Middleware wraps an HTTP handler, for example to log or authenticate
+// requests
+type Middleware func(http.Handler) http.Handler
+
+// router dispatches HTTP requests to handlers that can be added and removed
+// while the server is running. Patterns follow http.ServeMux syntax. Every
+// change builds a new ServeMux which is swapped in atomically, so requests
+// never wait for registrations.
+type router struct {
+	mu         sync.Mutex
+	routes     map[string]route
+	middleware []Middleware
+	mux        atomic.Pointer[http.ServeMux]
+}
+
+// route is a registered handler and its own middleware
+type route struct {
+	handler    http.Handler
+	middleware []Middleware
+}
+
+// newRouter creates a router without any routes
+func newRouter() *router {
+	r := &router{routes: make(map[string]route)}
+	r.mux.Store(http.NewServeMux())
+	return r
+}
+
+// ServeHTTP dispatches the request to the handler registered for its path
+func (r *router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mux.Load().ServeHTTP(w, req)
+}
+
+// handle registers or replaces the handler for pattern
+func (r *router) handle(pattern string, handler http.Handler, middleware ...Middleware) error {
+	if handler == nil {
+		return fmt.Errorf("nil handler for %s", pattern)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	routes := make(map[string]route, len(r.routes)+1)
+	for p, rt := range r.routes {
+		routes[p] = rt
+	}
+	routes[pattern] = route{handler: handler, middleware: middleware}
+
+	return r.rebuild(routes)
+}
+
+// remove unregisters the handler for pattern and reports whether there was
+// one
+func (r *router) remove(pattern string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.routes[pattern]; !ok {
+		return false
+	}
+
+	routes := make(map[string]route, len(r.routes))
+	for p, rt := range r.routes {
+		if p != pattern {
+			routes[p] = rt
+		}
+	}
+
+	// Removing a route cannot make the remaining patterns invalid
+	r.rebuild(routes)
+	return true
+}
+
+// use appends middleware applied to every handler
+func (r *router) use(middleware ...Middleware) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.middleware = append(r.middleware, middleware...)
+	r.rebuild(r.routes)
+}
+
+// patterns returns the registered patterns in sorted order
+func (r *router) patterns() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	patterns := make([]string, 0, len(r.routes))
+	for p := range r.routes {
+		patterns = append(patterns, p)
+	}
+	sort.Strings(patterns)
+	return patterns
+}
+
+// rebuild builds a ServeMux from routes and swaps it in. The router is left
+// unchanged if any pattern is rejected by the ServeMux. Callers must hold
+// r.mu.
+func (r *router) rebuild(routes map[string]route) (err error) {
+	mux := http.NewServeMux()
+
+	// ServeMux reports invalid and conflicting patterns by panicking
+	defer func() {
+		if v := recover(); v != nil {
+			err = fmt.Errorf("invalid HTTP handler pattern: %v", v)
+		}
+	}()
+
+	for pattern, rt := range routes {
+		h := rt.handler
+		for i := len(rt.middleware) - 1; i >= 0; i-- {
+			h = rt.middleware[i](h)
+		}
+		for i := len(r.middleware) - 1; i >= 0; i-- {
+			h = r.middleware[i](h)
+		}
+		mux.Handle(pattern, h)
+	}
+
+	r.routes = routes
+	r.mux.Store(mux)
+	return nil
+}
+
+// LogRequests is a Middleware that logs each request with its status, size
+// and duration
+func LogRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		log.Debug().
+			Str("method", r.Method).
+			Str("path", r.URL.Path).
+			Str("remote", r.RemoteAddr).
+			Int("status", rec.status).
+			Int64("bytes", rec.bytes).
+			Dur("duration", time.Since(start)).
+			Msg("HTTP request")
+	})
+}
+
+// RequireToken returns a Middleware that rejects requests that do not carry
+// token as a bearer token in the Authorization header or in the "token"
+// query parameter
+func RequireToken(token string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok {
+				got = r.URL.Query().Get("token")
+			}
+			if token == "" || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// statusRecorder captures the status code and body size of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+// WriteHeader records the status code
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Write records the number of bytes written
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// ReadFrom keeps sendfile available for file downloads
+func (r *statusRecorder) ReadFrom(src io.Reader) (int64, error) {
+	n, err := io.Copy(r.ResponseWriter, src)
+	r.bytes += n
+	return n, err
+}
+
+// Unwrap gives http.ResponseController access to the underlying writer
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
@@ -0,0 +1,174 @@
+package pxe
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// statusHandler answers every request with code
+func statusHandler(code int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(code)
+	})
+}
+
+// serve sends a GET request for path to h and returns the status code
+func serve(h http.Handler, path string) int {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	return rec.Code
+}
+
+func TestRouterConcurrentChanges(t *testing.T) {
+	r := newRouter()
+	if err := r.handle("/static", statusHandler(http.StatusOK)); err != nil {
+		t.Fatal(err)
+	}
+
+	const (
+		clients = 8
+		changes = 200
+	)
+	var (
+		wg   sync.WaitGroup
+		stop = make(chan struct{})
+	)
+	for range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if code := serve(r, "/static"); code != http.StatusOK {
+					t.Errorf("/static: status %d while handlers changed", code)
+					return
+				}
+				if code := serve(r, "/dynamic"); code != http.StatusAccepted && code != http.StatusNotFound {
+					t.Errorf("/dynamic: status %d", code)
+					return
+				}
+			}
+		}()
+	}
+
+	for i := range changes {
+		if err := r.handle("/dynamic", statusHandler(http.StatusAccepted)); err != nil {
+			t.Error(err)
+		}
+		if i%50 == 0 {
+			r.use(func(h http.Handler) http.Handler { return h })
+		}
+		r.patterns()
+		if !r.remove("/dynamic") {
+			t.Error("registered handler not removed")
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	if got := r.patterns(); !reflect.DeepEqual(got, []string{"/static"}) {
+		t.Errorf("patterns = %v, want [/static]", got)
+	}
+}
+
+func TestRouterRemoveInFlight(t *testing.T) {
+	r := newRouter()
+	started, release := make(chan struct{}), make(chan struct{})
+	r.handle("/slow", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		close(started)
+		<-release
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	done := make(chan int)
+	go func() { done <- serve(r, "/slow") }()
+	<-started
+	if !r.remove("/slow") {
+		t.Fatal("handler not removed")
+	}
+	if code := serve(r, "/slow"); code != http.StatusNotFound {
+		t.Errorf("status %d after removal, want %d", code, http.StatusNotFound)
+	}
+
+	// The request that was already being served completes
+	close(release)
+	if code := <-done; code != http.StatusOK {
+		t.Errorf("in-flight request: status %d, want %d", code, http.StatusOK)
+	}
+}
+
+func TestRouterInvalidPatterns(t *testing.T) {
+	r := newRouter()
+	if err := r.handle("/items/{id}", statusHandler(http.StatusOK)); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		pattern string
+		handler http.Handler
+	}{
+		{name: "nil handler", pattern: "/nil"},
+		{name: "invalid", pattern: "/items/{id", handler: statusHandler(http.StatusTeapot)},
+		{name: "conflicting", pattern: "/items/{name}", handler: statusHandler(http.StatusTeapot)},
+	}
+	for _, tt := range tests {
+		if err := r.handle(tt.pattern, tt.handler); err == nil {
+			t.Errorf("%s: pattern %q accepted", tt.name, tt.pattern)
+		}
+	}
+
+	// The rejected patterns left the router as it was
+	if got := r.patterns(); !reflect.DeepEqual(got, []string{"/items/{id}"}) {
+		t.Errorf("patterns = %v, want [/items/{id}]", got)
+	}
+	if code := serve(r, "/items/1"); code != http.StatusOK {
+		t.Errorf("status %d, want %d", code, http.StatusOK)
+	}
+	if r.remove("/nil") {
+		t.Error("removed a handler that was never added")
+	}
+}
+
+func TestAddPXEHandler(t *testing.T) {
+	s := newTestServer(t, Config{})
+	h := s.createHTTPHandler()
+
+	var order []string
+	mark := func(name string) Middleware {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				order = append(order, name)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+	s.AddPXEHandler("/custom/", statusHandler(http.StatusAccepted), mark("outer"), mark("inner"))
+	if code := serve(h, "/custom/x"); code != http.StatusAccepted {
+		t.Fatalf("status %d, want %d", code, http.StatusAccepted)
+	}
+	if !reflect.DeepEqual(order, []string{"outer", "inner"}) {
+		t.Errorf("middleware ran in order %v, want [outer inner]", order)
+	}
+
+	// Invalid and conflicting patterns are ignored
+	s.AddPXEHandler("/{dir}/x", statusHandler(http.StatusTeapot))
+	s.AddPXEHandler("/custom/{x", statusHandler(http.StatusTeapot))
+	if code := serve(h, "/custom/x"); code != http.StatusAccepted {
+		t.Errorf("status %d after invalid additions, want %d", code, http.StatusAccepted)
+	}
+
+	if !s.RemovePXEHandler("/custom/") {
+		t.Fatal("handler not removed")
+	}
+	if code := serve(h, "/custom/x"); code != http.StatusNotFound {
+		t.Errorf("status %d after removal, want %d", code, http.StatusNotFound)
+	}
+}
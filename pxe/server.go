@@ -3,17 +3,21 @@
 
 import (
 	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
-	"os"
-	"path/filepath"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/rs/zerolog/log"
-	"github.com/u-root/dhcp4"
-	"github.com/u-root/dhcp4/dhcp4opts"
-	"github.com/u-root/dhcp4/pxe"
+
+	"github.com/nimbus-project/nimbus/pxe/dhcp4"
+	"github.com/nimbus-project/nimbus/pxe/dhcp6"
+	"github.com/nimbus-project/nimbus/pxe/tftp"
 )
 
 // Server represents a PXE boot server
@@ -21,9 +25,61 @@ type Server struct {
 	config      *Config
 	tftpServer  *tftp.Server
 	dhcpServer  *dhcp4.Server
+	proxyServer *dhcp4.Server
+	dhcp6Server *dhcp6.Server
 	httpServer  *http.Server
-	pxeHandlers map[string]http.Handler
-	mu          sync.Mutex
+	// TFTP server for the IPv6 listener, when the configured TFTP address
+	// is IPv4 only
+	tftpServer6 *tftp.Server
+	// Sockets bound by Start
+	httpListener  net.Listener
+	tftpConn      net.PacketConn
+	dhcpConn      net.PacketConn
+	proxyConn     net.PacketConn
+	dhcp6Conn     net.PacketConn
+	httpListener6 net.Listener
+	tftpConn6     net.PacketConn
+	// Closed once all listeners are bound, or binding them failed with
+	// startErr
+	ready     chan struct{}
+	readyOnce sync.Once
+	startErr  error
+	// HTTP handlers, which may change while the server is running
+	router *router
+	// Dynamic TFTP files keyed by path prefix
+	tftpGenerators map[string]FileGenerator
+	// Remote kernels, initrds and images fetched on demand
+	artifacts *ArtifactCache
+	// DHCP address pool of the server's own network, nil when no range is
+	// configured, and those of networks behind relay agents
+	leases     *leasePool
+	subnets    []*subnet
+	ntpServers []net.IP
+	// DHCPv6 address pool, nil when no range is configured, and the DUID
+	// the DHCPv6 server identifies itself with
+	leases6 *lease6Pool
+	duid    dhcp6.DUID
+	// Boot profiles and the SMBIOS UUIDs and architectures reported by
+	// clients, keyed by MAC
+	profiles    *ProfileRegistry
+	clientUUIDs map[string]string
+	clientArchs map[string]Arch
+	// Extra kernel arguments for individual hosts, keyed by MAC
+	hostArgs map[string]string
+	// MAC addresses by the IP address clients were last acknowledged with,
+	// and the hosts whose last netboot request came over DHCPv6
+	clientMACs  map[string]net.HardwareAddr
+	ipv6Clients map[string]bool
+	// Provisioning ticket expiry by MAC, and single-use boot tokens
+	tickets    map[string]time.Time
+	bootTokens map[string]bootToken
+	// Boot event subscribers
+	events eventBus
+	// Receives inventories posted by the discovery agent, and the key their
+	// per-host tokens are derived from
+	inventoryHandler InventoryHandler
+	discoverySecret  []byte
+	mu               sync.Mutex
 }
 
 // Config holds the configuration for the PXE server
@@ -36,20 +92,113 @@ type Config struct {
 	DNSServers    []net.IP
 	NTP           string
 
-	// PXE boot files
-	Kernel  string
-	Initrd  string
-	Cmdline string
+	// DHCP configuration
+	DHCPRangeStart net.IP
+	DHCPRangeEnd   net.IP
+	LeaseTime      time.Duration
+
+	// File used to persist leases across restarts (in-memory if empty)
+	LeaseFile string
+
+	// Static MAC to address reservations
+	Reservations []Reservation
+
+	// Networks served through DHCP relay agents, each with its own range.
+	// Reservations are assigned to the subnet containing their address.
+	// Relayed requests arrive by unicast on whichever interface routes to
+	// the relay, so InterfaceName must be that interface or empty.
+	Subnets []Subnet
+
+	// ProxyDHCP only answers PXE clients with boot information and leaves
+	// address assignment to an existing DHCP server on the network
+	ProxyDHCP     bool
+	ProxyDHCPAddr string
+
+	// PXE boot files. Kernel and Initrd may be HTTP(S) URLs, which are
+	// downloaded on first use and verified against the SHA-256 digests.
+	Kernel       string
+	Initrd       string
+	Cmdline      string
+	KernelSHA256 string
+	InitrdSHA256 string
+
+	// Remote artifact cache size limit in bytes (unlimited if zero) and an
+	// optional signed manifest listing the digests of remote artifacts
+	ArtifactCacheSize   int64
+	ArtifactManifestURL string
+	ArtifactManifestKey ed25519.PublicKey
+
+	// Time allowed for downloading a remote artifact (defaults to 30m)
+	ArtifactFetchTimeout time.Duration
+
+	// Additional boot profiles and their assignment to hosts by MAC
+	// address. The default profile is built from Kernel, Initrd and Cmdline;
+	// profile names must be unique and may not be "default" or "discovery".
+	Profiles     []Profile
+	HostProfiles map[string]string
+
+	// Discovery is booted by hosts that have no reservation, profile
+	// assignment or entry in KnownHosts. It runs an agent that posts the
+	// host's hardware inventory back to the server. Its name and action are
+	// set by the server. It cannot be combined with RequireAuthorization,
+	// which refuses those hosts.
+	Discovery  *Profile
+	KnownHosts []string
+
+	// RequireAuthorization restricts DHCP, TFTP and HTTP to hosts that are
+	// known or hold a ticket from GrantTicket. TFTP and HTTP clients are
+	// identified by the address they were acknowledged with or, in proxy
+	// mode, the address they requested from the site's DHCP server. iPXE
+	// scripts, which carry the kernel command line, are then only served
+	// with a single-use boot token valid for BootTokenTTL (defaults to 5m).
+	RequireAuthorization bool
+	BootTokenTTL         time.Duration
+
+	// Boot file handed to PXE clients by architecture, overriding the
+	// defaults (pxelinux.0 for BIOS, bootx64.efi for x86-64 UEFI, ...)
+	BootFiles map[Arch]string
+
+	// IPXE chainloads iPXE (undionly.kpxe, ipxe.efi) instead of the
+	// default boot files. Once running, iPXE fetches its boot script from
+	// the HTTP server.
+	IPXE bool
 
-	// HTTP server configuration
+	// GRUB hands UEFI clients shim (shimx64.efi, shimaa64.efi) so that
+	// Secure Boot machines boot through signed loaders. GRUB then loads its
+	// per-host grub.cfg over TFTP or HTTP.
+	GRUB bool
+
+	// DHCPv6 answers netboot clients on DHCPv6Addr (defaults to ":547")
+	// with a boot file URL (option 59) on IPv6, the server's IPv6 address,
+	// which is taken from InterfaceName when unset. Clients are assigned an
+	// address from the DHCPv6 range, or only given boot information without
+	// one, leaving addressing to SLAAC. IPv6 leases are kept in memory.
+	// Hosts that boot over DHCPv6 are handed IPv6 URLs in their boot
+	// scripts and kernel command lines.
+	DHCPv6           bool
+	IPv6             net.IP
+	DHCPv6RangeStart net.IP
+	DHCPv6RangeEnd   net.IP
+	DHCPv6Addr       string
+
+	// HTTP server configuration. When HTTPAddr or TFTPAddr name an IPv4
+	// address and IPv6 is set, the server also listens on the same port
+	// of the IPv6 address.
 	HTTPAddr string
 	TFTPAddr string
 	DHCPAddr string
 
 	// Path to serve files from
 	RootDir string
+
+	// How long shutdown waits for in-flight HTTP requests and TFTP
+	// transfers before aborting them (defaults to 10s)
+	ShutdownTimeout time.Duration
 }
 
+// defaultShutdownTimeout is used when Config.ShutdownTimeout is not set
+const defaultShutdownTimeout = 10 * time.Second
+
 // NewServer creates a new PXE server instance
 func NewServer(cfg *Config) (*Server, error) {
 	if cfg == nil {
@@ -66,152 +215,635 @@ func NewServer(cfg *Config) (*Server, error) {
 	if cfg.DHCPAddr == "" {
 		cfg.DHCPAddr = ":67"
 	}
+	if cfg.ProxyDHCPAddr == "" {
+		cfg.ProxyDHCPAddr = ":4011"
+	}
+	if cfg.DHCPv6Addr == "" {
+		cfg.DHCPv6Addr = ":547"
+	}
 	if cfg.RootDir == "" {
 		cfg.RootDir = "./pxe/files"
 	}
 
+	// Use the address of the PXE interface when none is configured
+	if cfg.IP == nil && cfg.InterfaceName != "" {
+		ip, mask, err := interfaceIPv4(cfg.InterfaceName)
+		if err != nil {
+			log.Warn().Err(err).Str("interface", cfg.InterfaceName).Msg("Failed to determine server address")
+		} else {
+			cfg.IP = ip
+			if cfg.Netmask == nil {
+				cfg.Netmask = mask
+			}
+		}
+	}
+
+	if cfg.IPv6 == nil && cfg.InterfaceName != "" && cfg.DHCPv6 {
+		ip, err := interfaceIPv6(cfg.InterfaceName)
+		if err != nil {
+			log.Warn().Err(err).Str("interface", cfg.InterfaceName).Msg("Failed to determine server IPv6 address")
+		} else {
+			cfg.IPv6 = ip
+		}
+	}
+	if cfg.DHCPv6 && (cfg.IPv6 == nil || cfg.IPv6.To4() != nil) {
+		return nil, fmt.Errorf("DHCPv6 requires the server's IPv6 address")
+	}
+
+	if cfg.IPXE && cfg.GRUB {
+		return nil, fmt.Errorf("iPXE and GRUB boot loaders cannot both be enabled")
+	}
+	// Discovery boots exactly the hosts authorization refuses
+	if cfg.RequireAuthorization && cfg.Discovery != nil {
+		return nil, fmt.Errorf("discovery cannot be enabled when authorization is required")
+	}
+
 	s := &Server{
-		config:     cfg,
-		pxeHandlers: make(map[string]http.Handler),
+		config:         cfg,
+		router:         newRouter(),
+		ready:          make(chan struct{}),
+		tftpGenerators: make(map[string]FileGenerator),
+		profiles:       NewProfileRegistry(),
+		clientUUIDs:    make(map[string]string),
+		clientArchs:    make(map[string]Arch),
+		hostArgs:       make(map[string]string),
+		clientMACs:     make(map[string]net.HardwareAddr),
+		ipv6Clients:    make(map[string]bool),
+		tickets:        make(map[string]time.Time),
+		bootTokens:     make(map[string]bootToken),
+	}
+
+	artifacts, err := NewArtifactCache(cfg.RootDir, cfg.ArtifactCacheSize, cfg.ArtifactManifestURL, cfg.ArtifactManifestKey)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.ArtifactFetchTimeout > 0 {
+		artifacts.fetchTimeout = cfg.ArtifactFetchTimeout
+	}
+	s.artifacts = artifacts
+	s.profiles.artifacts = artifacts
+
+	// Register boot profiles
+	if err := s.registerProfiles(); err != nil {
+		return nil, err
+	}
+
+	// Serve per-client PXELINUX and GRUB configuration and iPXE scripts
+	s.tftpGenerators["pxelinux.cfg/"] = s.pxelinuxConfig
+	s.tftpGenerators[grubConfigPath] = s.grubConfig
+	s.router.handle("/", http.HandlerFunc(s.serveRootFile), s.httpEvents)
+	if cfg.RequireAuthorization {
+		s.router.handle(ipxeScriptPath, http.HandlerFunc(s.serveIPXEScript), s.httpEvents, s.RequireBootToken)
+	} else {
+		s.router.handle(ipxeScriptPath, http.HandlerFunc(s.serveIPXEScript), s.httpEvents)
+	}
+	s.router.handle("/"+grubConfigPath, generatorHandler("/"+grubConfigPath, s.grubConfig), s.httpEvents)
+	if cfg.Discovery != nil {
+		s.discoverySecret = make([]byte, 32)
+		if _, err := rand.Read(s.discoverySecret); err != nil {
+			return nil, fmt.Errorf("failed to generate discovery key: %w", err)
+		}
+		s.router.handle("POST "+discoveryInventoryPath, http.HandlerFunc(s.serveInventory))
+	}
+
+	// Create the DHCP address pools
+	if s.subnets, err = newSubnets(cfg.Subnets, cfg.IP); err != nil {
+		return nil, err
+	}
+	local, bySubnet := s.splitReservations(cfg.Reservations)
+	if cfg.DHCPRangeStart != nil || cfg.DHCPRangeEnd != nil || len(local) > 0 {
+		pool, err := newLeasePool(cfg.DHCPRangeStart, cfg.DHCPRangeEnd, cfg.IP, cfg.Gateway)
+		if err != nil {
+			return nil, err
+		}
+		if err := pool.setReservations(local); err != nil {
+			return nil, fmt.Errorf("invalid DHCP reservations: %w", err)
+		}
+		s.leases = pool
+	}
+	for _, sn := range s.subnets {
+		if err := sn.leases.setReservations(bySubnet[sn]); err != nil {
+			return nil, fmt.Errorf("invalid DHCP reservations for subnet %s: %w", sn.Network, err)
+		}
+	}
+
+	if cfg.DHCPv6 {
+		s.duid = serverDUID(cfg.InterfaceName)
+		if cfg.DHCPv6RangeStart != nil || cfg.DHCPv6RangeEnd != nil {
+			if s.leases6, err = newLease6Pool(cfg.DHCPv6RangeStart, cfg.DHCPv6RangeEnd, cfg.IPv6); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Restore leases from a previous run. All pools share the lease file.
+	if cfg.LeaseFile != "" {
+		store := &leaseStore{path: cfg.LeaseFile}
+		leases, err := store.load()
+		if err != nil {
+			return nil, err
+		}
+		for _, pool := range s.pools() {
+			pool.store = store
+			pool.restore(leases)
+		}
 	}
 
 	return s, nil
 }
 
-// Start starts the PXE server
+// Start starts the PXE server and blocks until ctx is cancelled or one of
+// the sub-servers fails. All listeners are bound before any requests are
+// served and Ready is closed once they are, or once binding them failed. On
+// return every sub-server has been shut down and its sockets released.
 func (s *Server) Start(ctx context.Context) error {
+	if err := s.listen(ctx); err != nil {
+		s.closeListeners()
+		s.mu.Lock()
+		s.startErr = err
+		s.mu.Unlock()
+		s.readyOnce.Do(func() { close(s.ready) })
+		return err
+	}
+	if s.dhcpServer != nil {
+		s.resolveNTP(ctx)
+	}
+	s.readyOnce.Do(func() { close(s.ready) })
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	var wg sync.WaitGroup
-	errCh := make(chan error, 3) // One for each server
-
-	// Start HTTP server
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		log.Info().Str("addr", s.config.HTTPAddr).Msg("Starting HTTP server")
-		if err := s.serveHTTP(ctx); err != nil && err != http.ErrServerClosed {
-			errCh <- fmt.Errorf("HTTP server error: %w", err)
-		}
-	}()
-
-	// Start TFTP server
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		log.Info().Str("addr", s.config.TFTPAddr).Msg("Starting TFTP server")
-		if err := s.serveTFTP(ctx); err != nil {
-			errCh <- fmt.Errorf("TFTP server error: %w", err)
-		}
-	}()
-
-	// Start DHCP server
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		log.Info().Str("addr", s.config.DHCPAddr).Msg("Starting DHCP server")
-		if err := s.serveDHCP(ctx); err != nil {
-			errCh <- fmt.Errorf("DHCP server error: %w", err)
-		}
-	}()
-
-	// Wait for context cancellation or error
+	errCh := make(chan error, 7) // One for each server
+
+	// Any sub-server failing stops the others
+	run := func(name string, serve func() error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := serve(); err != nil {
+				errCh <- fmt.Errorf("%s server error: %w", name, err)
+				cancel()
+			}
+		}()
+	}
+
+	log.Info().Str("addr", s.httpListener.Addr().String()).Msg("Starting HTTP server")
+	run("HTTP", func() error {
+		if err := s.httpServer.Serve(s.httpListener); err != http.ErrServerClosed {
+			return err
+		}
+		return nil
+	})
+
+	log.Info().Str("addr", s.tftpConn.LocalAddr().String()).Msg("Starting TFTP server")
+	run("TFTP", func() error {
+		if err := s.tftpServer.Serve(s.tftpConn); err != tftp.ErrServerClosed {
+			return err
+		}
+		return nil
+	})
+
+	if s.httpListener6 != nil {
+		log.Info().Str("addr", s.httpListener6.Addr().String()).Msg("Starting HTTP server on IPv6")
+		run("HTTP (IPv6)", func() error {
+			if err := s.httpServer.Serve(s.httpListener6); err != http.ErrServerClosed {
+				return err
+			}
+			return nil
+		})
+	}
+	if s.tftpServer6 != nil {
+		log.Info().Str("addr", s.tftpConn6.LocalAddr().String()).Msg("Starting TFTP server on IPv6")
+		run("TFTP (IPv6)", func() error {
+			if err := s.tftpServer6.Serve(s.tftpConn6); err != tftp.ErrServerClosed {
+				return err
+			}
+			return nil
+		})
+	}
+
+	if s.dhcp6Server != nil {
+		log.Info().Str("addr", s.dhcp6Conn.LocalAddr().String()).Msg("Starting DHCPv6 server")
+		run("DHCPv6", func() error {
+			if err := s.dhcp6Server.Serve(s.dhcp6Conn); err != dhcp6.ErrServerClosed {
+				return err
+			}
+			return nil
+		})
+	}
+
+	if s.dhcpServer != nil {
+		log.Info().Str("addr", s.dhcpConn.LocalAddr().String()).Msg("Starting DHCP server")
+		run("DHCP", func() error {
+			if err := s.dhcpServer.Serve(s.dhcpConn); err != dhcp4.ErrServerClosed {
+				return err
+			}
+			return nil
+		})
+	}
+
+	// In proxy mode PXE clients ask for their boot file on port 4011 once
+	// they have an address from the site's DHCP server
+	if s.proxyServer != nil {
+		log.Info().Str("addr", s.proxyConn.LocalAddr().String()).Msg("Starting proxyDHCP boot server")
+		run("proxyDHCP", func() error {
+			if err := s.proxyServer.Serve(s.proxyConn); err != dhcp4.ErrServerClosed {
+				return err
+			}
+			return nil
+		})
+	}
+
+	<-ctx.Done()
+	log.Info().Msg("Shutting down PXE server")
+
+	shutdownErr := s.shutdown()
+	wg.Wait()
+
+	// Sub-servers that were stopped before they started serving leave their
+	// sockets open
+	s.closeListeners()
+
+	// Report the failure that stopped the server rather than the shutdown
 	select {
-	case <-ctx.Done():
-		log.Info().Msg("Shutting down PXE server")
 	case err := <-errCh:
 		return err
+	default:
+		return shutdownErr
 	}
+}
 
-	// Shutdown servers
-	s.shutdown()
-	wg.Wait()
+// Ready returns a channel that is closed once all listeners are bound and
+// the server is accepting requests, or once Start failed to bind them, in
+// which case StartErr returns the reason
+func (s *Server) Ready() <-chan struct{} {
+	return s.ready
+}
 
-	return nil
+// StartErr returns the error Start failed to bind the listeners with, or
+// nil if it has not failed
+func (s *Server) StartErr() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.startErr
+}
+
+// ListenAddrs holds the addresses the sub-servers are bound to. HTTP6 and
+// TFTP6 are the additional IPv6 listeners, if any.
+type ListenAddrs struct {
+	HTTP      net.Addr
+	TFTP      net.Addr
+	DHCP      net.Addr
+	ProxyDHCP net.Addr
+	DHCPv6    net.Addr
+	HTTP6     net.Addr
+	TFTP6     net.Addr
+}
+
+// ListenAddrs returns the bound addresses of the sub-servers, which differ
+// from the configured ones when those use port 0. It is only meaningful once
+// Ready is closed and StartErr is nil; disabled servers have a nil address.
+func (s *Server) ListenAddrs() ListenAddrs {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var addrs ListenAddrs
+	if s.httpListener != nil {
+		addrs.HTTP = s.httpListener.Addr()
+	}
+	if s.tftpConn != nil {
+		addrs.TFTP = s.tftpConn.LocalAddr()
+	}
+	if s.dhcpConn != nil {
+		addrs.DHCP = s.dhcpConn.LocalAddr()
+	}
+	if s.proxyConn != nil {
+		addrs.ProxyDHCP = s.proxyConn.LocalAddr()
+	}
+	if s.dhcp6Conn != nil {
+		addrs.DHCPv6 = s.dhcp6Conn.LocalAddr()
+	}
+	if s.httpListener6 != nil {
+		addrs.HTTP6 = s.httpListener6.Addr()
+	}
+	if s.tftpConn6 != nil {
+		addrs.TFTP6 = s.tftpConn6.LocalAddr()
+	}
+	return addrs
 }
 
-// serveHTTP starts the HTTP server for serving PXE boot files
-func (s *Server) serveHTTP(ctx context.Context) error {
+// listen binds the sockets of all sub-servers
+func (s *Server) listen(ctx context.Context) error {
 	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ln, err := net.Listen("tcp", s.config.HTTPAddr)
+	if err != nil {
+		return fmt.Errorf("HTTP server error: %w", err)
+	}
+	s.httpListener = ln
 	s.httpServer = &http.Server{
-		Addr:    s.config.HTTPAddr,
 		Handler: s.createHTTPHandler(),
 	}
-	s.mu.Unlock()
 
-	// Start HTTP server in a goroutine
-	errCh := make(chan error, 1)
-	go func() {
-		if err := s.httpServer.ListenAndServe(); err != http.ErrServerClosed {
-			errCh <- err
+	if s.tftpConn, err = net.ListenPacket("udp", s.config.TFTPAddr); err != nil {
+		return fmt.Errorf("TFTP server error: %w", err)
+	}
+	s.tftpServer = tftp.NewServer(tftp.HandlerFunc(s.serveTFTPFile))
+
+	// Sockets bound to an IPv4 address are not reachable by IPv6 clients
+	if addr := s.ipv6ListenAddr(s.httpListener.Addr()); addr != "" {
+		if s.httpListener6, err = net.Listen("tcp6", addr); err != nil {
+			return fmt.Errorf("HTTP server error: %w", err)
 		}
-	}()
+	}
+	if addr := s.ipv6ListenAddr(s.tftpConn.LocalAddr()); addr != "" {
+		if s.tftpConn6, err = net.ListenPacket("udp6", addr); err != nil {
+			return fmt.Errorf("TFTP server error: %w", err)
+		}
+		s.tftpServer6 = tftp.NewServer(tftp.HandlerFunc(s.serveTFTPFile))
+	}
 
-	// Handle shutdown
-	select {
-	case <-ctx.Done():
-		return s.httpServer.Shutdown(context.Background())
-	case err := <-errCh:
-		return err
+	if s.config.DHCPv6 {
+		if s.dhcp6Conn, err = dhcp6.Listen(ctx, s.config.InterfaceName, s.config.DHCPv6Addr); err != nil {
+			return fmt.Errorf("DHCPv6 server error: %w", err)
+		}
+		s.dhcp6Server = dhcp6.NewServer(s)
 	}
-}
 
-// createHTTPHandler creates an HTTP handler for serving PXE boot files
-func (s *Server) createHTTPHandler() http.Handler {
-	mux := http.NewServeMux()
-	
-	// Serve static files
-	fs := http.FileServer(http.Dir(s.config.RootDir))
-	mux.Handle("/", fs)
-	
-	// Add PXE handlers
-	for path, handler := range s.pxeHandlers {
-		mux.Handle(path, handler)
-	}
-	
-	return mux
-}
-
-// serveTFTP starts the TFTP server for PXE boot
-func (s *Server) serveTFTP(ctx context.Context) error {
-	// TODO: Implement TFTP server
-	// This is a placeholder for the actual implementation
-	<-ctx.Done()
-	return nil
-}
+	if len(s.pools()) == 0 && !s.config.ProxyDHCP {
+		log.Warn().Msg("No DHCP range configured, DHCP server disabled")
+		return nil
+	}
+
+	if s.dhcpConn, err = dhcp4.Listen(ctx, s.config.InterfaceName, s.config.DHCPAddr); err != nil {
+		return fmt.Errorf("DHCP server error: %w", err)
+	}
+	s.dhcpServer = dhcp4.NewServer(s)
+
+	if s.config.ProxyDHCP {
+		if s.proxyConn, err = dhcp4.Listen(ctx, s.config.InterfaceName, s.config.ProxyDHCPAddr); err != nil {
+			return fmt.Errorf("proxyDHCP server error: %w", err)
+		}
+		s.proxyServer = dhcp4.NewServer(dhcp4.HandlerFunc(s.serveBootServer))
+		s.proxyServer.ReplyTo = replyToPeer
+	}
 
-// serveDHCP starts the DHCP server for PXE boot
-func (s *Server) serveDHCP(ctx context.Context) error {
-	// TODO: Implement DHCP server with PXE options
-	// This is a placeholder for the actual implementation
-	<-ctx.Done()
 	return nil
 }
 
-// shutdown gracefully shuts down all servers
-func (s *Server) shutdown() {
+// closeListeners releases the sockets bound by listen
+func (s *Server) closeListeners() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	// Shutdown HTTP server
-	if s.httpServer != nil {
-		s.httpServer.Shutdown(context.Background())
+	if s.httpListener != nil {
+		s.httpListener.Close()
+	}
+	if s.tftpConn != nil {
+		s.tftpConn.Close()
+	}
+	if s.dhcpConn != nil {
+		s.dhcpConn.Close()
+	}
+	if s.proxyConn != nil {
+		s.proxyConn.Close()
+	}
+	if s.dhcp6Conn != nil {
+		s.dhcp6Conn.Close()
+	}
+	if s.httpListener6 != nil {
+		s.httpListener6.Close()
+	}
+	if s.tftpConn6 != nil {
+		s.tftpConn6.Close()
+	}
+}
+
+// ipv6ListenAddr returns the address of the additional IPv6 listener for a
+// socket bound to bound, or "" if the socket already accepts IPv6 clients or
+// the server has no IPv6 address
+func (s *Server) ipv6ListenAddr(bound net.Addr) string {
+	if s.config.IPv6 == nil {
+		return ""
+	}
+	host, port, err := net.SplitHostPort(bound.String())
+	if err != nil {
+		return ""
+	}
+	if ip := net.ParseIP(host); ip == nil || ip.To4() == nil || ip.IsUnspecified() {
+		return ""
 	}
+	return net.JoinHostPort(s.config.IPv6.String(), port)
+}
 
-	// TODO: Shutdown TFTP and DHCP servers
+// createHTTPHandler creates an HTTP handler for serving PXE boot files.
+// Handlers added or removed later take effect immediately.
+func (s *Server) createHTTPHandler() http.Handler {
+	if s.config.RequireAuthorization {
+		return s.authorizeHTTP(s.router)
+	}
+	return s.router
 }
 
-// AddPXEHandler adds a custom PXE handler for a specific path
-func (s *Server) AddPXEHandler(path string, handler http.Handler) {
+// shutdown stops all sub-servers. DHCP stops first so that no new boots
+// start, then in-flight HTTP requests and TFTP transfers are drained until
+// Config.ShutdownTimeout expires, after which they are aborted.
+func (s *Server) shutdown() error {
 	s.mu.Lock()
-	defer s.mu.Unlock()
-	s.pxeHandlers[path] = handler
+	httpServer, tftpServer, tftpServer6 := s.httpServer, s.tftpServer, s.tftpServer6
+	dhcpServer, proxyServer, dhcp6Server := s.dhcpServer, s.proxyServer, s.dhcp6Server
+	s.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.shutdownTimeout())
+	defer cancel()
+
+	var (
+		mu   sync.Mutex
+		errs []error
+		wg   sync.WaitGroup
+	)
+	record := func(name string, err error) {
+		if err != nil {
+			mu.Lock()
+			errs = append(errs, fmt.Errorf("%s server shutdown: %w", name, err))
+			mu.Unlock()
+		}
+	}
+
+	// Shutdown DHCP servers
+	if dhcpServer != nil {
+		record("DHCP", dhcpServer.Close())
+	}
+	if proxyServer != nil {
+		record("proxyDHCP", proxyServer.Close())
+	}
+	if dhcp6Server != nil {
+		record("DHCPv6", dhcp6Server.Close())
+	}
+
+	// Drain HTTP and TFTP in parallel so they share the timeout
+	if httpServer != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := httpServer.Shutdown(ctx)
+			if err != nil {
+				// Drop connections that did not finish in time
+				httpServer.Close()
+			}
+			record("HTTP", err)
+		}()
+	}
+	if tftpServer != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			record("TFTP", tftpServer.Shutdown(ctx))
+		}()
+	}
+	if tftpServer6 != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			record("TFTP (IPv6)", tftpServer6.Shutdown(ctx))
+		}()
+	}
+	wg.Wait()
+
+	// End boot event subscriptions
+	s.closeEvents()
+
+	return errors.Join(errs...)
+}
+
+// shutdownTimeout returns how long shutdown waits for in-flight requests
+func (s *Server) shutdownTimeout() time.Duration {
+	if s.config.ShutdownTimeout > 0 {
+		return s.config.ShutdownTimeout
+	}
+	return defaultShutdownTimeout
+}
+
+// AddPXEHandler adds a custom PXE handler for a specific path, replacing any
+// handler already registered for it. path is a pattern as accepted by
+// http.ServeMux. The handler is wrapped in middleware in the order given and
+// can be added before or after the server starts. An invalid or conflicting
+// pattern is logged and leaves the registered handlers unchanged.
+func (s *Server) AddPXEHandler(path string, handler http.Handler, middleware ...Middleware) {
+	if err := s.router.handle(path, handler, middleware...); err != nil {
+		log.Error().Err(err).Str("path", path).Msg("Failed to add HTTP handler")
+	}
+}
+
+// RemovePXEHandler removes the handler for a path and reports whether one
+// was registered. Requests already being served are not interrupted.
+func (s *Server) RemovePXEHandler(path string) bool {
+	return s.router.remove(path)
+}
+
+// PXEHandlers returns the paths handlers are registered for
+func (s *Server) PXEHandlers() []string {
+	return s.router.patterns()
 }
 
-// GeneratePXEConfig generates a PXE configuration for a machine
+// UseHTTPMiddleware adds middleware applied to every HTTP handler, including
+// the static file and boot configuration handlers
+func (s *Server) UseHTTPMiddleware(middleware ...Middleware) {
+	s.router.use(middleware...)
+}
+
+// GeneratePXEConfig generates a PXELINUX configuration for a machine from its
+// boot profile
 func (s *Server) GeneratePXEConfig(mac string) (string, error) {
-	// TODO: Generate PXE configuration based on MAC address
-	// This is a placeholder for the actual implementation
-	return fmt.Sprintf(`DEFAULT linux
-LABEL linux
+	profile, err := s.resolveProfile(mac)
+	if err != nil {
+		return "", err
+	}
+
+	if profile.Action == ActionLocalBoot {
+		return `DEFAULT local
+LABEL local
+  LOCALBOOT 0
+`, nil
+	}
+
+	args := profile.Cmdline
+	if profile.Initrd != "" {
+		args = strings.TrimSpace("initrd=" + profile.Initrd + " " + args)
+	}
+
+	return fmt.Sprintf(`DEFAULT %s
+LABEL %s
   KERNEL %s
-  APPEND initrd=%s %s`, s.config.Kernel, s.config.Initrd, s.config.Cmdline), nil
+  APPEND %s
+`, profile.Action, profile.Action, profile.Kernel, args), nil
+}
+
+// registerProfiles adds the default profile and any configured profiles to
+// the registry and applies the configured host assignments
+func (s *Server) registerProfiles() error {
+	def := Profile{
+		Name:    DefaultProfile,
+		Action:  ActionInstall,
+		Kernel:  s.config.Kernel,
+		Initrd:  s.config.Initrd,
+		Cmdline: s.config.Cmdline,
+
+		KernelSHA256: s.config.KernelSHA256,
+		InitrdSHA256: s.config.InitrdSHA256,
+	}
+	// Without a kernel the safest default is to boot from disk
+	if def.Kernel == "" {
+		def.Action = ActionLocalBoot
+	}
+	if err := s.profiles.Add(def); err != nil {
+		return err
+	}
+	if err := s.profiles.SetDefault(DefaultProfile); err != nil {
+		return err
+	}
+
+	// A profile configured twice, or under the name of a built-in one, would
+	// silently replace the other
+	configured := make(map[string]bool)
+	for _, p := range s.config.Profiles {
+		switch {
+		case p.Name == DefaultProfile || p.Name == DiscoveryProfile:
+			return fmt.Errorf("invalid boot profile: %s is reserved", p.Name)
+		case configured[p.Name]:
+			return fmt.Errorf("duplicate boot profile %s", p.Name)
+		}
+		configured[p.Name] = true
+		if err := s.profiles.Add(p); err != nil {
+			return fmt.Errorf("invalid boot profile: %w", err)
+		}
+	}
+	for mac, name := range s.config.HostProfiles {
+		if err := s.profiles.AssignMAC(mac, name); err != nil {
+			return fmt.Errorf("failed to assign boot profile to %s: %w", mac, err)
+		}
+	}
+
+	known := append([]string(nil), s.config.KnownHosts...)
+	for _, r := range s.config.Reservations {
+		known = append(known, r.MAC.String())
+	}
+	for _, mac := range known {
+		if err := s.profiles.SetKnown(mac, true); err != nil {
+			return fmt.Errorf("invalid known host %s: %w", mac, err)
+		}
+	}
+
+	if s.config.Discovery == nil {
+		return nil
+	}
+	discovery := *s.config.Discovery
+	discovery.Name = DiscoveryProfile
+	discovery.Action = ActionDiscover
+	if err := s.profiles.Add(discovery); err != nil {
+		return fmt.Errorf("invalid discovery profile: %w", err)
+	}
+	return s.profiles.SetDiscovery(DiscoveryProfile)
 }
@@ -0,0 +1,78 @@
+package pxe
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestStartReady(t *testing.T) {
+	s, err := NewServer(&Config{
+		IP:       testServerIP,
+		Netmask:  net.CIDRMask(24, 32),
+		HTTPAddr: "127.0.0.1:0",
+		TFTPAddr: "127.0.0.1:0",
+		RootDir:  t.TempDir(),
+	})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.Start(ctx) }()
+
+	select {
+	case <-s.Ready():
+	case <-time.After(5 * time.Second):
+		t.Fatal("server never became ready")
+	}
+	if err := s.StartErr(); err != nil {
+		t.Fatalf("StartErr = %v", err)
+	}
+	if addrs := s.ListenAddrs(); addrs.HTTP == nil || addrs.TFTP == nil || addrs.DHCP != nil {
+		t.Errorf("ListenAddrs = %+v", addrs)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+}
+
+func TestStartListenFailure(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+
+	s, err := NewServer(&Config{
+		IP:       testServerIP,
+		Netmask:  net.CIDRMask(24, 32),
+		HTTPAddr: busy.Addr().String(),
+		TFTPAddr: "127.0.0.1:0",
+		RootDir:  t.TempDir(),
+	})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- s.Start(context.Background()) }()
+
+	// Callers waiting for the server must not block forever
+	select {
+	case <-s.Ready():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Ready not closed after the listeners failed to bind")
+	}
+	startErr := s.StartErr()
+	if startErr == nil {
+		t.Fatal("StartErr = nil after the listeners failed to bind")
+	}
+	if err := <-done; err != startErr {
+		t.Fatalf("Start returned %v, StartErr %v", err, startErr)
+	}
+}
@@ -0,0 +1,181 @@
+package pxe
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/nimbus-project/nimbus/pxe/dhcp4"
+)
+
+// Subnet is a network whose hosts reach the server through DHCP relay
+// agents. Relayed requests are assigned addresses from the subnet whose
+// Network contains the relay's address (giaddr), unless the relay agent
+// information in option 82 selects another one.
+type Subnet struct {
+	Network    *net.IPNet
+	RangeStart net.IP
+	RangeEnd   net.IP
+
+	// Router handed to clients and DNS servers, defaulting to
+	// Config.DNSServers. Without a gateway clients are given the relay
+	// agent's address, which renewals sent straight to the server do not
+	// carry, so it should be set.
+	Gateway    net.IP
+	DNSServers []net.IP
+
+	// Relay agent circuit-ids and remote-ids that select this subnet
+	// regardless of giaddr, for relays serving several subnets on one
+	// interface
+	CircuitIDs []string
+	RemoteIDs  []string
+}
+
+// subnet is a configured Subnet and its address pool
+type subnet struct {
+	Subnet
+	leases *leasePool
+}
+
+// newSubnets creates the address pools of the configured subnets
+func newSubnets(subnets []Subnet, exclude ...net.IP) ([]*subnet, error) {
+	var pools []*subnet
+	for _, sn := range subnets {
+		if sn.Network == nil || sn.Network.IP.To4() == nil {
+			return nil, fmt.Errorf("subnet network must be IPv4")
+		}
+		for _, ip := range []net.IP{sn.RangeStart, sn.RangeEnd, sn.Gateway} {
+			if ip != nil && !sn.Network.Contains(ip) {
+				return nil, fmt.Errorf("subnet %s: %s is outside the network", sn.Network, ip)
+			}
+		}
+		for _, other := range pools {
+			if other.Network.Contains(sn.Network.IP) || sn.Network.Contains(other.Network.IP) {
+				return nil, fmt.Errorf("subnets %s and %s overlap", other.Network, sn.Network)
+			}
+		}
+
+		pool, err := newLeasePool(sn.RangeStart, sn.RangeEnd, append([]net.IP{sn.Gateway}, exclude...)...)
+		if err != nil {
+			return nil, fmt.Errorf("subnet %s: %w", sn.Network, err)
+		}
+		pools = append(pools, &subnet{Subnet: sn, leases: pool})
+	}
+	return pools, nil
+}
+
+// matchesRelay reports whether the relay agent information selects the
+// subnet
+func (sn *subnet) matchesRelay(info dhcp4.RelayAgentInfo) bool {
+	for _, id := range sn.CircuitIDs {
+		if len(info.CircuitID) > 0 && id == string(info.CircuitID) {
+			return true
+		}
+	}
+	for _, id := range sn.RemoteIDs {
+		if len(info.RemoteID) > 0 && id == string(info.RemoteID) {
+			return true
+		}
+	}
+	return false
+}
+
+// selectSubnet returns the address pool for a request and the subnet it
+// belongs to, which is nil for the server's own network. Relayed requests
+// are matched by relay agent information and then by giaddr; unicast
+// renewals, which bypass the relay, by the address being renewed. The pool
+// is nil if the request comes from a network the server does not serve.
+func (s *Server) selectSubnet(req *dhcp4.Packet) (*leasePool, *subnet) {
+	relayed := isRelayed(req)
+
+	if info, ok := req.Options.RelayAgentInfo(); ok && relayed {
+		for _, sn := range s.subnets {
+			if sn.matchesRelay(info) {
+				return sn.leases, sn
+			}
+		}
+	}
+
+	addr := req.GIAddr
+	if !relayed {
+		addr = req.CIAddr
+		if addr == nil || addr.IsUnspecified() {
+			return s.leases, nil
+		}
+	}
+	for _, sn := range s.subnets {
+		if sn.Network.Contains(addr) {
+			return sn.leases, sn
+		}
+	}
+	if !relayed || s.localNetworkContains(addr) {
+		return s.leases, nil
+	}
+
+	log.Debug().Str("mac", req.CHAddr.String()).Str("giaddr", req.GIAddr.String()).Msg("DHCP request relayed from unknown subnet")
+	return nil, nil
+}
+
+// localNetworkContains reports whether ip is on the server's own network
+func (s *Server) localNetworkContains(ip net.IP) bool {
+	if s.config.IP == nil || s.config.Netmask == nil {
+		return false
+	}
+	network := &net.IPNet{IP: s.config.IP.Mask(s.config.Netmask), Mask: s.config.Netmask}
+	return network.Contains(ip)
+}
+
+// isRelayed reports whether a request was forwarded by a relay agent
+func isRelayed(req *dhcp4.Packet) bool {
+	return req.GIAddr.To4() != nil && !req.GIAddr.IsUnspecified()
+}
+
+// claimPortReservation hands a relayed client the reservation of the switch
+// port reported in option 82, if there is one. Option 82 on a request that
+// was not relayed may have been added by the client itself and is ignored.
+func claimPortReservation(pool *leasePool, req *dhcp4.Packet) {
+	if !isRelayed(req) {
+		return
+	}
+	info, ok := req.Options.RelayAgentInfo()
+	if !ok || (len(info.CircuitID) == 0 && len(info.RemoteID) == 0) {
+		return
+	}
+	pool.claimPort(req.CHAddr, string(info.RemoteID), string(info.CircuitID))
+}
+
+// splitReservations assigns each reservation to the pool of the subnet
+// containing its address. Reservations outside all subnets belong to the
+// server's own network.
+func (s *Server) splitReservations(reservations []Reservation) ([]Reservation, map[*subnet][]Reservation) {
+	var local []Reservation
+	bySubnet := make(map[*subnet][]Reservation)
+	for _, r := range reservations {
+		var owner *subnet
+		for _, sn := range s.subnets {
+			if sn.Network.Contains(r.IP) {
+				owner = sn
+				break
+			}
+		}
+		if owner == nil {
+			local = append(local, r)
+		} else {
+			bySubnet[owner] = append(bySubnet[owner], r)
+		}
+	}
+	return local, bySubnet
+}
+
+// pools returns all address pools
+func (s *Server) pools() []*leasePool {
+	var pools []*leasePool
+	if s.leases != nil {
+		pools = append(pools, s.leases)
+	}
+	for _, sn := range s.subnets {
+		pools = append(pools, sn.leases)
+	}
+	return pools
+}
@@ -0,0 +1,51 @@
+package pxe
+
+import (
+	"net"
+	"testing"
+
+	"github.com/nimbus-project/nimbus/pxe/dhcp4"
+)
+
+// relayAgentInfo encodes option 82 with a circuit-id and remote-id
+func relayAgentInfo(circuitID, remoteID string) []byte {
+	b := append([]byte{dhcp4.RelayCircuitID, byte(len(circuitID))}, circuitID...)
+	return append(append(b, dhcp4.RelayRemoteID, byte(len(remoteID))), remoteID...)
+}
+
+func TestPortReservationRequiresRelay(t *testing.T) {
+	reserved := net.IPv4(10, 0, 0, 50).To4()
+	s := newTestServer(t, Config{Reservations: []Reservation{{
+		IP:        reserved,
+		Hostname:  "n1",
+		CircuitID: "Gi1/0/12",
+		RemoteID:  "rack07-tor",
+	}}})
+
+	tests := []struct {
+		name   string
+		giaddr net.IP
+		want   bool
+	}{
+		{name: "spoofed without relay", giaddr: nil, want: false},
+		{name: "relayed", giaddr: testGateway, want: true},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mac := net.HardwareAddr{0x52, 0x54, 0x00, 0xaa, 0x00, byte(i)}
+			req := pxeRequest(dhcp4.Discover, mac, ArchBIOS)
+			req.Options[dhcp4.OptionRelayAgentInfo] = relayAgentInfo("Gi1/0/12", "rack07-tor")
+			if tt.giaddr != nil {
+				req.GIAddr = tt.giaddr
+			}
+
+			offer := s.ServeDHCP(req, nil)
+			if offer == nil {
+				t.Fatal("no offer")
+			}
+			if got := offer.YIAddr.Equal(reserved); got != tt.want {
+				t.Errorf("offered %s, reserved address claimed = %t, want %t", offer.YIAddr, got, tt.want)
+			}
+		})
+	}
+}
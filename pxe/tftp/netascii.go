@@ -0,0 +1,48 @@
+package tftp
+
+import (
+	"bufio"
+	"io"
+)
+
+// netasciiReader converts a file to netascii as it is read. Line feeds are
+// sent as CR LF and bare carriage returns as CR NUL (RFC 764).
+type netasciiReader struct {
+	r *bufio.Reader
+	// next is the second byte of a translated sequence that did not fit
+	// into the previous read
+	next    byte
+	pending bool
+}
+
+// newNetasciiReader returns a reader that translates r to netascii
+func newNetasciiReader(r io.Reader) *netasciiReader {
+	return &netasciiReader{r: bufio.NewReader(r)}
+}
+
+func (r *netasciiReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if r.pending {
+			p[n] = r.next
+			r.pending = false
+			n++
+			continue
+		}
+
+		c, err := r.r.ReadByte()
+		if err != nil {
+			return n, err
+		}
+		switch c {
+		case '\n':
+			p[n], r.next, r.pending = '\r', '\n', true
+		case '\r':
+			p[n], r.next, r.pending = '\r', 0, true
+		default:
+			p[n] = c
+		}
+		n++
+	}
+	return n, nil
+}
@@ -0,0 +1,190 @@
+// Package tftp implements a read-only TFTP server (RFC 1350) with support for
+// option negotiation (RFC 2347), the blksize option (RFC 2348), the timeout and
+// tsize options (RFC 2349) and the windowsize option (RFC 7440).
+package tftp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// TFTP opcodes
+const (
+	opRRQ   uint16 = 1
+	opWRQ   uint16 = 2
+	opDATA  uint16 = 3
+	opACK   uint16 = 4
+	opERROR uint16 = 5
+	opOACK  uint16 = 6
+)
+
+// TFTP error codes
+const (
+	errCodeUndefined     uint16 = 0
+	errCodeNotFound      uint16 = 1
+	errCodeAccess        uint16 = 2
+	errCodeIllegalOp     uint16 = 4
+	errCodeUnknownTID    uint16 = 5
+	errCodeOptionRefused uint16 = 8
+)
+
+// Option names
+const (
+	optBlockSize  = "blksize"
+	optTimeout    = "timeout"
+	optTransferSz = "tsize"
+	optWindowSize = "windowsize"
+)
+
+// Protocol limits
+const (
+	defaultBlockSize = 512
+	minBlockSize     = 8
+	maxBlockSize     = 65464
+	minTimeout       = 1
+	maxTimeout       = 255
+	minWindowSize    = 1
+	maxWindowSize    = 65535
+)
+
+var (
+	// ErrNotFound is returned by a Handler when the requested file does not exist
+	ErrNotFound = errors.New("file not found")
+
+	// ErrAccess is returned by a Handler when the requested file may not be read
+	ErrAccess = errors.New("access violation")
+)
+
+// request is a parsed read or write request
+type request struct {
+	opcode   uint16
+	filename string
+	mode     string
+	options  map[string]string
+	// order preserves the order in which options were received so the OACK
+	// can echo them back in the same order
+	order []string
+}
+
+// parseRequest parses an RRQ or WRQ packet
+func parseRequest(b []byte) (*request, error) {
+	if len(b) < 4 {
+		return nil, fmt.Errorf("short request packet")
+	}
+
+	req := &request{
+		opcode:  binary.BigEndian.Uint16(b),
+		options: make(map[string]string),
+	}
+	if req.opcode != opRRQ && req.opcode != opWRQ {
+		return nil, fmt.Errorf("unexpected opcode %d", req.opcode)
+	}
+
+	fields := bytes.Split(b[2:], []byte{0})
+	// A well-formed request is NUL terminated, which leaves an empty last field
+	if len(fields) < 3 || len(fields[len(fields)-1]) != 0 {
+		return nil, fmt.Errorf("malformed request packet")
+	}
+	fields = fields[:len(fields)-1]
+
+	req.filename = string(fields[0])
+	req.mode = strings.ToLower(string(fields[1]))
+	if req.filename == "" {
+		return nil, fmt.Errorf("empty filename")
+	}
+
+	opts := fields[2:]
+	if len(opts)%2 != 0 {
+		return nil, fmt.Errorf("malformed options")
+	}
+	for i := 0; i < len(opts); i += 2 {
+		name := strings.ToLower(string(opts[i]))
+		if _, ok := req.options[name]; !ok {
+			req.order = append(req.order, name)
+		}
+		req.options[name] = string(opts[i+1])
+	}
+
+	return req, nil
+}
+
+// dataPacket builds a DATA packet
+func dataPacket(buf []byte, block uint16, data []byte) []byte {
+	buf = buf[:4+len(data)]
+	binary.BigEndian.PutUint16(buf[0:], opDATA)
+	binary.BigEndian.PutUint16(buf[2:], block)
+	copy(buf[4:], data)
+	return buf
+}
+
+// errorPacket builds an ERROR packet
+func errorPacket(code uint16, msg string) []byte {
+	b := make([]byte, 4, 5+len(msg))
+	binary.BigEndian.PutUint16(b[0:], opERROR)
+	binary.BigEndian.PutUint16(b[2:], code)
+	b = append(b, msg...)
+	return append(b, 0)
+}
+
+// oackPacket builds an OACK packet from the accepted options
+func oackPacket(order []string, opts map[string]string) []byte {
+	b := make([]byte, 2, 64)
+	binary.BigEndian.PutUint16(b, opOACK)
+	for _, name := range order {
+		value, ok := opts[name]
+		if !ok {
+			continue
+		}
+		b = append(b, name...)
+		b = append(b, 0)
+		b = append(b, value...)
+		b = append(b, 0)
+	}
+	return b
+}
+
+// parseAck parses an ACK packet and returns its block number. If the packet is
+// an ERROR packet, the error it carries is returned instead.
+func parseAck(b []byte) (uint16, error) {
+	if len(b) < 4 {
+		return 0, fmt.Errorf("short packet")
+	}
+
+	switch op := binary.BigEndian.Uint16(b); op {
+	case opACK:
+		return binary.BigEndian.Uint16(b[2:]), nil
+	case opERROR:
+		code := binary.BigEndian.Uint16(b[2:])
+		msg := strings.TrimRight(string(b[4:]), "\x00")
+		return 0, &RemoteError{Code: code, Message: msg}
+	default:
+		return 0, fmt.Errorf("unexpected opcode %d", op)
+	}
+}
+
+// RemoteError is an error reported by the client through an ERROR packet
+type RemoteError struct {
+	Code    uint16
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("client error %d: %s", e.Code, e.Message)
+}
+
+// parseIntOption parses a numeric option value and clamps it to [min, max].
+// Values below min are rejected.
+func parseIntOption(value string, min, max int) (int, bool) {
+	n, err := strconv.Atoi(value)
+	if err != nil || n < min {
+		return 0, false
+	}
+	if n > max {
+		n = max
+	}
+	return n, true
+}
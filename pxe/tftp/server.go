@@ -0,0 +1,486 @@
+package tftp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ErrServerClosed is returned by Serve after a call to Shutdown or Close
+var ErrServerClosed = errors.New("tftp: server closed")
+
+// Default server settings
+const (
+	DefaultTimeout       = 2 * time.Second
+	DefaultRetries       = 5
+	DefaultMaxBlockSize  = maxBlockSize
+	DefaultMaxWindowSize = 64
+)
+
+// Handler opens files requested by TFTP clients
+type Handler interface {
+	// ServeTFTP returns a reader for the requested file along with its size in
+	// bytes. A negative size means the size is not known in advance, in which
+	// case the tsize option is not acknowledged. Returning ErrNotFound or
+	// ErrAccess maps to the corresponding TFTP error code.
+	ServeTFTP(filename string, remote net.Addr) (io.ReadCloser, int64, error)
+}
+
+// HandlerFunc adapts an ordinary function to the Handler interface
+type HandlerFunc func(filename string, remote net.Addr) (io.ReadCloser, int64, error)
+
+// ServeTFTP calls f(filename, remote)
+func (f HandlerFunc) ServeTFTP(filename string, remote net.Addr) (io.ReadCloser, int64, error) {
+	return f(filename, remote)
+}
+
+// Server is a read-only TFTP server
+type Server struct {
+	// Handler opens requested files
+	Handler Handler
+
+	// Timeout is the retransmission timeout used unless the client
+	// negotiates a different one with the timeout option
+	Timeout time.Duration
+
+	// Retries is the number of retransmissions before a transfer is aborted
+	Retries int
+
+	// MaxBlockSize caps the block size a client may negotiate
+	MaxBlockSize int
+
+	// MaxWindowSize caps the window size a client may negotiate
+	MaxWindowSize int
+
+	mu        sync.Mutex
+	conn      net.PacketConn
+	transfers map[*transfer]struct{}
+	closed    bool
+	wg        sync.WaitGroup
+}
+
+// NewServer creates a new TFTP server that serves files using h
+func NewServer(h Handler) *Server {
+	return &Server{
+		Handler:       h,
+		Timeout:       DefaultTimeout,
+		Retries:       DefaultRetries,
+		MaxBlockSize:  DefaultMaxBlockSize,
+		MaxWindowSize: DefaultMaxWindowSize,
+	}
+}
+
+// ListenAndServe listens on the UDP address addr and serves requests
+func (s *Server) ListenAndServe(addr string) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(conn)
+}
+
+// Serve accepts requests on conn until the server is shut down. Each transfer
+// is handled from its own ephemeral port as required by RFC 1350.
+func (s *Server) Serve(conn net.PacketConn) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		conn.Close()
+		return ErrServerClosed
+	}
+	s.conn = conn
+	s.mu.Unlock()
+
+	buf := make([]byte, 4096)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			return err
+		}
+
+		req, err := parseRequest(buf[:n])
+		if err != nil {
+			log.Debug().Err(err).Str("remote", addr.String()).Msg("Invalid TFTP request")
+			conn.WriteTo(errorPacket(errCodeIllegalOp, err.Error()), addr)
+			continue
+		}
+
+		if req.opcode == opWRQ {
+			conn.WriteTo(errorPacket(errCodeAccess, "server is read-only"), addr)
+			continue
+		}
+		if req.mode != "octet" && req.mode != "netascii" {
+			conn.WriteTo(errorPacket(errCodeIllegalOp, "unsupported mode "+req.mode), addr)
+			continue
+		}
+
+		// Register the transfer under the lock so that it cannot race with
+		// Shutdown waiting for in-flight transfers
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			return ErrServerClosed
+		}
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go func() {
+			defer s.wg.Done()
+			s.handleRead(req, addr)
+		}()
+	}
+}
+
+// Shutdown stops accepting new requests and waits for in-flight transfers to
+// complete. If ctx expires first, the remaining transfers are aborted and the
+// context's error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closed = true
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.abortTransfers()
+		<-done
+		return ctx.Err()
+	}
+}
+
+// Close immediately closes the listener and aborts all in-flight transfers
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	var err error
+	if s.conn != nil {
+		err = s.conn.Close()
+	}
+	s.mu.Unlock()
+
+	s.abortTransfers()
+	s.wg.Wait()
+	return err
+}
+
+// isClosed reports whether the server has been shut down
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// abortTransfers closes the sockets of all in-flight transfers
+func (s *Server) abortTransfers() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for t := range s.transfers {
+		t.conn.Close()
+	}
+}
+
+// track registers or unregisters an in-flight transfer
+func (s *Server) track(t *transfer, add bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.transfers == nil {
+		s.transfers = make(map[*transfer]struct{})
+	}
+	if add {
+		s.transfers[t] = struct{}{}
+	} else {
+		delete(s.transfers, t)
+	}
+}
+
+// localIP returns the IP address the listener is bound to, if any
+func (s *Server) localIP() net.IP {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	if addr, ok := s.conn.LocalAddr().(*net.UDPAddr); ok && !addr.IP.IsUnspecified() {
+		return addr.IP
+	}
+	return nil
+}
+
+// handleRead serves a single read request
+func (s *Server) handleRead(req *request, remote net.Addr) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: s.localIP()})
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to open TFTP transfer socket")
+		return
+	}
+
+	t := &transfer{
+		conn:      conn,
+		remote:    remote,
+		blockSize: defaultBlockSize,
+		window:    1,
+		timeout:   s.Timeout,
+		retries:   s.Retries,
+	}
+	if t.timeout <= 0 {
+		t.timeout = DefaultTimeout
+	}
+	if t.retries <= 0 {
+		t.retries = DefaultRetries
+	}
+
+	s.track(t, true)
+	defer s.track(t, false)
+	defer conn.Close()
+
+	if s.Handler == nil {
+		t.sendError(errCodeNotFound, ErrNotFound.Error())
+		return
+	}
+
+	r, size, err := s.Handler.ServeTFTP(req.filename, remote)
+	if err != nil {
+		code := uint16(errCodeUndefined)
+		switch {
+		case errors.Is(err, ErrNotFound):
+			code = errCodeNotFound
+		case errors.Is(err, ErrAccess):
+			code = errCodeAccess
+		}
+		log.Debug().Err(err).Str("file", req.filename).Str("remote", remote.String()).Msg("TFTP request rejected")
+		t.sendError(code, err.Error())
+		return
+	}
+	defer r.Close()
+
+	// The transfer size of a netascii file is only known once it has been
+	// translated, so tsize is not acknowledged for it
+	var src io.Reader = r
+	if req.mode == "netascii" {
+		src = newNetasciiReader(r)
+		size = -1
+	}
+
+	accepted := s.negotiate(t, req, size)
+	if len(accepted) > 0 {
+		if err := t.sendOACK(req.order, accepted); err != nil {
+			log.Debug().Err(err).Str("file", req.filename).Str("remote", remote.String()).Msg("TFTP option negotiation failed")
+			return
+		}
+	}
+
+	start := time.Now()
+	sent, err := t.send(src)
+	if err != nil {
+		log.Warn().Err(err).Str("file", req.filename).Str("remote", remote.String()).Msg("TFTP transfer failed")
+		return
+	}
+
+	log.Debug().
+		Str("file", req.filename).
+		Str("remote", remote.String()).
+		Int64("bytes", sent).
+		Dur("duration", time.Since(start)).
+		Msg("TFTP transfer complete")
+}
+
+// negotiate applies the options requested by the client to t and returns the
+// options that should be acknowledged
+func (s *Server) negotiate(t *transfer, req *request, size int64) map[string]string {
+	accepted := make(map[string]string)
+
+	if v, ok := req.options[optBlockSize]; ok {
+		limit := s.MaxBlockSize
+		if limit <= 0 || limit > maxBlockSize {
+			limit = maxBlockSize
+		}
+		if n, ok := parseIntOption(v, minBlockSize, limit); ok {
+			t.blockSize = n
+			accepted[optBlockSize] = strconv.Itoa(n)
+		}
+	}
+
+	if v, ok := req.options[optTimeout]; ok {
+		// The timeout option must be echoed verbatim, so out of range
+		// values are ignored rather than clamped
+		if n, err := strconv.Atoi(v); err == nil && n >= minTimeout && n <= maxTimeout {
+			t.timeout = time.Duration(n) * time.Second
+			accepted[optTimeout] = strconv.Itoa(n)
+		}
+	}
+
+	if _, ok := req.options[optTransferSz]; ok && size >= 0 {
+		accepted[optTransferSz] = strconv.FormatInt(size, 10)
+	}
+
+	if v, ok := req.options[optWindowSize]; ok {
+		limit := s.MaxWindowSize
+		if limit <= 0 || limit > maxWindowSize {
+			limit = maxWindowSize
+		}
+		if n, ok := parseIntOption(v, minWindowSize, limit); ok {
+			t.window = n
+			accepted[optWindowSize] = strconv.Itoa(n)
+		}
+	}
+
+	return accepted
+}
+
+// transfer holds the state of a single read transfer
+type transfer struct {
+	conn      *net.UDPConn
+	remote    net.Addr
+	blockSize int
+	window    int
+	timeout   time.Duration
+	retries   int
+}
+
+// sendError sends an ERROR packet to the client
+func (t *transfer) sendError(code uint16, msg string) {
+	t.conn.WriteTo(errorPacket(code, msg), t.remote)
+}
+
+// sendOACK acknowledges the negotiated options and waits for the client to
+// acknowledge block 0
+func (t *transfer) sendOACK(order []string, opts map[string]string) error {
+	pkt := oackPacket(order, opts)
+	for attempt := 0; attempt <= t.retries; attempt++ {
+		if _, err := t.conn.WriteTo(pkt, t.remote); err != nil {
+			return err
+		}
+		block, err := t.readAck(time.Now().Add(t.timeout))
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			return err
+		}
+		if block == 0 {
+			return nil
+		}
+	}
+	return fmt.Errorf("timed out waiting for OACK acknowledgement")
+}
+
+// send streams r to the client using the negotiated block and window size and
+// returns the number of bytes transferred
+func (t *transfer) send(r io.Reader) (int64, error) {
+	var (
+		// pending holds blocks that have been read but not acknowledged;
+		// pending[0] has block number base
+		pending  [][]byte
+		base     uint16 = 1
+		eof      bool
+		sent     int64
+		attempts int
+	)
+
+	pkt := make([]byte, 4+t.blockSize)
+	for {
+		for len(pending) < t.window && !eof {
+			buf := make([]byte, t.blockSize)
+			n, err := io.ReadFull(r, buf)
+			switch {
+			case err == io.EOF || err == io.ErrUnexpectedEOF:
+				eof = true
+			case err != nil:
+				t.sendError(errCodeUndefined, "read error")
+				return sent, err
+			}
+			pending = append(pending, buf[:n])
+		}
+		if len(pending) == 0 {
+			return sent, nil
+		}
+
+		for i, data := range pending {
+			if _, err := t.conn.WriteTo(dataPacket(pkt, base+uint16(i), data), t.remote); err != nil {
+				return sent, err
+			}
+		}
+
+		acked, err := t.awaitWindowAck(base, len(pending))
+		if err != nil {
+			var ne net.Error
+			if !errors.As(err, &ne) || !ne.Timeout() {
+				return sent, err
+			}
+			if attempts++; attempts > t.retries {
+				return sent, fmt.Errorf("timed out waiting for ACK of block %d", base)
+			}
+			continue
+		}
+
+		for _, data := range pending[:acked] {
+			sent += int64(len(data))
+		}
+		pending = pending[acked:]
+		base += uint16(acked)
+		attempts = 0
+	}
+}
+
+// awaitWindowAck waits for an ACK within the window of size blocks starting at
+// base and returns the number of blocks it acknowledges. Block numbers wrap
+// around, so the distance from base is computed using 16-bit arithmetic.
+// Duplicate ACKs for earlier blocks are ignored rather than triggering a
+// retransmission, which avoids the Sorcerer's Apprentice problem.
+func (t *transfer) awaitWindowAck(base uint16, size int) (int, error) {
+	deadline := time.Now().Add(t.timeout)
+	for {
+		block, err := t.readAck(deadline)
+		if err != nil {
+			return 0, err
+		}
+		if acked := int(block-base) + 1; acked >= 1 && acked <= size {
+			return acked, nil
+		}
+	}
+}
+
+// readAck waits until deadline for an ACK from the client, ignoring packets
+// from other hosts
+func (t *transfer) readAck(deadline time.Time) (uint16, error) {
+	buf := make([]byte, 516)
+	for {
+		if err := t.conn.SetReadDeadline(deadline); err != nil {
+			return 0, err
+		}
+		n, addr, err := t.conn.ReadFrom(buf)
+		if err != nil {
+			return 0, err
+		}
+		if addr.String() != t.remote.String() {
+			t.conn.WriteTo(errorPacket(errCodeUnknownTID, "unknown transfer id"), addr)
+			continue
+		}
+		return parseAck(buf[:n])
+	}
+}
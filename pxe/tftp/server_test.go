@@ -0,0 +1,436 @@
+package tftp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// bytesHandler serves data under any name
+func bytesHandler(data []byte) Handler {
+	return HandlerFunc(func(filename string, remote net.Addr) (io.ReadCloser, int64, error) {
+		return io.NopCloser(bytes.NewReader(data)), int64(len(data)), nil
+	})
+}
+
+// loopbackTFTP serves s on a loopback UDP socket and returns a client socket
+// and the server's address
+func loopbackTFTP(t *testing.T, s *Server) (*net.UDPConn, net.Addr) {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	go s.Serve(conn)
+	t.Cleanup(func() { s.Close() })
+
+	client, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client, conn.LocalAddr()
+}
+
+// rrq builds a read request; opts are option name and value pairs
+func rrq(filename, mode string, opts ...string) []byte {
+	b := binary.BigEndian.AppendUint16(nil, opRRQ)
+	for _, field := range append([]string{filename, mode}, opts...) {
+		b = append(b, field...)
+		b = append(b, 0)
+	}
+	return b
+}
+
+// ackPacket builds an ACK packet
+func ackPacket(block uint16) []byte {
+	b := binary.BigEndian.AppendUint16(nil, opACK)
+	return binary.BigEndian.AppendUint16(b, block)
+}
+
+// receive reads a packet sent to the client and returns its opcode, block
+// number or error code, payload and sender
+func receive(t *testing.T, client *net.UDPConn, wait time.Duration) (uint16, uint16, []byte, net.Addr) {
+	t.Helper()
+
+	buf := make([]byte, 4+maxBlockSize)
+	client.SetReadDeadline(time.Now().Add(wait))
+	n, addr, err := client.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("no packet from server: %v", err)
+	}
+	if n < 2 {
+		t.Fatalf("short packet %x", buf[:n])
+	}
+	op := binary.BigEndian.Uint16(buf)
+	if op == opOACK {
+		return op, 0, append([]byte(nil), buf[2:n]...), addr
+	}
+	if n < 4 {
+		t.Fatalf("short packet %x", buf[:n])
+	}
+	return op, binary.BigEndian.Uint16(buf[2:]), append([]byte(nil), buf[4:n]...), addr
+}
+
+// parseOACK returns the options acknowledged in an OACK payload
+func parseOACK(t *testing.T, payload []byte) []string {
+	t.Helper()
+	fields := bytes.Split(bytes.TrimSuffix(payload, []byte{0}), []byte{0})
+	opts := make([]string, len(fields))
+	for i, f := range fields {
+		opts[i] = string(f)
+	}
+	return opts
+}
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		name    string
+		options map[string]string
+		size    int64
+		server  func(*Server)
+		want    map[string]string
+		check   func(*testing.T, *transfer)
+	}{
+		{
+			name:    "blksize",
+			options: map[string]string{optBlockSize: "1468"},
+			want:    map[string]string{optBlockSize: "1468"},
+			check:   func(t *testing.T, tr *transfer) { wantInt(t, "block size", tr.blockSize, 1468) },
+		},
+		{
+			name:    "blksize below minimum",
+			options: map[string]string{optBlockSize: "4"},
+			want:    map[string]string{},
+			check:   func(t *testing.T, tr *transfer) { wantInt(t, "block size", tr.blockSize, defaultBlockSize) },
+		},
+		{
+			name:    "blksize not a number",
+			options: map[string]string{optBlockSize: "large"},
+			want:    map[string]string{},
+		},
+		{
+			name:    "blksize above server limit",
+			options: map[string]string{optBlockSize: "9000"},
+			server:  func(s *Server) { s.MaxBlockSize = 1024 },
+			want:    map[string]string{optBlockSize: "1024"},
+			check:   func(t *testing.T, tr *transfer) { wantInt(t, "block size", tr.blockSize, 1024) },
+		},
+		{
+			name:    "blksize above protocol limit",
+			options: map[string]string{optBlockSize: "70000"},
+			want:    map[string]string{optBlockSize: "65464"},
+		},
+		{
+			name:    "timeout",
+			options: map[string]string{optTimeout: "5"},
+			want:    map[string]string{optTimeout: "5"},
+			check: func(t *testing.T, tr *transfer) {
+				if tr.timeout != 5*time.Second {
+					t.Errorf("timeout = %s, want 5s", tr.timeout)
+				}
+			},
+		},
+		{
+			name:    "timeout zero",
+			options: map[string]string{optTimeout: "0"},
+			want:    map[string]string{},
+		},
+		{
+			name:    "timeout above maximum",
+			options: map[string]string{optTimeout: "256"},
+			want:    map[string]string{},
+			check: func(t *testing.T, tr *transfer) {
+				if tr.timeout != DefaultTimeout {
+					t.Errorf("timeout = %s, want %s", tr.timeout, DefaultTimeout)
+				}
+			},
+		},
+		{
+			name:    "tsize",
+			options: map[string]string{optTransferSz: "0"},
+			size:    1234,
+			want:    map[string]string{optTransferSz: "1234"},
+		},
+		{
+			name:    "tsize of unknown size",
+			options: map[string]string{optTransferSz: "0"},
+			size:    -1,
+			want:    map[string]string{},
+		},
+		{
+			name:    "windowsize",
+			options: map[string]string{optWindowSize: "8"},
+			want:    map[string]string{optWindowSize: "8"},
+			check:   func(t *testing.T, tr *transfer) { wantInt(t, "window", tr.window, 8) },
+		},
+		{
+			name:    "windowsize above server limit",
+			options: map[string]string{optWindowSize: "1000"},
+			want:    map[string]string{optWindowSize: "64"},
+		},
+		{
+			name:    "windowsize zero",
+			options: map[string]string{optWindowSize: "0"},
+			want:    map[string]string{},
+			check:   func(t *testing.T, tr *transfer) { wantInt(t, "window", tr.window, 1) },
+		},
+		{
+			name:    "unknown option",
+			options: map[string]string{"multicast": ""},
+			want:    map[string]string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer(nil)
+			if tt.server != nil {
+				tt.server(s)
+			}
+			tr := &transfer{blockSize: defaultBlockSize, window: 1, timeout: s.Timeout}
+			got := s.negotiate(tr, &request{options: tt.options}, tt.size)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("accepted %v, want %v", got, tt.want)
+			}
+			if tt.check != nil {
+				tt.check(t, tr)
+			}
+		})
+	}
+}
+
+func wantInt(t *testing.T, name string, got, want int) {
+	t.Helper()
+	if got != want {
+		t.Errorf("%s = %d, want %d", name, got, want)
+	}
+}
+
+func TestTransferWithOptions(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 300)
+	client, server := loopbackTFTP(t, NewServer(bytesHandler(data)))
+
+	req := rrq("pxelinux.0", "octet", "tsize", "0", "blksize", "1024", "windowsize", "2", "timeout", "3")
+	if _, err := client.WriteTo(req, server); err != nil {
+		t.Fatalf("send request: %v", err)
+	}
+
+	op, _, payload, peer := receive(t, client, 2*time.Second)
+	if op != opOACK {
+		t.Fatalf("opcode %d, want OACK", op)
+	}
+	// The options are acknowledged in the order they were requested
+	want := []string{"tsize", "3000", "blksize", "1024", "windowsize", "2", "timeout", "3"}
+	if got := parseOACK(t, payload); !reflect.DeepEqual(got, want) {
+		t.Errorf("OACK = %q, want %q", got, want)
+	}
+	if peer.String() == server.String() {
+		t.Error("transfer not served from its own port")
+	}
+	client.WriteTo(ackPacket(0), peer)
+
+	var got []byte
+	for block := uint16(1); ; block++ {
+		op, n, payload, _ := receive(t, client, 2*time.Second)
+		if op != opDATA || n != block {
+			t.Fatalf("got opcode %d block %d, want DATA block %d", op, n, block)
+		}
+		got = append(got, payload...)
+		last := len(payload) < 1024
+		if block%2 == 0 || last {
+			client.WriteTo(ackPacket(block), peer)
+		}
+		if last {
+			break
+		}
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("received %d bytes, want %d", len(got), len(data))
+	}
+}
+
+func TestTransferBlockWraparound(t *testing.T) {
+	const (
+		blockSize = minBlockSize
+		window    = 64
+	)
+	// Two blocks more than the block number can count
+	data := make([]byte, (1<<16+1)*blockSize)
+	for i := range data {
+		data[i] = byte(i / blockSize)
+	}
+	client, server := loopbackTFTP(t, NewServer(bytesHandler(data)))
+
+	if _, err := client.WriteTo(rrq("big.img", "octet", "blksize", "8", "windowsize", "64"), server); err != nil {
+		t.Fatalf("send request: %v", err)
+	}
+	op, _, _, peer := receive(t, client, 2*time.Second)
+	if op != opOACK {
+		t.Fatalf("opcode %d, want OACK", op)
+	}
+	client.WriteTo(ackPacket(0), peer)
+
+	var (
+		got     []byte
+		block   uint16 = 1
+		wrapped bool
+		blocks  int
+	)
+	for {
+		op, n, payload, _ := receive(t, client, 2*time.Second)
+		if op != opDATA || n != block {
+			t.Fatalf("got opcode %d block %d, want DATA block %d", op, n, block)
+		}
+		got = append(got, payload...)
+		blocks++
+		wrapped = wrapped || block == 0
+		last := len(payload) < blockSize
+		if blocks%window == 0 || last {
+			client.WriteTo(ackPacket(block), peer)
+		}
+		if last {
+			break
+		}
+		block++
+	}
+	if !wrapped {
+		t.Error("block number did not wrap around to 0")
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("received %d bytes, want %d", len(got), len(data))
+	}
+}
+
+func TestTransferRetransmitsLostBlock(t *testing.T) {
+	data := bytes.Repeat([]byte{'x'}, defaultBlockSize+10)
+	s := NewServer(bytesHandler(data))
+	s.Timeout = 50 * time.Millisecond
+	client, server := loopbackTFTP(t, s)
+
+	if _, err := client.WriteTo(rrq("pxelinux.0", "octet"), server); err != nil {
+		t.Fatalf("send request: %v", err)
+	}
+
+	// The ACK of the first block is lost, so it is sent again
+	op, n, first, peer := receive(t, client, 2*time.Second)
+	if op != opDATA || n != 1 {
+		t.Fatalf("got opcode %d block %d, want DATA block 1", op, n)
+	}
+	op, n, again, _ := receive(t, client, 2*time.Second)
+	if op != opDATA || n != 1 || !bytes.Equal(again, first) {
+		t.Fatalf("got opcode %d block %d, want block 1 retransmitted", op, n)
+	}
+	client.WriteTo(ackPacket(1), peer)
+
+	// A duplicate ACK does not cause the next block to be sent twice
+	op, n, last, _ := receive(t, client, 2*time.Second)
+	if op != opDATA || n != 2 || len(last) != 10 {
+		t.Fatalf("got opcode %d block %d with %d bytes, want the last block", op, n, len(last))
+	}
+	client.WriteTo(ackPacket(1), peer)
+	client.WriteTo(ackPacket(2), peer)
+
+	buf := make([]byte, 16)
+	client.SetReadDeadline(time.Now().Add(4 * s.Timeout))
+	if n, _, err := client.ReadFrom(buf); err == nil {
+		t.Errorf("unexpected packet %x after the transfer completed", buf[:n])
+	}
+}
+
+func TestTransferGivesUp(t *testing.T) {
+	s := NewServer(bytesHandler([]byte("data")))
+	s.Timeout = 20 * time.Millisecond
+	s.Retries = 2
+	client, server := loopbackTFTP(t, s)
+
+	if _, err := client.WriteTo(rrq("pxelinux.0", "octet"), server); err != nil {
+		t.Fatalf("send request: %v", err)
+	}
+	// The block is sent once and retransmitted Retries times
+	for i := 0; i <= s.Retries; i++ {
+		if op, n, _, _ := receive(t, client, time.Second); op != opDATA || n != 1 {
+			t.Fatalf("got opcode %d block %d, want DATA block 1", op, n)
+		}
+	}
+	buf := make([]byte, 16)
+	client.SetReadDeadline(time.Now().Add(5 * s.Timeout))
+	if n, _, err := client.ReadFrom(buf); err == nil {
+		t.Errorf("unexpected packet %x after retries were exhausted", buf[:n])
+	}
+}
+
+func TestTransferNetascii(t *testing.T) {
+	client, server := loopbackTFTP(t, NewServer(bytesHandler([]byte("a\nb\rc\r\n"))))
+
+	// tsize is not acknowledged as the translated size is not known up front
+	if _, err := client.WriteTo(rrq("boot.msg", "NETASCII", "tsize", "0"), server); err != nil {
+		t.Fatalf("send request: %v", err)
+	}
+	op, n, payload, peer := receive(t, client, 2*time.Second)
+	if op != opDATA || n != 1 {
+		t.Fatalf("got opcode %d block %d, want DATA block 1", op, n)
+	}
+	if want := "a\r\nb\r\x00c\r\x00\r\n"; string(payload) != want {
+		t.Errorf("data = %q, want %q", payload, want)
+	}
+	client.WriteTo(ackPacket(1), peer)
+}
+
+func TestNetasciiReaderSplitsSequences(t *testing.T) {
+	// Reading one byte at a time splits every translated sequence
+	r := newNetasciiReader(bytes.NewReader([]byte("\n\r\nx")))
+	var got []byte
+	buf := make([]byte, 1)
+	for {
+		n, err := r.Read(buf)
+		got = append(got, buf[:n]...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+	}
+	if want := "\r\n\r\x00\r\nx"; string(got) != want {
+		t.Errorf("read %q, want %q", got, want)
+	}
+}
+
+func TestRequestErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		req  []byte
+		code uint16
+	}{
+		{name: "write request", req: append(binary.BigEndian.AppendUint16(nil, opWRQ), "f\x00octet\x00"...), code: errCodeAccess},
+		{name: "mail mode", req: rrq("f", "mail"), code: errCodeIllegalOp},
+		{name: "unterminated", req: rrq("f", "octet")[:8], code: errCodeIllegalOp},
+		{name: "empty filename", req: rrq("", "octet"), code: errCodeIllegalOp},
+		{name: "not found", req: rrq("missing", "octet"), code: errCodeNotFound},
+		{name: "access", req: rrq("secret", "octet"), code: errCodeAccess},
+	}
+
+	h := HandlerFunc(func(filename string, remote net.Addr) (io.ReadCloser, int64, error) {
+		if filename == "secret" {
+			return nil, 0, ErrAccess
+		}
+		return nil, 0, ErrNotFound
+	})
+	client, server := loopbackTFTP(t, NewServer(h))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := client.WriteTo(tt.req, server); err != nil {
+				t.Fatalf("send request: %v", err)
+			}
+			if op, code, _, _ := receive(t, client, 2*time.Second); op != opERROR || code != tt.code {
+				t.Errorf("got opcode %d code %d, want ERROR code %d", op, code, tt.code)
+			}
+		})
+	}
+}